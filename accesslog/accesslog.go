@@ -0,0 +1,220 @@
+// Package accesslog writes access logs of listeners: a line for every request
+// that a listener gets, including requests that are not routed to any
+// frontend, and for every TLS handshake that fails.
+package accesslog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/vulcand/logsink"
+)
+
+// tlsHandshakeError is the prefix of errors that http.Server logs when TLS
+// handshakes fail.
+const tlsHandshakeError = "http: TLS handshake error from "
+
+// Entry is a request, or a failed TLS handshake, in the access log. Custom
+// formats are templates of it.
+type Entry struct {
+	// Time when the request was received.
+	Time time.Time
+	// Listener is the id of the listener.
+	Listener string
+	// RemoteAddr is the IP address of the client.
+	RemoteAddr string
+	// RemoteUser is the user name of basic authentication, if any.
+	RemoteUser string
+	Method     string
+	URI        string
+	Proto      string
+	Host       string
+	// Status is the status code of the response, 0 if the handshake failed or
+	// the request was aborted before the response was sent.
+	Status int
+	// Bytes is the size of the response body.
+	Bytes     int64
+	Duration  time.Duration
+	Referer   string
+	UserAgent string
+	// RequestId is the id that the proxy assigned to the request, if any.
+	RequestId string
+	// Error tells why the TLS handshake failed.
+	Error string
+}
+
+// Config is the access log of a listener.
+type Config struct {
+	// Listener is the id of the listener.
+	Listener string
+	// Format is FormatCommon (the default), FormatCombined, FormatJSON or a
+	// template of Entry.
+	Format string
+	// Addr is the address of the output, see package logsink.
+	Addr string
+	// RequestIdHeader is the response header to take request ids from.
+	RequestIdHeader string
+}
+
+// Logger writes the access log of a listener. Lines are written in the
+// background and never block requests, see logsink.Open.
+type Logger struct {
+	cfg    Config
+	format formatter
+	writer io.Writer
+	clock  timetools.TimeProvider
+}
+
+// New returns the access logger of a listener.
+func New(cfg Config) (*Logger, error) {
+	format, err := newFormatter(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	w, err := logsink.Open(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{cfg: cfg, format: format, writer: w, clock: &timetools.RealTime{}}, nil
+}
+
+// Wrap returns a handler that writes every request handled by the handler to
+// the access log.
+func (l *Logger) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := l.clock.UtcNow()
+		rw := &responseWriter{ResponseWriter: w}
+		completed := false
+		defer func() {
+			// Requests that the handler aborted with a panic are logged
+			// with the status sent, if any.
+			if completed && rw.code == 0 {
+				rw.code = http.StatusOK
+			}
+			l.write(l.newEntry(r, rw, start))
+		}()
+		next.ServeHTTP(rw, r)
+		completed = true
+	})
+}
+
+func (l *Logger) newEntry(r *http.Request, rw *responseWriter, start time.Time) *Entry {
+	e := &Entry{
+		Time:       start,
+		Listener:   l.cfg.Listener,
+		RemoteAddr: remoteIP(r.RemoteAddr),
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Host:       r.Host,
+		Status:     rw.code,
+		Bytes:      rw.bytes,
+		Duration:   l.clock.UtcNow().Sub(start),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+	if e.URI == "" {
+		e.URI = r.URL.RequestURI()
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		e.RemoteUser = user
+	}
+	if l.cfg.RequestIdHeader != "" {
+		e.RequestId = rw.Header().Get(l.cfg.RequestIdHeader)
+	}
+	return e
+}
+
+// ErrorLog returns a logger for http.Server.ErrorLog that writes failed TLS
+// handshakes to the access log, and passes other errors on to the standard
+// logger, where http.Server writes them by default.
+func (l *Logger) ErrorLog() *stdlog.Logger {
+	return stdlog.New(&errorLogWriter{l: l}, "", 0)
+}
+
+type errorLogWriter struct {
+	l *Logger
+}
+
+func (w *errorLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	if rest := strings.TrimPrefix(msg, tlsHandshakeError); rest != msg {
+		// The address of the client is followed by the error.
+		if i := strings.Index(rest, ": "); i != -1 {
+			w.l.write(&Entry{
+				Time:       w.l.clock.UtcNow(),
+				Listener:   w.l.cfg.Listener,
+				RemoteAddr: remoteIP(rest[:i]),
+				Error:      rest[i+2:],
+			})
+			return len(p), nil
+		}
+	}
+	stdlog.Print(msg)
+	return len(p), nil
+}
+
+func (l *Logger) write(e *Entry) {
+	buf := &bytes.Buffer{}
+	if err := l.format(buf, e); err != nil {
+		log.Errorf("Failed to format access log entry of %v: %v", l.cfg.Listener, err)
+		return
+	}
+	l.writer.Write(buf.Bytes())
+}
+
+// remoteIP returns the IP address of a host:port address.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// responseWriter records the status code and the size of a response.
+type responseWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.code == 0 || rw.code < http.StatusOK {
+		rw.code = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.code == 0 {
+		rw.code = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", rw.ResponseWriter)
+	}
+	rw.code = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
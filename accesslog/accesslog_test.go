@@ -0,0 +1,141 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "gopkg.in/check.v1"
+)
+
+func TestAccessLog(t *testing.T) { TestingT(t) }
+
+type AccessLogSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&AccessLogSuite{})
+
+func (s *AccessLogSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+// newLogger returns a logger that writes to the buffer.
+func (s *AccessLogSuite) newLogger(c *C, format string, buf *bytes.Buffer) *Logger {
+	l, err := New(Config{Listener: "l1", Format: format, Addr: "stdout://", RequestIdHeader: "X-Request-Id"})
+	c.Assert(err, IsNil)
+	l.writer = buf
+	l.clock = s.clock
+	return l
+}
+
+func (s *AccessLogSuite) serve(l *Logger, h http.HandlerFunc, r *http.Request) {
+	l.Wrap(h).ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func newRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/a?b=c", nil)
+	r.Host = "example.com"
+	r.RemoteAddr = "10.0.0.1:5123"
+	r.SetBasicAuth("frank", "secret")
+	r.Header.Set("Referer", "http://example.com/")
+	r.Header.Set("User-Agent", `Mozilla/5.0 "quoted"`)
+	return r
+}
+
+func (s *AccessLogSuite) TestFormats(c *C) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		s.clock.Sleep(1500 * time.Microsecond)
+		w.Header().Set("X-Request-Id", "abc")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}
+	tcs := []struct {
+		format string
+		line   string
+	}{
+		{
+			format: "",
+			line:   `10.0.0.1 - frank [04/Mar/2012:05:06:07 +0000] "GET /a?b=c HTTP/1.1" 201 5` + "\n",
+		},
+		{
+			format: FormatCommon,
+			line:   `10.0.0.1 - frank [04/Mar/2012:05:06:07 +0000] "GET /a?b=c HTTP/1.1" 201 5` + "\n",
+		},
+		{
+			format: FormatCombined,
+			line: `10.0.0.1 - frank [04/Mar/2012:05:06:07 +0000] "GET /a?b=c HTTP/1.1" 201 5 ` +
+				`"http://example.com/" "Mozilla/5.0 \"quoted\""` + "\n",
+		},
+		{
+			format: FormatJSON,
+			line: `{"time":"2012-03-04T05:06:07Z","listener":"l1","remote_addr":"10.0.0.1","remote_user":"frank",` +
+				`"method":"GET","uri":"/a?b=c","proto":"HTTP/1.1","host":"example.com","status":201,"bytes":5,` +
+				`"duration_ms":1.5,"referer":"http://example.com/","user_agent":"Mozilla/5.0 \"quoted\"","request_id":"abc"}` + "\n",
+		},
+		{
+			format: "{{.Listener}} {{.Method}} {{.URI}} {{.Status}} {{.Duration}} {{.RequestId}}",
+			line:   "l1 GET /a?b=c 201 1.5ms abc\n",
+		},
+	}
+	for i, tc := range tcs {
+		s.SetUpTest(c)
+		buf := &bytes.Buffer{}
+		s.serve(s.newLogger(c, tc.format, buf), h, newRequest())
+		c.Assert(buf.String(), Equals, tc.line, Commentf("test case #%d", i))
+	}
+}
+
+func (s *AccessLogSuite) TestBadFormats(c *C) {
+	for _, format := range []string{"fancy", "{{.Method", "{{.Nope}}"} {
+		c.Assert(CheckFormat(format), NotNil, Commentf("format %q", format))
+		_, err := New(Config{Format: format, Addr: "stdout://"})
+		c.Assert(err, NotNil)
+	}
+	_, err := New(Config{Addr: "omglog://"})
+	c.Assert(err, NotNil)
+}
+
+func (s *AccessLogSuite) TestEscaping(c *C) {
+	buf := &bytes.Buffer{}
+	l := s.newLogger(c, FormatCombined, buf)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:5123"
+	r.SetBasicAuth("fr ank", "secret")
+	r.Header.Set("User-Agent", "a\\b\x01")
+	s.serve(l, func(w http.ResponseWriter, r *http.Request) {}, r)
+	c.Assert(buf.String(), Equals, `10.0.0.1 - fr\x20ank [04/Mar/2012:05:06:07 +0000] "GET / HTTP/1.1" 200 - "-" "a\\b\x01"`+"\n")
+}
+
+func (s *AccessLogSuite) TestAbortedRequest(c *C) {
+	buf := &bytes.Buffer{}
+	l := s.newLogger(c, FormatCommon, buf)
+	func() {
+		defer func() { recover() }()
+		s.serve(l, func(w http.ResponseWriter, r *http.Request) { panic(http.ErrAbortHandler) }, newRequest())
+	}()
+	c.Assert(buf.String(), Equals, `10.0.0.1 - frank [04/Mar/2012:05:06:07 +0000] "GET /a?b=c HTTP/1.1" - -`+"\n")
+}
+
+func (s *AccessLogSuite) TestTLSHandshakeErrors(c *C) {
+	buf := &bytes.Buffer{}
+	l := s.newLogger(c, FormatJSON, buf)
+	l.ErrorLog().Printf("http: TLS handshake error from [::1]:5123: tls: client offered only unsupported versions")
+	c.Assert(buf.String(), Equals, `{"time":"2012-03-04T05:06:07Z","listener":"l1","remote_addr":"::1","bytes":0,"duration_ms":0,`+
+		`"error":"tls: client offered only unsupported versions"}`+"\n")
+
+	// Other errors go to the standard logger
+	buf.Reset()
+	l.ErrorLog().Printf("http: Accept error: too many open files")
+	c.Assert(buf.String(), Equals, "")
+
+	buf.Reset()
+	l = s.newLogger(c, FormatCommon, buf)
+	l.ErrorLog().Printf("http: TLS handshake error from 10.0.0.1:5123: EOF")
+	c.Assert(buf.String(), Equals, `10.0.0.1 - - [04/Mar/2012:05:06:07 +0000] "-" - -`+"\n")
+}
@@ -0,0 +1,192 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Formats of access log lines.
+const (
+	// FormatCommon is the Common Log Format of NCSA and Apache:
+	// 127.0.0.1 - frank [10/Oct/2000:13:55:36 +0000] "GET /a.gif HTTP/1.0" 200 2326
+	FormatCommon = "common"
+	// FormatCombined is the Common Log Format with the referer and the user
+	// agent: ... 200 2326 "http://example.com/" "Mozilla/5.0"
+	FormatCombined = "combined"
+	// FormatJSON writes every entry as a JSON object on its own line.
+	FormatJSON = "json"
+)
+
+// commonTimeFormat is the format of time in the Common Log Format.
+const commonTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// formatter writes an entry as a line to the buffer.
+type formatter func(buf *bytes.Buffer, e *Entry) error
+
+// CheckFormat validates a format of access log lines.
+func CheckFormat(format string) error {
+	_, err := newFormatter(format)
+	return err
+}
+
+// newFormatter returns the formatter of one of the named formats, or of a
+// custom format, which is a text/template template of Entry, e.g.
+// "{{.RemoteAddr}} {{.Method}} {{.URI}} {{.Status}} {{.Duration}}".
+func newFormatter(format string) (formatter, error) {
+	switch format {
+	case "", FormatCommon:
+		return formatCommon, nil
+	case FormatCombined:
+		return formatCombined, nil
+	case FormatJSON:
+		return formatJSON, nil
+	}
+	if !strings.Contains(format, "{{") {
+		return nil, fmt.Errorf("unsupported format %q, expected %s, %s, %s or a template, e.g. {{.Method}} {{.URI}} {{.Status}}",
+			format, FormatCommon, FormatCombined, FormatJSON)
+	}
+	t, err := template.New("accesslog").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("bad format template: %v", err)
+	}
+	// Templates that refer to unknown fields fail only when they are executed.
+	if err := t.Execute(&bytes.Buffer{}, &Entry{}); err != nil {
+		return nil, fmt.Errorf("bad format template: %v", err)
+	}
+	return func(buf *bytes.Buffer, e *Entry) error {
+		if err := t.Execute(buf, e); err != nil {
+			return err
+		}
+		if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		return nil
+	}, nil
+}
+
+func formatCommon(buf *bytes.Buffer, e *Entry) error {
+	writeCommon(buf, e)
+	buf.WriteByte('\n')
+	return nil
+}
+
+func formatCombined(buf *bytes.Buffer, e *Entry) error {
+	writeCommon(buf, e)
+	buf.WriteByte(' ')
+	writeQuoted(buf, e.Referer)
+	buf.WriteByte(' ')
+	writeQuoted(buf, e.UserAgent)
+	buf.WriteByte('\n')
+	return nil
+}
+
+// writeCommon writes the entry in the Common Log Format. Failed TLS
+// handshakes have no request line, status and size, which are written as
+// dashes.
+func writeCommon(buf *bytes.Buffer, e *Entry) {
+	writeField(buf, e.RemoteAddr)
+	buf.WriteString(" - ")
+	writeField(buf, e.RemoteUser)
+	buf.WriteString(" [")
+	buf.WriteString(e.Time.Format(commonTimeFormat))
+	buf.WriteString("] ")
+	if e.Method == "" {
+		buf.WriteString(`"-"`)
+	} else {
+		writeQuoted(buf, e.Method+" "+e.URI+" "+e.Proto)
+	}
+	buf.WriteByte(' ')
+	if e.Status == 0 {
+		buf.WriteByte('-')
+	} else {
+		buf.WriteString(strconv.Itoa(e.Status))
+	}
+	buf.WriteByte(' ')
+	if e.Bytes == 0 {
+		buf.WriteByte('-')
+	} else {
+		buf.WriteString(strconv.FormatInt(e.Bytes, 10))
+	}
+}
+
+// writeField writes a value that can not contain spaces, or a dash if it is
+// empty.
+func writeField(buf *bytes.Buffer, v string) {
+	if v == "" {
+		buf.WriteByte('-')
+		return
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] <= ' ' || v[i] > '~' || v[i] == '"' {
+			fmt.Fprintf(buf, `\x%02x`, v[i])
+		} else {
+			buf.WriteByte(v[i])
+		}
+	}
+}
+
+// writeQuoted writes a value in quotes, escaping quotes and bytes that are
+// not printable, or "-" if the value is empty.
+func writeQuoted(buf *bytes.Buffer, v string) {
+	if v == "" {
+		buf.WriteString(`"-"`)
+		return
+	}
+	buf.WriteByte('"')
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(buf, `\x%02x`, c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// jsonEntry is an entry in the JSON format.
+type jsonEntry struct {
+	Time       time.Time `json:"time"`
+	Listener   string    `json:"listener,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	RemoteUser string    `json:"remote_user,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	URI        string    `json:"uri,omitempty"`
+	Proto      string    `json:"proto,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Bytes      int64     `json:"bytes"`
+	Duration   float64   `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RequestId  string    `json:"request_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func formatJSON(buf *bytes.Buffer, e *Entry) error {
+	return json.NewEncoder(buf).Encode(&jsonEntry{
+		Time:       e.Time,
+		Listener:   e.Listener,
+		RemoteAddr: e.RemoteAddr,
+		RemoteUser: e.RemoteUser,
+		Method:     e.Method,
+		URI:        e.URI,
+		Proto:      e.Proto,
+		Host:       e.Host,
+		Status:     e.Status,
+		Bytes:      e.Bytes,
+		Duration:   float64(e.Duration) / float64(time.Millisecond),
+		Referer:    e.Referer,
+		UserAgent:  e.UserAgent,
+		RequestId:  e.RequestId,
+		Error:      e.Error,
+	})
+}
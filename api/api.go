@@ -17,6 +17,9 @@ import (
 	"github.com/vulcand/vulcand/anomaly"
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/cache"
+	"github.com/vulcand/vulcand/plugin/cbreaker"
+	"github.com/vulcand/vulcand/plugin/quota"
 	"github.com/vulcand/vulcand/router"
 )
 
@@ -38,6 +41,10 @@ func InitProxyController(ng engine.Engine, stats engine.StatsProvider, router *m
 	router.HandleFunc("/v2/log/severity", handlerWithBody(c.getLogSeverity)).Methods("GET")
 	router.HandleFunc("/v2/log/severity", handlerWithBody(c.updateLogSeverity)).Methods("PUT")
 
+	// Fault injection kill switch
+	router.HandleFunc("/v2/faults", handlerWithBody(c.getFaultsEnabled)).Methods("GET")
+	router.HandleFunc("/v2/faults", handlerWithBody(c.updateFaultsEnabled)).Methods("PUT")
+
 	// Hosts
 	router.HandleFunc("/v2/hosts", handlerWithBody(c.upsertHost)).Methods("POST")
 	router.HandleFunc("/v2/hosts", handlerWithBody(c.getHosts)).Methods("GET")
@@ -65,11 +72,13 @@ func InitProxyController(ng engine.Engine, stats engine.StatsProvider, router *m
 	router.HandleFunc("/v2/backends", handlerWithBody(c.getBackends)).Methods("GET")
 	router.HandleFunc("/v2/backends/{id}", handlerWithBody(c.deleteBackend)).Methods("DELETE")
 	router.HandleFunc("/v2/backends/{id}", handlerWithBody(c.getBackend)).Methods("GET")
+	router.HandleFunc("/v2/backends/{id}/stats", handlerWithBody(c.getBackendStats)).Methods("GET")
 
 	// Servers
 	router.HandleFunc("/v2/backends/{backendId}/servers", handlerWithBody(c.getServers)).Methods("GET")
 	router.HandleFunc("/v2/backends/{backendId}/servers", handlerWithBody(c.upsertServer)).Methods("POST")
 	router.HandleFunc("/v2/backends/{backendId}/servers/{id}", handlerWithBody(c.getServer)).Methods("GET")
+	router.HandleFunc("/v2/backends/{backendId}/servers/{id}/stats", handlerWithBody(c.getServerStats)).Methods("GET")
 	router.HandleFunc("/v2/backends/{backendId}/servers/{id}", handlerWithBody(c.deleteServer)).Methods("DELETE")
 
 	// Middlewares
@@ -77,6 +86,130 @@ func InitProxyController(ng engine.Engine, stats engine.StatsProvider, router *m
 	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}", handlerWithBody(c.getMiddleware)).Methods("GET")
 	router.HandleFunc("/v2/frontends/{frontend}/middlewares", handlerWithBody(c.getMiddlewares)).Methods("GET")
 	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}", handlerWithBody(c.deleteMiddleware)).Methods("DELETE")
+
+	// Quotas
+	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}/quotas/{key}", handlerWithBody(c.getQuotaUsage)).Methods("GET")
+	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}/quotas/{key}", handlerWithBody(c.resetQuota)).Methods("DELETE")
+
+	// Circuit breakers
+	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}/state", handlerWithBody(c.getCircuitBreakerState)).Methods("GET")
+	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}/state/override", handlerWithBody(c.setCircuitBreakerOverride)).Methods("POST")
+	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}/state/override", handlerWithBody(c.deleteCircuitBreakerOverride)).Methods("DELETE")
+
+	// Cache
+	router.HandleFunc("/v2/cache/purge", handlerWithBody(c.purgeCache)).Methods("POST")
+}
+
+func (c *ProxyController) getQuotaUsage(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	mk := engine.MiddlewareKey{Id: params["id"], FrontendKey: engine.FrontendKey{Id: params["frontend"]}}
+	q, err := c.getQuota(mk)
+	if err != nil {
+		return nil, err
+	}
+	return formatResult(q.Usage(r.Context(), c.ng.GetRegistry().GetCacheProvider(), mk.FrontendKey.Id, mk.Id, params["key"]))
+}
+
+func (c *ProxyController) resetQuota(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	mk := engine.MiddlewareKey{Id: params["id"], FrontendKey: engine.FrontendKey{Id: params["frontend"]}}
+	q, err := c.getQuota(mk)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Reset usage of %s in quota %v", params["key"], mk)
+	if err := q.Reset(r.Context(), c.ng.GetRegistry().GetCacheProvider(), mk.FrontendKey.Id, mk.Id, params["key"]); err != nil {
+		return nil, err
+	}
+	return Response{"message": "Quota usage reset"}, nil
+}
+
+func (c *ProxyController) getQuota(mk engine.MiddlewareKey) (*quota.Quota, error) {
+	m, err := c.ng.GetMiddleware(mk)
+	if err != nil {
+		return nil, err
+	}
+	q, ok := m.Middleware.(*quota.Quota)
+	if !ok {
+		return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("middleware %v is %s, not %s", mk.Id, m.Type, quota.Type)}
+	}
+	return q, nil
+}
+
+func (c *ProxyController) getCircuitBreakerState(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	mk := engine.MiddlewareKey{Id: params["id"], FrontendKey: engine.FrontendKey{Id: params["frontend"]}}
+	if err := c.checkCircuitBreaker(mk); err != nil {
+		return nil, err
+	}
+	return formatResult(cbreaker.GetState(mk.FrontendKey.Id, mk.Id), nil)
+}
+
+func (c *ProxyController) setCircuitBreakerOverride(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	mk := engine.MiddlewareKey{Id: params["id"], FrontendKey: engine.FrontendKey{Id: params["frontend"]}}
+	if err := c.checkCircuitBreaker(mk); err != nil {
+		return nil, err
+	}
+	var p overridePack
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	if p.Override == "" {
+		return nil, errMissingField{Field: "Override"}
+	}
+	st, err := cbreaker.SetOverride(mk.FrontendKey.Id, mk.Id, p.Override)
+	if err != nil {
+		return nil, &engine.InvalidFormatError{Message: err.Error()}
+	}
+	log.Warnf("Circuit breaker %v forced %s", mk, p.Override)
+	return formatResult(st, nil)
+}
+
+func (c *ProxyController) deleteCircuitBreakerOverride(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	mk := engine.MiddlewareKey{Id: params["id"], FrontendKey: engine.FrontendKey{Id: params["frontend"]}}
+	if err := c.checkCircuitBreaker(mk); err != nil {
+		return nil, err
+	}
+	log.Infof("Circuit breaker %v override cleared", mk)
+	if _, err := cbreaker.SetOverride(mk.FrontendKey.Id, mk.Id, ""); err != nil {
+		return nil, err
+	}
+	return Response{"message": "Circuit breaker override cleared"}, nil
+}
+
+func (c *ProxyController) checkCircuitBreaker(mk engine.MiddlewareKey) error {
+	m, err := c.ng.GetMiddleware(mk)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.Middleware.(*cbreaker.Spec); !ok {
+		return &engine.InvalidFormatError{Message: fmt.Sprintf("middleware %v is %s, not %s", mk.Id, m.Type, cbreaker.Type)}
+	}
+	return nil
+}
+
+func (c *ProxyController) purgeCache(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	var p cachePurgePack
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	if p.URL == "" && p.Tag == "" {
+		return nil, errMissingField{Field: "URL or Tag"}
+	}
+	storage := cache.Storage(c.ng.GetRegistry().GetCacheProvider())
+	if p.URL != "" {
+		if u, err := url.Parse(p.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("URL %q should be absolute", p.URL)}
+		}
+		log.Infof("Purge cached responses for %s", p.URL)
+		if err := cache.Purge(r.Context(), storage, p.URL); err != nil {
+			return nil, err
+		}
+	}
+	if p.Tag != "" {
+		log.Infof("Purge cached responses tagged %s", p.Tag)
+		if err := cache.PurgeTag(r.Context(), storage, p.Tag); err != nil {
+			return nil, err
+		}
+	}
+	return Response{"message": "Cache purged"}, nil
 }
 
 func (c *ProxyController) handleError(w http.ResponseWriter, r *http.Request) {
@@ -104,6 +237,32 @@ func (c *ProxyController) updateLogSeverity(w http.ResponseWriter, r *http.Reque
 	return Response{"message": fmt.Sprintf("Severity has been updated to %v", sev.String())}, nil
 }
 
+func (c *ProxyController) getFaultsEnabled(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	faults, err := c.ng.GetFaults()
+	if err != nil {
+		return nil, err
+	}
+	return Response{
+		"Enabled": !faults.Disabled,
+	}, nil
+}
+
+func (c *ProxyController) updateFaultsEnabled(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	enabled, err := strconv.ParseBool(r.Form.Get("enabled"))
+	if err != nil {
+		return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("enabled should be true or false, got %q", r.Form.Get("enabled"))}
+	}
+	if err := c.ng.UpsertFaults(engine.Faults{Disabled: !enabled}); err != nil {
+		return nil, err
+	}
+	if enabled {
+		log.Warnf("Fault injection enabled")
+		return Response{"message": "Fault injection enabled"}, nil
+	}
+	log.Warnf("Fault injection disabled")
+	return Response{"message": "Fault injection disabled"}, nil
+}
+
 func (c *ProxyController) getHosts(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	hosts, err := c.ng.GetHosts()
 	return Response{
@@ -254,6 +413,10 @@ func (c *ProxyController) getBackend(w http.ResponseWriter, r *http.Request, par
 	return formatResult(c.ng.GetBackend(engine.BackendKey{Id: params["id"]}))
 }
 
+func (c *ProxyController) getBackendStats(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	return formatResult(c.stats.BackendStats(engine.BackendKey{Id: params["id"]}))
+}
+
 func (c *ProxyController) upsertFrontend(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	frontend, ttl, err := parseFrontendPack(c.ng.GetRegistry().GetRouter(), body)
 	if err != nil {
@@ -292,11 +455,28 @@ func (c *ProxyController) getServer(w http.ResponseWriter, r *http.Request, para
 	return formatResult(srv, err)
 }
 
+func (c *ProxyController) getServerStats(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: params["backendId"]}, Id: params["id"]}
+	return formatResult(c.stats.ServerStats(sk))
+}
+
 func (c *ProxyController) getServers(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
-	srvs, err := c.ng.GetServers(engine.BackendKey{Id: params["backendId"]})
+	bk := engine.BackendKey{Id: params["backendId"]}
+	srvs, err := c.ng.GetServers(bk)
 	if err != nil {
 		return nil, err
 	}
+	// The proxy may lag behind the engine, so servers are listed without
+	// circuit breaker states if those are not available.
+	circuitBreakers, err := c.stats.ServerCircuitBreakers(bk)
+	if err != nil {
+		log.Debugf("Circuit breakers of %v are not available: %v", bk, err)
+	}
+	for i := range srvs {
+		if cb, ok := circuitBreakers[srvs[i].Id]; ok {
+			srvs[i].CircuitBreaker = &cb
+		}
+	}
 	return Response{
 		"Servers": srvs,
 	}, nil
@@ -408,6 +588,18 @@ type serverReadPack struct {
 	TTL    string
 }
 
+// cachePurgePack tells what cached responses to purge: those of the URL, those
+// with the tag, or both.
+type cachePurgePack struct {
+	URL string
+	Tag string
+}
+
+// overridePack forces a circuit breaker open or closed.
+type overridePack struct {
+	Override string
+}
+
 type serverPack struct {
 	Server engine.Server
 	TTL    string
@@ -3,14 +3,20 @@ package api
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	oxytest "github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/engine/memng"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/cache"
+	"github.com/vulcand/vulcand/plugin/cbreaker"
 	"github.com/vulcand/vulcand/plugin/connlimit"
+	"github.com/vulcand/vulcand/plugin/quota"
 	"github.com/vulcand/vulcand/plugin/registry"
 	"github.com/vulcand/vulcand/proxy"
 	"github.com/vulcand/vulcand/proxy/builder"
@@ -60,6 +66,130 @@ func (s *ApiSuite) TestStatusV1(c *C) {
 	c.Assert(string(body), Equals, `{"Status":"ok"}`)
 }
 
+func (s *ApiSuite) TestPurgeCache(c *C) {
+	cm, err := cache.NewCache(cache.Cache{})
+	c.Assert(err, IsNil)
+	hits := 0
+	h, err := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Cache-Tag", "purge-api-test")
+		w.Write([]byte("hello"))
+	}))
+	c.Assert(err, IsNil)
+	get := func(path string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://purge.example.com"+path, nil))
+	}
+
+	get("/a")
+	get("/b")
+	get("/a")
+	c.Assert(hits, Equals, 2)
+
+	c.Assert(s.client.PurgeCache("http://purge.example.com/a", ""), IsNil)
+	get("/a")
+	get("/b")
+	c.Assert(hits, Equals, 3)
+
+	c.Assert(s.client.PurgeCache("", "purge-api-test"), IsNil)
+	get("/a")
+	get("/b")
+	c.Assert(hits, Equals, 5)
+
+	c.Assert(s.client.PurgeCache("", ""), NotNil)
+	c.Assert(s.client.PurgeCache("/a", ""), NotNil)
+}
+
+func (s *ApiSuite) TestQuotaUsage(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "quota-api-test", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertFrontend(*f, 0), IsNil)
+	fk := engine.FrontendKey{Id: f.Id}
+
+	q, err := quota.NewQuota(quota.Quota{Variable: "request.header.X-Api-Key", Limit: 10, Window: quota.WindowDay, Store: quota.StoreMemory})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertMiddleware(fk, engine.Middleware{Id: "q1", Type: quota.Type, Middleware: q}, 0), IsNil)
+	mk := engine.MiddlewareKey{FrontendKey: fk, Id: "q1"}
+
+	h, err := q.NewHandlerWithEnv(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), plugin.Env{FrontendId: f.Id, MiddlewareId: "q1"})
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("X-Api-Key", "k1")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	usage, err := s.client.GetQuotaUsage(mk, "k1")
+	c.Assert(err, IsNil)
+	c.Assert(usage.Key, Equals, "k1")
+	c.Assert(usage.Used, Equals, int64(3))
+	c.Assert(usage.Remaining, Equals, int64(7))
+	c.Assert(usage.WindowEnd.Sub(usage.WindowStart), Equals, 24*time.Hour)
+
+	c.Assert(s.client.ResetQuota(mk, "k1"), IsNil)
+	usage, err = s.client.GetQuotaUsage(mk, "k1")
+	c.Assert(err, IsNil)
+	c.Assert(usage.Used, Equals, int64(0))
+
+	// Only quota middlewares have usage
+	c.Assert(s.client.UpsertMiddleware(fk, s.makeConnLimit("c1", 10, "client.ip", 2, f), 0), IsNil)
+	_, err = s.client.GetQuotaUsage(engine.MiddlewareKey{FrontendKey: fk, Id: "c1"}, "k1")
+	c.Assert(err, NotNil)
+	_, err = s.client.GetQuotaUsage(engine.MiddlewareKey{FrontendKey: fk, Id: "missing"}, "k1")
+	c.Assert(err, NotNil)
+}
+
+func (s *ApiSuite) TestCircuitBreakerState(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "cbreaker-api-test", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertFrontend(*f, 0), IsNil)
+	fk := engine.FrontendKey{Id: f.Id}
+
+	cb, err := cbreaker.NewSpec(`ResponseCodeRatio(500, 600, 0, 600) > 0.5`, `{"Type": "response", "Action": {"StatusCode": 503, "Body": "Come back later"}}`, "", "", time.Minute, time.Minute, 0)
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertMiddleware(fk, engine.Middleware{Id: "cb1", Type: cbreaker.Type, Middleware: cb}, 0), IsNil)
+	mk := engine.MiddlewareKey{FrontendKey: fk, Id: "cb1"}
+
+	h, err := cb.NewHandlerWithEnv(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}), plugin.Env{FrontendId: f.Id, MiddlewareId: "cb1"})
+	c.Assert(err, IsNil)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+	st, err := s.client.GetCircuitBreakerState(mk)
+	c.Assert(err, IsNil)
+	c.Assert(st.State, Equals, cbreaker.StateTripped)
+	c.Assert(st.TrippedBy, DeepEquals, map[string]float64{"ResponseCodeRatio(500, 600, 0, 600)": 1})
+	c.Assert(len(st.History), Equals, 1)
+
+	st, err = s.client.SetCircuitBreakerOverride(mk, cbreaker.OverrideClosed)
+	c.Assert(err, IsNil)
+	c.Assert(st.State, Equals, cbreaker.StateStandby)
+	c.Assert(st.Override, Equals, cbreaker.OverrideClosed)
+
+	_, err = s.client.SetCircuitBreakerOverride(mk, "ajar")
+	c.Assert(err, NotNil)
+
+	c.Assert(s.client.DeleteCircuitBreakerOverride(mk), IsNil)
+	st, err = s.client.GetCircuitBreakerState(mk)
+	c.Assert(err, IsNil)
+	c.Assert(st.Override, Equals, "")
+	c.Assert(len(st.History), Equals, 3)
+
+	// Only circuit breaker middlewares have state
+	c.Assert(s.client.UpsertMiddleware(fk, s.makeConnLimit("c1", 10, "client.ip", 2, f), 0), IsNil)
+	_, err = s.client.GetCircuitBreakerState(engine.MiddlewareKey{FrontendKey: fk, Id: "c1"})
+	c.Assert(err, NotNil)
+	_, err = s.client.SetCircuitBreakerOverride(engine.MiddlewareKey{FrontendKey: fk, Id: "missing"}, cbreaker.OverrideOpen)
+	c.Assert(err, NotNil)
+}
+
 func (s *ApiSuite) TestSeverity(c *C) {
 	for _, sev := range []log.Level{log.InfoLevel, log.WarnLevel, log.ErrorLevel} {
 		err := s.client.UpdateLogSeverity(sev)
@@ -70,6 +200,19 @@ func (s *ApiSuite) TestSeverity(c *C) {
 	}
 }
 
+func (s *ApiSuite) TestFaultsKillSwitch(c *C) {
+	for _, enabled := range []bool{false, true} {
+		c.Assert(s.client.SetFaultsEnabled(enabled), IsNil)
+		out, err := s.client.GetFaultsEnabled()
+		c.Assert(err, IsNil)
+		c.Assert(out, Equals, enabled)
+		faults, err := s.ng.GetFaults()
+		c.Assert(err, IsNil)
+		c.Assert(faults, DeepEquals, &engine.Faults{Disabled: !enabled})
+	}
+	c.Assert(s.client.PutForm(s.client.endpoint("faults"), url.Values{"enabled": {"maybe"}}), NotNil)
+}
+
 func (s *ApiSuite) TestInvalidSeverity(c *C) {
 	err := s.client.UpdateLogSeverity(255)
 	c.Assert(err, NotNil)
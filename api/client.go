@@ -8,10 +8,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/cbreaker"
+	"github.com/vulcand/vulcand/plugin/quota"
 	"github.com/vulcand/vulcand/utils/json"
 
 	log "github.com/sirupsen/logrus"
@@ -61,6 +64,24 @@ func (c *Client) GetLogSeverity() (log.Level, error) {
 	return lvl, nil
 }
 
+// SetFaultsEnabled turns injection of faults by fault middlewares on or off.
+func (c *Client) SetFaultsEnabled(enabled bool) error {
+	return c.PutForm(c.endpoint("faults"), url.Values{"enabled": {strconv.FormatBool(enabled)}})
+}
+
+// GetFaultsEnabled tells whether fault middlewares inject faults.
+func (c *Client) GetFaultsEnabled() (bool, error) {
+	data, err := c.Get(c.endpoint("faults"), url.Values{})
+	if err != nil {
+		return false, err
+	}
+	var faults *FaultsResponse
+	if err := json.Unmarshal(data, &faults); err != nil {
+		return false, err
+	}
+	return faults.Enabled, nil
+}
+
 func (c *Client) GetHost(hk engine.HostKey) (*engine.Host, error) {
 	response, err := c.Get(c.endpoint("hosts", hk.Name), url.Values{})
 	if err != nil {
@@ -162,6 +183,79 @@ func (c *Client) GetBackend(bk engine.BackendKey) (*engine.Backend, error) {
 	return engine.BackendFromJSON(response)
 }
 
+func (c *Client) GetBackendStats(bk engine.BackendKey) (*engine.RoundTripStats, error) {
+	data, err := c.Get(c.endpoint("backends", bk.Id, "stats"), url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var stats *engine.RoundTripStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// GetQuotaUsage returns the usage of the key in the current window of the
+// quota middleware.
+func (c *Client) GetQuotaUsage(mk engine.MiddlewareKey, key string) (*quota.Usage, error) {
+	data, err := c.Get(c.endpoint("frontends", mk.FrontendKey.Id, "middlewares", mk.Id, "quotas", url.PathEscape(key)), url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var usage *quota.Usage
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// ResetQuota resets the usage of the key in the current window of the quota
+// middleware.
+func (c *Client) ResetQuota(mk engine.MiddlewareKey, key string) error {
+	return c.Delete(c.endpoint("frontends", mk.FrontendKey.Id, "middlewares", mk.Id, "quotas", url.PathEscape(key)))
+}
+
+// GetCircuitBreakerState returns the state and recent transitions of the
+// circuit breaker middleware.
+func (c *Client) GetCircuitBreakerState(mk engine.MiddlewareKey) (*cbreaker.State, error) {
+	data, err := c.Get(c.endpoint("frontends", mk.FrontendKey.Id, "middlewares", mk.Id, "state"), url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var st *cbreaker.State
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// SetCircuitBreakerOverride forces the circuit breaker middleware open or
+// closed.
+func (c *Client) SetCircuitBreakerOverride(mk engine.MiddlewareKey, override string) (*cbreaker.State, error) {
+	data, err := c.Post(c.endpoint("frontends", mk.FrontendKey.Id, "middlewares", mk.Id, "state", "override"), overridePack{Override: override})
+	if err != nil {
+		return nil, err
+	}
+	var st *cbreaker.State
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// DeleteCircuitBreakerOverride lets the condition of the circuit breaker
+// middleware decide its state again.
+func (c *Client) DeleteCircuitBreakerOverride(mk engine.MiddlewareKey) error {
+	return c.Delete(c.endpoint("frontends", mk.FrontendKey.Id, "middlewares", mk.Id, "state", "override"))
+}
+
+// PurgeCache purges responses cached for the URL, those tagged with the tag,
+// or both.
+func (c *Client) PurgeCache(rawURL, tag string) error {
+	_, err := c.Post(c.endpoint("cache", "purge"), cachePurgePack{URL: rawURL, Tag: tag})
+	return err
+}
+
 func (c *Client) GetBackends() ([]engine.Backend, error) {
 	data, err := c.Get(c.endpoint("backends"), url.Values{})
 	if err != nil {
@@ -204,6 +298,18 @@ func (c *Client) GetServer(sk engine.ServerKey) (*engine.Server, error) {
 	return engine.ServerFromJSON(data)
 }
 
+func (c *Client) GetServerStats(sk engine.ServerKey) (*engine.RoundTripStats, error) {
+	data, err := c.Get(c.endpoint("backends", sk.BackendKey.Id, "servers", sk.Id, "stats"), url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var stats *engine.RoundTripStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
 func (c *Client) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
 	if bk.Id == "" {
 		return nil, fmt.Errorf("backend id can not be empty")
@@ -374,3 +480,7 @@ type ConnectionsResponse struct {
 type SeverityResponse struct {
 	Severity string
 }
+
+type FaultsResponse struct {
+	Enabled bool
+}
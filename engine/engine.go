@@ -80,6 +80,12 @@ type Engine interface {
 	// Returns engine.NotFoundError if server not found
 	DeleteServer(ServerKey) error
 
+	// GetFaults returns the kill switch of fault injection middlewares, it is
+	// zero if the switch has never been set
+	GetFaults() (*Faults, error)
+	// UpsertFaults updates the kill switch of fault injection middlewares of all vulcand instances
+	UpsertFaults(Faults) error
+
 	// Subscribe is an entry point for getting the configuration changes as well as the initial configuration.
 	// It should be a blocking function generating events from change.go to the changes channel.
 	// Each change should be an instance of the struct provided in events.go
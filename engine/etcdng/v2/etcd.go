@@ -88,6 +88,10 @@ func (n *ng) GetSnapshot() (*engine.Snapshot, error) {
 			if err != nil {
 				return nil, err
 			}
+		case "faults":
+			if err := json.Unmarshal([]byte(node.Value), &s.Faults); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return s, nil
@@ -113,7 +117,7 @@ func (n *ng) parseFrontends(node *etcd.Node, skipMiddlewares ...bool) ([]engine.
 				middlewares := make([]engine.Middleware, len(node.Nodes))
 				for idx, mwNode := range node.Nodes {
 					middlewareId := suffix(mwNode.Key)
-					middleware, err := engine.MiddlewareFromJSON([]byte(mwNode.Value), n.registry.GetSpec, middlewareId)
+					middleware, err := n.middlewareFromJSON([]byte(mwNode.Value), middlewareId)
 					if err != nil {
 						log.WithError(err).Warnf("middleware '%s' for frontend '%s' has invalid config. skipping...", mwNode.Key, node.Key)
 						continue
@@ -274,6 +278,39 @@ func (n *ng) GetRegistry() *plugin.Registry {
 	return n.registry
 }
 
+// GetValue returns the value stored under <etcdKey>/values/<key>, or nil if
+// there is no such key.
+func (n *ng) GetValue(key string) ([]byte, error) {
+	if key == "" || strings.Contains(key, "/") {
+		return nil, fmt.Errorf("invalid value key %q", key)
+	}
+	val, err := n.getVal(n.path("values", key))
+	if err != nil {
+		if _, ok := err.(*engine.NotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return []byte(val), nil
+}
+
+// GetFaults returns the fault injection kill switch stored under
+// <etcdKey>/faults, it is zero if there is no such key.
+func (n *ng) GetFaults() (*engine.Faults, error) {
+	var faults engine.Faults
+	if err := n.getJSONVal(n.path("faults"), &faults); err != nil {
+		if _, ok := err.(*engine.NotFoundError); ok {
+			return &faults, nil
+		}
+		return nil, err
+	}
+	return &faults, nil
+}
+
+func (n *ng) UpsertFaults(f engine.Faults) error {
+	return n.setJSONVal(n.path("faults"), f, noTTL)
+}
+
 func (n *ng) GetHosts() ([]engine.Host, error) {
 	hosts := []engine.Host{}
 	vals, err := n.getDirs(n.etcdKey, "hosts")
@@ -515,7 +552,7 @@ func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error)
 	if err != nil {
 		return nil, err
 	}
-	return engine.MiddlewareFromJSON([]byte(bytes), n.registry.GetSpec, key.Id)
+	return n.middlewareFromJSON([]byte(bytes), key.Id)
 }
 
 func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
@@ -525,9 +562,33 @@ func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl ti
 	if _, err := n.GetFrontend(fk); err != nil {
 		return err
 	}
+	if sm, ok := m.Middleware.(plugin.SealedMiddleware); ok {
+		sealed, err := sm.Seal(n.sealJSONVal)
+		if err != nil {
+			return errors.Wrapf(err, "while sealing middleware '%s'", m.Id)
+		}
+		m.Middleware = sealed
+	}
 	return n.setJSONVal(n.path("frontends", fk.Id, "middlewares", m.Id), m, ttl)
 }
 
+// middlewareFromJSON parses a stored middleware, opening its sealed settings
+// if it has any.
+func (n *ng) middlewareFromJSON(bytes []byte, id string) (*engine.Middleware, error) {
+	m, err := engine.MiddlewareFromJSON(bytes, n.registry.GetSpec, id)
+	if err != nil {
+		return nil, err
+	}
+	if sm, ok := m.Middleware.(plugin.SealedMiddleware); ok {
+		opened, err := sm.Open(n.openSealedJSONVal)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while opening sealed middleware '%s'", id)
+		}
+		m.Middleware = opened
+	}
+	return m, nil
+}
+
 func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey) error {
 	if mk.FrontendKey.Id == "" || mk.Id == "" {
 		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
@@ -595,7 +656,7 @@ func (n *ng) openSealedJSONVal(bytes []byte, val interface{}) error {
 
 func (n *ng) sealJSONVal(val interface{}) ([]byte, error) {
 	if n.options.Box == nil {
-		return nil, errors.New("this backend does not support encryption")
+		return nil, errors.New("this backend does not support encryption, vulcand should run with -sealKey")
 	}
 	bytes, err := json.Marshal(val)
 	if err != nil {
@@ -667,6 +728,7 @@ func (n *ng) parseChange(response *etcd.Response) (interface{}, error) {
 		n.parseFrontendChange,
 		n.parseHostChange,
 		n.parseListenerChange,
+		n.parseFaultsChange,
 	}
 	for _, matcher := range matchers {
 		a, err := matcher(response)
@@ -727,6 +789,26 @@ func (n *ng) parseListenerChange(r *etcd.Response) (interface{}, error) {
 	return nil, fmt.Errorf("unsupported action on the listener: %s", r.Action)
 }
 
+func (n *ng) parseFaultsChange(r *etcd.Response) (interface{}, error) {
+	if r.Node.Key != n.path("faults") {
+		return nil, nil
+	}
+
+	switch r.Action {
+	case createA, setA:
+		var faults engine.Faults
+		if err := json.Unmarshal([]byte(r.Node.Value), &faults); err != nil {
+			return nil, err
+		}
+		return &engine.FaultsUpserted{
+			Faults: faults,
+		}, nil
+	case deleteA, expireA:
+		return &engine.FaultsUpserted{}, nil
+	}
+	return nil, fmt.Errorf("unsupported action on the faults: %s", r.Action)
+}
+
 func (n *ng) parseFrontendChange(r *etcd.Response) (interface{}, error) {
 	out := regexp.MustCompile("/frontends/([^/]+)(?:/frontend)?$").FindStringSubmatch(r.Node.Key)
 	if len(out) != 2 {
@@ -1,14 +1,18 @@
 package v3
 
 import (
+	"encoding/json"
 	"os"
 	"strings"
 	"testing"
 
+	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/engine/etcdng"
 	"github.com/vulcand/vulcand/engine/test"
+	"github.com/vulcand/vulcand/plugin/jwtauth"
 	"github.com/vulcand/vulcand/plugin/registry"
 	"github.com/vulcand/vulcand/secret"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	etcd "go.etcd.io/etcd/client/v3"
 	"golang.org/x/net/context"
 	. "gopkg.in/check.v1"
@@ -141,6 +145,10 @@ func (s *EtcdSuite) TestListenerSettingsCRUD(c *C) {
 	s.suite.ListenerSettingsCRUD(c)
 }
 
+func (s *EtcdSuite) TestFaultsCRUD(c *C) {
+	s.suite.FaultsCRUD(c)
+}
+
 func (s *EtcdSuite) TestBackendCRUD(c *C) {
 	s.suite.BackendCRUD(c)
 }
@@ -157,6 +165,10 @@ func (s *EtcdSuite) TestServerCRUD(c *C) {
 	s.suite.ServerCRUD(c)
 }
 
+func (s *EtcdSuite) TestBackupServerCRUD(c *C) {
+	s.suite.BackupServerCRUD(c)
+}
+
 func (s *EtcdSuite) TestServerExpire(c *C) {
 	s.suite.ServerExpire(c)
 }
@@ -177,6 +189,10 @@ func (s *EtcdSuite) TestMiddlewareCRUD(c *C) {
 	s.suite.MiddlewareCRUD(c)
 }
 
+func (s *EtcdSuite) TestSealedMiddlewareCRUD(c *C) {
+	s.suite.SealedMiddlewareCRUD(c)
+}
+
 func (s *EtcdSuite) TestMiddlewareExpire(c *C) {
 	s.suite.MiddlewareExpire(c)
 
@@ -189,3 +205,70 @@ func (s *EtcdSuite) TestMiddlewareBadFrontend(c *C) {
 func (s *EtcdSuite) TestMiddlewareBadType(c *C) {
 	s.suite.MiddlewareBadType(c)
 }
+
+// SealSuite checks sealing of middleware secrets, which does not need etcd.
+type SealSuite struct{}
+
+var _ = Suite(&SealSuite{})
+
+func (s *SealSuite) TestMiddlewareRoundTrip(c *C) {
+	keyString, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+	key, err := secret.KeyFromString(keyString)
+	c.Assert(err, IsNil)
+	box, err := secret.NewBox(key)
+	c.Assert(err, IsNil)
+	n := &ng{registry: registry.GetRegistry(), options: etcdng.Options{Box: box}}
+
+	keys := []jwtauth.Key{{Id: "k1", Algorithm: "HS256", Secret: "aG1hYy1rZXktMQ=="}}
+	j, err := jwtauth.NewJWTAuth(jwtauth.JWTAuth{Keys: keys})
+	c.Assert(err, IsNil)
+	sealed, err := j.Seal(n.sealJSONVal)
+	c.Assert(err, IsNil)
+	c.Assert(sealed.(*jwtauth.JWTAuth).Keys[0].Secret, Equals, "")
+	c.Assert(sealed.(*jwtauth.JWTAuth).Keys[0].SealedSecret, NotNil)
+
+	bytes, err := json.Marshal(engine.Middleware{Id: "j1", Type: jwtauth.Type, Priority: 1, Middleware: sealed})
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(bytes), "aG1hYy1rZXktMQ=="), Equals, false)
+
+	out, err := n.middlewareFromJSON(bytes, "j1")
+	c.Assert(err, IsNil)
+	c.Assert(out.Middleware.(*jwtauth.JWTAuth).Keys, DeepEquals, keys)
+
+	// Without the seal key secrets can be neither stored nor read.
+	n = &ng{registry: registry.GetRegistry()}
+	_, err = j.Seal(n.sealJSONVal)
+	c.Assert(err, NotNil)
+	_, err = n.middlewareFromJSON(bytes, "j1")
+	c.Assert(err, NotNil)
+}
+
+// FaultsSuite checks parsing of the fault injection kill switch, which does
+// not need etcd.
+type FaultsSuite struct{}
+
+var _ = Suite(&FaultsSuite{})
+
+func (s *FaultsSuite) TestParseChange(c *C) {
+	n := &ng{etcdKey: "/vulcand", registry: registry.GetRegistry()}
+	put := func(key, val string) *etcd.Event {
+		return &etcd.Event{Type: etcd.EventTypePut, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte(val)}}
+	}
+
+	change, err := n.parseChange(put("/vulcand/faults", `{"Disabled":true}`))
+	c.Assert(err, IsNil)
+	c.Assert(change, DeepEquals, &engine.FaultsUpserted{Faults: engine.Faults{Disabled: true}})
+
+	change, err = n.parseChange(&etcd.Event{Type: etcd.EventTypeDelete, Kv: &mvccpb.KeyValue{Key: []byte("/vulcand/faults")}})
+	c.Assert(err, IsNil)
+	c.Assert(change, DeepEquals, &engine.FaultsUpserted{})
+
+	// Values named faults are not the kill switch.
+	change, err = n.parseChange(put("/vulcand/values/faults", `{"Disabled":true}`))
+	c.Assert(err, IsNil)
+	c.Assert(change, IsNil)
+
+	_, err = n.parseChange(put("/vulcand/faults", "yes"))
+	c.Assert(err, NotNil)
+}
@@ -100,3 +100,11 @@ type ServerDeleted struct {
 func (s *ServerDeleted) String() string {
 	return fmt.Sprintf("ServerDeleted(serverKey=%v)", &s.ServerKey)
 }
+
+type FaultsUpserted struct {
+	Faults Faults
+}
+
+func (f *FaultsUpserted) String() string {
+	return fmt.Sprintf("FaultsUpserted(disabled=%v)", f.Faults.Disabled)
+}
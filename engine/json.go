@@ -296,5 +296,14 @@ func ServerFromJSON(in []byte, id ...string) (*Server, error) {
 	if len(id) != 0 {
 		e.Id = id[0]
 	}
-	return NewServer(e.Id, e.URL)
+	s, err := NewServer(e.Id, e.URL)
+	if err != nil {
+		return nil, err
+	}
+	s.Backup = e.Backup
+	s.Zone = e.Zone
+	s.Region = e.Region
+	s.Labels = e.Labels
+	s.CircuitBreaker = e.CircuitBreaker
+	return s, nil
 }
@@ -20,6 +20,7 @@ type Mem struct {
 
 	Middlewares map[engine.FrontendKey][]engine.Middleware
 	Servers     map[engine.BackendKey][]engine.Server
+	Faults      engine.Faults
 
 	Registry    *plugin.Registry
 	ChangesC    chan interface{}
@@ -95,6 +96,7 @@ func (m *Mem) GetSnapshot() (*engine.Snapshot, error) {
 		}
 		ss.FrontendSpecs = append(ss.FrontendSpecs, fes)
 	}
+	ss.Faults = m.Faults
 	return &ss, nil
 }
 
@@ -362,6 +364,17 @@ func (m *Mem) DeleteServer(sk engine.ServerKey) error {
 	return &engine.NotFoundError{}
 }
 
+func (m *Mem) GetFaults() (*engine.Faults, error) {
+	faults := m.Faults
+	return &faults, nil
+}
+
+func (m *Mem) UpsertFaults(f engine.Faults) error {
+	m.Faults = f
+	m.emit(&engine.FaultsUpserted{Faults: f})
+	return nil
+}
+
 func (m *Mem) Subscribe(changes chan interface{}, afterIdx uint64, cancelC chan struct{}) error {
 	for {
 		select {
@@ -56,6 +56,10 @@ func (s *MemSuite) TestListenerSettingsCRUD(c *C) {
 	s.suite.ListenerSettingsCRUD(c)
 }
 
+func (s *MemSuite) TestFaultsCRUD(c *C) {
+	s.suite.FaultsCRUD(c)
+}
+
 func (s *MemSuite) TestBackendCRUD(c *C) {
 	s.suite.BackendCRUD(c)
 }
@@ -68,6 +72,10 @@ func (s *MemSuite) TestServerCRUD(c *C) {
 	s.suite.ServerCRUD(c)
 }
 
+func (s *MemSuite) TestBackupServerCRUD(c *C) {
+	s.suite.BackupServerCRUD(c)
+}
+
 func (s *MemSuite) TestFrontendCRUD(c *C) {
 	s.suite.FrontendCRUD(c)
 }
@@ -5,6 +5,7 @@ import (
 	"crypto/subtle"
 	"crypto/tls"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
 	"strings"
@@ -14,6 +15,8 @@ import (
 	"github.com/vulcand/oxy/buffer"
 	"github.com/vulcand/oxy/memmetrics"
 	"github.com/vulcand/route"
+	"github.com/vulcand/vulcand/accesslog"
+	"github.com/vulcand/vulcand/logsink"
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/router"
 )
@@ -23,6 +26,9 @@ type StatsProvider interface {
 	FrontendStats(FrontendKey) (*RoundTripStats, error)
 	ServerStats(ServerKey) (*RoundTripStats, error)
 	BackendStats(BackendKey) (*RoundTripStats, error)
+	// ServerCircuitBreakers returns circuit breaker states of backend servers
+	// by server id, it is empty if the backend has circuit breakers disabled
+	ServerCircuitBreakers(BackendKey) (map[string]CircuitBreakerStats, error)
 
 	// TopFrontends returns locations sorted by criteria (faulty, slow, most used)
 	// if hostname or backendId is present, will filter out locations for that host or backendId
@@ -116,11 +122,44 @@ func (l *Listener) SettingsEquals(o *Listener) bool {
 	if (ls == nil && os != nil) || (ls != nil && os == nil) {
 		return false
 	}
-	return (&os.TLS).Equals(&ls.TLS)
+	return (&os.TLS).Equals(&ls.TLS) && ls.AccessLog.Equals(os.AccessLog)
 }
 
 type HTTPSListenerSettings struct {
 	TLS TLSSettings
+	// AccessLog writes every request that the listener gets to the access log
+	AccessLog *AccessLogSettings `json:",omitempty"`
+}
+
+// AccessLogSettings configures the access log of a listener.
+type AccessLogSettings struct {
+	// Format of log lines: common (the default), combined, json, or a
+	// text/template template of accesslog.Entry, e.g. "{{.Method}} {{.URI}} {{.Status}}"
+	Format string `json:",omitempty"`
+	// Addr of the output, e.g. file:///var/log/vulcand/access.log?maxSizeMB=100&maxBackups=7,
+	// stdout:// or syslog://, see package logsink
+	Addr string
+}
+
+// Check validates the access log settings.
+func (a *AccessLogSettings) Check() error {
+	if a.Addr == "" {
+		return fmt.Errorf("access log address is missing")
+	}
+	if err := logsink.Check(a.Addr); err != nil {
+		return fmt.Errorf("bad access log address: %v", err)
+	}
+	if err := accesslog.CheckFormat(a.Format); err != nil {
+		return fmt.Errorf("bad access log format: %v", err)
+	}
+	return nil
+}
+
+func (a *AccessLogSettings) Equals(o *AccessLogSettings) bool {
+	if a == nil || o == nil {
+		return a == o
+	}
+	return *a == *o
 }
 
 // Sets up OCSP stapling, see http://en.wikipedia.org/wiki/OCSP_stapling
@@ -262,6 +301,18 @@ type HTTPFrontendLimits struct {
 }
 
 // Additional options to control this location, such as timeouts
+// HTTPFrontendSubset limits load balancing to a subset of backend servers that
+// have certain labels.
+type HTTPFrontendSubset struct {
+	// Selector maps label names to values that servers must have. A value
+	// can be a request variable, e.g. request.header.X-Version, in which case
+	// it is taken from every request.
+	Selector map[string]string `json:",omitempty"`
+	// Fallback is either "any" (default) to use all servers when none match
+	// the selector, or "none" to reject such requests
+	Fallback string `json:",omitempty"`
+}
+
 type HTTPFrontendSettings struct {
 	// Limits contains various limits one can supply for a location.
 	Limits HTTPFrontendLimits
@@ -277,6 +328,8 @@ type HTTPFrontendSettings struct {
 	Stream bool
 	// How frequently should we flush the stream?
 	StreamFlushIntervalNanoSecs int64
+	// Subset limits load balancing to servers with certain labels
+	Subset HTTPFrontendSubset
 }
 
 func NewAddress(network, address string) (*Address, error) {
@@ -309,6 +362,12 @@ func NewListener(id, protocol, network, address, scope, proxyHeader string, sett
 		return nil, err
 	}
 
+	if settings != nil && settings.AccessLog != nil {
+		if err := settings.AccessLog.Check(); err != nil {
+			return nil, err
+		}
+	}
+
 	proxyHeader = strings.ToUpper(proxyHeader)
 	switch proxyHeader {
 	case "PROXY_V1":
@@ -347,6 +406,10 @@ func NewHTTPFrontend(router router.Router, id, backendId string, routeExpr strin
 		return nil, fmt.Errorf("invalid failover predicate: %s", settings.FailoverPredicate)
 	}
 
+	if err := settings.Subset.Validate(); err != nil {
+		return nil, err
+	}
+
 	return &Frontend{
 		Id:        id,
 		BackendId: backendId,
@@ -365,7 +428,37 @@ func (l HTTPFrontendSettings) Equals(o HTTPFrontendSettings) bool {
 		l.Limits.MaxBodyBytes == o.Limits.MaxBodyBytes &&
 		l.FailoverPredicate == o.FailoverPredicate &&
 		l.Hostname == o.Hostname &&
-		l.TrustForwardHeader == o.TrustForwardHeader
+		l.TrustForwardHeader == o.TrustForwardHeader &&
+		l.Subset.Equals(o.Subset)
+}
+
+// Validate makes sure that the subset selector and fallback are valid.
+func (s HTTPFrontendSubset) Validate() error {
+	if _, err := plugin.NewServerSelector(s.Selector); err != nil {
+		return errors.Wrap(err, "invalid subset selector")
+	}
+	switch s.Fallback {
+	case "", SubsetFallbackAny, SubsetFallbackNone:
+		return nil
+	}
+	return errors.Errorf("unsupported subset fallback '%s', supported are %s and %s",
+		s.Fallback, SubsetFallbackAny, SubsetFallbackNone)
+}
+
+func (s HTTPFrontendSubset) Equals(o HTTPFrontendSubset) bool {
+	return s.Fallback == o.Fallback && labelsEqual(s.Selector, o.Selector)
+}
+
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
 }
 
 func (f *Frontend) String() string {
@@ -408,6 +501,68 @@ type HTTPBackendKeepAlive struct {
 	MaxIdleConnsPerHost int
 }
 
+// HTTPBackendSlowStart controls how newly added servers are brought into
+// rotation. Instead of getting a full share of requests right away a server
+// starts with a fraction of its weight that grows to the full weight over
+// the slow start period.
+type HTTPBackendSlowStart struct {
+	// Period over which a server weight ramps up to full, slow start is
+	// disabled if empty
+	Period string
+	// Ramp is either "linear" (default) or "exponential"
+	Ramp string
+	// MinWeight is the fraction of the full weight a server starts with,
+	// defaults to 0.1
+	MinWeight float64
+}
+
+// HTTPBackendConcurrency caps the number of requests that a backend server
+// handles at a time. When every server is at its cap requests wait in a
+// bounded queue for a server to free up.
+type HTTPBackendConcurrency struct {
+	// MaxPerServer is the max number of in-flight requests per server,
+	// concurrency is not limited if 0
+	MaxPerServer int
+	// QueueSize is the max number of requests waiting for a free server,
+	// requests are rejected right away when all servers are busy if 0
+	QueueSize int
+	// QueueTimeout is how long a request may wait in the queue, defaults to 5s
+	QueueTimeout string
+}
+
+// HTTPBackendLocality makes a backend prefer servers that are located close to
+// the vulcand instance, i.e. in the same zone or region. When there are not
+// enough local servers some traffic spills over to farther ones.
+type HTTPBackendLocality struct {
+	// Prefer is either "zone" or "region", locality is ignored if empty
+	Prefer string
+	// MinLocalServers is the number of local servers below which traffic
+	// starts spilling over to farther servers, defaults to 1
+	MinLocalServers int
+}
+
+// HTTPBackendCircuitBreaker takes backend servers that fail too many requests
+// out of rotation. A server circuit breaker trips when the ratio of failed
+// requests, i.e. network errors and 5xx responses, exceeds the threshold. The
+// server gets no traffic for the fallback duration, and then its share of
+// traffic grows back over the recovery duration.
+type HTTPBackendCircuitBreaker struct {
+	// ErrorRatio is the ratio of failed requests that trips a breaker,
+	// circuit breakers are disabled if 0
+	ErrorRatio float64
+	// MinRequests is the number of requests within the window below which a
+	// breaker does not trip, defaults to 10
+	MinRequests int
+	// Window is the period over which requests are counted, defaults to 10s
+	Window string
+	// FallbackDuration is how long a tripped server gets no traffic,
+	// defaults to 10s
+	FallbackDuration string
+	// RecoveryDuration is how long it takes a server to get back to its full
+	// share of traffic, defaults to 10s
+	RecoveryDuration string
+}
+
 type HTTPBackendSettings struct {
 	// Timeouts provides timeout settings for backend servers
 	Timeouts HTTPBackendTimeouts
@@ -415,6 +570,14 @@ type HTTPBackendSettings struct {
 	KeepAlive HTTPBackendKeepAlive
 	// TLS provides optional TLS settings for HTTP backend
 	TLS *TLSSettings `json:",omitempty"`
+	// SlowStart controls ramp up of newly added servers
+	SlowStart HTTPBackendSlowStart
+	// Concurrency caps the number of in-flight requests per server
+	Concurrency HTTPBackendConcurrency
+	// Locality makes the backend prefer servers close to vulcand
+	Locality HTTPBackendLocality
+	// CircuitBreaker takes failing servers out of rotation
+	CircuitBreaker HTTPBackendCircuitBreaker
 }
 
 func (s *HTTPBackendSettings) Equals(o HTTPBackendSettings) bool {
@@ -423,6 +586,10 @@ func (s *HTTPBackendSettings) Equals(o HTTPBackendSettings) bool {
 		s.Timeouts.TLSHandshake == o.Timeouts.TLSHandshake &&
 		s.KeepAlive.Period == o.KeepAlive.Period &&
 		s.KeepAlive.MaxIdleConnsPerHost == o.KeepAlive.MaxIdleConnsPerHost &&
+		s.SlowStart == o.SlowStart &&
+		s.Concurrency == o.Concurrency &&
+		s.Locality == o.Locality &&
+		s.CircuitBreaker == o.CircuitBreaker &&
 		((s.TLS == nil && o.TLS == nil) ||
 			((s.TLS != nil && o.TLS != nil) && s.TLS.Equals(o.TLS)))
 }
@@ -465,6 +632,124 @@ func (s *HTTPBackendSettings) TransportSettings() (TransportSettings, error) {
 	return t, nil
 }
 
+// SlowStartSettings parses and validates slow start settings of the backend.
+func (s *HTTPBackendSettings) SlowStartSettings() (SlowStartSettings, error) {
+	var ss SlowStartSettings
+	var err error
+	if len(s.SlowStart.Period) != 0 {
+		if ss.Period, err = time.ParseDuration(s.SlowStart.Period); err != nil {
+			return SlowStartSettings{}, errors.Wrap(err, "invalid slow start period")
+		}
+	}
+	switch s.SlowStart.Ramp {
+	case "", SlowStartLinear:
+		ss.Ramp = SlowStartLinear
+	case SlowStartExponential:
+		ss.Ramp = SlowStartExponential
+	default:
+		return SlowStartSettings{}, errors.Errorf("unsupported slow start ramp '%s', supported ramps are %s and %s",
+			s.SlowStart.Ramp, SlowStartLinear, SlowStartExponential)
+	}
+	ss.MinWeight = s.SlowStart.MinWeight
+	if ss.MinWeight == 0 {
+		ss.MinWeight = DefaultSlowStartMinWeight
+	}
+	if ss.MinWeight < 0 || ss.MinWeight > 1 {
+		return SlowStartSettings{}, errors.Errorf("slow start min weight should be in (0, 1], got %v", ss.MinWeight)
+	}
+	return ss, nil
+}
+
+// ConcurrencySettings parses and validates concurrency settings of the backend.
+func (s *HTTPBackendSettings) ConcurrencySettings() (ConcurrencySettings, error) {
+	cs := ConcurrencySettings{
+		MaxPerServer: s.Concurrency.MaxPerServer,
+		QueueSize:    s.Concurrency.QueueSize,
+		QueueTimeout: DefaultQueueTimeout,
+	}
+	if cs.MaxPerServer < 0 {
+		return ConcurrencySettings{}, errors.Errorf("max concurrency per server can not be negative, got %v", cs.MaxPerServer)
+	}
+	if cs.QueueSize < 0 {
+		return ConcurrencySettings{}, errors.Errorf("queue size can not be negative, got %v", cs.QueueSize)
+	}
+	if len(s.Concurrency.QueueTimeout) != 0 {
+		var err error
+		if cs.QueueTimeout, err = time.ParseDuration(s.Concurrency.QueueTimeout); err != nil {
+			return ConcurrencySettings{}, errors.Wrap(err, "invalid queue timeout")
+		}
+		if cs.QueueTimeout <= 0 {
+			return ConcurrencySettings{}, errors.Errorf("queue timeout should be positive, got %v", cs.QueueTimeout)
+		}
+	}
+	return cs, nil
+}
+
+// LocalitySettings parses and validates locality settings of the backend.
+func (s *HTTPBackendSettings) LocalitySettings() (LocalitySettings, error) {
+	ls := LocalitySettings{
+		MinLocalServers: s.Locality.MinLocalServers,
+	}
+	switch s.Locality.Prefer {
+	case "":
+	case LocalityZone, LocalityRegion:
+		ls.Prefer = s.Locality.Prefer
+	default:
+		return LocalitySettings{}, errors.Errorf("unsupported locality '%s', supported are %s and %s",
+			s.Locality.Prefer, LocalityZone, LocalityRegion)
+	}
+	if ls.MinLocalServers < 0 {
+		return LocalitySettings{}, errors.Errorf("min local servers can not be negative, got %v", ls.MinLocalServers)
+	}
+	if ls.MinLocalServers == 0 {
+		ls.MinLocalServers = 1
+	}
+	return ls, nil
+}
+
+// CircuitBreakerSettings parses and validates server circuit breaker settings
+// of the backend.
+func (s *HTTPBackendSettings) CircuitBreakerSettings() (CircuitBreakerSettings, error) {
+	cb := CircuitBreakerSettings{
+		ErrorRatio:       s.CircuitBreaker.ErrorRatio,
+		MinRequests:      s.CircuitBreaker.MinRequests,
+		Window:           DefaultCircuitBreakerWindow,
+		FallbackDuration: DefaultCircuitBreakerFallback,
+		RecoveryDuration: DefaultCircuitBreakerRecovery,
+	}
+	if cb.ErrorRatio < 0 || cb.ErrorRatio >= 1 {
+		return CircuitBreakerSettings{}, errors.Errorf("circuit breaker error ratio should be in [0, 1), got %v", cb.ErrorRatio)
+	}
+	if cb.MinRequests < 0 {
+		return CircuitBreakerSettings{}, errors.Errorf("circuit breaker min requests can not be negative, got %v", cb.MinRequests)
+	}
+	if cb.MinRequests == 0 {
+		cb.MinRequests = DefaultCircuitBreakerMinRequests
+	}
+	durations := []struct {
+		name  string
+		value string
+		out   *time.Duration
+	}{
+		{"window", s.CircuitBreaker.Window, &cb.Window},
+		{"fallback duration", s.CircuitBreaker.FallbackDuration, &cb.FallbackDuration},
+		{"recovery duration", s.CircuitBreaker.RecoveryDuration, &cb.RecoveryDuration},
+	}
+	for _, d := range durations {
+		if len(d.value) == 0 {
+			continue
+		}
+		var err error
+		if *d.out, err = time.ParseDuration(d.value); err != nil {
+			return CircuitBreakerSettings{}, errors.Wrapf(err, "invalid circuit breaker %s", d.name)
+		}
+		if *d.out <= 0 {
+			return CircuitBreakerSettings{}, errors.Errorf("circuit breaker %s should be positive, got %v", d.name, *d.out)
+		}
+	}
+	return cb, nil
+}
+
 type MiddlewareKey struct {
 	FrontendKey FrontendKey
 	Id          string
@@ -496,6 +781,18 @@ func NewHTTPBackend(id string, s HTTPBackendSettings) (*Backend, error) {
 	if _, err := s.TransportSettings(); err != nil {
 		return nil, err
 	}
+	if _, err := s.SlowStartSettings(); err != nil {
+		return nil, err
+	}
+	if _, err := s.ConcurrencySettings(); err != nil {
+		return nil, err
+	}
+	if _, err := s.LocalitySettings(); err != nil {
+		return nil, err
+	}
+	if _, err := s.CircuitBreakerSettings(); err != nil {
+		return nil, err
+	}
 	return &Backend{
 		Id:       id,
 		Type:     HTTP,
@@ -526,9 +823,22 @@ func (b *Backend) TransportSettings() (TransportSettings, error) {
 
 // Server is a final destination of the request
 type Server struct {
-	Id    string
-	URL   string
-	Stats *RoundTripStats `json:",omitempty"`
+	Id  string
+	URL string
+	// Backup servers only get traffic when no primary server of the backend
+	// is available
+	Backup bool `json:",omitempty"`
+	// Zone and Region tell where the server is located, they are used by
+	// backends that prefer local servers
+	Zone   string `json:",omitempty"`
+	Region string `json:",omitempty"`
+	// Labels are arbitrary key/value pairs that frontends and middlewares
+	// can use to limit load balancing to a subset of backend servers
+	Labels map[string]string `json:",omitempty"`
+	Stats  *RoundTripStats   `json:",omitempty"`
+	// CircuitBreaker is only reported for servers of backends with circuit
+	// breakers enabled
+	CircuitBreaker *CircuitBreakerStats `json:",omitempty"`
 }
 
 func NewServer(id, u string) (*Server, error) {
@@ -569,6 +879,53 @@ type RoundTripStats struct {
 	Verdict         Verdict
 	Counters        Counters
 	LatencyBrackets LatencyBrackets
+	// SlowStart is only reported for servers that are ramping up
+	SlowStart *SlowStartStats `json:",omitempty"`
+	// Queue is only reported for backends with capped server concurrency
+	Queue *QueueStats `json:",omitempty"`
+	// CircuitBreaker is only reported for servers of backends with circuit
+	// breakers enabled
+	CircuitBreaker *CircuitBreakerStats `json:",omitempty"`
+}
+
+const (
+	CircuitBreakerStandby    = "standby"
+	CircuitBreakerTripped    = "tripped"
+	CircuitBreakerRecovering = "recovering"
+)
+
+// CircuitBreakerStats describes the state of a server circuit breaker.
+type CircuitBreakerStats struct {
+	// State is one of standby, tripped or recovering
+	State string
+	// Since is the time the breaker entered the state, it is zero for
+	// breakers that have been in standby from the very beginning
+	Since time.Time
+}
+
+// SlowStartStats describes where a server is on its slow start ramp.
+type SlowStartStats struct {
+	// Since is the time the server was brought into rotation
+	Since time.Time
+	// Weight is the fraction of the full weight the server currently gets
+	Weight float64
+}
+
+// QueueStats describes the queue of requests waiting for a backend server to
+// free up. Counters are accumulated since the backend was created.
+type QueueStats struct {
+	// Depth is the number of requests waiting at the moment
+	Depth int
+	// Enqueued is the number of requests that had to wait
+	Enqueued int64
+	// Rejected is the number of requests turned down because the queue was full
+	Rejected int64
+	// TimedOut is the number of requests that did not get a server in time
+	TimedOut int64
+	// MeanWait is the average time requests spent in the queue
+	MeanWait time.Duration
+	// MaxWait is the longest time a request spent in the queue
+	MaxWait time.Duration
 }
 
 func NewRoundTripStats(m *memmetrics.RTMetrics) (*RoundTripStats, error) {
@@ -793,6 +1150,97 @@ type TransportSettings struct {
 	TLS       *tls.Config
 }
 
+const (
+	SlowStartLinear      = "linear"
+	SlowStartExponential = "exponential"
+
+	DefaultSlowStartMinWeight = 0.1
+)
+
+// SlowStartSettings is a parsed form of HTTPBackendSlowStart.
+type SlowStartSettings struct {
+	Period    time.Duration
+	Ramp      string
+	MinWeight float64
+}
+
+// Enabled tells whether servers should be ramped up at all.
+func (s SlowStartSettings) Enabled() bool {
+	return s.Period > 0
+}
+
+// Weight returns the fraction of the full weight that a server should get
+// after being in rotation for the given time.
+func (s SlowStartSettings) Weight(elapsed time.Duration) float64 {
+	if !s.Enabled() || elapsed >= s.Period {
+		return 1
+	}
+	if elapsed <= 0 {
+		return s.MinWeight
+	}
+	progress := float64(elapsed) / float64(s.Period)
+	if s.Ramp == SlowStartExponential {
+		return s.MinWeight * math.Pow(1/s.MinWeight, progress)
+	}
+	return s.MinWeight + (1-s.MinWeight)*progress
+}
+
+const DefaultQueueTimeout = 5 * time.Second
+
+// ConcurrencySettings is a parsed form of HTTPBackendConcurrency.
+type ConcurrencySettings struct {
+	MaxPerServer int
+	QueueSize    int
+	QueueTimeout time.Duration
+}
+
+// Enabled tells whether server concurrency is capped at all.
+func (s ConcurrencySettings) Enabled() bool {
+	return s.MaxPerServer > 0
+}
+
+const (
+	DefaultCircuitBreakerMinRequests = 10
+	DefaultCircuitBreakerWindow      = 10 * time.Second
+	DefaultCircuitBreakerFallback    = 10 * time.Second
+	DefaultCircuitBreakerRecovery    = 10 * time.Second
+)
+
+// CircuitBreakerSettings is a parsed form of HTTPBackendCircuitBreaker.
+type CircuitBreakerSettings struct {
+	ErrorRatio       float64
+	MinRequests      int
+	Window           time.Duration
+	FallbackDuration time.Duration
+	RecoveryDuration time.Duration
+}
+
+// Enabled tells whether server circuit breakers are enabled at all.
+func (s CircuitBreakerSettings) Enabled() bool {
+	return s.ErrorRatio > 0
+}
+
+const (
+	SubsetFallbackAny  = "any"
+	SubsetFallbackNone = "none"
+)
+
+const (
+	LocalityZone   = "zone"
+	LocalityRegion = "region"
+)
+
+// LocalitySettings is a parsed form of HTTPBackendLocality.
+type LocalitySettings struct {
+	Prefer          string
+	MinLocalServers int
+}
+
+// Enabled tells whether local servers should be preferred at all.
+func (s LocalitySettings) Enabled() bool {
+	return s.Prefer != ""
+}
+
 // FrontendSpec fully specifies a particular frontend.
 type FrontendSpec struct {
 	Frontend    Frontend
@@ -805,6 +1253,14 @@ type BackendSpec struct {
 	Servers []Server
 }
 
+// Faults is the kill switch of fault injection middlewares. It is kept in the
+// engine, so that every vulcand instance obeys it.
+type Faults struct {
+	// Disabled turns injection of faults off in all fault middlewares.
+	// Faults are injected unless the switch is set.
+	Disabled bool
+}
+
 // Snapshot represents system config at a given time.
 type Snapshot struct {
 	Index         uint64
@@ -812,4 +1268,5 @@ type Snapshot struct {
 	BackendSpecs  []BackendSpec
 	Hosts         []Host
 	Listeners     []Listener
+	Faults        Faults
 }
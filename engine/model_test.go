@@ -50,6 +50,10 @@ func (s *BackendSuite) TestNewFrontendWithOptions(c *C) {
 		FailoverPredicate:  "IsNetworkError() && Attempts() <= 1",
 		Hostname:           "host1",
 		TrustForwardHeader: true,
+		Subset: HTTPFrontendSubset{
+			Selector: map[string]string{"version": "request.header.X-Version"},
+			Fallback: SubsetFallbackNone,
+		},
 	}
 	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, settings)
 	c.Assert(err, IsNil)
@@ -63,6 +67,7 @@ func (s *BackendSuite) TestNewFrontendWithOptions(c *C) {
 	c.Assert(o.FailoverPredicate, NotNil)
 	c.Assert(o.TrustForwardHeader, Equals, true)
 	c.Assert(o.Hostname, Equals, "host1")
+	c.Assert(o.Subset, DeepEquals, settings.Subset)
 }
 
 func (s *BackendSuite) TestFrontendBadParams(c *C) {
@@ -80,6 +85,15 @@ func (s *BackendSuite) TestFrontendBadOptions(c *C) {
 		HTTPFrontendSettings{
 			FailoverPredicate: "bad predicate",
 		},
+		HTTPFrontendSettings{
+			Subset: HTTPFrontendSubset{Selector: map[string]string{"version": "request.bogus"}},
+		},
+		HTTPFrontendSettings{
+			Subset: HTTPFrontendSubset{Selector: map[string]string{"": "v1"}},
+		},
+		HTTPFrontendSettings{
+			Subset: HTTPFrontendSubset{Fallback: "sometimes"},
+		},
 	}
 	for _, s := range settings {
 		f, err := NewHTTPFrontend(route.NewMux(), "f1", "b", `Path("/home")`, s)
@@ -253,6 +267,24 @@ func (s *BackendSuite) TestListenerSettingsEq(c *C) {
 			e: false,
 			c: "session tickets",
 		},
+		{
+			a: Listener{Settings: &HTTPSListenerSettings{AccessLog: &AccessLogSettings{Addr: "stdout://"}}},
+			b: Listener{Settings: &HTTPSListenerSettings{AccessLog: &AccessLogSettings{Addr: "stdout://"}}},
+			e: true,
+			c: "same access log",
+		},
+		{
+			a: Listener{Settings: &HTTPSListenerSettings{AccessLog: &AccessLogSettings{Addr: "stdout://"}}},
+			b: Listener{Settings: &HTTPSListenerSettings{}},
+			e: false,
+			c: "access log on",
+		},
+		{
+			a: Listener{Settings: &HTTPSListenerSettings{AccessLog: &AccessLogSettings{Addr: "stdout://", Format: "json"}}},
+			b: Listener{Settings: &HTTPSListenerSettings{AccessLog: &AccessLogSettings{Addr: "stdout://"}}},
+			e: false,
+			c: "access log format",
+		},
 	}
 	for _, o := range options {
 		c.Assert((&o.a).SettingsEquals(&o.b), Equals, o.e, Commentf("TC: %v", o.c))
@@ -281,6 +313,74 @@ func (s *BackendSuite) TestNewBackendWithBadOptions(c *C) {
 				Period: "1what?",
 			},
 		},
+		HTTPBackendSettings{
+			SlowStart: HTTPBackendSlowStart{
+				Period: "1what?",
+			},
+		},
+		HTTPBackendSettings{
+			SlowStart: HTTPBackendSlowStart{
+				Period: "10s",
+				Ramp:   "sideways",
+			},
+		},
+		HTTPBackendSettings{
+			SlowStart: HTTPBackendSlowStart{
+				Period:    "10s",
+				MinWeight: 1.5,
+			},
+		},
+		HTTPBackendSettings{
+			Concurrency: HTTPBackendConcurrency{
+				MaxPerServer: -1,
+			},
+		},
+		HTTPBackendSettings{
+			Locality: HTTPBackendLocality{
+				Prefer: "rack",
+			},
+		},
+		HTTPBackendSettings{
+			Locality: HTTPBackendLocality{
+				Prefer:          LocalityZone,
+				MinLocalServers: -1,
+			},
+		},
+		HTTPBackendSettings{
+			Concurrency: HTTPBackendConcurrency{
+				MaxPerServer: 1,
+				QueueSize:    -1,
+			},
+		},
+		HTTPBackendSettings{
+			Concurrency: HTTPBackendConcurrency{
+				MaxPerServer: 1,
+				QueueTimeout: "1what?",
+			},
+		},
+		HTTPBackendSettings{
+			CircuitBreaker: HTTPBackendCircuitBreaker{
+				ErrorRatio: 1,
+			},
+		},
+		HTTPBackendSettings{
+			CircuitBreaker: HTTPBackendCircuitBreaker{
+				ErrorRatio:  0.5,
+				MinRequests: -1,
+			},
+		},
+		HTTPBackendSettings{
+			CircuitBreaker: HTTPBackendCircuitBreaker{
+				ErrorRatio: 0.5,
+				Window:     "1what?",
+			},
+		},
+		HTTPBackendSettings{
+			CircuitBreaker: HTTPBackendCircuitBreaker{
+				ErrorRatio:       0.5,
+				FallbackDuration: "-1s",
+			},
+		},
 	}
 	for _, o := range options {
 		b, err := NewHTTPBackend("b1", o)
@@ -289,6 +389,78 @@ func (s *BackendSuite) TestNewBackendWithBadOptions(c *C) {
 	}
 }
 
+func (s *BackendSuite) TestSlowStartSettings(c *C) {
+	settings := HTTPBackendSettings{}
+	ss, err := settings.SlowStartSettings()
+	c.Assert(err, IsNil)
+	c.Assert(ss.Enabled(), Equals, false)
+	c.Assert(ss.Weight(0), Equals, 1.0)
+
+	settings.SlowStart = HTTPBackendSlowStart{Period: "10s"}
+	ss, err = settings.SlowStartSettings()
+	c.Assert(err, IsNil)
+	c.Assert(ss.Enabled(), Equals, true)
+	c.Assert(ss.Ramp, Equals, SlowStartLinear)
+	c.Assert(ss.MinWeight, Equals, DefaultSlowStartMinWeight)
+	c.Assert(ss.Weight(0), Equals, DefaultSlowStartMinWeight)
+	c.Assert(ss.Weight(5*time.Second), Equals, 0.55)
+	c.Assert(ss.Weight(10*time.Second), Equals, 1.0)
+	c.Assert(ss.Weight(time.Minute), Equals, 1.0)
+
+	settings.SlowStart = HTTPBackendSlowStart{Period: "10s", Ramp: SlowStartExponential, MinWeight: 0.25}
+	ss, err = settings.SlowStartSettings()
+	c.Assert(err, IsNil)
+	c.Assert(ss.Weight(0), Equals, 0.25)
+	c.Assert(ss.Weight(5*time.Second), Equals, 0.5)
+	c.Assert(ss.Weight(10*time.Second), Equals, 1.0)
+}
+
+func (s *BackendSuite) TestConcurrencySettings(c *C) {
+	settings := HTTPBackendSettings{}
+	cs, err := settings.ConcurrencySettings()
+	c.Assert(err, IsNil)
+	c.Assert(cs.Enabled(), Equals, false)
+	c.Assert(cs.QueueTimeout, Equals, DefaultQueueTimeout)
+
+	settings.Concurrency = HTTPBackendConcurrency{MaxPerServer: 10, QueueSize: 100, QueueTimeout: "300ms"}
+	cs, err = settings.ConcurrencySettings()
+	c.Assert(err, IsNil)
+	c.Assert(cs, Equals, ConcurrencySettings{MaxPerServer: 10, QueueSize: 100, QueueTimeout: 300 * time.Millisecond})
+	c.Assert(cs.Enabled(), Equals, true)
+}
+
+func (s *BackendSuite) TestLocalitySettings(c *C) {
+	settings := HTTPBackendSettings{}
+	ls, err := settings.LocalitySettings()
+	c.Assert(err, IsNil)
+	c.Assert(ls.Enabled(), Equals, false)
+
+	settings.Locality = HTTPBackendLocality{Prefer: LocalityZone}
+	ls, err = settings.LocalitySettings()
+	c.Assert(err, IsNil)
+	c.Assert(ls, Equals, LocalitySettings{Prefer: LocalityZone, MinLocalServers: 1})
+	c.Assert(ls.Enabled(), Equals, true)
+}
+
+func (s *BackendSuite) TestCircuitBreakerSettings(c *C) {
+	settings := HTTPBackendSettings{}
+	cb, err := settings.CircuitBreakerSettings()
+	c.Assert(err, IsNil)
+	c.Assert(cb.Enabled(), Equals, false)
+
+	settings.CircuitBreaker = HTTPBackendCircuitBreaker{ErrorRatio: 0.5, RecoveryDuration: "1m"}
+	cb, err = settings.CircuitBreakerSettings()
+	c.Assert(err, IsNil)
+	c.Assert(cb, Equals, CircuitBreakerSettings{
+		ErrorRatio:       0.5,
+		MinRequests:      DefaultCircuitBreakerMinRequests,
+		Window:           DefaultCircuitBreakerWindow,
+		FallbackDuration: DefaultCircuitBreakerFallback,
+		RecoveryDuration: time.Minute,
+	})
+	c.Assert(cb.Enabled(), Equals, true)
+}
+
 func (s *BackendSuite) TestNewServer(c *C) {
 	sv, err := NewServer("s1", "http://falhost")
 	c.Assert(err, IsNil)
@@ -310,6 +482,10 @@ func (s *BackendSuite) TestNewListener(c *C) {
 
 	_, err = NewListener("id", "http", "tcp", "127.0.0.1:4000", "", "PROXY_V1", nil)
 	c.Assert(err, IsNil)
+
+	_, err = NewListener("id", "http", "tcp", "127.0.0.1:4000", "", "", &HTTPSListenerSettings{
+		AccessLog: &AccessLogSettings{Addr: "file:///var/log/vulcand/access.log", Format: "combined"}})
+	c.Assert(err, IsNil)
 }
 
 func (s *BackendSuite) TestNewListenerBadParams(c *C) {
@@ -324,6 +500,16 @@ func (s *BackendSuite) TestNewListenerBadParams(c *C) {
 
 	_, err = NewListener("id", "http", "tcp", "127.0.0.1:4000", "", "NOT_VALID", nil)
 	c.Assert(err, NotNil)
+
+	for _, a := range []AccessLogSettings{
+		{},
+		{Addr: "omglog://"},
+		{Addr: "stdout://", Format: "fancy"},
+		{Addr: "stdout://", Format: "{{.Nope}}"},
+	} {
+		_, err = NewListener("id", "http", "tcp", "127.0.0.1:4000", "", "", &HTTPSListenerSettings{AccessLog: &a})
+		c.Assert(err, NotNil, Commentf("access log %v", a))
+	}
 }
 
 func (s *BackendSuite) TestFrontendsFromJSON(c *C) {
@@ -386,6 +572,17 @@ func (s *BackendSuite) TestServerFromJSON(c *C) {
 	c.Assert(out, NotNil)
 
 	c.Assert(out, DeepEquals, e)
+
+	e.Backup = true
+	e.Zone = "us-east-1a"
+	e.Region = "us-east-1"
+	e.Labels = map[string]string{"version": "v2"}
+	bytes, err = json.Marshal(e)
+	c.Assert(err, IsNil)
+
+	out, err = ServerFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, e)
 }
 
 func (s *BackendSuite) TestNewTLSSettings(c *C) {
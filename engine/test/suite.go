@@ -6,6 +6,7 @@ import (
 
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/plugin/connlimit"
+	"github.com/vulcand/vulcand/plugin/jwtauth"
 
 	. "gopkg.in/check.v1"
 )
@@ -182,6 +183,30 @@ func (s *EngineSuite) ListenerCRUD(c *C) {
 	)
 }
 
+func (s *EngineSuite) FaultsCRUD(c *C) {
+	faults, err := s.Engine.GetFaults()
+	c.Assert(err, IsNil)
+	c.Assert(faults, DeepEquals, &engine.Faults{})
+
+	c.Assert(s.Engine.UpsertFaults(engine.Faults{Disabled: true}), IsNil)
+	s.expectChanges(c,
+		&engine.FaultsUpserted{Faults: engine.Faults{Disabled: true}},
+	)
+
+	faults, err = s.Engine.GetFaults()
+	c.Assert(err, IsNil)
+	c.Assert(faults, DeepEquals, &engine.Faults{Disabled: true})
+
+	ss, err := s.Engine.GetSnapshot()
+	c.Assert(err, IsNil)
+	c.Assert(ss.Faults, DeepEquals, engine.Faults{Disabled: true})
+
+	c.Assert(s.Engine.UpsertFaults(engine.Faults{}), IsNil)
+	s.expectChanges(c,
+		&engine.FaultsUpserted{Faults: engine.Faults{}},
+	)
+}
+
 func (s *EngineSuite) ListenerSettingsCRUD(c *C) {
 	listener := engine.Listener{
 		Id:       "l1",
@@ -332,6 +357,40 @@ func (s *EngineSuite) ServerCRUD(c *C) {
 	})
 }
 
+func (s *EngineSuite) BackupServerCRUD(c *C) {
+	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+
+	c.Assert(s.Engine.UpsertBackend(b), IsNil)
+
+	s.expectChanges(c, &engine.BackendUpserted{Backend: b})
+
+	srv := engine.Server{Id: "srv0", URL: "http://localhost:1000", Backup: true}
+	bk := engine.BackendKey{Id: b.Id}
+	sk := engine.ServerKey{BackendKey: bk, Id: srv.Id}
+
+	c.Assert(s.Engine.UpsertServer(bk, srv, 0), IsNil)
+
+	srvo, err := s.Engine.GetServer(sk)
+	c.Assert(err, IsNil)
+	c.Assert(srvo, DeepEquals, &srv)
+
+	srvs, err := s.Engine.GetServers(bk)
+	c.Assert(err, IsNil)
+	c.Assert(srvs, DeepEquals, []engine.Server{srv})
+
+	s.expectChanges(c, &engine.ServerUpserted{
+		BackendKey: bk,
+		Server:     srv,
+	})
+
+	err = s.Engine.DeleteServer(sk)
+	c.Assert(err, IsNil)
+
+	s.expectChanges(c, &engine.ServerDeleted{
+		ServerKey: sk,
+	})
+}
+
 func (s *EngineSuite) ServerExpire(c *C) {
 	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
 
@@ -483,6 +542,40 @@ func (s *EngineSuite) MiddlewareCRUD(c *C) {
 	})
 }
 
+// SealedMiddlewareCRUD checks that middleware secrets are sealed when stored
+// and come back opened.
+func (s *EngineSuite) SealedMiddlewareCRUD(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.Engine.UpsertBackend(b), IsNil)
+
+	f := engine.Frontend{
+		Id:        "f1",
+		Type:      engine.HTTP,
+		Route:     `Path("/hello")`,
+		Settings:  engine.HTTPFrontendSettings{},
+		BackendId: b.Id,
+	}
+	c.Assert(s.Engine.UpsertFrontend(f, 0), IsNil)
+	s.collectChanges(c, 2)
+
+	keys := []jwtauth.Key{{Id: "k1", Algorithm: "HS256", Secret: "aG1hYy1rZXktMQ=="}}
+	j, err := jwtauth.NewJWTAuth(jwtauth.JWTAuth{Keys: keys})
+	c.Assert(err, IsNil)
+	fk := engine.FrontendKey{Id: f.Id}
+	m := engine.Middleware{Id: "j1", Type: jwtauth.Type, Priority: 1, Middleware: j}
+	c.Assert(s.Engine.UpsertMiddleware(fk, m, 0), IsNil)
+
+	changes := s.collectChanges(c, 1)
+	upserted := changes[0].(*engine.MiddlewareUpserted)
+	c.Assert(upserted.Middleware.Middleware.(*jwtauth.JWTAuth).Keys, DeepEquals, keys)
+
+	mk := engine.MiddlewareKey{Id: m.Id, FrontendKey: fk}
+	out, err := s.Engine.GetMiddleware(mk)
+	c.Assert(err, IsNil)
+	opened := out.Middleware.(*jwtauth.JWTAuth)
+	c.Assert(opened.Keys, DeepEquals, keys)
+}
+
 func (s *EngineSuite) MiddlewareExpire(c *C) {
 	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
 	c.Assert(s.Engine.UpsertBackend(b), IsNil)
@@ -3,11 +3,14 @@ module github.com/vulcand/vulcand
 go 1.18
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/armon/go-proxyproto v0.0.0-20160718231624-3daa90aec003
 	github.com/bshuster-repo/logrus-logstash-hook v0.0.0-20170822102739-ebf008572634
 	github.com/buger/goterm v0.0.0-20161103140809-cc3942e537b1
 	github.com/coreos/etcd v3.3.9+incompatible
+	github.com/golang-jwt/jwt/v4 v4.4.2
 	github.com/gorilla/mux v0.0.0-20160920230813-757bef944d0f
+	github.com/klauspost/compress v1.15.9
 	github.com/mailgun/metrics v0.0.0-20150124003306-2b3c4565aafd
 	github.com/mailgun/timetools v0.0.0-20170619190023-f3a7b8ffff47
 	github.com/mailgun/ttlmap v0.0.0-20170619185759-c1c17f74874f
@@ -18,6 +21,7 @@ require (
 	github.com/uber/jaeger-client-go v2.17.0+incompatible
 	github.com/urfave/cli v1.22.4
 	github.com/vulcand/oxy v1.4.1
+	github.com/vulcand/predicate v1.2.0
 	github.com/vulcand/route v0.1.0
 	go.etcd.io/etcd/api/v3 v3.5.5
 	go.etcd.io/etcd/client/v2 v2.305.5
@@ -55,7 +59,6 @@ require (
 	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
 	github.com/uber-go/atomic v1.4.0 // indirect
 	github.com/uber/jaeger-lib v2.0.0+incompatible // indirect
-	github.com/vulcand/predicate v1.2.0 // indirect
 	go.etcd.io/etcd/client/pkg/v3 v3.5.5 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
@@ -0,0 +1,218 @@
+package logsink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Formats of batches sent to HTTP sinks.
+const (
+	// FormatNDJSON sends records separated by newlines.
+	FormatNDJSON = "ndjson"
+	// FormatBulk sends records as index actions of the Elasticsearch bulk API.
+	FormatBulk = "bulk"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	batchTimeout         = 10 * time.Second
+	// maxSinkResponseBytes is how much of a response of a sink is logged
+	// when a batch fails.
+	maxSinkResponseBytes = 4096
+)
+
+type batchOutput struct {
+	url           string
+	format        string
+	index         string
+	batchSize     int
+	flushInterval time.Duration
+}
+
+// newBatchOutput parses the address of an HTTP sink, e.g.
+// http://localhost:9200/_bulk?format=bulk&index=vulcand&batchSize=500&flushInterval=5s
+// Query parameters other than the ones of the sink are kept in the URL that
+// batches are posted to.
+func newBatchOutput(u *url.URL) (*batchOutput, error) {
+	q := u.Query()
+	batchSize, err := queryInt(q, "batchSize", defaultBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	if batchSize == 0 {
+		return nil, fmt.Errorf("batchSize should be > 0")
+	}
+	flushInterval, err := queryDuration(q, "flushInterval", defaultFlushInterval)
+	if err != nil {
+		return nil, err
+	}
+	if flushInterval == 0 {
+		return nil, fmt.Errorf("flushInterval should be > 0")
+	}
+	o := &batchOutput{
+		format:        q.Get("format"),
+		index:         q.Get("index"),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+	switch o.format {
+	case "":
+		o.format = FormatNDJSON
+	case FormatNDJSON, FormatBulk:
+	default:
+		return nil, fmt.Errorf("unsupported format %q, expected %s or %s", o.format, FormatNDJSON, FormatBulk)
+	}
+	if o.index != "" && o.format != FormatBulk {
+		return nil, fmt.Errorf("index is supported by the %s format only", FormatBulk)
+	}
+	for _, name := range []string{"format", "index", "batchSize", "flushInterval"} {
+		q.Del(name)
+	}
+	sink := *u
+	sink.RawQuery = q.Encode()
+	o.url = sink.String()
+	return o, nil
+}
+
+func (o *batchOutput) open() (io.Writer, error) {
+	w := &batchWriter{
+		batchOutput: *o,
+		client:      &http.Client{Timeout: batchTimeout},
+		records:     make(chan []byte, maxQueuedRecords),
+		closed:      make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// batchWriter queues records and posts them to an HTTP sink in batches, when
+// there are enough records for a batch or every flush interval. Batches that
+// fail to be sent are dropped.
+type batchWriter struct {
+	batchOutput
+	client  *http.Client
+	records chan []byte
+	closed  chan struct{}
+	dropped int64
+}
+
+func (w *batchWriter) Write(p []byte) (int, error) {
+	record := make([]byte, len(p))
+	copy(record, p)
+	select {
+	case w.records <- record:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+	}
+	return len(p), nil
+}
+
+func (w *batchWriter) run() {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+	var batch [][]byte
+	for {
+		select {
+		case record, ok := <-w.records:
+			if !ok {
+				w.flush(batch)
+				close(w.closed)
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= w.batchSize {
+				w.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// close sends the queued records and stops the writer, it is not safe to
+// write to the writer afterwards.
+func (w *batchWriter) close() {
+	close(w.records)
+	<-w.closed
+}
+
+func (w *batchWriter) flush(batch [][]byte) {
+	if dropped := atomic.SwapInt64(&w.dropped, 0); dropped != 0 {
+		log.Warningf("Dropped %d records for %v, the queue is full", dropped, w.url)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if err := w.send(batch); err != nil {
+		log.Errorf("Failed to send %d records to %v: %v", len(batch), w.url, err)
+	}
+}
+
+func (w *batchWriter) send(batch [][]byte) error {
+	body := &bytes.Buffer{}
+	action := []byte("{\"index\":{}}\n")
+	if w.index != "" {
+		action, _ = json.Marshal(map[string]map[string]string{"index": {"_index": w.index}})
+		action = append(action, '\n')
+	}
+	for _, record := range batch {
+		if w.format == FormatBulk {
+			body.Write(action)
+		}
+		body.Write(record)
+		if len(record) != 0 && record[len(record)-1] != '\n' {
+			body.WriteByte('\n')
+		}
+	}
+	re, err := w.client.Post(w.url, "application/x-ndjson", body)
+	if err != nil {
+		return err
+	}
+	defer re.Body.Close()
+	if re.StatusCode < 200 || re.StatusCode >= 300 {
+		out, _ := ioutil.ReadAll(io.LimitReader(re.Body, maxSinkResponseBytes))
+		return fmt.Errorf("got %v: %s", re.Status, out)
+	}
+	if w.format == FormatBulk && bulkErrors(re.Body) {
+		return fmt.Errorf("some of the records were not indexed")
+	}
+	return nil
+}
+
+// bulkErrors tells whether a response of the bulk API reports records that
+// were not indexed. The bulk API responds with 200 even then, and lists
+// results of all records after the errors flag, so the rest of the response
+// is not read.
+func bulkErrors(body io.Reader) bool {
+	d := json.NewDecoder(body)
+	if t, err := d.Token(); err != nil || t != json.Delim('{') {
+		return false
+	}
+	for d.More() {
+		key, err := d.Token()
+		if err != nil {
+			return false
+		}
+		if key == "errors" {
+			var errors bool
+			return d.Decode(&errors) == nil && errors
+		}
+		var value json.RawMessage
+		if err := d.Decode(&value); err != nil {
+			return false
+		}
+	}
+	return false
+}
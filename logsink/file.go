@@ -0,0 +1,154 @@
+package logsink
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+)
+
+// backupTimeFormat is the format of the time suffix of rotated files, it
+// sorts in the order of rotation.
+const backupTimeFormat = "20060102T150405.000"
+
+type fileOutput struct {
+	path        string
+	maxSize     int64
+	rotateEvery time.Duration
+	maxBackups  int
+}
+
+// newFileOutput parses the address of a file, e.g.
+// file:///var/log/vulcand/out.log?maxSizeMB=100&rotateEvery=24h&maxBackups=7
+func newFileOutput(u *url.URL) (*fileOutput, error) {
+	if u.Host != "" || u.Path == "" {
+		return nil, fmt.Errorf("file address should have an absolute path, e.g. file:///var/log/out.log")
+	}
+	q := u.Query()
+	maxSizeMB, err := queryInt(q, "maxSizeMB", 0)
+	if err != nil {
+		return nil, err
+	}
+	rotateEvery, err := queryDuration(q, "rotateEvery", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxBackups, err := queryInt(q, "maxBackups", 0)
+	if err != nil {
+		return nil, err
+	}
+	return &fileOutput{
+		path:        u.Path,
+		maxSize:     int64(maxSizeMB) << 20,
+		rotateEvery: rotateEvery,
+		maxBackups:  maxBackups,
+	}, nil
+}
+
+func (o *fileOutput) open() (io.Writer, error) {
+	w := &fileWriter{fileOutput: *o, clock: &timetools.RealTime{}}
+	if err := w.openFile(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// fileWriter appends records to a file. The file is rotated when it gets
+// larger than the max size or older than the rotation period, if they are
+// set: it is renamed to the path with the time of rotation appended, and
+// the oldest rotated files over the max number of backups are removed.
+type fileWriter struct {
+	fileOutput
+	mutex  sync.Mutex
+	clock  timetools.TimeProvider
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file != nil && w.shouldRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			log.Errorf("Failed to rotate %v: %v", w.path, err)
+		}
+	}
+	if w.file == nil {
+		if err := w.openFile(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *fileWriter) shouldRotate(next int) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.maxSize != 0 && w.size+int64(next) > w.maxSize {
+		return true
+	}
+	return w.rotateEvery != 0 && w.clock.UtcNow().Sub(w.opened) >= w.rotateEvery
+}
+
+func (w *fileWriter) openFile() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size, w.opened = f, fi.Size(), w.clock.UtcNow()
+	return nil
+}
+
+// rotate closes the file and renames it, the file is opened again by the
+// next write.
+func (w *fileWriter) rotate() error {
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return err
+	}
+	backup := w.path + "." + w.clock.UtcNow().Format(backupTimeFormat)
+	if err := os.Rename(w.path, backup); err != nil {
+		return err
+	}
+	return w.removeOldBackups()
+}
+
+func (w *fileWriter) removeOldBackups() error {
+	if w.maxBackups == 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return err
+	}
+	if len(backups) <= w.maxBackups {
+		return nil
+	}
+	sort.Strings(backups)
+	for _, b := range backups[:len(backups)-w.maxBackups] {
+		if err := os.Remove(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
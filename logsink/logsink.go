@@ -0,0 +1,174 @@
+// Package logsink writes log records, e.g. trace records and access log
+// lines, to outputs given by addresses: syslog, files with rotation, the
+// standard output and HTTP batch sinks.
+package logsink
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxQueuedRecords is how many records can wait to be written to an output,
+// records written while the queue is full are dropped.
+const maxQueuedRecords = 10000
+
+// output is a destination of records parsed from an address.
+type output interface {
+	// open returns a writer that writes records to the output.
+	open() (io.Writer, error)
+}
+
+// newOutput parses an address of an output. Supported addresses are:
+//
+//	syslog://host:port, syslog:///path/socket.sock or syslog:// - syslog
+//	file:///path/out.log?maxSizeMB=100&rotateEvery=24h&maxBackups=7 - a file
+//	stdout:// - the standard output
+//	http(s)://host:port/path?batchSize=100&flushInterval=1s&format=bulk&index=i - an HTTP batch sink
+func newOutput(addr string) (output, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bad address %q: %v", addr, err)
+	}
+	switch u.Scheme {
+	case "syslog":
+		return newSyslogOutput(u)
+	case "file":
+		return newFileOutput(u)
+	case "stdout":
+		return stdoutOutput{}, nil
+	case "http", "https":
+		return newBatchOutput(u)
+	}
+	return nil, fmt.Errorf("unsupported scheme '%v', supported are 'syslog', 'file', 'stdout', 'http' and 'https'", u.Scheme)
+}
+
+// Check validates the address of an output without opening it.
+func Check(addr string) error {
+	_, err := newOutput(addr)
+	return err
+}
+
+// New opens the output with the address. Every write to the returned writer
+// is a record, and is written to the output before the write returns, except
+// for HTTP batch sinks, which send records in the background.
+func New(addr string) (io.Writer, error) {
+	o, err := newOutput(addr)
+	if err != nil {
+		return nil, err
+	}
+	return o.open()
+}
+
+// Open returns the shared writer of the output with the address, opening the
+// output if it is not open yet. Writes to it never block: records are queued
+// and written in the background, and are dropped when the queue is full.
+// Outputs are kept open while the process runs, there are as many of them as
+// there were distinct addresses, and updates of whatever writes to them do
+// not reopen files or start new batches.
+func Open(addr string) (io.Writer, error) {
+	return defaultWriters.get(addr)
+}
+
+type writers struct {
+	mutex   sync.Mutex
+	writers map[string]io.Writer
+}
+
+var defaultWriters = &writers{writers: make(map[string]io.Writer)}
+
+func (ws *writers) get(addr string) (io.Writer, error) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	if w, ok := ws.writers[addr]; ok {
+		return w, nil
+	}
+	w, err := New(addr)
+	if err != nil {
+		return nil, err
+	}
+	// Batch writers queue records on their own.
+	if _, ok := w.(*batchWriter); !ok {
+		w = newAsyncWriter(addr, w)
+	}
+	ws.writers[addr] = w
+	return w, nil
+}
+
+// asyncWriter writes records to the writer in the background, so that slow
+// disks or sockets do not block writers of records.
+type asyncWriter struct {
+	addr    string
+	w       io.Writer
+	records chan []byte
+	dropped int64
+}
+
+func newAsyncWriter(addr string, w io.Writer) *asyncWriter {
+	aw := &asyncWriter{addr: addr, w: w, records: make(chan []byte, maxQueuedRecords)}
+	go aw.run()
+	return aw
+}
+
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	record := make([]byte, len(p))
+	copy(record, p)
+	select {
+	case w.records <- record:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+	}
+	return len(p), nil
+}
+
+func (w *asyncWriter) run() {
+	for record := range w.records {
+		if dropped := atomic.SwapInt64(&w.dropped, 0); dropped != 0 {
+			log.Warningf("Dropped %d records for %v, the queue is full", dropped, w.addr)
+		}
+		if _, err := w.w.Write(record); err != nil {
+			log.Errorf("Failed to write a record to %v: %v", w.addr, err)
+		}
+	}
+}
+
+type stdoutOutput struct{}
+
+func (stdoutOutput) open() (io.Writer, error) {
+	return os.Stdout, nil
+}
+
+// queryInt returns the value of an integer query parameter of an address, or
+// the default value if it is not set.
+func queryInt(q url.Values, name string, def int) (int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%s should be an integer >= 0, got %q", name, v)
+	}
+	return i, nil
+}
+
+// queryDuration returns the value of a duration query parameter of an
+// address, or the default value if it is not set.
+func queryDuration(q url.Values, name string, def time.Duration) (time.Duration, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s should be a duration >= 0, got %q", name, v)
+	}
+	return d, nil
+}
@@ -0,0 +1,267 @@
+package logsink
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "gopkg.in/check.v1"
+)
+
+func TestLogSink(t *testing.T) { TestingT(t) }
+
+type LogSinkSuite struct{}
+
+var _ = Suite(&LogSinkSuite{})
+
+func (s *LogSinkSuite) TestBadAddr(c *C) {
+	vals := []string{
+		"omglog://",
+		"syslog://localhost:5000?f=SHMAIL",
+		"syslog://localhost:5000?sev=SHMEVERITY",
+		"file://out.log",
+		"file:///tmp/out.log?maxSizeMB=-1",
+		"file:///tmp/out.log?rotateEvery=daily",
+		"http://localhost:9200/_bulk?format=xml",
+		"http://localhost:9200/_bulk?index=vulcand",
+		"http://localhost:9200/_bulk?batchSize=0",
+		"http://localhost:9200/_bulk?flushInterval=0s",
+	}
+	for _, v := range vals {
+		c.Assert(Check(v), NotNil, Commentf("address %v", v))
+		out, err := New(v)
+		c.Assert(err, NotNil)
+		c.Assert(out, IsNil)
+	}
+}
+
+func (s *LogSinkSuite) TestStdout(c *C) {
+	out, err := New("stdout://")
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, os.Stdout)
+}
+
+func (s *LogSinkSuite) TestFileRotation(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "trace.log")
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	w := &fileWriter{
+		fileOutput: fileOutput{path: path, maxSize: 10, rotateEvery: time.Hour, maxBackups: 2},
+		clock:      clock,
+	}
+	c.Assert(w.openFile(), IsNil)
+
+	write := func(data string) {
+		_, err := w.Write([]byte(data))
+		c.Assert(err, IsNil)
+	}
+	// Rotated by size
+	write("12345")
+	write("67890")
+	write("abc")
+	c.Assert(readDir(c, dir), DeepEquals, map[string]string{
+		"trace.log":                     "abc",
+		"trace.log.20120304T050607.000": "1234567890",
+	})
+
+	// Rotated by time
+	clock.Sleep(time.Hour)
+	write("def")
+	c.Assert(readDir(c, dir), DeepEquals, map[string]string{
+		"trace.log":                     "def",
+		"trace.log.20120304T050607.000": "1234567890",
+		"trace.log.20120304T060607.000": "abc",
+	})
+
+	// The oldest backups are removed
+	clock.Sleep(time.Second)
+	write("1234567890")
+	c.Assert(readDir(c, dir), DeepEquals, map[string]string{
+		"trace.log":                     "1234567890",
+		"trace.log.20120304T060607.000": "abc",
+		"trace.log.20120304T060608.000": "def",
+	})
+
+	// Records larger than the max size are not split
+	clock.Sleep(time.Second)
+	write("123456789012")
+	c.Assert(readDir(c, dir)["trace.log"], Equals, "123456789012")
+}
+
+func readDir(c *C, dir string) map[string]string {
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	out := make(map[string]string)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		c.Assert(err, IsNil)
+		out[f.Name()] = string(data)
+	}
+	return out
+}
+
+// sink is a local stand-in of an HTTP batch sink.
+type sink struct {
+	srv      *httptest.Server
+	requests chan sinkRequest
+	response string
+}
+
+type sinkRequest struct {
+	url         string
+	contentType string
+	body        string
+}
+
+func newSink() *sink {
+	s := &sink{requests: make(chan sinkRequest, 10), response: `{"took":1,"errors":false,"items":[]}`}
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.requests <- sinkRequest{url: r.URL.String(), contentType: r.Header.Get("Content-Type"), body: string(body)}
+		w.Write([]byte(s.response))
+	}))
+	return s
+}
+
+func (s *sink) next(c *C) sinkRequest {
+	select {
+	case r := <-s.requests:
+		return r
+	case <-time.After(time.Second):
+		c.Fatalf("timeout")
+	}
+	return sinkRequest{}
+}
+
+func (s *LogSinkSuite) TestBatchBulk(c *C) {
+	sink := newSink()
+	defer sink.srv.Close()
+
+	out, err := New(sink.srv.URL + "/_bulk?format=bulk&index=vulcand&batchSize=2&flushInterval=1h&refresh=true")
+	c.Assert(err, IsNil)
+	w := out.(*batchWriter)
+	for _, r := range []string{`{"a":1}`, `{"a":2}`, `{"a":3}`} {
+		_, err := w.Write([]byte(r + "\n"))
+		c.Assert(err, IsNil)
+	}
+
+	// Full batches are sent right away
+	r := sink.next(c)
+	c.Assert(r.url, Equals, "/_bulk?refresh=true")
+	c.Assert(r.contentType, Equals, "application/x-ndjson")
+	c.Assert(r.body, Equals, `{"index":{"_index":"vulcand"}}
+{"a":1}
+{"index":{"_index":"vulcand"}}
+{"a":2}
+`)
+
+	// The rest is sent when the writer is closed
+	w.close()
+	r = sink.next(c)
+	c.Assert(r.body, Equals, `{"index":{"_index":"vulcand"}}
+{"a":3}
+`)
+}
+
+func (s *LogSinkSuite) TestBatchFlushInterval(c *C) {
+	sink := newSink()
+	defer sink.srv.Close()
+
+	out, err := New(sink.srv.URL + "/records?flushInterval=10ms")
+	c.Assert(err, IsNil)
+	defer out.(*batchWriter).close()
+	_, err = out.Write([]byte(`{"a":1}`))
+	c.Assert(err, IsNil)
+
+	r := sink.next(c)
+	c.Assert(r.url, Equals, "/records")
+	c.Assert(r.body, Equals, "{\"a\":1}\n")
+}
+
+func (s *LogSinkSuite) TestBulkErrors(c *C) {
+	tcs := []struct {
+		body   string
+		errors bool
+	}{
+		{body: `{"took":1,"errors":false,"items":[]}`, errors: false},
+		{body: `{"took":1,"errors":true,"items":[{"index":{"status":400}}]}`, errors: true},
+		{body: `{"took":{"ms":1},"errors":true`, errors: true},
+		{body: `{"took":1}`, errors: false},
+		{body: `not json`, errors: false},
+	}
+	for i, tc := range tcs {
+		c.Assert(bulkErrors(strings.NewReader(tc.body)), Equals, tc.errors, Commentf("test case #%d", i))
+	}
+}
+
+// blockingWriter blocks writes until it is unblocked.
+type blockingWriter struct {
+	mutex   sync.Mutex
+	blocked chan struct{}
+	unblock chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case w.blocked <- struct{}{}:
+	default:
+	}
+	<-w.unblock
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *blockingWriter) String() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.buf.String()
+}
+
+func (s *LogSinkSuite) TestAsyncWriter(c *C) {
+	bw := &blockingWriter{blocked: make(chan struct{}, 1), unblock: make(chan struct{})}
+	w := newAsyncWriter("test://", bw)
+	_, err := w.Write([]byte("a"))
+	c.Assert(err, IsNil)
+	<-bw.blocked
+
+	// Writes do not wait for the output, and are dropped when the queue is full
+	for i := 0; i < maxQueuedRecords+10; i++ {
+		_, err := w.Write([]byte("a"))
+		c.Assert(err, IsNil)
+	}
+	close(bw.unblock)
+	deadline := time.Now().Add(time.Second)
+	for bw.String() != strings.Repeat("a", maxQueuedRecords+1) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(bw.String(), Equals, strings.Repeat("a", maxQueuedRecords+1))
+}
+
+func (s *LogSinkSuite) TestOpenShares(c *C) {
+	path := filepath.Join(c.MkDir(), "logs", "out.log")
+	w, err := Open("file://" + path)
+	c.Assert(err, IsNil)
+	w2, err := Open("file://" + path)
+	c.Assert(err, IsNil)
+	c.Assert(w2, Equals, w)
+
+	_, err = w.Write([]byte("hello\n"))
+	c.Assert(err, IsNil)
+	deadline := time.Now().Add(time.Second)
+	var data []byte
+	for string(data) != "hello\n" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		data, _ = ioutil.ReadFile(path)
+	}
+	c.Assert(string(data), Equals, "hello\n")
+}
@@ -0,0 +1,141 @@
+package logsink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+// SyslogTag is the tag of syslog messages.
+const SyslogTag = "pid"
+
+type syslogOutput struct {
+	network  string
+	raddr    string
+	priority syslog.Priority
+	prefix   string
+}
+
+// newSyslogOutput parses the address of syslog, e.g. syslog://host:port for
+// UDP, syslog:///path/socket.sock for a unixgram socket, or syslog:// for the
+// default socket of the OS. Facility, severity and the prefix of messages are
+// set with the f, sev and prefix query parameters.
+func newSyslogOutput(u *url.URL) (*syslogOutput, error) {
+	pr, err := parseSyslogPriority(u)
+	if err != nil {
+		return nil, err
+	}
+	o := &syslogOutput{priority: pr, prefix: u.Query().Get("prefix")}
+	if u.Host != "" {
+		o.network, o.raddr = "udp", u.Host
+	} else if u.Path != "" {
+		o.network, o.raddr = "unixgram", u.Path
+	}
+	return o, nil
+}
+
+func (o *syslogOutput) open() (io.Writer, error) {
+	w, err := syslog.Dial(o.network, o.raddr, o.priority, SyslogTag)
+	if err != nil {
+		return nil, err
+	}
+	if o.prefix == "" {
+		return w, nil
+	}
+	return &prefixWriter{p: []byte(o.prefix), w: w}, nil
+}
+
+func parseSyslogPriority(u *url.URL) (syslog.Priority, error) {
+	vals := u.Query()
+	pr, err := sevToString(vals.Get("sev"))
+	if err != nil {
+		return 0, err
+	}
+	f, err := fToString(vals.Get("f"))
+	if err != nil {
+		return 0, err
+	}
+	return pr | f, nil
+}
+
+func sevToString(sev string) (pr syslog.Priority, err error) {
+	switch sev {
+	case "ALERT":
+		pr |= syslog.LOG_ALERT
+	case "CRIT":
+		pr |= syslog.LOG_CRIT
+	case "ERR":
+		pr |= syslog.LOG_ERR
+	case "WARNING":
+		pr |= syslog.LOG_WARNING
+	case "NOTICE":
+		pr |= syslog.LOG_NOTICE
+	case "INFO":
+		pr |= syslog.LOG_INFO
+	case "DEBUG", "":
+		pr |= syslog.LOG_DEBUG
+	default:
+		return 0, fmt.Errorf("uknown severity: %v", sev)
+	}
+	return pr, nil
+}
+
+func fToString(v string) (f syslog.Priority, err error) {
+	switch v {
+	case "USER":
+		f |= syslog.LOG_USER
+	case "MAIL":
+		f |= syslog.LOG_MAIL
+	case "DAEMON":
+		f |= syslog.LOG_DAEMON
+	case "AUTH":
+		f |= syslog.LOG_AUTH
+	case "SYSLOG":
+		f |= syslog.LOG_SYSLOG
+	case "LPR":
+		f |= syslog.LOG_LPR
+	case "NEWS":
+		f |= syslog.LOG_NEWS
+	case "UUCP":
+		f |= syslog.LOG_UUCP
+	case "CRON":
+		f |= syslog.LOG_CRON
+	case "AUTHPRIV":
+		f |= syslog.LOG_AUTHPRIV
+	case "FTP":
+		f |= syslog.LOG_FTP
+	case "LOG_LOCAL0", "":
+		f |= syslog.LOG_LOCAL0
+	case "LOG_LOCAL1":
+		f |= syslog.LOG_LOCAL1
+	case "LOG_LOCAL2":
+		f |= syslog.LOG_LOCAL2
+	case "LOG_LOCAL3":
+		f |= syslog.LOG_LOCAL3
+	case "LOG_LOCAL4":
+		f |= syslog.LOG_LOCAL4
+	case "LOG_LOCAL5":
+		f |= syslog.LOG_LOCAL5
+	case "LOG_LOCAL6":
+		f |= syslog.LOG_LOCAL6
+	case "LOG_LOCAL7":
+		f |= syslog.LOG_LOCAL7
+	default:
+		return 0, fmt.Errorf("unsupported facility: %v", v)
+	}
+	return f, nil
+}
+
+type prefixWriter struct {
+	w io.Writer
+	p []byte
+}
+
+func (p *prefixWriter) Write(val []byte) (int, error) {
+	b := bytes.Buffer{}
+	b.Write(p.p)
+	b.Write(val)
+	return p.w.Write(b.Bytes())
+}
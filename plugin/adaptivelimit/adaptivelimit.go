@@ -0,0 +1,251 @@
+package adaptivelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "adaptivelimit"
+
+// Algorithms that learn the limit.
+const (
+	AlgorithmGradient = "gradient"
+	AlgorithmAIMD     = "aimd"
+)
+
+// Defaults of settings that are not set.
+const (
+	DefaultInitialLimit    = 20
+	DefaultMinLimit        = 1
+	DefaultMaxLimit        = 1000
+	DefaultSmoothing       = 0.2
+	DefaultTolerance       = 1.5
+	DefaultBackoffRatio    = 0.9
+	DefaultTimeout         = time.Second
+	DefaultPriorityReserve = 0.2
+)
+
+// longWindow is how many samples the gradient algorithm averages latency over.
+const longWindow = 600
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// AdaptiveLimit limits how many requests to a frontend are in flight at once,
+// like connlimit does, but learns the limit from the latency of requests
+// instead of taking a fixed one. Requests over the limit are rejected with
+// 503 Service Unavailable, so that backends are not overloaded.
+//
+// Requests can be split into priority classes by a variable, classes of lower
+// priority are rejected first.
+type AdaptiveLimit struct {
+	// Algorithm is 'gradient' (the default) or 'aimd'.
+	Algorithm string
+	// InitialLimit, MinLimit and MaxLimit bound the limit.
+	InitialLimit int64
+	MinLimit     int64
+	MaxLimit     int64
+	// Smoothing is how fast the gradient algorithm changes the limit, from 0
+	// to 1.
+	Smoothing float64 `json:",omitempty"`
+	// Tolerance is how much slower than the average requests can get before
+	// the gradient algorithm shrinks the limit, e.g. 1.5 for 50% slower.
+	Tolerance float64 `json:",omitempty"`
+	// BackoffRatio is how much the AIMD algorithm shrinks the limit by when
+	// requests take longer than Timeout, from 0 to 1.
+	BackoffRatio float64 `json:",omitempty"`
+	Timeout      string  `json:",omitempty"`
+	// PriorityVariable is the variable to get the class of a request from,
+	// e.g. 'request.header.X-Priority'.
+	PriorityVariable string `json:",omitempty"`
+	// Priorities are classes from the highest priority to the lowest,
+	// requests of other classes have the lowest priority of all.
+	Priorities []string `json:",omitempty"`
+	// PriorityReserve is the share of the limit that is reserved for classes
+	// above the lowest, e.g. with 0.2 requests of the lowest priority are
+	// rejected once 80% of the limit is in flight.
+	PriorityReserve float64 `json:",omitempty"`
+
+	timeout         time.Duration
+	extractPriority utils.SourceExtractor
+	clock           timetools.TimeProvider
+}
+
+// NewAdaptiveLimit validates settings and returns an adaptive limit
+// middleware. Settings that are not set get default values.
+func NewAdaptiveLimit(a AdaptiveLimit) (*AdaptiveLimit, error) {
+	switch a.Algorithm {
+	case "":
+		a.Algorithm = AlgorithmGradient
+	case AlgorithmGradient, AlgorithmAIMD:
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q, expected %s or %s", a.Algorithm, AlgorithmGradient, AlgorithmAIMD)
+	}
+	if a.MinLimit == 0 {
+		a.MinLimit = DefaultMinLimit
+	}
+	if a.MaxLimit == 0 {
+		a.MaxLimit = DefaultMaxLimit
+	}
+	if a.InitialLimit == 0 {
+		a.InitialLimit = DefaultInitialLimit
+		if a.InitialLimit > a.MaxLimit {
+			a.InitialLimit = a.MaxLimit
+		}
+	}
+	if a.MinLimit < 1 || a.MinLimit > a.MaxLimit {
+		return nil, fmt.Errorf("limits should be 1 <= min <= max, got min %d and max %d", a.MinLimit, a.MaxLimit)
+	}
+	if a.InitialLimit < a.MinLimit || a.InitialLimit > a.MaxLimit {
+		return nil, fmt.Errorf("initial limit should be between %d and %d, got %d", a.MinLimit, a.MaxLimit, a.InitialLimit)
+	}
+	if a.Smoothing == 0 {
+		a.Smoothing = DefaultSmoothing
+	}
+	if a.Smoothing < 0 || a.Smoothing > 1 {
+		return nil, fmt.Errorf("smoothing should be between 0 and 1, got %v", a.Smoothing)
+	}
+	if a.Tolerance == 0 {
+		a.Tolerance = DefaultTolerance
+	}
+	if a.Tolerance < 1 {
+		return nil, fmt.Errorf("tolerance should be >= 1, got %v", a.Tolerance)
+	}
+	if a.BackoffRatio == 0 {
+		a.BackoffRatio = DefaultBackoffRatio
+	}
+	if a.BackoffRatio <= 0 || a.BackoffRatio >= 1 {
+		return nil, fmt.Errorf("backoff ratio should be between 0 and 1, got %v", a.BackoffRatio)
+	}
+	if a.Timeout == "" {
+		a.timeout = DefaultTimeout
+	} else {
+		d, err := time.ParseDuration(a.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("timeout should be a duration > 0, got %q", a.Timeout)
+		}
+		a.timeout = d
+	}
+	if a.PriorityReserve == 0 {
+		a.PriorityReserve = DefaultPriorityReserve
+	}
+	if a.PriorityReserve < 0 || a.PriorityReserve >= 1 {
+		return nil, fmt.Errorf("priority reserve should be between 0 and 1, got %v", a.PriorityReserve)
+	}
+	if (a.PriorityVariable == "") != (len(a.Priorities) == 0) {
+		return nil, fmt.Errorf("priority variable and priorities should be set together")
+	}
+	if a.PriorityVariable != "" {
+		extract, err := utils.NewExtractor(a.PriorityVariable)
+		if err != nil {
+			return nil, err
+		}
+		a.extractPriority = extract
+	}
+	if a.clock == nil {
+		a.clock = &timetools.RealTime{}
+	}
+	return &a, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (a *AdaptiveLimit) NewHandler(next http.Handler) (http.Handler, error) {
+	return a.NewHandlerWithEnv(next, plugin.Env{})
+}
+
+// NewHandlerWithEnv returns a handler that reports the current limit in the
+// "limit" gauge of the middleware.
+func (a *AdaptiveLimit) NewHandlerWithEnv(next http.Handler, env plugin.Env) (http.Handler, error) {
+	var alg algorithm
+	if a.Algorithm == AlgorithmAIMD {
+		alg = &aimd{backoffRatio: a.BackoffRatio, timeout: a.timeout}
+	} else {
+		alg = &gradient{smoothing: a.Smoothing, tolerance: a.Tolerance, longWindow: longWindow}
+	}
+	env.SetGauge("limit", a.InitialLimit)
+	l := newLimiter(alg, a.InitialLimit, a.MinLimit, a.MaxLimit, func(limit int64) {
+		env.SetGauge("limit", limit)
+	})
+	return &handler{next: next, config: a, limiter: l, env: env}, nil
+}
+
+// share returns the share of the limit that requests of the class can use.
+func (a *AdaptiveLimit) share(class string) float64 {
+	if len(a.Priorities) == 0 {
+		return 1
+	}
+	rank := len(a.Priorities)
+	for i, p := range a.Priorities {
+		if p == class {
+			rank = i
+			break
+		}
+	}
+	return 1 - a.PriorityReserve*float64(rank)/float64(len(a.Priorities))
+}
+
+func (a *AdaptiveLimit) String() string {
+	out := fmt.Sprintf("algorithm=%s, limit=%d..%d..%d", a.Algorithm, a.MinLimit, a.InitialLimit, a.MaxLimit)
+	if a.Algorithm == AlgorithmAIMD {
+		out += fmt.Sprintf(", backoffRatio=%v, timeout=%v", a.BackoffRatio, a.timeout)
+	} else {
+		out += fmt.Sprintf(", smoothing=%v, tolerance=%v", a.Smoothing, a.Tolerance)
+	}
+	if a.PriorityVariable != "" {
+		out += fmt.Sprintf(", priorityVar=%s, priorities=%s, priorityReserve=%v", a.PriorityVariable, strings.Join(a.Priorities, ","), a.PriorityReserve)
+	}
+	return out
+}
+
+func FromOther(a AdaptiveLimit) (plugin.Middleware, error) {
+	return NewAdaptiveLimit(a)
+}
+
+// FromCli constructs a middleware instance from the command line parameters.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	a := AdaptiveLimit{
+		Algorithm:        c.String("algorithm"),
+		InitialLimit:     int64(c.Int("initialLimit")),
+		MinLimit:         int64(c.Int("minLimit")),
+		MaxLimit:         int64(c.Int("maxLimit")),
+		Smoothing:        c.Float64("smoothing"),
+		Tolerance:        c.Float64("tolerance"),
+		BackoffRatio:     c.Float64("backoffRatio"),
+		PriorityVariable: c.String("priorityVar"),
+		Priorities:       c.StringSlice("priority"),
+		PriorityReserve:  c.Float64("priorityReserve"),
+	}
+	if d := c.Duration("timeout"); d != 0 {
+		a.Timeout = d.String()
+	}
+	return NewAdaptiveLimit(a)
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "algorithm", Usage: "algorithm that learns the limit: gradient or aimd"},
+		cli.IntFlag{Name: "initialLimit", Usage: "limit to start with"},
+		cli.IntFlag{Name: "minLimit", Usage: "lowest limit"},
+		cli.IntFlag{Name: "maxLimit", Usage: "highest limit"},
+		cli.Float64Flag{Name: "smoothing", Usage: "how fast the gradient algorithm changes the limit, from 0 to 1"},
+		cli.Float64Flag{Name: "tolerance", Usage: "how much slower than the average requests can get before the limit shrinks"},
+		cli.Float64Flag{Name: "backoffRatio", Usage: "how much the aimd algorithm shrinks the limit by, from 0 to 1"},
+		cli.DurationFlag{Name: "timeout", Usage: "latency above which the aimd algorithm shrinks the limit"},
+		cli.StringFlag{Name: "priorityVar", Usage: "variable to get the class of requests from, e.g. request.header.X-Priority"},
+		cli.StringSliceFlag{Name: "priority", Usage: "class of requests, from the highest priority to the lowest, can be repeated"},
+		cli.Float64Flag{Name: "priorityReserve", Usage: "share of the limit reserved for classes above the lowest"},
+	}
+}
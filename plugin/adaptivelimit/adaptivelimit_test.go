@@ -0,0 +1,265 @@
+package adaptivelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/metrics"
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestAdaptiveLimit(t *testing.T) { TestingT(t) }
+
+type AdaptiveLimitSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&AdaptiveLimitSuite{})
+
+func (s *AdaptiveLimitSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *AdaptiveLimitSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *AdaptiveLimitSuite) TestDefaults(c *C) {
+	a, err := NewAdaptiveLimit(AdaptiveLimit{})
+	c.Assert(err, IsNil)
+	c.Assert(fmt.Sprint(a), Equals, "algorithm=gradient, limit=1..20..1000, smoothing=0.2, tolerance=1.5")
+
+	a, err = NewAdaptiveLimit(AdaptiveLimit{Algorithm: AlgorithmAIMD, MaxLimit: 10, PriorityVariable: "request.header.X-Priority", Priorities: []string{"high", "low"}})
+	c.Assert(err, IsNil)
+	c.Assert(fmt.Sprint(a), Equals,
+		"algorithm=aimd, limit=1..10..10, backoffRatio=0.9, timeout=1s, priorityVar=request.header.X-Priority, priorities=high,low, priorityReserve=0.2")
+}
+
+func (s *AdaptiveLimitSuite) TestFromOtherBadParams(c *C) {
+	tcs := []AdaptiveLimit{
+		{Algorithm: "vegas"},
+		{MinLimit: -1},
+		{MinLimit: 10, MaxLimit: 5},
+		{InitialLimit: 2000},
+		{MinLimit: 5, InitialLimit: 2},
+		{Smoothing: 2},
+		{Tolerance: 0.5},
+		{BackoffRatio: 1},
+		{Timeout: "soon"},
+		{Timeout: "-1s"},
+		{PriorityReserve: 1},
+		{PriorityVariable: "request.header.X-Priority"},
+		{Priorities: []string{"high"}},
+		{PriorityVariable: "priority", Priorities: []string{"high"}},
+	}
+	for _, tc := range tcs {
+		_, err := FromOther(tc)
+		c.Assert(err, NotNil, Commentf("%#v", tc))
+	}
+}
+
+func (s *AdaptiveLimitSuite) TestFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	app.Flags = CliFlags()
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+		a := out.(*AdaptiveLimit)
+		c.Assert(a.Algorithm, Equals, AlgorithmAIMD)
+		c.Assert(a.InitialLimit, Equals, int64(10))
+		c.Assert(a.MinLimit, Equals, int64(2))
+		c.Assert(a.MaxLimit, Equals, int64(100))
+		c.Assert(a.BackoffRatio, Equals, 0.5)
+		c.Assert(a.Timeout, Equals, "200ms")
+		c.Assert(a.PriorityVariable, Equals, "request.header.X-Priority")
+		c.Assert(a.Priorities, DeepEquals, []string{"critical", "normal"})
+		c.Assert(a.PriorityReserve, Equals, 0.3)
+		return nil
+	}
+	app.Run([]string{"test", "--algorithm=aimd", "--initialLimit=10", "--minLimit=2", "--maxLimit=100", "--backoffRatio=0.5",
+		"--timeout=200ms", "--priorityVar=request.header.X-Priority", "--priority=critical", "--priority=normal", "--priorityReserve=0.3"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *AdaptiveLimitSuite) TestAIMD(c *C) {
+	a := &aimd{backoffRatio: 0.5, timeout: time.Second}
+	c.Assert(a.update(10, time.Millisecond, 5, false), Equals, 11.0)
+	// Limits that are not used do not grow
+	c.Assert(a.update(10, time.Millisecond, 4, false), Equals, 10.0)
+	c.Assert(a.update(10, 2*time.Second, 5, false), Equals, 5.0)
+	c.Assert(a.update(10, time.Millisecond, 5, true), Equals, 5.0)
+}
+
+func (s *AdaptiveLimitSuite) TestGradient(c *C) {
+	g := &gradient{smoothing: 0.5, tolerance: 1.5, longWindow: 600}
+	limit := 16.0
+	// Latency does not change, the limit grows by its square root
+	limit = g.update(limit, 100*time.Millisecond, 16, false)
+	c.Assert(limit, Equals, 18.0)
+	for i := 0; i < 10; i++ {
+		limit = g.update(limit, 100*time.Millisecond, int64(limit), false)
+	}
+	grown := limit
+
+	// Latency grows, requests queue up and the limit shrinks
+	for i := 0; i < 5; i++ {
+		limit = g.update(limit, time.Second, int64(limit), false)
+	}
+	c.Assert(limit < grown/2, Equals, true, Commentf("limit %v, was %v", limit, grown))
+
+	// Latency within the tolerance is fine
+	g = &gradient{smoothing: 0.5, tolerance: 1.5, longWindow: 600}
+	g.update(16, 100*time.Millisecond, 16, false)
+	c.Assert(g.update(16, 140*time.Millisecond, 16, false) > 16, Equals, true)
+
+	// Limits that are not used do not change
+	c.Assert(g.update(16, time.Second, 7, false), Equals, 16.0)
+}
+
+func (s *AdaptiveLimitSuite) TestLimiterBounds(c *C) {
+	var changes []int64
+	l := newLimiter(&aimd{backoffRatio: 0.5, timeout: time.Second}, 4, 2, 5, func(limit int64) {
+		changes = append(changes, limit)
+	})
+	for i := 0; i < 3; i++ {
+		inflight, ok := l.acquire(1)
+		c.Assert(ok, Equals, true)
+		l.release(time.Millisecond, inflight+2, false)
+	}
+	limit, inflight := l.state()
+	c.Assert(limit, Equals, int64(5))
+	c.Assert(inflight, Equals, int64(0))
+
+	for i := 0; i < 3; i++ {
+		l.acquire(1)
+		l.release(2*time.Second, 1, false)
+	}
+	limit, _ = l.state()
+	c.Assert(limit, Equals, int64(2))
+	c.Assert(changes, DeepEquals, []int64{5, 2})
+}
+
+// Classes of lower priority are rejected first.
+func (s *AdaptiveLimitSuite) TestPriorities(c *C) {
+	a, err := NewAdaptiveLimit(AdaptiveLimit{
+		InitialLimit:     10,
+		PriorityVariable: "request.header.X-Priority",
+		Priorities:       []string{"critical", "normal"},
+		PriorityReserve:  0.4,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(a.share("critical"), Equals, 1.0)
+	c.Assert(a.share("normal"), Equals, 0.8)
+	c.Assert(a.share("batch"), Equals, 0.6)
+
+	l := newLimiter(&aimd{backoffRatio: 0.5, timeout: time.Second}, 10, 1, 10, nil)
+	for i := 0; i < 6; i++ {
+		_, ok := l.acquire(a.share(""))
+		c.Assert(ok, Equals, true)
+	}
+	_, ok := l.acquire(a.share(""))
+	c.Assert(ok, Equals, false)
+	_, ok = l.acquire(a.share("normal"))
+	c.Assert(ok, Equals, true)
+	_, ok = l.acquire(a.share("normal"))
+	c.Assert(ok, Equals, true)
+	_, ok = l.acquire(a.share("normal"))
+	c.Assert(ok, Equals, false)
+	_, ok = l.acquire(a.share("critical"))
+	c.Assert(ok, Equals, true)
+}
+
+// Requests over the limit are shed, the limit is reported in metrics.
+func (s *AdaptiveLimitSuite) TestShed(c *C) {
+	a, err := NewAdaptiveLimit(AdaptiveLimit{Algorithm: AlgorithmAIMD, InitialLimit: 2, Timeout: "1s"})
+	c.Assert(err, IsNil)
+	a.clock = s.clock
+
+	started := make(chan bool)
+	release := make(chan bool)
+	client := &recordingClient{Client: metrics.NewNop()}
+	h, err := a.NewHandlerWithEnv(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- true
+			<-release
+		}
+		w.Write([]byte("hello"))
+	}), plugin.Env{MetricsClient: client, FrontendId: "f1", MiddlewareId: "a1"})
+	c.Assert(err, IsNil)
+	get := func(path string) int {
+		re := httptest.NewRecorder()
+		h.ServeHTTP(re, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		return re.Code
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(get("/slow"), Equals, http.StatusOK)
+		}()
+		<-started
+	}
+	c.Assert(get("/"), Equals, http.StatusServiceUnavailable)
+	close(release)
+	wg.Wait()
+
+	// Both slow requests used the limit, so it grew
+	c.Assert(get("/"), Equals, http.StatusOK)
+	c.Assert(client.gauges["frontend.f1.middleware.a1.limit"], DeepEquals, []int64{2, 3, 4})
+	c.Assert(client.counters["frontend.f1.middleware.a1.shed"], Equals, int64(1))
+}
+
+// Backends that say they are overloaded shrink the limit.
+func (s *AdaptiveLimitSuite) TestOverloaded(c *C) {
+	a, err := NewAdaptiveLimit(AdaptiveLimit{Algorithm: AlgorithmAIMD, InitialLimit: 10, BackoffRatio: 0.5})
+	c.Assert(err, IsNil)
+	hd, err := a.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	c.Assert(err, IsNil)
+	hd.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com", nil))
+	limit, _ := hd.(*handler).limiter.state()
+	c.Assert(limit, Equals, int64(5))
+}
+
+// recordingClient records metrics instead of sending them.
+type recordingClient struct {
+	metrics.Client
+	mutex    sync.Mutex
+	counters map[string]int64
+	gauges   map[string][]int64
+}
+
+func (m *recordingClient) Inc(stat interface{}, value int64, rate float32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.counters == nil {
+		m.counters = make(map[string]int64)
+	}
+	m.counters[fmt.Sprint(stat)] += value
+	return nil
+}
+
+func (m *recordingClient) Gauge(stat interface{}, value int64, rate float32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.gauges == nil {
+		m.gauges = make(map[string][]int64)
+	}
+	m.gauges[fmt.Sprint(stat)] = append(m.gauges[fmt.Sprint(stat)], value)
+	return nil
+}
@@ -0,0 +1,84 @@
+package adaptivelimit
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/vulcand/vulcand/plugin"
+)
+
+type handler struct {
+	next    http.Handler
+	config  *AdaptiveLimit
+	limiter *limiter
+	env     plugin.Env
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	share := 1.0
+	if h.config.extractPriority != nil {
+		class, _, err := h.config.extractPriority.Extract(r)
+		if err != nil {
+			plugin.RequestLog(r).Warnf("Failed to get the priority of request to %s: %v", r.URL, err)
+		}
+		share = h.config.share(class)
+	}
+	inflight, ok := h.limiter.acquire(share)
+	if !ok {
+		plugin.RequestLog(r).Debugf("Shed request to %s, %d requests in flight", r.URL, inflight)
+		h.env.IncCounter("shed", 1)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	start := h.config.clock.UtcNow()
+	defer func() {
+		h.limiter.release(h.config.clock.UtcNow().Sub(start), inflight, overloaded(sw.status))
+	}()
+	h.next.ServeHTTP(sw, r)
+}
+
+// overloaded tells whether the status means that the backend is overloaded.
+func overloaded(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// statusWriter remembers the status of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", sw.ResponseWriter)
+	}
+	return hj.Hijack()
+}
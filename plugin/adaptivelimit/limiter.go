@@ -0,0 +1,131 @@
+package adaptivelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// algorithm computes the next concurrency limit from a sample.
+type algorithm interface {
+	// update returns the new limit given the current one, the latency of a
+	// request, how many requests were in flight when it started, and whether
+	// the backend was overloaded.
+	update(limit float64, rtt time.Duration, inflight int64, dropped bool) float64
+}
+
+// aimd increases the limit by one while requests are fast and backs off by
+// the ratio when they time out or the backend is overloaded.
+type aimd struct {
+	backoffRatio float64
+	timeout      time.Duration
+}
+
+func (a *aimd) update(limit float64, rtt time.Duration, inflight int64, dropped bool) float64 {
+	if dropped || rtt > a.timeout {
+		return limit * a.backoffRatio
+	}
+	// The limit is not increased unless it is used, so that idle frontends do
+	// not grow limits they have never tried.
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// gradient compares the latency of requests to the long term average: the
+// limit shrinks when requests get slower than the average, which means they
+// queue somewhere, and grows by the square root of the limit otherwise, the
+// room it leaves for queueing.
+//
+// It follows the Gradient2 limit of Netflix concurrency-limits.
+type gradient struct {
+	smoothing float64
+	tolerance float64
+	// longRTT is the average latency over longWindow samples, in nanoseconds.
+	longRTT    float64
+	longWindow float64
+	samples    int
+}
+
+func (g *gradient) update(limit float64, rtt time.Duration, inflight int64, dropped bool) float64 {
+	short := float64(rtt)
+	if short <= 0 {
+		short = 1
+	}
+	g.samples++
+	if g.samples == 1 {
+		g.longRTT = short
+	} else {
+		window := math.Min(float64(g.samples), g.longWindow)
+		g.longRTT += (short - g.longRTT) / window
+	}
+	// Recover quickly when latency drops after a long period of slow
+	// requests, otherwise the limit stays high until the average catches up.
+	if g.longRTT/short > 2 {
+		g.longRTT *= 0.95
+	}
+	// Frontends that do not use half of the limit say nothing about it.
+	if float64(inflight) < limit/2 && !dropped {
+		return limit
+	}
+	grad := math.Max(0.5, math.Min(1.0, g.tolerance*g.longRTT/short))
+	if dropped {
+		grad = 0.5
+	}
+	next := limit*grad + math.Sqrt(limit)
+	return limit*(1-g.smoothing) + next*g.smoothing
+}
+
+// limiter lets through as many requests at once as the limit, the algorithm
+// updates the limit as requests complete.
+type limiter struct {
+	mutex     sync.Mutex
+	algorithm algorithm
+	limit     float64
+	min, max  float64
+	inflight  int64
+	// onChange is called with the limit rounded down when it changes.
+	onChange func(limit int64)
+}
+
+func newLimiter(a algorithm, initial, min, max int64, onChange func(int64)) *limiter {
+	return &limiter{
+		algorithm: a,
+		limit:     float64(initial),
+		min:       float64(min),
+		max:       float64(max),
+		onChange:  onChange,
+	}
+}
+
+// acquire takes a slot if fewer requests than the share of the limit are in
+// flight and returns how many requests are in flight, including this one.
+func (l *limiter) acquire(share float64) (int64, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if float64(l.inflight) >= math.Max(1, math.Floor(l.limit*share)) {
+		return l.inflight, false
+	}
+	l.inflight++
+	return l.inflight, true
+}
+
+// release frees the slot of a request that started with inflight requests in
+// flight and updates the limit.
+func (l *limiter) release(rtt time.Duration, inflight int64, dropped bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inflight--
+	old := int64(l.limit)
+	l.limit = math.Max(l.min, math.Min(l.max, l.algorithm.update(l.limit, rtt, inflight, dropped)))
+	if current := int64(l.limit); current != old && l.onChange != nil {
+		l.onChange(current)
+	}
+}
+
+func (l *limiter) state() (limit, inflight int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int64(l.limit), l.inflight
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
+)
+
+const Type = "cache"
+
+const (
+	// DefaultMaxEntryBytes is the default max size of a response body that
+	// can be cached.
+	DefaultMaxEntryBytes = 1 << 20
+	// DefaultTagHeader is the default response header that lists tags that
+	// a cached response can be purged by.
+	DefaultTagHeader = "Cache-Tag"
+)
+
+// defaultStorage keeps cached responses when vulcand is configured with a
+// cache provider that can not store them.
+var defaultStorage = cacheprovider.NewMemCacheProvider().(cacheprovider.ResponseCacheProvider).GetResponseCache()
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// Cache is a shared HTTP cache that follows RFC 7234. It respects
+// Cache-Control, Expires and Vary, serves conditional requests, revalidates
+// stale responses that have an ETag or Last-Modified, and supports
+// stale-while-revalidate (RFC 5861). Responses are kept in the storage of the
+// vulcand cache provider.
+type Cache struct {
+	// MaxEntryBytes is the max size of a response body that can be cached.
+	MaxEntryBytes int64
+	// DefaultTTL is how long responses that do not tell how long they are
+	// fresh for are cached, e.g. "1m". Such responses are not cached if it is
+	// empty, unless they have Last-Modified to estimate freshness from.
+	DefaultTTL string
+	// StaleWhileRevalidate is how long a stale response can be served while it
+	// is revalidated in the background, e.g. "10s", unless the response sets
+	// the stale-while-revalidate Cache-Control directive.
+	StaleWhileRevalidate string
+	// TagHeader is a response header that lists tags the response can be
+	// purged by, "Cache-Tag" by default.
+	TagHeader string
+
+	defaultTTL time.Duration
+	swr        time.Duration
+	clock      timetools.TimeProvider
+}
+
+// NewCache validates cache settings and returns a cache middleware.
+func NewCache(c Cache) (*Cache, error) {
+	if c.MaxEntryBytes < 0 {
+		return nil, fmt.Errorf("max entry bytes should be >= 0, got %d", c.MaxEntryBytes)
+	}
+	var err error
+	if c.defaultTTL, err = parseDuration("default TTL", c.DefaultTTL); err != nil {
+		return nil, err
+	}
+	if c.swr, err = parseDuration("stale while revalidate", c.StaleWhileRevalidate); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// NewHandler returns a handler that keeps cached responses in process memory.
+func (c *Cache) NewHandler(next http.Handler) (http.Handler, error) {
+	return c.NewHandlerWithEnv(next, plugin.Env{})
+}
+
+// NewHandlerWithEnv returns a handler that keeps cached responses in the
+// storage of the vulcand cache provider.
+func (c *Cache) NewHandlerWithEnv(next http.Handler, env plugin.Env) (http.Handler, error) {
+	clock := c.clock
+	if clock == nil {
+		clock = &timetools.RealTime{}
+	}
+	maxEntryBytes := c.MaxEntryBytes
+	if maxEntryBytes == 0 {
+		maxEntryBytes = DefaultMaxEntryBytes
+	}
+	tagHeader := c.TagHeader
+	if tagHeader == "" {
+		tagHeader = DefaultTagHeader
+	}
+	return &handler{
+		next:          next,
+		store:         &store{storage: Storage(env.CacheProvider), clock: clock},
+		clock:         clock,
+		maxEntryBytes: maxEntryBytes,
+		defaultTTL:    c.defaultTTL,
+		swr:           c.swr,
+		tagHeader:     tagHeader,
+		revalidating:  make(map[string]bool),
+	}, nil
+}
+
+func (c *Cache) String() string {
+	return fmt.Sprintf("maxEntryBytes=%d, defaultTTL=%s, staleWhileRevalidate=%s, tagHeader=%s",
+		c.MaxEntryBytes, c.defaultTTL, c.swr, c.TagHeader)
+}
+
+func FromOther(c Cache) (plugin.Middleware, error) {
+	return NewCache(c)
+}
+
+// FromCli constructs the middleware from the command line.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	return NewCache(Cache{
+		MaxEntryBytes:        int64(c.Int("maxEntryKB")) * 1024,
+		DefaultTTL:           durationString(c.Duration("defaultTTL")),
+		StaleWhileRevalidate: durationString(c.Duration("staleWhileRevalidate")),
+		TagHeader:            c.String("tagHeader"),
+	})
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.IntFlag{Name: "maxEntryKB", Usage: "max size of a response body that can be cached, in KB"},
+		cli.DurationFlag{Name: "defaultTTL", Usage: "how long to cache responses that do not tell how long they are fresh for"},
+		cli.DurationFlag{Name: "staleWhileRevalidate, swr", Usage: "how long a stale response can be served while it is revalidated"},
+		cli.StringFlag{Name: "tagHeader", Usage: fmt.Sprintf("response header with tags to purge by, %q by default", DefaultTagHeader)},
+	}
+}
+
+// Storage returns the storage that cached responses are kept in given the
+// vulcand cache provider.
+func Storage(p cacheprovider.T) cacheprovider.ResponseCache {
+	if rp, ok := p.(cacheprovider.ResponseCacheProvider); ok {
+		if rc := rp.GetResponseCache(); rc != nil {
+			return rc
+		}
+	}
+	return defaultStorage
+}
+
+func parseDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s should be >= 0, got %s", name, value)
+	}
+	return d, nil
+}
+
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
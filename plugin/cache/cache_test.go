@@ -0,0 +1,398 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
+	. "gopkg.in/check.v1"
+)
+
+func TestCache(t *testing.T) { TestingT(t) }
+
+type CacheSuite struct {
+	clock    *timetools.FreezedTime
+	provider cacheprovider.T
+	hits     int64
+}
+
+var _ = Suite(&CacheSuite{})
+
+func (s *CacheSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{CurrentTime: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	s.provider = cacheprovider.NewMemCacheProvider()
+	s.hits = 0
+}
+
+// Make sure the spec is compatible and will be accepted by middleware registry
+func (s *CacheSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *CacheSuite) TestNewCacheBadParams(c *C) {
+	_, err := NewCache(Cache{MaxEntryBytes: -1})
+	c.Assert(err, NotNil)
+
+	_, err = NewCache(Cache{DefaultTTL: "forever"})
+	c.Assert(err, NotNil)
+
+	_, err = NewCache(Cache{StaleWhileRevalidate: "-1s"})
+	c.Assert(err, NotNil)
+}
+
+func (s *CacheSuite) TestNewCacheFromOther(c *C) {
+	cl, err := NewCache(Cache{MaxEntryBytes: 1024, DefaultTTL: "1m", StaleWhileRevalidate: "10s", TagHeader: "Surrogate-Key"})
+	c.Assert(err, IsNil)
+	c.Assert(cl.String(), Not(Equals), "")
+
+	out, err := FromOther(*cl)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, cl)
+}
+
+func (s *CacheSuite) TestNewCacheFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		cl := out.(*Cache)
+		c.Assert(cl.MaxEntryBytes, Equals, int64(2048))
+		c.Assert(cl.DefaultTTL, Equals, "1m0s")
+		c.Assert(cl.StaleWhileRevalidate, Equals, "10s")
+		c.Assert(cl.TagHeader, Equals, "Surrogate-Key")
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--maxEntryKB=2", "--defaultTTL=1m", "--swr=10s", "--tagHeader=Surrogate-Key"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *CacheSuite) TestFreshResponseIsServedFromCache(c *C) {
+	h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+
+	re := s.get(h, "/a")
+	c.Assert(re.Body.String(), Equals, "hello")
+	c.Assert(re.Header().Get("X-Cache"), Equals, cacheMiss)
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(30 * time.Second)
+	re = s.get(h, "/a")
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Body.String(), Equals, "hello")
+	c.Assert(re.Header().Get("X-Cache"), Equals, cacheHit)
+	c.Assert(re.Header().Get("Age"), Equals, "30")
+	c.Assert(s.hits, Equals, int64(1))
+
+	// Other URLs are cached separately.
+	s.get(h, "/b")
+	c.Assert(s.hits, Equals, int64(2))
+
+	// Once stale, the response is fetched again.
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(31 * time.Second)
+	re = s.get(h, "/a")
+	c.Assert(re.Header().Get("X-Cache"), Equals, cacheMiss)
+	c.Assert(s.hits, Equals, int64(3))
+}
+
+func (s *CacheSuite) TestUncacheableResponses(c *C) {
+	for _, cc := range []string{"no-store", "private, max-age=60", ""} {
+		s.hits = 0
+		h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+			if cc != "" {
+				w.Header().Set("Cache-Control", cc)
+			}
+			w.Write([]byte("hello"))
+		})
+		s.get(h, "/")
+		s.get(h, "/")
+		c.Assert(s.hits, Equals, int64(2), Commentf("Cache-Control: %s", cc))
+	}
+
+	// Responses that set cookies or vary by everything are not cached either.
+	for _, header := range []string{"Set-Cookie", "Vary"} {
+		s.hits = 0
+		h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set(header, "*")
+			w.Write([]byte("hello"))
+		})
+		s.get(h, "/")
+		s.get(h, "/")
+		c.Assert(s.hits, Equals, int64(2), Commentf("%s", header))
+	}
+}
+
+func (s *CacheSuite) TestRangeRequestsBypassCache(c *C) {
+	h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.Header.Get("Range") == "bytes=0-1" {
+			w.Header().Set("Content-Range", "bytes 0-1/5")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("he"))
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	re := s.get(h, "/", "Range", "bytes=0-1")
+	c.Assert(re.Code, Equals, http.StatusPartialContent)
+	c.Assert(re.Body.String(), Equals, "he")
+
+	// The partial response is not served to requests for the whole resource.
+	re = s.get(h, "/")
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Body.String(), Equals, "hello")
+	c.Assert(s.hits, Equals, int64(2))
+
+	// And the whole resource is not served to requests for ranges.
+	re = s.get(h, "/", "Range", "bytes=0-1")
+	c.Assert(re.Code, Equals, http.StatusPartialContent)
+	c.Assert(s.hits, Equals, int64(3))
+}
+
+func (s *CacheSuite) TestPartialResponsesAreNotCached(c *C) {
+	for _, status := range []int{http.StatusPartialContent, http.StatusOK} {
+		s.hits = 0
+		h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Content-Range", "bytes 0-1/5")
+			w.WriteHeader(status)
+			w.Write([]byte("he"))
+		})
+		s.get(h, "/")
+		s.get(h, "/")
+		c.Assert(s.hits, Equals, int64(2), Commentf("status %d", status))
+	}
+}
+
+func (s *CacheSuite) TestDefaultTTL(c *C) {
+	h := s.newHandler(c, Cache{DefaultTTL: "10s"}, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	s.get(h, "/")
+	s.get(h, "/")
+	c.Assert(s.hits, Equals, int64(1))
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(10 * time.Second)
+	s.get(h, "/")
+	c.Assert(s.hits, Equals, int64(2))
+}
+
+func (s *CacheSuite) TestLargeResponsesAreNotCached(c *C) {
+	h := s.newHandler(c, Cache{MaxEntryBytes: 4}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+	c.Assert(s.get(h, "/").Body.String(), Equals, "hello")
+	c.Assert(s.get(h, "/").Body.String(), Equals, "hello")
+	c.Assert(s.hits, Equals, int64(2))
+}
+
+func (s *CacheSuite) TestRequestCacheControl(c *C) {
+	h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+	s.get(h, "/")
+	c.Assert(s.get(h, "/", "Cache-Control", "no-cache").Header().Get("X-Cache"), Equals, cacheMiss)
+	c.Assert(s.hits, Equals, int64(2))
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(20 * time.Second)
+	c.Assert(s.get(h, "/", "Cache-Control", "max-age=10").Header().Get("X-Cache"), Equals, cacheMiss)
+	c.Assert(s.get(h, "/", "Cache-Control", "max-age=30").Header().Get("X-Cache"), Equals, cacheHit)
+	c.Assert(s.hits, Equals, int64(3))
+
+	c.Assert(s.get(h, "/other", "Cache-Control", "only-if-cached").Code, Equals, http.StatusGatewayTimeout)
+	c.Assert(s.hits, Equals, int64(3))
+
+	// Requests with credentials bypass the cache.
+	s.get(h, "/", "Authorization", "Bearer secret")
+	c.Assert(s.hits, Equals, int64(4))
+}
+
+func (s *CacheSuite) TestVary(c *C) {
+	h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("hello in " + r.Header.Get("Accept-Language")))
+	})
+	c.Assert(s.get(h, "/", "Accept-Language", "en").Body.String(), Equals, "hello in en")
+	c.Assert(s.get(h, "/", "Accept-Language", "fr").Body.String(), Equals, "hello in fr")
+	c.Assert(s.get(h, "/", "Accept-Language", "en").Body.String(), Equals, "hello in en")
+	c.Assert(s.get(h, "/", "Accept-Language", "fr").Body.String(), Equals, "hello in fr")
+	c.Assert(s.hits, Equals, int64(2))
+}
+
+func (s *CacheSuite) TestConditionalRequests(c *C) {
+	h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("hello"))
+	})
+	s.get(h, "/")
+
+	re := s.get(h, "/", "If-None-Match", `"v0", "v1"`)
+	c.Assert(re.Code, Equals, http.StatusNotModified)
+	c.Assert(re.Body.Len(), Equals, 0)
+
+	re = s.get(h, "/", "If-None-Match", `"v2"`)
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Body.String(), Equals, "hello")
+	c.Assert(s.hits, Equals, int64(1))
+}
+
+func (s *CacheSuite) TestRevalidation(c *C) {
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	notModified := int64(0)
+	h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", etag.Load().(string))
+		if r.Header.Get("If-None-Match") == etag.Load().(string) {
+			atomic.AddInt64(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello " + etag.Load().(string)))
+	})
+	s.get(h, "/")
+
+	// A stale response that has not changed is revalidated and served again.
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(20 * time.Second)
+	re := s.get(h, "/")
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Body.String(), Equals, `hello "v1"`)
+	c.Assert(re.Header().Get("X-Cache"), Equals, cacheRevalidated)
+	c.Assert(notModified, Equals, int64(1))
+
+	// And is fresh again.
+	c.Assert(s.get(h, "/").Header().Get("X-Cache"), Equals, cacheHit)
+	c.Assert(s.hits, Equals, int64(2))
+
+	// A changed one gets replaced.
+	etag.Store(`"v2"`)
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(20 * time.Second)
+	c.Assert(s.get(h, "/").Body.String(), Equals, `hello "v2"`)
+	c.Assert(s.get(h, "/").Header().Get("X-Cache"), Equals, cacheHit)
+	c.Assert(s.get(h, "/").Body.String(), Equals, `hello "v2"`)
+	c.Assert(s.hits, Equals, int64(3))
+}
+
+func (s *CacheSuite) TestStaleWhileRevalidate(c *C) {
+	revalidated := make(chan bool, 1)
+	h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=10, stale-while-revalidate=30")
+		fmt.Fprintf(w, "hello %d", atomic.LoadInt64(&s.hits))
+		if r.Header.Get("X-Test") == "" {
+			revalidated <- true
+		}
+	})
+	s.get(h, "/", "X-Test", "1")
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(20 * time.Second)
+	re := s.get(h, "/", "X-Test", "")
+	c.Assert(re.Body.String(), Equals, "hello 1")
+	c.Assert(re.Header().Get("X-Cache"), Equals, cacheStale)
+
+	select {
+	case <-revalidated:
+	case <-time.After(time.Second):
+		c.Fatal("response was not revalidated")
+	}
+	// The revalidated response replaces the stale one.
+	for i := 0; i < 100; i++ {
+		if re = s.get(h, "/", "X-Test", "1"); re.Header().Get("X-Cache") == cacheHit {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(re.Body.String(), Equals, "hello 2")
+
+	// Beyond the window, the request waits for the backend.
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(time.Minute)
+	c.Assert(s.get(h, "/", "X-Test", "1").Header().Get("X-Cache"), Equals, cacheMiss)
+}
+
+func (s *CacheSuite) TestPurge(c *C) {
+	h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if strings.HasPrefix(r.URL.Path, "/products") {
+			w.Header().Set("Cache-Tag", "products, catalog")
+		}
+		w.Write([]byte("hello"))
+	})
+	s.get(h, "/a")
+	s.get(h, "/products/1")
+	s.get(h, "/products/2")
+	c.Assert(s.hits, Equals, int64(3))
+
+	storage := Storage(s.provider)
+	c.Assert(Purge(context.Background(), storage, "http://example.com/a"), IsNil)
+	s.get(h, "/a")
+	s.get(h, "/products/1")
+	c.Assert(s.hits, Equals, int64(4))
+
+	c.Assert(PurgeTag(context.Background(), storage, "catalog"), IsNil)
+	s.get(h, "/a")
+	s.get(h, "/products/1")
+	s.get(h, "/products/2")
+	c.Assert(s.hits, Equals, int64(6))
+
+	c.Assert(Purge(context.Background(), storage, "/a"), NotNil)
+	c.Assert(PurgeTag(context.Background(), storage, ""), NotNil)
+}
+
+func (s *CacheSuite) TestUnsafeMethodsInvalidate(c *C) {
+	h := s.newHandler(c, Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+	s.get(h, "/")
+	s.get(h, "/")
+	c.Assert(s.hits, Equals, int64(1))
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(s.hits, Equals, int64(2))
+
+	s.get(h, "/")
+	c.Assert(s.hits, Equals, int64(3))
+}
+
+func (s *CacheSuite) newHandler(c *C, cfg Cache, fn http.HandlerFunc) http.Handler {
+	cl, err := NewCache(cfg)
+	c.Assert(err, IsNil)
+	cl.clock = s.clock
+	h, err := cl.NewHandlerWithEnv(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.hits, 1)
+		fn(w, r)
+	}), plugin.Env{CacheProvider: s.provider})
+	c.Assert(err, IsNil)
+	return h
+}
+
+func (s *CacheSuite) get(h http.Handler, path string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		if headers[i+1] != "" {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+	}
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, req)
+	return re
+}
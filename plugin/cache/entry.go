@@ -0,0 +1,229 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHeuristicFreshness caps freshness estimated from Last-Modified.
+	maxHeuristicFreshness = 24 * time.Hour
+	// keepForRevalidation is how long responses that can be revalidated are
+	// kept after they go stale.
+	keepForRevalidation = time.Hour
+)
+
+// entry is a cached response.
+type entry struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	// Stored is when the response was received, and InitialAge is how old it
+	// was at that moment.
+	Stored     time.Time
+	InitialAge time.Duration
+	// Freshness is how long the response is fresh for since it was created.
+	Freshness time.Duration
+	// StaleWhileRevalidate is how long after the response goes stale it can
+	// still be served while it is revalidated.
+	StaleWhileRevalidate time.Duration
+	// MustRevalidate forbids serving the response once it is stale.
+	MustRevalidate bool
+}
+
+func (e *entry) age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.Stored)
+}
+
+func (e *entry) canRevalidate() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// ttl is how long the response is worth keeping in the storage.
+func (e *entry) ttl(now time.Time) time.Duration {
+	ttl := e.Freshness - e.age(now)
+	if !e.MustRevalidate {
+		ttl += e.StaleWhileRevalidate
+	}
+	if e.canRevalidate() {
+		ttl += keepForRevalidation
+	}
+	return ttl
+}
+
+// cacheControl holds Cache-Control directives with their arguments.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, arg = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns a directive argument that is a number of seconds.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheableByDefault are status codes that can be cached without explicit
+// freshness, see RFC 7231 section 6.1.
+var cacheableByDefault = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// newEntry creates an entry for a response received at the moment, or returns
+// nil if the response can not be stored by a shared cache.
+func newEntry(status int, header http.Header, body []byte, now time.Time, defaultTTL, swr time.Duration) *entry {
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") {
+		return nil
+	}
+	if header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	// Partial responses would be served to requests for whole resources.
+	if status == http.StatusPartialContent || header.Get("Content-Range") != "" {
+		return nil
+	}
+	for _, name := range varyHeaders(header) {
+		if name == "*" {
+			return nil
+		}
+	}
+	freshness, explicit := responseFreshness(header, cc, now)
+	if !explicit {
+		if !cacheableByDefault[status] {
+			return nil
+		}
+		freshness = heuristicFreshness(header, now, defaultTTL)
+	}
+	if cc.has("no-cache") {
+		freshness = 0
+	}
+	if s, ok := cc.seconds("stale-while-revalidate"); ok {
+		swr = s
+	}
+	e := &entry{
+		Status:               status,
+		Header:               header,
+		Body:                 body,
+		Stored:               now,
+		InitialAge:           initialAge(header, now),
+		Freshness:            freshness,
+		StaleWhileRevalidate: swr,
+		MustRevalidate:       cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("s-maxage"),
+	}
+	if e.Freshness <= e.InitialAge && !e.canRevalidate() {
+		return nil
+	}
+	return e
+}
+
+// responseFreshness returns freshness that the response explicitly tells.
+func responseFreshness(header http.Header, cc cacheControl, now time.Time) (time.Duration, bool) {
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d, true
+	}
+	if v := header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// Invalid dates, e.g. "0", mean the response has already expired.
+			return 0, true
+		}
+		if d := expires.Sub(responseDate(header, now)); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// heuristicFreshness estimates freshness of a response that does not tell
+// it, as a fraction of time since it was last modified. If it was not, the
+// default TTL is used.
+func heuristicFreshness(header http.Header, now time.Time, defaultTTL time.Duration) time.Duration {
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return defaultTTL
+	}
+	d := responseDate(header, now).Sub(lastModified) / 10
+	if d < 0 {
+		return 0
+	}
+	if d > maxHeuristicFreshness {
+		return maxHeuristicFreshness
+	}
+	return d
+}
+
+func responseDate(header http.Header, now time.Time) time.Time {
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		return date
+	}
+	return now
+}
+
+// initialAge returns how old a response is at the moment it is received.
+func initialAge(header http.Header, now time.Time) time.Duration {
+	var age time.Duration
+	if n, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && n > 0 {
+		age = time.Duration(n) * time.Second
+	}
+	if apparent := now.Sub(responseDate(header, now)); apparent > age {
+		age = apparent
+	}
+	return age
+}
+
+// update refreshes a stored response with a 304 Not Modified response
+// received at the moment.
+func (e *entry) update(header http.Header, now time.Time, defaultTTL, swr time.Duration) *entry {
+	merged := e.Header.Clone()
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		merged[name] = values
+	}
+	return newEntry(e.Status, merged, e.Body, now, defaultTTL, swr)
+}
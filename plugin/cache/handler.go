@@ -0,0 +1,336 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// Values of the X-Cache response header that tells how a request was served.
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheStale       = "STALE"
+	cacheRevalidated = "REVALIDATED"
+)
+
+type handler struct {
+	next          http.Handler
+	store         *store
+	clock         timetools.TimeProvider
+	maxEntryBytes int64
+	defaultTTL    time.Duration
+	swr           time.Duration
+	tagHeader     string
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.serveUnsafe(w, r)
+		return
+	}
+	reqCC := parseCacheControl(r.Header)
+	// Responses to requests with credentials are private unless they say
+	// otherwise, so it is simpler to not cache them at all. Ranges are not
+	// cached either, for entries are complete responses.
+	if reqCC.has("no-store") || r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	key := requestKey(r)
+	e, err := h.store.lookup(r.Context(), key, r)
+	if err != nil {
+		plugin.RequestLog(r).Warnf("Failed to look up cached response for %s: %v", key, err)
+	}
+	if e != nil {
+		now := h.clock.UtcNow()
+		age := e.age(now)
+		noCache := reqCC.has("no-cache") || (!reqCC.has("max-age") && r.Header.Get("Pragma") == "no-cache")
+		maxAge, hasMaxAge := reqCC.seconds("max-age")
+		acceptable := !noCache && (!hasMaxAge || age <= maxAge)
+		if acceptable && age < e.Freshness {
+			h.serveEntry(w, r, e, age, cacheHit)
+			return
+		}
+		if acceptable && !e.MustRevalidate && age < e.Freshness+e.StaleWhileRevalidate {
+			h.serveEntry(w, r, e, age, cacheStale)
+			h.revalidateAsync(r, key, e)
+			return
+		}
+		if e.canRevalidate() && r.Method == http.MethodGet {
+			h.revalidate(w, r, key, e)
+			return
+		}
+	}
+	if reqCC.has("only-if-cached") {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	h.fetch(w, r, key)
+}
+
+// serveUnsafe forwards requests with methods that may change the resource,
+// and invalidates responses cached for the URL if they succeed.
+func (h *handler) serveUnsafe(w http.ResponseWriter, r *http.Request) {
+	cw := &captureWriter{w: w}
+	h.next.ServeHTTP(cw, r)
+	cw.finish()
+	switch r.Method {
+	case http.MethodOptions, http.MethodTrace:
+		return
+	}
+	if cw.status < http.StatusBadRequest {
+		if err := h.store.purge(r.Context(), requestKey(r)); err != nil {
+			plugin.RequestLog(r).Warnf("Failed to invalidate cached response for %s: %v", requestKey(r), err)
+		}
+	}
+}
+
+// fetch forwards a request that can not be served from the cache, and stores
+// the response if it is cacheable.
+func (h *handler) fetch(w http.ResponseWriter, r *http.Request, key string) {
+	w.Header().Set("X-Cache", cacheMiss)
+	if r.Method == http.MethodHead {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	cw := &captureWriter{w: w, limit: h.maxEntryBytes}
+	h.next.ServeHTTP(cw, r)
+	cw.finish()
+	h.save(r.Context(), key, r, cw)
+}
+
+// revalidate asks the backend whether a stale response is still good, and
+// either serves it or the new response.
+func (h *handler) revalidate(w http.ResponseWriter, r *http.Request, key string, e *entry) {
+	cw := &captureWriter{w: w, limit: h.maxEntryBytes, holdNotModified: true}
+	h.next.ServeHTTP(cw, conditionalRequest(r, e))
+	cw.finish()
+	if cw.status != http.StatusNotModified {
+		h.save(r.Context(), key, r, cw)
+		return
+	}
+	now := h.clock.UtcNow()
+	updated := e.update(cw.header, now, h.defaultTTL, h.swr)
+	if updated == nil {
+		if err := h.store.purge(r.Context(), key); err != nil {
+			plugin.RequestLog(r).Warnf("Failed to invalidate cached response for %s: %v", key, err)
+		}
+		h.serveEntry(w, r, e, e.age(now), cacheRevalidated)
+		return
+	}
+	if err := h.store.save(r.Context(), key, r, updated, h.tags(updated.Header), updated.ttl(now)); err != nil {
+		plugin.RequestLog(r).Warnf("Failed to cache response for %s: %v", key, err)
+	}
+	h.serveEntry(w, r, updated, updated.age(now), cacheRevalidated)
+}
+
+// revalidateAsync revalidates a stale response in the background, unless it
+// is already being revalidated.
+func (h *handler) revalidateAsync(r *http.Request, key string, e *entry) {
+	h.mu.Lock()
+	if h.revalidating[key] {
+		h.mu.Unlock()
+		return
+	}
+	h.revalidating[key] = true
+	h.mu.Unlock()
+
+	// The revalidation must not be cancelled when the client goes away, but
+	// its log lines should still carry the request id.
+	outReq := plugin.WithRequestId(r.Clone(context.Background()), plugin.RequestId(r))
+	go func() {
+		defer func() {
+			h.mu.Lock()
+			delete(h.revalidating, key)
+			h.mu.Unlock()
+		}()
+		outReq.Method = http.MethodGet
+		h.revalidate(discardWriter{header: make(http.Header)}, outReq, key, e)
+	}()
+}
+
+func (h *handler) save(ctx context.Context, key string, r *http.Request, cw *captureWriter) {
+	if cw.overflow {
+		return
+	}
+	now := h.clock.UtcNow()
+	e := newEntry(cw.status, cw.header.Clone(), cw.body.Bytes(), now, h.defaultTTL, h.swr)
+	if e == nil {
+		return
+	}
+	e.Header.Del("X-Cache")
+	if err := h.store.save(ctx, key, r, e, h.tags(e.Header), e.ttl(now)); err != nil {
+		plugin.RequestLog(r).Warnf("Failed to cache response for %s: %v", key, err)
+	}
+}
+
+// serveEntry writes a cached response, or 304 Not Modified if the request is
+// conditional and the cached response matches it.
+func (h *handler) serveEntry(w http.ResponseWriter, r *http.Request, e *entry, age time.Duration, status string) {
+	header := w.Header()
+	for name, values := range e.Header {
+		header[name] = values
+	}
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	header.Set("X-Cache", status)
+	if notModified(r, e.Header) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// tags returns tags that the response can be purged by.
+func (h *handler) tags(header http.Header) []string {
+	var tags []string
+	for _, v := range header.Values(h.tagHeader) {
+		for _, tag := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' }) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// conditionalRequest returns a copy of the request that asks the backend to
+// only return a response if it differs from the cached one.
+func conditionalRequest(r *http.Request, e *entry) *http.Request {
+	outReq := r.Clone(r.Context())
+	outReq.Header.Del("If-None-Match")
+	outReq.Header.Del("If-Modified-Since")
+	outReq.Header.Del("If-Match")
+	outReq.Header.Del("If-Unmodified-Since")
+	outReq.Header.Del("If-Range")
+	if etag := e.Header.Get("ETag"); etag != "" {
+		outReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		outReq.Header.Set("If-Modified-Since", lastModified)
+	}
+	return outReq
+}
+
+// notModified tells whether a conditional request matches the response, see
+// RFC 7232 section 6.
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ims)
+}
+
+// captureWriter passes a response through to the client while keeping a copy
+// of it, unless it gets larger than the limit. If told to, it holds back 304
+// Not Modified responses to revalidation requests, since the client did not
+// ask for them.
+type captureWriter struct {
+	w               http.ResponseWriter
+	limit           int64
+	holdNotModified bool
+
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	overflow    bool
+	wroteHeader bool
+}
+
+func (cw *captureWriter) Header() http.Header {
+	if cw.header == nil {
+		cw.header = make(http.Header)
+	}
+	return cw.header
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	if cw.holdNotModified && status == http.StatusNotModified {
+		return
+	}
+	header := cw.w.Header()
+	for name, values := range cw.Header() {
+		header[name] = values
+	}
+	cw.w.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.holdNotModified && cw.status == http.StatusNotModified {
+		return len(p), nil
+	}
+	if !cw.overflow {
+		if int64(cw.body.Len()+len(p)) > cw.limit {
+			cw.overflow = true
+			cw.body.Reset()
+		} else {
+			cw.body.Write(p)
+		}
+	}
+	return cw.w.Write(p)
+}
+
+// finish sends the response headers if the handler has not written anything.
+func (cw *captureWriter) finish() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+}
+
+func (cw *captureWriter) Flush() {
+	if cw.holdNotModified && cw.status == http.StatusNotModified {
+		return
+	}
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// discardWriter is a response writer for background requests.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
+)
+
+// maxTagKeys is the max number of URLs a tag can refer to. When a tag gets
+// more, the oldest ones can no longer be purged by the tag.
+const maxTagKeys = 1000
+
+// store keeps cached responses in a storage. Every URL has an index record
+// that tells what request headers its responses vary by. Responses themselves
+// are stored under variant keys made of the URL, the index id and the values
+// of the vary headers. The index id changes whenever the index is recreated,
+// so purging a URL only takes deleting its index: variants of the old index
+// become unreachable and eventually expire.
+//
+// Tag records list URLs that have responses with the tag.
+type store struct {
+	storage cacheprovider.ResponseCache
+	clock   timetools.TimeProvider
+}
+
+type index struct {
+	Id   string
+	Vary []string
+}
+
+type tagRecord struct {
+	Keys    []string
+	Expires time.Time
+}
+
+// lookup returns a cached response for the request, or nil if there is none.
+func (s *store) lookup(ctx context.Context, key string, r *http.Request) (*entry, error) {
+	idx, err := s.index(ctx, key)
+	if err != nil || idx == nil {
+		return nil, err
+	}
+	data, err := s.storage.Get(ctx, variantKey(key, idx, r))
+	if err != nil {
+		if err == cacheprovider.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("failed to decode cached response: %v", err)
+	}
+	return &e, nil
+}
+
+// save stores a response to the request for the ttl, and adds it to the tags.
+func (s *store) save(ctx context.Context, key string, r *http.Request, e *entry, tags []string, ttl time.Duration) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	vary := varyHeaders(e.Header)
+	idx, err := s.index(ctx, key)
+	if err != nil {
+		return err
+	}
+	if idx == nil || !reflect.DeepEqual(idx.Vary, vary) {
+		idx = &index{Id: fmt.Sprintf("%x", rand.Int63()), Vary: vary}
+	}
+	idxData, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.Put(ctx, variantKey(key, idx, r), data, ttl); err != nil {
+		return err
+	}
+	if err := s.storage.Put(ctx, indexKey(key), idxData, ttl); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := s.tag(ctx, tag, key, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purge makes all responses cached for the URL key unreachable.
+func (s *store) purge(ctx context.Context, key string) error {
+	return s.storage.Delete(ctx, indexKey(key))
+}
+
+// purgeTag purges all URLs that have responses with the tag.
+func (s *store) purgeTag(ctx context.Context, tag string) error {
+	rec, err := s.tagRecord(ctx, tag)
+	if err != nil || rec == nil {
+		return err
+	}
+	for _, key := range rec.Keys {
+		if err := s.purge(ctx, key); err != nil {
+			return err
+		}
+	}
+	return s.storage.Delete(ctx, tagKey(tag))
+}
+
+func (s *store) index(ctx context.Context, key string) (*index, error) {
+	data, err := s.storage.Get(ctx, indexKey(key))
+	if err != nil {
+		if err == cacheprovider.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var idx index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("failed to decode cache index: %v", err)
+	}
+	return &idx, nil
+}
+
+// tag adds the URL key to the tag. The tag record is kept for as long as the
+// longest lived response with the tag.
+func (s *store) tag(ctx context.Context, tag, key string, ttl time.Duration) error {
+	rec, err := s.tagRecord(ctx, tag)
+	if err != nil {
+		return err
+	}
+	now := s.clock.UtcNow()
+	if rec == nil {
+		rec = &tagRecord{}
+	}
+	found := false
+	for _, k := range rec.Keys {
+		if k == key {
+			found = true
+			break
+		}
+	}
+	if !found {
+		rec.Keys = append(rec.Keys, key)
+		if len(rec.Keys) > maxTagKeys {
+			rec.Keys = rec.Keys[len(rec.Keys)-maxTagKeys:]
+		}
+	}
+	if expires := now.Add(ttl); expires.After(rec.Expires) {
+		rec.Expires = expires
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.storage.Put(ctx, tagKey(tag), data, rec.Expires.Sub(now))
+}
+
+func (s *store) tagRecord(ctx context.Context, tag string) (*tagRecord, error) {
+	data, err := s.storage.Get(ctx, tagKey(tag))
+	if err != nil {
+		if err == cacheprovider.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var rec tagRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("failed to decode cache tag: %v", err)
+	}
+	return &rec, nil
+}
+
+// Purge removes all responses cached for the URL, e.g.
+// http://example.com/products?page=2, from the storage.
+func Purge(ctx context.Context, storage cacheprovider.ResponseCache, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %v", rawURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("URL %q should be absolute", rawURL)
+	}
+	s := &store{storage: storage, clock: &timetools.RealTime{}}
+	return s.purge(ctx, urlKey(u.Scheme, u.Host, u.RequestURI()))
+}
+
+// PurgeTag removes all responses that have the tag from the storage.
+func PurgeTag(ctx context.Context, storage cacheprovider.ResponseCache, tag string) error {
+	if tag == "" {
+		return fmt.Errorf("tag can not be empty")
+	}
+	s := &store{storage: storage, clock: &timetools.RealTime{}}
+	return s.purgeTag(ctx, tag)
+}
+
+// requestKey returns the URL key of a request.
+func requestKey(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return urlKey(scheme, r.Host, r.URL.RequestURI())
+}
+
+func urlKey(scheme, host, requestURI string) string {
+	return strings.ToLower(scheme) + "://" + strings.ToLower(host) + requestURI
+}
+
+func indexKey(key string) string {
+	return "idx:" + key
+}
+
+func tagKey(tag string) string {
+	return "tag:" + tag
+}
+
+func variantKey(key string, idx *index, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString("var:")
+	b.WriteString(idx.Id)
+	b.WriteByte(':')
+	b.WriteString(key)
+	for _, name := range idx.Vary {
+		b.WriteString("\n")
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// varyHeaders returns sorted canonical names of request headers that a
+// response varies by.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,7 +1,68 @@
 package cacheprovider
 
-import "golang.org/x/crypto/acme/autocert"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
 
 type T interface {
 	GetAutoCertCache() autocert.Cache
 }
+
+// ResponseCacheProvider is implemented by cache providers that can also store
+// HTTP responses for the cache middleware.
+type ResponseCacheProvider interface {
+	T
+	GetResponseCache() ResponseCache
+}
+
+// ErrCacheMiss is returned by ResponseCache.Get when there is no data stored
+// under a key, or it has expired.
+var ErrCacheMiss = errors.New("cache miss")
+
+// ResponseCache stores cached HTTP responses along with their indexes.
+type ResponseCache interface {
+	// Get returns data stored under the key. If there's no such key, or the
+	// data has expired, Get returns ErrCacheMiss.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Put stores the data under the key for the ttl. The data may be evicted
+	// earlier if the cache runs out of space.
+	Put(ctx context.Context, key string, data []byte, ttl time.Duration) error
+
+	// Delete removes the data stored under the key. If there's no such key in
+	// the cache, Delete returns nil.
+	Delete(ctx context.Context, key string) error
+}
+
+// SharedCacheProvider is implemented by cache providers that keep data shared
+// by all vulcand instances, e.g. in Etcd.
+type SharedCacheProvider interface {
+	T
+	GetSharedCache() SharedCache
+}
+
+// SharedCache stores small values that vulcand instances update concurrently,
+// e.g. counters of rate limits.
+type SharedCache interface {
+	// Get returns data stored under the key. If there's no such key, or the
+	// data has expired, Get returns ErrCacheMiss.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// CompareAndSwap stores the data under the key for the ttl if the key
+	// holds old data, or if there's no such key and old is nil. It returns
+	// false if the key holds other data.
+	CompareAndSwap(ctx context.Context, key string, old, data []byte, ttl time.Duration) (bool, error)
+}
+
+// hashKey turns an arbitrary cache key into one that is safe to use as an
+// etcd key or a file name.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,231 @@
+package cacheprovider
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DefaultDiskResponseCacheBytes is the default size limit of the response
+// cache kept in files.
+const DefaultDiskResponseCacheBytes = 1 << 30
+
+// diskSweepInterval is how often expired files are removed from the response
+// cache dir.
+const diskSweepInterval = time.Minute
+
+// NewDiskCacheProvider creates a cache provider that keeps data in files under
+// the dir. Expired responses are removed every minute, and so are the least
+// recently stored ones when the responses take more than maxBytes. The size
+// is not limited if maxBytes is 0.
+func NewDiskCacheProvider(dir string, maxBytes int64) T {
+	rc := newDiskResponseCache(filepath.Join(dir, "response_cache"), maxBytes, &timetools.RealTime{})
+	go rc.run()
+	return &diskCacheProvider{
+		autoCertCache: autocert.DirCache(filepath.Join(dir, "autocert_cache")),
+		responseCache: rc,
+	}
+}
+
+type diskCacheProvider struct {
+	autoCertCache autocert.Cache
+	responseCache *diskResponseCache
+}
+
+func (p *diskCacheProvider) GetAutoCertCache() autocert.Cache {
+	return p.autoCertCache
+}
+
+func (p *diskCacheProvider) GetResponseCache() ResponseCache {
+	return p.responseCache
+}
+
+// diskResponseCache stores every key in a file of its own. A file starts with
+// the expiration time in unix nanoseconds followed by the data.
+type diskResponseCache struct {
+	dir      string
+	maxBytes int64
+	clock    timetools.TimeProvider
+	// bytes is the size of the files as of the last sweep plus what has been
+	// put since then.
+	bytes int64
+	// sweepC asks for a sweep before the next one is due, when the files
+	// have grown beyond the limit.
+	sweepC chan struct{}
+}
+
+const diskExpiresBytes = 8
+
+func newDiskResponseCache(dir string, maxBytes int64, clock timetools.TimeProvider) *diskResponseCache {
+	return &diskResponseCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		clock:    clock,
+		sweepC:   make(chan struct{}, 1),
+	}
+}
+
+// Get returns data stored under the key.
+// If there's no such key, or the data has expired, Get returns ErrCacheMiss.
+func (c *diskResponseCache) Get(ctx context.Context, key string) ([]byte, error) {
+	path := c.path(key)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCacheMiss
+		}
+		return nil, err
+	}
+	if len(content) < diskExpiresBytes {
+		return nil, ErrCacheMiss
+	}
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(content)))
+	if !c.clock.UtcNow().Before(expires) {
+		os.Remove(path)
+		return nil, ErrCacheMiss
+	}
+	return content[diskExpiresBytes:], nil
+}
+
+// Put stores the data under the key for the ttl. The file is written
+// atomically, so that concurrent readers never see partial data.
+func (c *diskResponseCache) Put(ctx context.Context, key string, data []byte, ttl time.Duration) error {
+	size := int64(diskExpiresBytes + len(data))
+	// Data larger than the whole cache is not stored.
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return nil
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "tmp")
+	if err != nil {
+		return err
+	}
+	var expires [diskExpiresBytes]byte
+	binary.BigEndian.PutUint64(expires[:], uint64(c.clock.UtcNow().Add(ttl).UnixNano()))
+	_, err = f.Write(expires[:])
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if c.maxBytes > 0 && atomic.AddInt64(&c.bytes, size) > c.maxBytes {
+		select {
+		case c.sweepC <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Delete removes the data stored under the key.
+// If there's no such key in the cache, Delete returns nil.
+func (c *diskResponseCache) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// path returns a file path for the key. Files are spread over subdirectories
+// by the first byte of the key hash to keep directories reasonably small.
+func (c *diskResponseCache) path(key string) string {
+	h := hashKey(key)
+	return filepath.Join(c.dir, h[:2], h)
+}
+
+// run sweeps the dir periodically, and whenever the files grow beyond the
+// limit.
+func (c *diskResponseCache) run() {
+	ticker := time.NewTicker(diskSweepInterval)
+	defer ticker.Stop()
+	for {
+		c.sweep()
+		select {
+		case <-ticker.C:
+		case <-c.sweepC:
+		}
+	}
+}
+
+type diskFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// sweep removes files that have expired, and then the least recently stored
+// ones until the rest fit in the limit. Temporary files that are left over
+// from failed writes are removed too.
+func (c *diskResponseCache) sweep() {
+	now := c.clock.UtcNow()
+	var files []diskFile
+	var total int64
+	filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), "tmp") {
+			if now.Sub(info.ModTime()) > diskSweepInterval {
+				os.Remove(path)
+			}
+			return nil
+		}
+		if diskFileExpired(path, now) {
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, diskFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if c.maxBytes > 0 && total > c.maxBytes {
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+		for _, f := range files {
+			if total <= c.maxBytes {
+				break
+			}
+			if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+				log.Warnf("Failed to remove cached response %s: %v", f.path, err)
+				continue
+			}
+			total -= f.size
+		}
+	}
+	atomic.StoreInt64(&c.bytes, total)
+}
+
+// diskFileExpired tells whether a file has expired or is not a valid one.
+func diskFileExpired(path string, now time.Time) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var expires [diskExpiresBytes]byte
+	if _, err := io.ReadFull(f, expires[:]); err != nil {
+		return true
+	}
+	return !now.Before(time.Unix(0, int64(binary.BigEndian.Uint64(expires[:]))))
+}
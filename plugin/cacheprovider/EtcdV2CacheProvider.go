@@ -2,6 +2,7 @@ package cacheprovider
 
 import (
 	"context"
+	"time"
 
 	etcd "go.etcd.io/etcd/client/v2"
 	"golang.org/x/crypto/acme/autocert"
@@ -20,6 +21,20 @@ type etcdv2CacheProvider struct {
 	autoCertCache autocert.Cache
 }
 
+func (p *etcdv2CacheProvider) GetResponseCache() ResponseCache {
+	return &etcdv2ResponseCache{
+		kapi:   p.kapi,
+		prefix: p.vulcanPrefix + "/response_cache/",
+	}
+}
+
+func (p *etcdv2CacheProvider) GetSharedCache() SharedCache {
+	return &etcdv2SharedCache{
+		kapi:   p.kapi,
+		prefix: p.vulcanPrefix + "/shared_cache/",
+	}
+}
+
 func (p *etcdv2CacheProvider) GetAutoCertCache() autocert.Cache {
 	if p.autoCertCache == nil {
 		p.autoCertCache = &etcdv2AutoCertCache{
@@ -69,3 +84,93 @@ func (ng *etcdv2AutoCertCache) Delete(ctx context.Context, rawKey string) error
 func (ng *etcdv2AutoCertCache) normalized(key string) string {
 	return ng.prefix + key
 }
+
+type etcdv2ResponseCache struct {
+	kapi   etcd.KeysAPI
+	prefix string
+}
+
+// Get returns data stored under the key.
+// If there's no such key, or the data has expired, Get returns ErrCacheMiss.
+func (c *etcdv2ResponseCache) Get(ctx context.Context, key string) ([]byte, error) {
+	r, err := c.kapi.Get(ctx, c.prefix+hashKey(key), &etcd.GetOptions{})
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, ErrCacheMiss
+		}
+		return nil, err
+	}
+	if r.Node == nil {
+		return nil, ErrCacheMiss
+	}
+	return []byte(r.Node.Value), nil
+}
+
+// Put stores the data under the key for the ttl.
+func (c *etcdv2ResponseCache) Put(ctx context.Context, key string, data []byte, ttl time.Duration) error {
+	_, err := c.kapi.Set(ctx, c.prefix+hashKey(key), string(data), &etcd.SetOptions{TTL: etcdTTL(ttl)})
+	return err
+}
+
+// Delete removes the data stored under the key.
+// If there's no such key in the cache, Delete returns nil.
+func (c *etcdv2ResponseCache) Delete(ctx context.Context, key string) error {
+	_, err := c.kapi.Delete(ctx, c.prefix+hashKey(key), &etcd.DeleteOptions{})
+	if err != nil && etcd.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+type etcdv2SharedCache struct {
+	kapi   etcd.KeysAPI
+	prefix string
+}
+
+// Get returns data stored under the key.
+// If there's no such key, or the data has expired, Get returns ErrCacheMiss.
+func (c *etcdv2SharedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	r, err := c.kapi.Get(ctx, c.prefix+hashKey(key), &etcd.GetOptions{Quorum: true})
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, ErrCacheMiss
+		}
+		return nil, err
+	}
+	if r.Node == nil {
+		return nil, ErrCacheMiss
+	}
+	return []byte(r.Node.Value), nil
+}
+
+// CompareAndSwap stores the data under the key for the ttl if the key holds
+// old data, or if there's no such key and old is nil.
+func (c *etcdv2SharedCache) CompareAndSwap(ctx context.Context, key string, old, data []byte, ttl time.Duration) (bool, error) {
+	opts := &etcd.SetOptions{TTL: etcdTTL(ttl)}
+	if old == nil {
+		opts.PrevExist = etcd.PrevNoExist
+	} else {
+		opts.PrevExist = etcd.PrevExist
+		opts.PrevValue = string(old)
+	}
+	_, err := c.kapi.Set(ctx, c.prefix+hashKey(key), string(data), opts)
+	if err != nil {
+		if e, ok := err.(etcd.Error); ok {
+			switch e.Code {
+			case etcd.ErrorCodeTestFailed, etcd.ErrorCodeNodeExist, etcd.ErrorCodeKeyNotFound:
+				return false, nil
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// etcdTTL rounds a ttl up to whole seconds, since etcd does not support
+// finer ones.
+func etcdTTL(ttl time.Duration) time.Duration {
+	if ttl < time.Second {
+		return time.Second
+	}
+	return (ttl + time.Second - 1).Truncate(time.Second)
+}
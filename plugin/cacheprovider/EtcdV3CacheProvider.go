@@ -2,6 +2,7 @@ package cacheprovider
 
 import (
 	"context"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	etcd "go.etcd.io/etcd/client/v3"
@@ -21,6 +22,20 @@ type etcdv3CacheProvider struct {
 	autoCertCache autocert.Cache
 }
 
+func (p *etcdv3CacheProvider) GetResponseCache() ResponseCache {
+	return &etcdv3ResponseCache{
+		client: p.client,
+		prefix: p.vulcanPrefix + "/response_cache/",
+	}
+}
+
+func (p *etcdv3CacheProvider) GetSharedCache() SharedCache {
+	return &etcdv3SharedCache{
+		client: p.client,
+		prefix: p.vulcanPrefix + "/shared_cache/",
+	}
+}
+
 func (p *etcdv3CacheProvider) GetAutoCertCache() autocert.Cache {
 	if p.autoCertCache == nil {
 		p.autoCertCache = &etcdv3AutoCertCache{
@@ -74,3 +89,81 @@ func (ng *etcdv3AutoCertCache) Delete(ctx context.Context, rawKey string) error
 func (ng *etcdv3AutoCertCache) normalize(rawKey string) string {
 	return ng.prefix + rawKey
 }
+
+type etcdv3ResponseCache struct {
+	client *etcd.Client
+	prefix string
+}
+
+// Get returns data stored under the key.
+// If there's no such key, or the data has expired, Get returns ErrCacheMiss.
+func (c *etcdv3ResponseCache) Get(ctx context.Context, key string) ([]byte, error) {
+	r, err := c.client.Get(ctx, c.prefix+hashKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if r.Count == 0 {
+		return nil, ErrCacheMiss
+	}
+	return r.Kvs[0].Value, nil
+}
+
+// Put stores the data under the key for the ttl. The data is attached to a
+// lease, so that etcd removes it once the ttl is over.
+func (c *etcdv3ResponseCache) Put(ctx context.Context, key string, data []byte, ttl time.Duration) error {
+	lease, err := c.client.Grant(ctx, int64(etcdTTL(ttl)/time.Second))
+	if err != nil {
+		return err
+	}
+	_, err = c.client.Put(ctx, c.prefix+hashKey(key), string(data), etcd.WithLease(lease.ID))
+	return err
+}
+
+// Delete removes the data stored under the key.
+// If there's no such key in the cache, Delete returns nil.
+func (c *etcdv3ResponseCache) Delete(ctx context.Context, key string) error {
+	_, err := c.client.Delete(ctx, c.prefix+hashKey(key))
+	return err
+}
+
+type etcdv3SharedCache struct {
+	client *etcd.Client
+	prefix string
+}
+
+// Get returns data stored under the key.
+// If there's no such key, or the data has expired, Get returns ErrCacheMiss.
+func (c *etcdv3SharedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	r, err := c.client.Get(ctx, c.prefix+hashKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if r.Count == 0 {
+		return nil, ErrCacheMiss
+	}
+	return r.Kvs[0].Value, nil
+}
+
+// CompareAndSwap stores the data under the key for the ttl if the key holds
+// old data, or if there's no such key and old is nil. The data is attached to
+// a lease, so that etcd removes it once the ttl is over.
+func (c *etcdv3SharedCache) CompareAndSwap(ctx context.Context, key string, old, data []byte, ttl time.Duration) (bool, error) {
+	lease, err := c.client.Grant(ctx, int64(etcdTTL(ttl)/time.Second))
+	if err != nil {
+		return false, err
+	}
+	k := c.prefix + hashKey(key)
+	cmp := etcd.Compare(etcd.Value(k), "=", string(old))
+	if old == nil {
+		cmp = etcd.Compare(etcd.CreateRevision(k), "=", 0)
+	}
+	r, err := c.client.Txn(ctx).If(cmp).Then(etcd.OpPut(k, string(data), etcd.WithLease(lease.ID))).Commit()
+	if err != nil {
+		return false, err
+	}
+	if !r.Succeeded {
+		// The lease would otherwise linger until it expires.
+		c.client.Revoke(ctx, lease.ID)
+	}
+	return r.Succeeded, nil
+}
@@ -1,18 +1,35 @@
 package cacheprovider
 
 import (
+	"container/list"
 	"context"
 	"sync"
+	"time"
 
+	"github.com/mailgun/timetools"
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// DefaultMemResponseCacheBytes is the default size limit of the in-memory
+// response cache.
+const DefaultMemResponseCacheBytes = 64 << 20
+
 func NewMemCacheProvider() T {
-	return &memCacheProvider{}
+	return NewMemCacheProviderWithLimit(DefaultMemResponseCacheBytes)
+}
+
+// NewMemCacheProviderWithLimit creates an in-memory cache provider that keeps
+// up to maxBytes of cached responses, evicting the least recently used ones
+// when the limit is hit.
+func NewMemCacheProviderWithLimit(maxBytes int64) T {
+	return &memCacheProvider{
+		responseCache: newMemResponseCache(maxBytes, &timetools.RealTime{}),
+	}
 }
 
 type memCacheProvider struct {
 	autocertCache autocert.Cache
+	responseCache *memResponseCache
 }
 
 func (p *memCacheProvider) GetAutoCertCache() autocert.Cache {
@@ -24,6 +41,10 @@ func (p *memCacheProvider) GetAutoCertCache() autocert.Cache {
 	return p.autocertCache
 }
 
+func (p *memCacheProvider) GetResponseCache() ResponseCache {
+	return p.responseCache
+}
+
 type memAutoCertCache struct {
 	kv  map[string][]byte
 	mtx sync.Mutex
@@ -59,3 +80,85 @@ func (ng *memAutoCertCache) Delete(ctx context.Context, key string) error {
 	delete(ng.kv, key)
 	return nil
 }
+
+// memResponseCache is an LRU cache bounded by the total size of stored data.
+type memResponseCache struct {
+	mtx      sync.Mutex
+	clock    timetools.TimeProvider
+	maxBytes int64
+	bytes    int64
+	lru      *list.List
+	items    map[string]*list.Element
+}
+
+type memResponseCacheItem struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+func newMemResponseCache(maxBytes int64, clock timetools.TimeProvider) *memResponseCache {
+	return &memResponseCache{
+		clock:    clock,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns data stored under the key.
+// If there's no such key, or the data has expired, Get returns ErrCacheMiss.
+func (c *memResponseCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	item := e.Value.(*memResponseCacheItem)
+	if !c.clock.UtcNow().Before(item.expires) {
+		c.remove(e)
+		return nil, ErrCacheMiss
+	}
+	c.lru.MoveToFront(e)
+	return item.data, nil
+}
+
+// Put stores the data under the key for the ttl, evicting the least recently
+// used data if the cache is full. Data that is larger than the whole cache is
+// not stored.
+func (c *memResponseCache) Put(ctx context.Context, key string, data []byte, ttl time.Duration) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	size := int64(len(key) + len(data))
+	if size > c.maxBytes {
+		return nil
+	}
+	for c.bytes+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	item := &memResponseCacheItem{key: key, data: data, expires: c.clock.UtcNow().Add(ttl)}
+	c.items[key] = c.lru.PushFront(item)
+	c.bytes += size
+	return nil
+}
+
+// Delete removes the data stored under the key.
+// If there's no such key in the cache, Delete returns nil.
+func (c *memResponseCache) Delete(ctx context.Context, key string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	return nil
+}
+
+func (c *memResponseCache) remove(e *list.Element) {
+	item := c.lru.Remove(e).(*memResponseCacheItem)
+	delete(c.items, item.key)
+	c.bytes -= int64(len(item.key) + len(item.data))
+}
@@ -0,0 +1,131 @@
+package cacheprovider
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "gopkg.in/check.v1"
+)
+
+func TestCacheProvider(t *testing.T) { TestingT(t) }
+
+type ResponseCacheSuite struct {
+	clock *timetools.FreezedTime
+	ctx   context.Context
+}
+
+var _ = Suite(&ResponseCacheSuite{})
+
+func (s *ResponseCacheSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{CurrentTime: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	s.ctx = context.Background()
+}
+
+func (s *ResponseCacheSuite) TestMemEvictsLeastRecentlyUsed(c *C) {
+	rc := newMemResponseCache(12, s.clock)
+	c.Assert(rc.Put(s.ctx, "a", []byte("1234"), time.Minute), IsNil)
+	c.Assert(rc.Put(s.ctx, "b", []byte("1234"), time.Minute), IsNil)
+
+	_, err := rc.Get(s.ctx, "a")
+	c.Assert(err, IsNil)
+
+	// "b" is the least recently used one now.
+	c.Assert(rc.Put(s.ctx, "c", []byte("1234"), time.Minute), IsNil)
+	_, err = rc.Get(s.ctx, "b")
+	c.Assert(err, Equals, ErrCacheMiss)
+	data, err := rc.Get(s.ctx, "a")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "1234")
+
+	// Data larger than the whole cache is not stored.
+	c.Assert(rc.Put(s.ctx, "d", []byte("1234567890123"), time.Minute), IsNil)
+	_, err = rc.Get(s.ctx, "d")
+	c.Assert(err, Equals, ErrCacheMiss)
+	c.Assert(rc.bytes <= rc.maxBytes, Equals, true)
+}
+
+func (s *ResponseCacheSuite) TestMem(c *C) {
+	s.testResponseCache(c, newMemResponseCache(1<<20, s.clock))
+}
+
+func (s *ResponseCacheSuite) TestDisk(c *C) {
+	dir, err := ioutil.TempDir("", "vulcand-cache")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	s.testResponseCache(c, newDiskResponseCache(dir, 0, s.clock))
+}
+
+func (s *ResponseCacheSuite) TestDiskSweep(c *C) {
+	dir, err := ioutil.TempDir("", "vulcand-cache")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	// Every entry takes 12 bytes with the expiration time.
+	rc := newDiskResponseCache(dir, 24, s.clock)
+	c.Assert(rc.Put(s.ctx, "a", []byte("1234"), time.Minute), IsNil)
+	c.Assert(rc.Put(s.ctx, "b", []byte("1234"), time.Hour), IsNil)
+
+	// Expired entries are removed even if nobody reads them.
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(2 * time.Minute)
+	rc.sweep()
+	_, err = os.Stat(rc.path("a"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(rc.bytes, Equals, int64(12))
+
+	// The least recently stored entries go once the limit is hit.
+	c.Assert(rc.Put(s.ctx, "c", []byte("1234"), time.Hour), IsNil)
+	c.Assert(rc.Put(s.ctx, "d", []byte("1234"), time.Hour), IsNil)
+	for i, key := range []string{"b", "c", "d"} {
+		modTime := s.clock.CurrentTime.Add(time.Duration(i) * time.Second)
+		c.Assert(os.Chtimes(rc.path(key), modTime, modTime), IsNil)
+	}
+	c.Assert(rc.bytes, Equals, int64(36))
+	select {
+	case <-rc.sweepC:
+	default:
+		c.Fatal("expected a sweep to be requested")
+	}
+	rc.sweep()
+	_, err = rc.Get(s.ctx, "b")
+	c.Assert(err, Equals, ErrCacheMiss)
+	for _, key := range []string{"c", "d"} {
+		_, err = rc.Get(s.ctx, key)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(rc.bytes, Equals, int64(24))
+
+	// Data larger than the whole cache is not stored.
+	c.Assert(rc.Put(s.ctx, "e", []byte("12345678901234567"), time.Hour), IsNil)
+	_, err = rc.Get(s.ctx, "e")
+	c.Assert(err, Equals, ErrCacheMiss)
+}
+
+func (s *ResponseCacheSuite) testResponseCache(c *C, rc ResponseCache) {
+	_, err := rc.Get(s.ctx, "http://example.com/a")
+	c.Assert(err, Equals, ErrCacheMiss)
+
+	c.Assert(rc.Put(s.ctx, "http://example.com/a", []byte("hello"), time.Minute), IsNil)
+	data, err := rc.Get(s.ctx, "http://example.com/a")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+
+	c.Assert(rc.Put(s.ctx, "http://example.com/a", []byte("bye"), time.Minute), IsNil)
+	data, err = rc.Get(s.ctx, "http://example.com/a")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "bye")
+
+	c.Assert(rc.Delete(s.ctx, "http://example.com/a"), IsNil)
+	_, err = rc.Get(s.ctx, "http://example.com/a")
+	c.Assert(err, Equals, ErrCacheMiss)
+	c.Assert(rc.Delete(s.ctx, "http://example.com/a"), IsNil)
+
+	c.Assert(rc.Put(s.ctx, "http://example.com/b", []byte("hello"), time.Minute), IsNil)
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(time.Minute)
+	_, err = rc.Get(s.ctx, "http://example.com/b")
+	c.Assert(err, Equals, ErrCacheMiss)
+}
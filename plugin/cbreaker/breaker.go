@@ -0,0 +1,123 @@
+package cbreaker
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/cbreaker"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// breaker is a circuit breaker handler. It works the same way as the one of
+// the oxy library, but keeps its state in a circuit that can be inspected and
+// overridden.
+type breaker struct {
+	next             http.Handler
+	fallback         http.Handler
+	condition        hpredicate
+	onTripped        cbreaker.SideEffect
+	onStandby        cbreaker.SideEffect
+	fallbackDuration time.Duration
+	recoveryDuration time.Duration
+	checkPeriod      time.Duration
+	clock            timetools.TimeProvider
+	circuit          *circuit
+}
+
+func (b *breaker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if b.activateFallback(r) {
+		b.fallback.ServeHTTP(w, r)
+		return
+	}
+	start := b.clock.UtcNow()
+	pw := utils.NewProxyWriter(w)
+	b.next.ServeHTTP(pw, r)
+	b.circuit.metrics.Record(pw.StatusCode(), b.clock.UtcNow().Sub(start))
+	b.checkAndSet(r)
+}
+
+// activateFallback updates the state and tells whether the request should
+// get the fallback.
+func (b *breaker) activateFallback(r *http.Request) bool {
+	c := b.circuit
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch c.override {
+	case OverrideOpen:
+		return true
+	case OverrideClosed:
+		return false
+	}
+	now := b.clock.UtcNow()
+	switch c.current {
+	case StateTripped:
+		if now.Before(c.until) {
+			return true
+		}
+		// We have been tripped long enough, start recovering.
+		b.setState(r, StateRecovering, now, reasonFallbackOver, nil)
+		c.until = now.Add(b.recoveryDuration)
+		c.rc = newRatioController(now, b.recoveryDuration)
+		fallthrough
+	case StateRecovering:
+		if now.After(c.until) {
+			b.setState(r, StateStandby, now, reasonRecovered, nil)
+			return false
+		}
+		return !c.rc.allowRequest(now)
+	}
+	return false
+}
+
+// checkAndSet trips the breaker if the condition matches. The condition is
+// checked at most once per check period.
+func (b *breaker) checkAndSet(r *http.Request) {
+	c := b.circuit
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := b.clock.UtcNow()
+	if c.override != "" || now.Before(c.lastCheck) {
+		return
+	}
+	c.lastCheck = now.Add(b.checkPeriod)
+	if c.current == StateTripped {
+		return
+	}
+	e := &evaluation{metrics: c.metrics}
+	if !b.condition(e) {
+		return
+	}
+	plugin.RequestLog(r).Warnf("Circuit breaker tripped by %v", e.values)
+	c.until = now.Add(b.fallbackDuration)
+	b.setState(r, StateTripped, now, reasonCondition, e.values)
+	c.metrics.Reset()
+}
+
+// setState moves the circuit to the state and executes side effects of the
+// transition, it should be called with the circuit mutex held. The request is
+// the one that caused the transition.
+func (b *breaker) setState(r *http.Request, state string, now time.Time, reason string, values map[string]float64) {
+	b.circuit.transition(state, now, reason, values)
+	switch state {
+	case StateTripped:
+		b.exec(r, b.onTripped)
+	case StateStandby:
+		b.exec(r, b.onStandby)
+	}
+}
+
+func (b *breaker) exec(r *http.Request, s cbreaker.SideEffect) {
+	if s == nil {
+		return
+	}
+	logger := plugin.RequestLog(r)
+	go func() {
+		if err := s.Exec(); err != nil {
+			logger.Errorf("Circuit breaker side effect failure: %v", err)
+		}
+	}()
+}
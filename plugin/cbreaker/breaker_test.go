@@ -0,0 +1,178 @@
+package cbreaker
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+type BreakerSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&BreakerSuite{})
+
+func (s *BreakerSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *BreakerSuite) newSpec(c *C) *Spec {
+	spec, err := NewSpec(
+		`ResponseCodeRatio(500, 600, 0, 600) > 0.5`,
+		`{"Type": "response", "Action": {"StatusCode": 400, "Body": "Come back later"}}`,
+		nil, nil, 10*time.Second, 10*time.Second, 0)
+	c.Assert(err, IsNil)
+	spec.clock = s.clock
+	return spec
+}
+
+// failing is a backend that fails every request.
+var failing = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusInternalServerError)
+})
+
+func get(h http.Handler) int {
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, httptest.NewRequest(http.MethodGet, "http://example.com", nil))
+	return re.Code
+}
+
+func (s *BreakerSuite) TestTransitions(c *C) {
+	env := plugin.Env{FrontendId: "f1", MiddlewareId: "transitions"}
+	h, err := s.newSpec(c).NewHandlerWithEnv(failing, env)
+	c.Assert(err, IsNil)
+
+	c.Assert(GetState("f1", "transitions").State, Equals, StateStandby)
+
+	// The first failure trips the breaker, requests get the fallback.
+	c.Assert(get(h), Equals, http.StatusInternalServerError)
+	c.Assert(get(h), Equals, http.StatusBadRequest)
+	trippedAt := s.clock.CurrentTime
+	values := map[string]float64{"ResponseCodeRatio(500, 600, 0, 600)": 1}
+	st := GetState("f1", "transitions")
+	c.Assert(st.State, Equals, StateTripped)
+	c.Assert(st.Since, Equals, trippedAt)
+	c.Assert(st.TrippedBy, DeepEquals, values)
+
+	// Once the fallback duration is over the breaker is recovering and lets
+	// the traffic back gradually.
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(15 * time.Second)
+	recoveringAt := s.clock.CurrentTime
+	c.Assert(get(h), Equals, http.StatusBadRequest)
+	c.Assert(GetState("f1", "transitions").State, Equals, StateRecovering)
+
+	// The state survives the frontend rebuilding the handler, and with the
+	// backend fixed the breaker stands by again.
+	h, err = s.newSpec(c).NewHandlerWithEnv(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), env)
+	c.Assert(err, IsNil)
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(11 * time.Second)
+	c.Assert(get(h), Equals, http.StatusOK)
+
+	st = GetState("f1", "transitions")
+	c.Assert(st.State, Equals, StateStandby)
+	c.Assert(st.TrippedBy, DeepEquals, values)
+	c.Assert(st.History, DeepEquals, []Transition{
+		{From: StateStandby, To: StateTripped, Time: trippedAt, Reason: reasonCondition, Values: values},
+		{From: StateTripped, To: StateRecovering, Time: recoveringAt, Reason: reasonFallbackOver},
+		{From: StateRecovering, To: StateStandby, Time: recoveringAt.Add(11 * time.Second), Reason: reasonRecovered},
+	})
+}
+
+func (s *BreakerSuite) TestTripLogHasRequestId(c *C) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	h, err := s.newSpec(c).NewHandler(failing)
+	c.Assert(err, IsNil)
+	r := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	h.ServeHTTP(httptest.NewRecorder(), plugin.WithRequestId(r, "req-1"))
+
+	e := hook.LastEntry()
+	c.Assert(e, NotNil)
+	c.Assert(e.Message, Matches, "Circuit breaker tripped by .*")
+	c.Assert(e.Data[plugin.RequestIdLogField], Equals, "req-1")
+}
+
+func (s *BreakerSuite) TestOverrides(c *C) {
+	h, err := s.newSpec(c).NewHandlerWithEnv(failing, plugin.Env{FrontendId: "f1", MiddlewareId: "overrides"})
+	c.Assert(err, IsNil)
+
+	// Forced closed, the breaker lets failing requests through.
+	st, err := SetOverride("f1", "overrides", OverrideClosed)
+	c.Assert(err, IsNil)
+	c.Assert(st.Override, Equals, OverrideClosed)
+	for i := 0; i < 3; i++ {
+		c.Assert(get(h), Equals, http.StatusInternalServerError)
+	}
+
+	// Forced open, all requests get the fallback.
+	st, err = SetOverride("f1", "overrides", OverrideOpen)
+	c.Assert(err, IsNil)
+	c.Assert(st.State, Equals, StateTripped)
+	c.Assert(get(h), Equals, http.StatusBadRequest)
+
+	// Cleared, the condition decides again.
+	st, err = SetOverride("f1", "overrides", "")
+	c.Assert(err, IsNil)
+	c.Assert(st.State, Equals, StateStandby)
+	c.Assert(st.Override, Equals, "")
+	c.Assert(get(h), Equals, http.StatusInternalServerError)
+	c.Assert(get(h), Equals, http.StatusBadRequest)
+
+	var reasons []string
+	for _, t := range GetState("f1", "overrides").History {
+		reasons = append(reasons, t.Reason)
+	}
+	c.Assert(reasons, DeepEquals, []string{reasonForcedClosed, reasonForcedOpen, reasonOverrideCleared, reasonCondition})
+
+	_, err = SetOverride("f1", "overrides", "ajar")
+	c.Assert(err, NotNil)
+}
+
+func (s *BreakerSuite) TestHistoryIsBounded(c *C) {
+	for i := 0; i < maxHistory+10; i++ {
+		override := OverrideOpen
+		if i%2 == 1 {
+			override = OverrideClosed
+		}
+		_, err := SetOverride("f1", "history", override)
+		c.Assert(err, IsNil)
+	}
+	history := GetState("f1", "history").History
+	c.Assert(len(history), Equals, maxHistory)
+	c.Assert(history[len(history)-1].Reason, Equals, reasonForcedClosed)
+}
+
+// Handlers created without the environment keep state of their own.
+func (s *BreakerSuite) TestNoEnv(c *C) {
+	spec := s.newSpec(c)
+	h1, err := spec.NewHandler(failing)
+	c.Assert(err, IsNil)
+	h2, err := spec.NewHandler(failing)
+	c.Assert(err, IsNil)
+
+	c.Assert(get(h1), Equals, http.StatusInternalServerError)
+	c.Assert(get(h1), Equals, http.StatusBadRequest)
+	c.Assert(get(h2), Equals, http.StatusInternalServerError)
+	c.Assert(GetState("", "").State, Equals, StateStandby)
+}
+
+func (s *BreakerSuite) TestConditionValues(c *C) {
+	p, err := parseExpression(`NetworkErrorRatio() > 0.5 || LatencyAtQuantileMS(50.0) > 10`)
+	c.Assert(err, IsNil)
+	e := &evaluation{metrics: newCircuit().metrics}
+	for i := 0; i < 4; i++ {
+		e.metrics.Record(http.StatusOK, 20*time.Millisecond)
+	}
+	c.Assert(p(e), Equals, true)
+	c.Assert(fmt.Sprint(e.values), Equals, "map[LatencyAtQuantileMS(50):20 NetworkErrorRatio():0]")
+}
@@ -0,0 +1,256 @@
+package cbreaker
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/predicate"
+)
+
+// evaluation is a single check of the condition against the metrics. It
+// remembers the values of the metrics that the condition looked at, so that
+// it can be told what tripped the breaker.
+type evaluation struct {
+	metrics *memmetrics.RTMetrics
+	values  map[string]float64
+}
+
+func (e *evaluation) record(name string, value float64) {
+	if e.values == nil {
+		e.values = make(map[string]float64)
+	}
+	e.values[name] = value
+}
+
+type hpredicate func(*evaluation) bool
+
+// parseExpression parses expression in the go language into predicates.
+func parseExpression(in string) (hpredicate, error) {
+	p, err := predicate.NewParser(predicate.Def{
+		Operators: predicate.Operators{
+			AND: and,
+			OR:  or,
+			EQ:  eq,
+			NEQ: neq,
+			LT:  lt,
+			LE:  le,
+			GT:  gt,
+			GE:  ge,
+		},
+		Functions: map[string]interface{}{
+			"LatencyAtQuantileMS": latencyAtQuantile,
+			"NetworkErrorRatio":   networkErrorRatio,
+			"ResponseCodeRatio":   responseCodeRatio,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	out, err := p.Parse(in)
+	if err != nil {
+		return nil, err
+	}
+	pr, ok := out.(hpredicate)
+	if !ok {
+		return nil, fmt.Errorf("expected predicate, got %T", out)
+	}
+	return pr, nil
+}
+
+type toInt func(e *evaluation) int
+
+type toFloat64 func(e *evaluation) float64
+
+func latencyAtQuantile(quantile float64) toInt {
+	return func(e *evaluation) int {
+		h, err := e.metrics.LatencyHistogram()
+		if err != nil {
+			log.Errorf("Failed to get latency histogram: %v", err)
+			return 0
+		}
+		value := int(h.LatencyAtQuantile(quantile) / time.Millisecond)
+		e.record(fmt.Sprintf("LatencyAtQuantileMS(%v)", quantile), float64(value))
+		return value
+	}
+}
+
+func networkErrorRatio() toFloat64 {
+	return func(e *evaluation) float64 {
+		value := e.metrics.NetworkErrorRatio()
+		e.record("NetworkErrorRatio()", value)
+		return value
+	}
+}
+
+func responseCodeRatio(startA, endA, startB, endB int) toFloat64 {
+	return func(e *evaluation) float64 {
+		value := e.metrics.ResponseCodeRatio(startA, endA, startB, endB)
+		e.record(fmt.Sprintf("ResponseCodeRatio(%d, %d, %d, %d)", startA, endA, startB, endB), value)
+		return value
+	}
+}
+
+// or returns predicate by joining the passed predicates with logical 'or'.
+func or(fns ...hpredicate) hpredicate {
+	return func(e *evaluation) bool {
+		for _, fn := range fns {
+			if fn(e) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// and returns predicate by joining the passed predicates with logical 'and'.
+func and(fns ...hpredicate) hpredicate {
+	return func(e *evaluation) bool {
+		for _, fn := range fns {
+			if !fn(e) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// not creates negation of the passed predicate.
+func not(p hpredicate) hpredicate {
+	return func(e *evaluation) bool {
+		return !p(e)
+	}
+}
+
+// eq returns predicate that tests for equality of the value of the mapper and the constant.
+func eq(m interface{}, value interface{}) (hpredicate, error) {
+	switch mapper := m.(type) {
+	case toInt:
+		return intEQ(mapper, value)
+	case toFloat64:
+		return float64EQ(mapper, value)
+	}
+	return nil, fmt.Errorf("eq: unsupported argument: %T", m)
+}
+
+// neq returns predicate that tests for inequality of the value of the mapper and the constant.
+func neq(m interface{}, value interface{}) (hpredicate, error) {
+	p, err := eq(m, value)
+	if err != nil {
+		return nil, err
+	}
+	return not(p), nil
+}
+
+// lt returns predicate that tests that value of the mapper function is less than the constant.
+func lt(m interface{}, value interface{}) (hpredicate, error) {
+	switch mapper := m.(type) {
+	case toInt:
+		return intLT(mapper, value)
+	case toFloat64:
+		return float64LT(mapper, value)
+	}
+	return nil, fmt.Errorf("lt: unsupported argument: %T", m)
+}
+
+// le returns predicate that tests that value of the mapper function is less or equal than the constant.
+func le(m interface{}, value interface{}) (hpredicate, error) {
+	l, err := lt(m, value)
+	if err != nil {
+		return nil, err
+	}
+	e, err := eq(m, value)
+	if err != nil {
+		return nil, err
+	}
+	return func(ev *evaluation) bool {
+		return l(ev) || e(ev)
+	}, nil
+}
+
+// gt returns predicate that tests that value of the mapper function is greater than the constant.
+func gt(m interface{}, value interface{}) (hpredicate, error) {
+	switch mapper := m.(type) {
+	case toInt:
+		return intGT(mapper, value)
+	case toFloat64:
+		return float64GT(mapper, value)
+	}
+	return nil, fmt.Errorf("gt: unsupported argument: %T", m)
+}
+
+// ge returns predicate that tests that value of the mapper function is greater or equal than the constant.
+func ge(m interface{}, value interface{}) (hpredicate, error) {
+	g, err := gt(m, value)
+	if err != nil {
+		return nil, err
+	}
+	e, err := eq(m, value)
+	if err != nil {
+		return nil, err
+	}
+	return func(ev *evaluation) bool {
+		return g(ev) || e(ev)
+	}, nil
+}
+
+func intEQ(m toInt, val interface{}) (hpredicate, error) {
+	value, ok := val.(int)
+	if !ok {
+		return nil, fmt.Errorf("expected int, got %T", val)
+	}
+	return func(e *evaluation) bool {
+		return m(e) == value
+	}, nil
+}
+
+func float64EQ(m toFloat64, val interface{}) (hpredicate, error) {
+	value, ok := val.(float64)
+	if !ok {
+		return nil, fmt.Errorf("expected float64, got %T", val)
+	}
+	return func(e *evaluation) bool {
+		return m(e) == value
+	}, nil
+}
+
+func intLT(m toInt, val interface{}) (hpredicate, error) {
+	value, ok := val.(int)
+	if !ok {
+		return nil, fmt.Errorf("expected int, got %T", val)
+	}
+	return func(e *evaluation) bool {
+		return m(e) < value
+	}, nil
+}
+
+func intGT(m toInt, val interface{}) (hpredicate, error) {
+	value, ok := val.(int)
+	if !ok {
+		return nil, fmt.Errorf("expected int, got %T", val)
+	}
+	return func(e *evaluation) bool {
+		return m(e) > value
+	}, nil
+}
+
+func float64LT(m toFloat64, val interface{}) (hpredicate, error) {
+	value, ok := val.(float64)
+	if !ok {
+		return nil, fmt.Errorf("expected float64, got %T", val)
+	}
+	return func(e *evaluation) bool {
+		return m(e) < value
+	}, nil
+}
+
+func float64GT(m toFloat64, val interface{}) (hpredicate, error) {
+	value, ok := val.(float64)
+	if !ok {
+		return nil, fmt.Errorf("expected float64, got %T", val)
+	}
+	return func(e *evaluation) bool {
+		return m(e) > value
+	}, nil
+}
@@ -21,6 +21,9 @@
 // It is possible to define actions of transitions (Standby -> Tripped) and (Recovering -> Standby)
 // using handlers 'OnTripped' and 'OnStandby', e.g. issuing webhook calls.
 //
+// The state of a circuit breaker, along with recent transitions, can be inspected via the API, where
+// a circuit breaker can also be forced open or closed.
+//
 
 package cbreaker
 
@@ -29,6 +32,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/mailgun/timetools"
 	"github.com/urfave/cli"
 	"github.com/vulcand/oxy/cbreaker"
 	"github.com/vulcand/vulcand/plugin"
@@ -65,9 +69,16 @@ type Spec struct {
 
 	// CheckPeriod defines the period between circuit breaker checks
 	CheckPeriod time.Duration
+
+	clock timetools.TimeProvider
 }
 
-func fromSpec(spec *Spec, next http.Handler) (*cbreaker.CircuitBreaker, error) {
+func fromSpec(spec *Spec, next http.Handler, c *circuit) (*breaker, error) {
+	condition, err := parseExpression(spec.Condition)
+	if err != nil {
+		return nil, err
+	}
+
 	b, err := toBytes(spec.Fallback)
 	if err != nil {
 		return nil, err
@@ -106,18 +117,36 @@ func fromSpec(spec *Spec, next http.Handler) (*cbreaker.CircuitBreaker, error) {
 		}
 	}
 
-	return cbreaker.New(next, spec.Condition,
-		cbreaker.Fallback(fallback),
-		cbreaker.FallbackDuration(spec.FallbackDuration),
-		cbreaker.RecoveryDuration(spec.RecoveryDuration),
-		cbreaker.OnTripped(onTripped),
-		cbreaker.OnStandby(onStandby),
-		cbreaker.CheckPeriod(spec.CheckPeriod))
+	return &breaker{
+		next:             next,
+		fallback:         fallback,
+		condition:        condition,
+		onTripped:        onTripped,
+		onStandby:        onStandby,
+		fallbackDuration: spec.FallbackDuration,
+		recoveryDuration: spec.RecoveryDuration,
+		checkPeriod:      spec.CheckPeriod,
+		clock:            spec.clock,
+		circuit:          c,
+	}, nil
 }
 
 // NewMiddleware vulcan library compatible middleware
 func (c *Spec) NewHandler(next http.Handler) (http.Handler, error) {
-	return fromSpec(c, next)
+	return fromSpec(c, next, newCircuit())
+}
+
+// NewHandlerWithEnv returns a handler that keeps its state in memory of the
+// process under the frontend and middleware ids, so that the state survives
+// updates of the frontend and can be reached via the API.
+func (c *Spec) NewHandlerWithEnv(next http.Handler, env plugin.Env) (http.Handler, error) {
+	return fromSpec(c, next, defaultCircuits.get(env.FrontendId, env.MiddlewareId))
+}
+
+// Release drops the state kept under the frontend and middleware ids, it is
+// called when the breaker is deleted or its settings change.
+func (c *Spec) Release(env plugin.Env) {
+	defaultCircuits.delete(env.FrontendId, env.MiddlewareId)
 }
 
 // NewSpec check parameters and returns new specification for the middleware
@@ -130,8 +159,9 @@ func NewSpec(condition string, fallback, onTripped, onStandby interface{}, fallb
 		RecoveryDuration: recoveryDuration,
 		FallbackDuration: fallbackDuration,
 		CheckPeriod:      checkPeriod,
+		clock:            &timetools.RealTime{},
 	}
-	if _, err := fromSpec(spec, nil); err != nil {
+	if _, err := fromSpec(spec, nil, newCircuit()); err != nil {
 		return nil, err
 	}
 	return spec, nil
@@ -0,0 +1,228 @@
+package cbreaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+// States of a circuit breaker.
+const (
+	StateStandby    = "standby"
+	StateTripped    = "tripped"
+	StateRecovering = "recovering"
+)
+
+// Overrides that force a circuit breaker into a state regardless of the
+// condition.
+const (
+	OverrideOpen   = "open"
+	OverrideClosed = "closed"
+)
+
+// Reasons of transitions.
+const (
+	reasonCondition       = "condition"
+	reasonFallbackOver    = "fallback duration is over"
+	reasonRecovered       = "recovery duration is over"
+	reasonForcedOpen      = "forced open"
+	reasonForcedClosed    = "forced closed"
+	reasonOverrideCleared = "override cleared"
+)
+
+// maxHistory is how many transitions a circuit breaker remembers.
+const maxHistory = 50
+
+// State describes a circuit breaker middleware of a frontend.
+type State struct {
+	// State is one of standby, tripped or recovering
+	State string
+	// Since is the time of the last transition, it is zero for breakers that
+	// have been in standby from the very beginning
+	Since time.Time
+	// Override is 'open' or 'closed' if the breaker is forced into a state
+	Override string `json:",omitempty"`
+	// TrippedBy holds values of the condition metrics that tripped the
+	// breaker the last time
+	TrippedBy map[string]float64 `json:",omitempty"`
+	// History lists recent transitions from the oldest to the newest
+	History []Transition
+}
+
+// Transition is a change of the circuit breaker state.
+type Transition struct {
+	From   string
+	To     string
+	Time   time.Time
+	Reason string
+	// Values holds values of the condition metrics for transitions caused
+	// by the condition
+	Values map[string]float64 `json:",omitempty"`
+}
+
+// GetState returns the state of a circuit breaker middleware of a frontend.
+// Breakers that have not handled any requests yet are in standby.
+func GetState(frontendId, middlewareId string) State {
+	return defaultCircuits.get(frontendId, middlewareId).state()
+}
+
+// SetOverride forces a circuit breaker middleware of a frontend open, so that
+// all requests get the fallback, or closed, so that all requests go through
+// whatever the condition says. An empty override lets the condition decide
+// again. Overrides are kept in memory of the vulcand process, and they are
+// dropped along with the rest of the state when the breaker is deleted or its
+// settings change.
+func SetOverride(frontendId, middlewareId, override string) (State, error) {
+	switch override {
+	case "", OverrideOpen, OverrideClosed:
+	default:
+		return State{}, fmt.Errorf("unsupported override %q, expected %s, %s or empty", override, OverrideOpen, OverrideClosed)
+	}
+	c := defaultCircuits.get(frontendId, middlewareId)
+	c.setOverride(override, defaultCircuits.clock.UtcNow())
+	return c.state(), nil
+}
+
+// circuits keeps circuits of breaker middlewares by frontend and middleware
+// ids, so that the state of a breaker survives updates of frontends and can
+// be reached via the API.
+type circuits struct {
+	mutex    sync.Mutex
+	circuits map[string]*circuit
+	clock    timetools.TimeProvider
+}
+
+var defaultCircuits = &circuits{circuits: make(map[string]*circuit), clock: &timetools.RealTime{}}
+
+func (cs *circuits) get(frontendId, middlewareId string) *circuit {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	key := circuitKey(frontendId, middlewareId)
+	c, ok := cs.circuits[key]
+	if !ok {
+		c = newCircuit()
+		cs.circuits[key] = c
+	}
+	return c
+}
+
+// delete forgets the circuit, so that a breaker created again under the same
+// ids starts in standby with no override and history.
+func (cs *circuits) delete(frontendId, middlewareId string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.circuits, circuitKey(frontendId, middlewareId))
+}
+
+func circuitKey(frontendId, middlewareId string) string {
+	return frontendId + "/" + middlewareId
+}
+
+// circuit is the state of a circuit breaker.
+type circuit struct {
+	mutex     sync.Mutex
+	metrics   *memmetrics.RTMetrics
+	current   string
+	since     time.Time
+	until     time.Time
+	rc        *ratioController
+	lastCheck time.Time
+	override  string
+	trippedBy map[string]float64
+	history   []Transition
+}
+
+func newCircuit() *circuit {
+	// RTMetrics with default settings never fails to be created.
+	metrics, _ := memmetrics.NewRTMetrics()
+	return &circuit{metrics: metrics, current: StateStandby}
+}
+
+func (c *circuit) state() State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return State{
+		State:     c.current,
+		Since:     c.since,
+		Override:  c.override,
+		TrippedBy: c.trippedBy,
+		History:   append([]Transition(nil), c.history...),
+	}
+}
+
+// transition moves the circuit to the state and remembers the transition,
+// it should be called with the mutex held.
+func (c *circuit) transition(to string, now time.Time, reason string, values map[string]float64) {
+	c.history = append(c.history, Transition{From: c.current, To: to, Time: now, Reason: reason, Values: values})
+	if len(c.history) > maxHistory {
+		c.history = append([]Transition(nil), c.history[len(c.history)-maxHistory:]...)
+	}
+	if to == StateTripped && values != nil {
+		c.trippedBy = values
+	}
+	c.current = to
+	c.since = now
+}
+
+func (c *circuit) setOverride(override string, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if override == c.override {
+		return
+	}
+	c.override = override
+	switch override {
+	case OverrideOpen:
+		c.transition(StateTripped, now, reasonForcedOpen, nil)
+	case OverrideClosed:
+		c.transition(StateStandby, now, reasonForcedClosed, nil)
+	default:
+		c.transition(StateStandby, now, reasonOverrideCleared, nil)
+	}
+	// Metrics collected before the override say nothing about what happens
+	// after it.
+	c.metrics.Reset()
+}
+
+// ratioController allows passing portions traffic back to the endpoints,
+// increasing the amount of passed requests using linear function:
+//
+//	allowedRequestsRatio = 0.5 * (Now() - Start())/Duration
+type ratioController struct {
+	duration time.Duration
+	start    time.Time
+	allowed  int
+	denied   int
+}
+
+func newRatioController(start time.Time, rampUp time.Duration) *ratioController {
+	return &ratioController{duration: rampUp, start: start}
+}
+
+func (r *ratioController) allowRequest(now time.Time) bool {
+	// Would we satisfy the target ratio if we allowed this request?
+	if r.computeRatio(r.allowed+1, r.denied) < r.targetRatio(now) {
+		r.allowed++
+		return true
+	}
+	r.denied++
+	return false
+}
+
+func (r *ratioController) computeRatio(allowed, denied int) float64 {
+	if denied+allowed == 0 {
+		return 0
+	}
+	return float64(allowed) / float64(denied+allowed)
+}
+
+func (r *ratioController) targetRatio(now time.Time) float64 {
+	// The ratio of allowed requests a / (a + d) reaches 0.5 when a = d, that
+	// is an equilibrium where all requests after this point would have to be
+	// allowed to reach 1, so the ramp stops there.
+	multiplier := 0.5 / float64(r.duration)
+	return multiplier * float64(now.Sub(r.start))
+}
@@ -0,0 +1,140 @@
+package collapse
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "collapse"
+
+const (
+	// DefaultMaxResponseBytes is the default max size of a response that can
+	// be shared between collapsed requests.
+	DefaultMaxResponseBytes = 1 << 20
+	// DefaultTimeout is how long requests wait for a response to a request
+	// they are collapsed with by default.
+	DefaultTimeout = 10 * time.Second
+)
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// Collapse merges concurrent identical GET and HEAD requests into one upstream
+// call, and gives every waiting client the same response. Requests are
+// identical if they have the same method, URL and values of the key headers.
+// Requests with credentials, i.e. Authorization or Cookie headers, are only
+// collapsed if the headers are part of the key.
+type Collapse struct {
+	// Headers are request headers that are part of the key along with the
+	// method and the URL, e.g. Accept-Encoding.
+	Headers []string
+	// MaxResponseBytes is the max size of a response body that can be shared.
+	// Waiting requests are forwarded on their own if a response is larger.
+	MaxResponseBytes int64
+	// MaxWaiters is the max number of requests that can wait for a single
+	// upstream call, unlimited if 0. Requests over the limit are forwarded on
+	// their own.
+	MaxWaiters int
+	// Timeout is how long requests wait for an upstream call before they are
+	// forwarded on their own, e.g. "5s".
+	Timeout string
+
+	timeout time.Duration
+}
+
+// NewCollapse validates settings and returns a request collapsing middleware.
+func NewCollapse(c Collapse) (*Collapse, error) {
+	if c.MaxResponseBytes < 0 {
+		return nil, fmt.Errorf("max response bytes should be >= 0, got %d", c.MaxResponseBytes)
+	}
+	if c.MaxWaiters < 0 {
+		return nil, fmt.Errorf("max waiters should be >= 0, got %d", c.MaxWaiters)
+	}
+	for _, name := range c.Headers {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("header name can not be empty")
+		}
+	}
+	c.timeout = DefaultTimeout
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %v", c.Timeout, err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("timeout should be > 0, got %s", c.Timeout)
+		}
+		c.timeout = timeout
+	}
+	return &c, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (c *Collapse) NewHandler(next http.Handler) (http.Handler, error) {
+	return c.NewHandlerWithEnv(next, plugin.Env{})
+}
+
+// NewHandlerWithEnv returns a handler that counts collapsed requests in the
+// collapsed metric of the middleware.
+func (c *Collapse) NewHandlerWithEnv(next http.Handler, env plugin.Env) (http.Handler, error) {
+	maxResponseBytes := c.MaxResponseBytes
+	if maxResponseBytes == 0 {
+		maxResponseBytes = DefaultMaxResponseBytes
+	}
+	headers := make([]string, len(c.Headers))
+	for i, name := range c.Headers {
+		headers[i] = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	}
+	return &handler{
+		next:             next,
+		env:              env,
+		headers:          headers,
+		maxResponseBytes: maxResponseBytes,
+		maxWaiters:       c.MaxWaiters,
+		timeout:          c.timeout,
+		calls:            make(map[string]*call),
+	}, nil
+}
+
+func (c *Collapse) String() string {
+	return fmt.Sprintf("headers=%s, maxResponseBytes=%d, maxWaiters=%d, timeout=%s",
+		strings.Join(c.Headers, ","), c.MaxResponseBytes, c.MaxWaiters, c.timeout)
+}
+
+func FromOther(c Collapse) (plugin.Middleware, error) {
+	return NewCollapse(c)
+}
+
+// FromCli constructs the middleware from the command line.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	var timeout string
+	if d := c.Duration("timeout"); d != 0 {
+		timeout = d.String()
+	}
+	return NewCollapse(Collapse{
+		Headers:          c.StringSlice("header"),
+		MaxResponseBytes: int64(c.Int("maxResponseKB")) * 1024,
+		MaxWaiters:       c.Int("maxWaiters"),
+		Timeout:          timeout,
+	})
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{Name: "header", Value: &cli.StringSlice{}, Usage: "request header that is part of the key, e.g. Accept-Encoding"},
+		cli.IntFlag{Name: "maxResponseKB", Usage: "max size of a response that can be shared, in KB"},
+		cli.IntFlag{Name: "maxWaiters", Usage: "max number of requests that can wait for a single upstream call, unlimited if 0"},
+		cli.DurationFlag{Name: "timeout", Usage: "how long requests wait for an upstream call before they are forwarded on their own"},
+	}
+}
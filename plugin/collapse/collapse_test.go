@@ -0,0 +1,320 @@
+package collapse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestCollapse(t *testing.T) { TestingT(t) }
+
+type CollapseSuite struct{}
+
+var _ = Suite(&CollapseSuite{})
+
+// Make sure the spec is compatible and will be accepted by middleware registry
+func (s *CollapseSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *CollapseSuite) TestNewCollapseBadParams(c *C) {
+	_, err := NewCollapse(Collapse{MaxResponseBytes: -1})
+	c.Assert(err, NotNil)
+
+	_, err = NewCollapse(Collapse{MaxWaiters: -1})
+	c.Assert(err, NotNil)
+
+	_, err = NewCollapse(Collapse{Headers: []string{" "}})
+	c.Assert(err, NotNil)
+
+	_, err = NewCollapse(Collapse{Timeout: "soon"})
+	c.Assert(err, NotNil)
+
+	_, err = NewCollapse(Collapse{Timeout: "0s"})
+	c.Assert(err, NotNil)
+}
+
+func (s *CollapseSuite) TestNewCollapseFromOther(c *C) {
+	cl, err := NewCollapse(Collapse{Headers: []string{"Accept-Encoding"}, MaxResponseBytes: 1024, MaxWaiters: 10, Timeout: "5s"})
+	c.Assert(err, IsNil)
+	c.Assert(cl.String(), Not(Equals), "")
+
+	out, err := FromOther(*cl)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, cl)
+}
+
+func (s *CollapseSuite) TestNewCollapseFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		cl := out.(*Collapse)
+		c.Assert(cl.Headers, DeepEquals, []string{"Accept-Encoding", "Accept-Language"})
+		c.Assert(cl.MaxResponseBytes, Equals, int64(2048))
+		c.Assert(cl.MaxWaiters, Equals, 5)
+		c.Assert(cl.Timeout, Equals, "3s")
+		c.Assert(cl.timeout, Equals, 3*time.Second)
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--header=Accept-Encoding", "--header=Accept-Language", "--maxResponseKB=2", "--maxWaiters=5", "--timeout=3s"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *CollapseSuite) TestCollapsesConcurrentRequests(c *C) {
+	b := newBackend("hello")
+	h := newHandler(c, Collapse{}, b)
+
+	leader := serveAsync(h, get("/a"))
+	<-b.started
+	followers := make([]<-chan *httptest.ResponseRecorder, 3)
+	for i := range followers {
+		followers[i] = serveAsync(h, get("/a"))
+	}
+	waitForWaiters(c, h, 3)
+	close(b.release)
+
+	re := <-leader
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Body.String(), Equals, "hello")
+	for _, f := range followers {
+		re := <-f
+		c.Assert(re.Code, Equals, http.StatusOK)
+		c.Assert(re.Body.String(), Equals, "hello")
+		c.Assert(re.Header().Get("X-Backend"), Equals, "yes")
+	}
+	c.Assert(atomic.LoadInt64(&b.calls), Equals, int64(1))
+	c.Assert(atomic.LoadInt64(&h.collapsed), Equals, int64(3))
+
+	// Requests that come in after the call is done go upstream
+	re = serve(h, get("/a"))
+	c.Assert(re.Body.String(), Equals, "hello")
+	c.Assert(atomic.LoadInt64(&b.calls), Equals, int64(2))
+}
+
+func (s *CollapseSuite) TestDifferentRequestsAreNotCollapsed(c *C) {
+	b := newBackend("hello")
+	h := newHandler(c, Collapse{Headers: []string{"accept-encoding"}}, b)
+
+	leader := serveAsync(h, get("/a"))
+	<-b.started
+
+	others := []*http.Request{get("/b"), get("/a?q=1"), get("/a"), get("/a"), post("/a")}
+	others[2].Header.Set("Accept-Encoding", "gzip")
+	others[3].Header.Set("Authorization", "Bearer token")
+	var results []<-chan *httptest.ResponseRecorder
+	for _, r := range others {
+		results = append(results, serveAsync(h, r))
+		<-b.started
+	}
+	close(b.release)
+
+	<-leader
+	for _, r := range results {
+		c.Assert((<-r).Body.String(), Equals, "hello")
+	}
+	c.Assert(atomic.LoadInt64(&b.calls), Equals, int64(6))
+	c.Assert(atomic.LoadInt64(&h.collapsed), Equals, int64(0))
+}
+
+func (s *CollapseSuite) TestKeyHeaderCredentials(c *C) {
+	b := newBackend("hello")
+	h := newHandler(c, Collapse{Headers: []string{"Authorization"}}, b)
+
+	first, second := get("/a"), get("/a")
+	first.Header.Set("Authorization", "Bearer token")
+	second.Header.Set("Authorization", "Bearer token")
+
+	leader := serveAsync(h, first)
+	<-b.started
+	follower := serveAsync(h, second)
+	waitForWaiters(c, h, 1)
+	close(b.release)
+
+	<-leader
+	c.Assert((<-follower).Body.String(), Equals, "hello")
+	c.Assert(atomic.LoadInt64(&b.calls), Equals, int64(1))
+}
+
+func (s *CollapseSuite) TestMaxWaiters(c *C) {
+	b := newBackend("hello")
+	h := newHandler(c, Collapse{MaxWaiters: 1}, b)
+
+	leader := serveAsync(h, get("/a"))
+	<-b.started
+	follower := serveAsync(h, get("/a"))
+	waitForWaiters(c, h, 1)
+
+	// The request over the limit goes upstream on its own
+	extra := serveAsync(h, get("/a"))
+	<-b.started
+	close(b.release)
+
+	<-leader
+	c.Assert((<-follower).Body.String(), Equals, "hello")
+	c.Assert((<-extra).Body.String(), Equals, "hello")
+	c.Assert(atomic.LoadInt64(&b.calls), Equals, int64(2))
+	c.Assert(atomic.LoadInt64(&h.collapsed), Equals, int64(1))
+}
+
+func (s *CollapseSuite) TestLargeResponsesAreNotShared(c *C) {
+	b := newBackend(strings.Repeat("a", 100))
+	h := newHandler(c, Collapse{MaxResponseBytes: 10}, b)
+
+	leader := serveAsync(h, get("/a"))
+	<-b.started
+	follower := serveAsync(h, get("/a"))
+	waitForWaiters(c, h, 1)
+	close(b.release)
+
+	c.Assert((<-leader).Body.Len(), Equals, 100)
+	c.Assert((<-follower).Body.Len(), Equals, 100)
+	c.Assert(atomic.LoadInt64(&b.calls), Equals, int64(2))
+	c.Assert(atomic.LoadInt64(&h.collapsed), Equals, int64(0))
+}
+
+func (s *CollapseSuite) TestResponsesWithCookiesAreNotShared(c *C) {
+	b := newBackend("hello")
+	b.header.Set("Set-Cookie", "session=1")
+	h := newHandler(c, Collapse{}, b)
+
+	leader := serveAsync(h, get("/a"))
+	<-b.started
+	follower := serveAsync(h, get("/a"))
+	waitForWaiters(c, h, 1)
+	close(b.release)
+
+	<-leader
+	c.Assert((<-follower).Body.String(), Equals, "hello")
+	c.Assert(atomic.LoadInt64(&b.calls), Equals, int64(2))
+}
+
+func (s *CollapseSuite) TestTimeout(c *C) {
+	b := newBackend("hello")
+	h := newHandler(c, Collapse{Timeout: "10ms"}, b)
+
+	leader := serveAsync(h, get("/a"))
+	<-b.started
+	follower := serveAsync(h, get("/a"))
+	// The follower gives up waiting and goes upstream on its own
+	<-b.started
+	close(b.release)
+
+	<-leader
+	c.Assert((<-follower).Body.String(), Equals, "hello")
+	c.Assert(atomic.LoadInt64(&b.calls), Equals, int64(2))
+	c.Assert(atomic.LoadInt64(&h.collapsed), Equals, int64(0))
+}
+
+func (s *CollapseSuite) TestHead(c *C) {
+	b := newBackend("hello")
+	h := newHandler(c, Collapse{}, b)
+
+	r := get("/a")
+	r.Method = http.MethodHead
+	leader := serveAsync(h, r)
+	<-b.started
+	r = get("/a")
+	r.Method = http.MethodHead
+	follower := serveAsync(h, r)
+	waitForWaiters(c, h, 1)
+	close(b.release)
+
+	<-leader
+	re := <-follower
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Body.Len(), Equals, 0)
+	c.Assert(atomic.LoadInt64(&b.calls), Equals, int64(1))
+}
+
+// backend blocks requests until it is released, and tells when a request
+// has come in.
+type backend struct {
+	body    string
+	header  http.Header
+	calls   int64
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBackend(body string) *backend {
+	return &backend{
+		body:    body,
+		header:  http.Header{"X-Backend": []string{"yes"}},
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&b.calls, 1)
+	b.started <- struct{}{}
+	<-b.release
+	for name, values := range b.header {
+		w.Header()[name] = values
+	}
+	if r.Method != http.MethodHead {
+		w.Write([]byte(b.body))
+	}
+}
+
+func newHandler(c *C, cfg Collapse, next http.Handler) *handler {
+	cl, err := NewCollapse(cfg)
+	c.Assert(err, IsNil)
+	h, err := cl.NewHandler(next)
+	c.Assert(err, IsNil)
+	return h.(*handler)
+}
+
+// waitForWaiters waits until the number of requests waiting for a call gets
+// to n.
+func waitForWaiters(c *C, h *handler, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		h.mu.Lock()
+		waiters := 0
+		for _, call := range h.calls {
+			waiters += call.waiters
+		}
+		h.mu.Unlock()
+		if waiters == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for %d waiters", n)
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, r)
+	return re
+}
+
+func serveAsync(h http.Handler, r *http.Request) <-chan *httptest.ResponseRecorder {
+	out := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		out <- serve(h, r)
+	}()
+	return out
+}
+
+func get(path string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+}
+
+func post(path string) *http.Request {
+	return httptest.NewRequest(http.MethodPost, "http://example.com"+path, nil)
+}
@@ -0,0 +1,220 @@
+package collapse
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vulcand/vulcand/plugin"
+)
+
+type handler struct {
+	next             http.Handler
+	env              plugin.Env
+	headers          []string
+	maxResponseBytes int64
+	maxWaiters       int
+	timeout          time.Duration
+	// collapsed is the number of requests that were served a response to
+	// another request.
+	collapsed int64
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// call is an upstream call that requests are waiting for. Its response can
+// only be read after done is closed.
+type call struct {
+	done    chan struct{}
+	waiters int
+
+	shared bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, ok := h.key(r)
+	if !ok {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	h.mu.Lock()
+	if c, ok := h.calls[key]; ok {
+		if h.maxWaiters > 0 && c.waiters >= h.maxWaiters {
+			h.mu.Unlock()
+			h.next.ServeHTTP(w, r)
+			return
+		}
+		c.waiters++
+		h.mu.Unlock()
+		h.wait(w, r, c)
+		return
+	}
+	c := &call{done: make(chan struct{})}
+	h.calls[key] = c
+	h.mu.Unlock()
+
+	h.lead(w, r, key, c)
+}
+
+// lead forwards a request and shares the response with requests that came in
+// while it was in flight.
+func (h *handler) lead(w http.ResponseWriter, r *http.Request, key string, c *call) {
+	tw := &teeWriter{w: w, limit: h.maxResponseBytes}
+	completed := false
+	defer func() {
+		h.mu.Lock()
+		delete(h.calls, key)
+		h.mu.Unlock()
+		// A response is not worth sharing if the upstream call was aborted,
+		// e.g. because the client went away, and must not be shared if it
+		// sets cookies.
+		if completed && !tw.overflow && r.Context().Err() == nil && tw.header.Get("Set-Cookie") == "" {
+			c.shared = true
+			c.status = tw.status
+			c.header = tw.header
+			c.body = tw.body.Bytes()
+		}
+		close(c.done)
+	}()
+	h.next.ServeHTTP(tw, r)
+	tw.finish()
+	completed = true
+}
+
+// wait waits for the response to the request it is collapsed with. If the
+// response can not be shared, or it takes too long, the request is forwarded
+// on its own.
+func (h *handler) wait(w http.ResponseWriter, r *http.Request, c *call) {
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case <-c.done:
+	case <-timer.C:
+		h.next.ServeHTTP(w, r)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	if !c.shared {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	atomic.AddInt64(&h.collapsed, 1)
+	h.env.IncCounter("collapsed", 1)
+
+	header := w.Header()
+	for name, values := range c.header {
+		header[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(c.status)
+	w.Write(c.body)
+}
+
+// key returns the key that identical requests share, or false if the request
+// should not be collapsed.
+func (h *handler) key(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", false
+	}
+	if !h.isKeyHeader("Authorization") && r.Header.Get("Authorization") != "" {
+		return "", false
+	}
+	if !h.isKeyHeader("Cookie") && r.Header.Get("Cookie") != "" {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	if r.TLS != nil {
+		b.WriteString("https://")
+	} else {
+		b.WriteString("http://")
+	}
+	b.WriteString(strings.ToLower(r.Host))
+	b.WriteString(r.URL.RequestURI())
+	for _, name := range h.headers {
+		b.WriteByte('\n')
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String(), true
+}
+
+func (h *handler) isKeyHeader(name string) bool {
+	for _, n := range h.headers {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// teeWriter passes a response through to the client while keeping a copy of
+// it, unless it gets larger than the limit.
+type teeWriter struct {
+	w     http.ResponseWriter
+	limit int64
+
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	overflow    bool
+	wroteHeader bool
+}
+
+func (tw *teeWriter) Header() http.Header {
+	if tw.header == nil {
+		tw.header = make(http.Header)
+	}
+	return tw.header
+}
+
+func (tw *teeWriter) WriteHeader(status int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.status = status
+	header := tw.w.Header()
+	for name, values := range tw.Header() {
+		header[name] = values
+	}
+	tw.w.WriteHeader(status)
+}
+
+func (tw *teeWriter) Write(p []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if !tw.overflow {
+		if int64(tw.body.Len()+len(p)) > tw.limit {
+			tw.overflow = true
+			tw.body = bytes.Buffer{}
+		} else {
+			tw.body.Write(p)
+		}
+	}
+	return tw.w.Write(p)
+}
+
+func (tw *teeWriter) Flush() {
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish sends the response headers if the handler has not written anything.
+func (tw *teeWriter) finish() {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+}
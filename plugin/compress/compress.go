@@ -0,0 +1,146 @@
+package compress
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "compress"
+
+// DefaultMinBytes is the default size a response should have to be compressed.
+const DefaultMinBytes = 1024
+
+// DefaultMaxDecompressedBytes is the default size a decompressed request
+// body may have.
+const DefaultMaxDecompressedBytes = 10 * 1024 * 1024
+
+// DefaultContentTypes are content types of responses compressed by default.
+// Entries that end with a slash match every subtype.
+var DefaultContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// DefaultEncodings are encodings in the order of preference used by default.
+var DefaultEncodings = []string{encodingBrotli, encodingZstd, encodingGzip}
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// Compress compresses responses with an encoding that both the client and
+// the middleware support, and optionally decompresses request bodies.
+type Compress struct {
+	// Encodings are supported encodings in the order of preference that is
+	// used when the client likes several of them equally, any of "br",
+	// "zstd" and "gzip".
+	Encodings []string
+	// MinBytes is the size a response should have to be compressed.
+	MinBytes int64
+	// ContentTypes are content types of responses to compress, e.g.
+	// "application/json". Entries that end with a slash, e.g. "text/",
+	// match every subtype.
+	ContentTypes []string
+	// DecompressRequests tells the middleware to decompress request bodies
+	// before they reach backends.
+	DecompressRequests bool
+	// MaxDecompressedBytes is the size a decompressed request body may have,
+	// larger bodies are rejected.
+	MaxDecompressedBytes int64
+}
+
+// NewCompress validates settings and returns a compression middleware.
+func NewCompress(c Compress) (*Compress, error) {
+	if c.MinBytes < 0 {
+		return nil, fmt.Errorf("min bytes should be >= 0, got %d", c.MinBytes)
+	}
+	if c.MaxDecompressedBytes < 0 {
+		return nil, fmt.Errorf("max decompressed bytes should be >= 0, got %d", c.MaxDecompressedBytes)
+	}
+	for _, e := range c.Encodings {
+		if _, ok := encoders[e]; !ok {
+			return nil, fmt.Errorf("unsupported encoding %q, supported are %s", e, strings.Join(DefaultEncodings, ", "))
+		}
+	}
+	for _, t := range c.ContentTypes {
+		if strings.HasSuffix(t, "/") && strings.Count(t, "/") == 1 {
+			continue
+		}
+		if _, _, err := mime.ParseMediaType(t); err != nil {
+			return nil, fmt.Errorf("invalid content type %q: %v", t, err)
+		}
+	}
+	return &c, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (c *Compress) NewHandler(next http.Handler) (http.Handler, error) {
+	h := &handler{
+		next:                 next,
+		encodings:            c.Encodings,
+		minBytes:             c.MinBytes,
+		contentTypes:         c.ContentTypes,
+		decompressRequests:   c.DecompressRequests,
+		maxDecompressedBytes: c.MaxDecompressedBytes,
+	}
+	if len(h.encodings) == 0 {
+		h.encodings = DefaultEncodings
+	}
+	if h.minBytes == 0 {
+		h.minBytes = DefaultMinBytes
+	}
+	if len(h.contentTypes) == 0 {
+		h.contentTypes = DefaultContentTypes
+	}
+	if h.maxDecompressedBytes == 0 {
+		h.maxDecompressedBytes = DefaultMaxDecompressedBytes
+	}
+	return h, nil
+}
+
+func (c *Compress) String() string {
+	return fmt.Sprintf("encodings=%s, minBytes=%d, contentTypes=%s, decompressRequests=%t, maxDecompressedBytes=%d",
+		strings.Join(c.Encodings, ","), c.MinBytes, strings.Join(c.ContentTypes, ","), c.DecompressRequests, c.MaxDecompressedBytes)
+}
+
+func FromOther(c Compress) (plugin.Middleware, error) {
+	return NewCompress(c)
+}
+
+// FromCli constructs the middleware from the command line.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	return NewCompress(Compress{
+		Encodings:            c.StringSlice("encoding"),
+		MinBytes:             int64(c.Int("minBytes")),
+		ContentTypes:         c.StringSlice("contentType"),
+		DecompressRequests:   c.Bool("decompressRequests"),
+		MaxDecompressedBytes: c.Int64("maxDecompressedBytes"),
+	})
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{Name: "encoding", Value: &cli.StringSlice{}, Usage: "supported encoding in the order of preference: br, zstd or gzip"},
+		cli.IntFlag{Name: "minBytes", Usage: "size a response should have to be compressed"},
+		cli.StringSliceFlag{Name: "contentType", Value: &cli.StringSlice{}, Usage: "content type of responses to compress, e.g. application/json or text/"},
+		cli.BoolFlag{Name: "decompressRequests", Usage: "decompress request bodies before they reach backends"},
+		cli.Int64Flag{Name: "maxDecompressedBytes", Usage: "size a decompressed request body may have, 10MB by default"},
+	}
+}
@@ -0,0 +1,394 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestCompress(t *testing.T) { TestingT(t) }
+
+type CompressSuite struct{}
+
+var _ = Suite(&CompressSuite{})
+
+var text = strings.Repeat("the quick brown fox jumps over the lazy dog ", 100)
+
+// Make sure the spec is compatible and will be accepted by middleware registry
+func (s *CompressSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *CompressSuite) TestNewCompressBadParams(c *C) {
+	_, err := NewCompress(Compress{MinBytes: -1})
+	c.Assert(err, NotNil)
+
+	_, err = NewCompress(Compress{Encodings: []string{"deflate"}})
+	c.Assert(err, NotNil)
+
+	_, err = NewCompress(Compress{ContentTypes: []string{"text/html; charset"}})
+	c.Assert(err, NotNil)
+
+	_, err = NewCompress(Compress{MaxDecompressedBytes: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *CompressSuite) TestNewCompressFromOther(c *C) {
+	cm, err := NewCompress(Compress{Encodings: []string{"gzip"}, MinBytes: 10, ContentTypes: []string{"text/", "application/json"}, DecompressRequests: true})
+	c.Assert(err, IsNil)
+	c.Assert(cm.String(), Not(Equals), "")
+
+	out, err := FromOther(*cm)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, cm)
+}
+
+func (s *CompressSuite) TestNewCompressFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		cm := out.(*Compress)
+		c.Assert(cm.Encodings, DeepEquals, []string{"zstd", "gzip"})
+		c.Assert(cm.MinBytes, Equals, int64(512))
+		c.Assert(cm.ContentTypes, DeepEquals, []string{"application/json"})
+		c.Assert(cm.DecompressRequests, Equals, true)
+		c.Assert(cm.MaxDecompressedBytes, Equals, int64(2048))
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--encoding=zstd", "--encoding=gzip", "--minBytes=512", "--contentType=application/json", "--decompressRequests", "--maxDecompressedBytes=2048"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *CompressSuite) TestNegotiate(c *C) {
+	supported := []string{"br", "zstd", "gzip"}
+	tcs := []struct {
+		accept   string
+		expected string
+	}{
+		{accept: "", expected: ""},
+		{accept: "gzip", expected: "gzip"},
+		{accept: "gzip, deflate, br", expected: "br"},
+		{accept: "gzip;q=1.0, br;q=0.5", expected: "gzip"},
+		{accept: "zstd, gzip", expected: "zstd"},
+		{accept: "*", expected: "br"},
+		{accept: "*, br;q=0", expected: "zstd"},
+		{accept: "gzip;q=0", expected: ""},
+		{accept: "deflate", expected: ""},
+		{accept: "identity", expected: ""},
+		{accept: "gzip;q=0.5, identity", expected: ""},
+		{accept: "GZIP;Q=0.5", expected: "gzip"},
+		{accept: "gzip;q=2", expected: ""},
+	}
+	for i, tc := range tcs {
+		var accept []string
+		if tc.accept != "" {
+			accept = []string{tc.accept}
+		}
+		c.Assert(negotiate(accept, supported), Equals, tc.expected, Commentf("case %d: %s", i, tc.accept))
+	}
+}
+
+func (s *CompressSuite) TestCompressesResponses(c *C) {
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		h := newHandler(c, Compress{}, textHandler(text))
+		re := serve(h, request(encoding))
+		c.Assert(re.Code, Equals, http.StatusOK)
+		c.Assert(re.Header().Get("Content-Encoding"), Equals, encoding)
+		c.Assert(re.Header().Get("Content-Length"), Equals, "")
+		c.Assert(re.Header().Get("Vary"), Equals, "Accept-Encoding")
+		c.Assert(re.Header().Get("ETag"), Equals, `W/"v1"`)
+		c.Assert(re.Body.Len() < len(text), Equals, true)
+		c.Assert(decode(c, encoding, re.Body.Bytes()), Equals, text)
+	}
+}
+
+func (s *CompressSuite) TestSmallResponses(c *C) {
+	h := newHandler(c, Compress{}, textHandler("hello"))
+	re := serve(h, request("gzip"))
+	c.Assert(re.Header().Get("Content-Encoding"), Equals, "")
+	c.Assert(re.Header().Get("Vary"), Equals, "Accept-Encoding")
+	c.Assert(re.Body.String(), Equals, "hello")
+
+	h = newHandler(c, Compress{MinBytes: 3}, textHandler("hello"))
+	re = serve(h, request("gzip"))
+	c.Assert(re.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(decode(c, "gzip", re.Body.Bytes()), Equals, "hello")
+}
+
+func (s *CompressSuite) TestSkipsResponses(c *C) {
+	tcs := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "image",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				io.WriteString(w, text)
+			},
+		},
+		{
+			name: "not allowed type",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				io.WriteString(w, text)
+			},
+		},
+		{
+			name: "already encoded",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Encoding", "custom")
+				io.WriteString(w, text)
+			},
+		},
+		{
+			name: "no-transform",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Cache-Control", "public, no-transform")
+				io.WriteString(w, text)
+			},
+		},
+		{
+			name: "partial content",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Range", "bytes 0-10/100")
+				w.WriteHeader(http.StatusPartialContent)
+				io.WriteString(w, text)
+			},
+		},
+		{
+			name: "small content length",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Length", "10")
+				io.WriteString(w, text[:10])
+			},
+		},
+	}
+	for _, tc := range tcs {
+		h := newHandler(c, Compress{}, tc.handler)
+		re := serve(h, request("gzip"))
+		c.Assert(re.Header().Get("Content-Encoding"), Not(Equals), "gzip", Commentf(tc.name))
+		c.Assert(strings.HasPrefix(text, re.Body.String()), Equals, true, Commentf(tc.name))
+	}
+}
+
+func (s *CompressSuite) TestContentTypes(c *C) {
+	json := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.WriteString(w, text)
+	})
+	h := newHandler(c, Compress{ContentTypes: []string{"text/"}}, json)
+	re := serve(h, request("gzip"))
+	c.Assert(re.Header().Get("Content-Encoding"), Equals, "")
+	c.Assert(re.Header().Get("Vary"), Equals, "")
+
+	h = newHandler(c, Compress{ContentTypes: []string{"application/json"}}, json)
+	re = serve(h, request("gzip"))
+	c.Assert(re.Header().Get("Content-Encoding"), Equals, "gzip")
+
+	// Type is sniffed if the backend does not tell it
+	sniffed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<html><body>"+text+"</body></html>")
+	})
+	h = newHandler(c, Compress{}, sniffed)
+	re = serve(h, request("gzip"))
+	c.Assert(re.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(re.Header().Get("Content-Type"), Equals, "text/html; charset=utf-8")
+}
+
+func (s *CompressSuite) TestNoAcceptEncoding(c *C) {
+	h := newHandler(c, Compress{}, textHandler(text))
+	re := serve(h, request(""))
+	c.Assert(re.Header().Get("Content-Encoding"), Equals, "")
+	c.Assert(re.Header().Get("Vary"), Equals, "Accept-Encoding")
+	c.Assert(re.Body.String(), Equals, text)
+}
+
+func (s *CompressSuite) TestFlush(c *C) {
+	flushed := make(chan struct{})
+	proceed := make(chan struct{})
+	h := newHandler(c, Compress{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		close(flushed)
+		<-proceed
+		io.WriteString(w, "data: 2\n\n")
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	re, err := http.DefaultTransport.RoundTrip(req)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	<-flushed
+	c.Assert(re.Header.Get("Content-Encoding"), Equals, "gzip")
+
+	// The first event can be read before the handler is done
+	zr, err := gzip.NewReader(re.Body)
+	c.Assert(err, IsNil)
+	buf := make([]byte, len("data: 1\n\n"))
+	_, err = io.ReadFull(zr, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "data: 1\n\n")
+
+	close(proceed)
+	rest, err := ioutil.ReadAll(zr)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "data: 2\n\n")
+}
+
+func (s *CompressSuite) TestDecompressRequests(c *C) {
+	var received string
+	var encoding string
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+		encoding = r.Header.Get("Content-Encoding")
+	})
+	h := newHandler(c, Compress{DecompressRequests: true}, echo)
+
+	for _, e := range []string{"gzip", "br", "zstd"} {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com", bytes.NewReader(encode(c, e, text)))
+		req.Header.Set("Content-Encoding", e)
+		re := serve(h, req)
+		c.Assert(re.Code, Equals, http.StatusOK)
+		c.Assert(received, Equals, text)
+		c.Assert(encoding, Equals, "")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com", strings.NewReader(text))
+	req.Header.Set("Content-Encoding", "compress")
+	re := serve(h, req)
+	c.Assert(re.Code, Equals, http.StatusUnsupportedMediaType)
+	c.Assert(re.Header().Get("Accept-Encoding"), Not(Equals), "")
+
+	req = httptest.NewRequest(http.MethodPost, "http://example.com", strings.NewReader(text))
+	req.Header.Set("Content-Encoding", "gzip")
+	re = serve(h, req)
+	c.Assert(re.Code, Equals, http.StatusBadRequest)
+
+	// Request bodies are left alone unless told otherwise
+	h = newHandler(c, Compress{}, echo)
+	req = httptest.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("data"))
+	req.Header.Set("Content-Encoding", "gzip")
+	serve(h, req)
+	c.Assert(received, Equals, "data")
+	c.Assert(encoding, Equals, "gzip")
+}
+
+func (s *CompressSuite) TestDecompressedRequestsTooLarge(c *C) {
+	var received string
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			// The way a proxy reports a body it failed to send.
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		received = string(body)
+	})
+	h := newHandler(c, Compress{DecompressRequests: true, MaxDecompressedBytes: int64(len(text))}, echo)
+
+	// A body that is exactly as large as allowed is fine.
+	req := httptest.NewRequest(http.MethodPost, "http://example.com", bytes.NewReader(encode(c, "gzip", text)))
+	req.Header.Set("Content-Encoding", "gzip")
+	re := serve(h, req)
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(received, Equals, text)
+
+	for _, e := range []string{"gzip", "br", "zstd"} {
+		received = ""
+		req := httptest.NewRequest(http.MethodPost, "http://example.com", bytes.NewReader(encode(c, e, text+"!")))
+		req.Header.Set("Content-Encoding", e)
+		req.Header.Set("Accept-Encoding", "gzip")
+		re := serve(h, req)
+		c.Assert(re.Code, Equals, http.StatusRequestEntityTooLarge)
+		c.Assert(re.Header().Get("Content-Encoding"), Equals, "")
+		c.Assert(re.Body.String(), Equals, errBodyTooLarge.Error()+"\n")
+		c.Assert(received, Equals, "")
+	}
+}
+
+func newHandler(c *C, cfg Compress, next http.Handler) http.Handler {
+	cm, err := NewCompress(cfg)
+	c.Assert(err, IsNil)
+	h, err := cm.NewHandler(next)
+	c.Assert(err, IsNil)
+	return h
+}
+
+func textHandler(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, body)
+	})
+}
+
+func request(acceptEncoding string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	return r
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, r)
+	return re
+}
+
+func encode(c *C, encoding, data string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		c.Assert(err, IsNil)
+		w = zw
+	}
+	_, err := io.WriteString(w, data)
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	return buf.Bytes()
+}
+
+func decode(c *C, encoding string, data []byte) string {
+	r, ok, err := newDecoder(encoding, ioutil.NopCloser(bytes.NewReader(data)))
+	c.Assert(ok, Equals, true)
+	c.Assert(err, IsNil)
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	return string(out)
+}
@@ -0,0 +1,150 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingBrotli   = "br"
+	encodingZstd     = "zstd"
+	encodingGzip     = "gzip"
+	encodingIdentity = "identity"
+)
+
+// encoder is a compressing writer that can be reused.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// encoders keep compressing writers for reuse, since they allocate large
+// buffers.
+var encoders = map[string]*sync.Pool{
+	encodingBrotli: {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotli.DefaultCompression)
+	}},
+	encodingZstd: {New: func() interface{} {
+		w, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			panic(err)
+		}
+		return w
+	}},
+	encodingGzip: {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+func getEncoder(encoding string, w io.Writer) encoder {
+	e := encoders[encoding].Get().(encoder)
+	e.Reset(w)
+	return e
+}
+
+func putEncoder(encoding string, e encoder) {
+	encoders[encoding].Put(e)
+}
+
+// newDecoder returns a reader that decompresses a request body, or false if
+// the encoding is not supported.
+func newDecoder(encoding string, r io.ReadCloser) (io.ReadCloser, bool, error) {
+	switch encoding {
+	case encodingGzip, "x-gzip":
+		d, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, true, err
+		}
+		return &decoder{Reader: d, closers: []func() error{d.Close, r.Close}}, true, nil
+	case encodingBrotli:
+		return &decoder{Reader: brotli.NewReader(r), closers: []func() error{r.Close}}, true, nil
+	case encodingZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, true, err
+		}
+		return &decoder{Reader: d, closers: []func() error{func() error { d.Close(); return nil }, r.Close}}, true, nil
+	}
+	return nil, false, nil
+}
+
+type decoder struct {
+	io.Reader
+	closers []func() error
+}
+
+func (d *decoder) Close() error {
+	var err error
+	for _, c := range d.closers {
+		if cerr := c(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// negotiate picks an encoding for the response from the Accept-Encoding
+// request header, see RFC 7231 section 5.3.4. Supported encodings are in the
+// order of preference, which breaks ties between equally liked encodings. It
+// returns an empty string if the response should not be compressed.
+func negotiate(acceptEncoding []string, supported []string) string {
+	if len(acceptEncoding) == 0 {
+		return ""
+	}
+	weights := map[string]float64{}
+	for _, v := range acceptEncoding {
+		for _, part := range strings.Split(v, ",") {
+			name, q := parseCoding(part)
+			if name == "" {
+				continue
+			}
+			weights[name] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range supported {
+		q, ok := weights[encoding]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if !ok || q <= bestQ {
+			continue
+		}
+		best, bestQ = encoding, q
+	}
+	if best == "" {
+		return ""
+	}
+	// The client prefers the response as it is.
+	if q, ok := weights[encodingIdentity]; ok && q > bestQ {
+		return ""
+	}
+	return best
+}
+
+// parseCoding parses an element of the Accept-Encoding header, e.g.
+// "gzip;q=0.8".
+func parseCoding(s string) (string, float64) {
+	params := strings.Split(s, ";")
+	name := strings.ToLower(strings.TrimSpace(params[0]))
+	q := 1.0
+	for _, p := range params[1:] {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "q=") && !strings.HasPrefix(p, "Q=") {
+			continue
+		}
+		v, err := strconv.ParseFloat(p[2:], 64)
+		if err != nil || v < 0 || v > 1 {
+			return "", 0
+		}
+		q = v
+	}
+	return name, q
+}
@@ -0,0 +1,351 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type handler struct {
+	next                 http.Handler
+	encodings            []string
+	minBytes             int64
+	contentTypes         []string
+	decompressRequests   bool
+	maxDecompressedBytes int64
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body *limitedBody
+	if h.decompressRequests && r.Header.Get("Content-Encoding") != "" {
+		var ok bool
+		if r, body, ok = h.decompress(w, r); !ok {
+			return
+		}
+	}
+	// Upgraded connections are not HTTP responses, so there is nothing to
+	// compress.
+	if r.Header.Get("Upgrade") != "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	cw := &compressWriter{
+		w:        w,
+		h:        h,
+		encoding: negotiate(r.Header.Values("Accept-Encoding"), h.encodings),
+		body:     body,
+	}
+	defer cw.finish()
+	h.next.ServeHTTP(cw, r)
+}
+
+// decompress replaces a compressed request body with a decompressed one that
+// may be at most maxDecompressedBytes large. It replies with an error and
+// returns false if the body can not be decompressed.
+func (h *handler) decompress(w http.ResponseWriter, r *http.Request) (*http.Request, *limitedBody, bool) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	outReq := r.Clone(r.Context())
+	outReq.Header.Del("Content-Encoding")
+	if encoding == encodingIdentity {
+		return outReq, nil, true
+	}
+	decoder, ok, err := newDecoder(encoding, r.Body)
+	if !ok {
+		// RFC 7694 tells to list encodings that the server does accept.
+		w.Header().Set("Accept-Encoding", strings.Join(DefaultEncodings, ", "))
+		http.Error(w, "unsupported content encoding "+encoding, http.StatusUnsupportedMediaType)
+		return nil, nil, false
+	}
+	if err != nil {
+		http.Error(w, "invalid "+encoding+" request body", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	body := &limitedBody{ReadCloser: decoder, left: h.maxDecompressedBytes}
+	outReq.Body = body
+	outReq.ContentLength = -1
+	outReq.Header.Del("Content-Length")
+	return outReq, body, true
+}
+
+// errBodyTooLarge is returned by reads past the limit of a decompressed
+// request body.
+var errBodyTooLarge = errors.New("decompressed request body is too large")
+
+// limitedBody fails reads once more than the allowed number of bytes is
+// decompressed, much like http.MaxBytesReader does. A small compressed body
+// can decompress to a lot of data.
+type limitedBody struct {
+	io.ReadCloser
+	left     int64
+	exceeded int32
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&b.exceeded) != 0 {
+		return 0, errBodyTooLarge
+	}
+	// Read a byte more to tell a body that is exactly as large as allowed
+	// from a larger one.
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.left {
+		b.left -= int64(n)
+		return n, err
+	}
+	n = int(b.left)
+	b.left = 0
+	atomic.StoreInt32(&b.exceeded, 1)
+	return n, errBodyTooLarge
+}
+
+// tooLarge tells whether reads went past the limit.
+func (b *limitedBody) tooLarge() bool {
+	return b != nil && atomic.LoadInt32(&b.exceeded) != 0
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// the response is worth compressing, then either compresses it or passes it
+// through as it is.
+type compressWriter struct {
+	w        http.ResponseWriter
+	h        *handler
+	encoding string
+	// body is the decompressed request body, if any.
+	body *limitedBody
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	discard     bool
+	buf         bytes.Buffer
+	enc         encoder
+}
+
+func (cw *compressWriter) Header() http.Header {
+	return cw.w.Header()
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	// Informational responses are followed by the actual one.
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		cw.w.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+
+	// Whatever went wrong downstream, it was caused by the request body that
+	// is too large to accept.
+	if cw.body.tooLarge() {
+		cw.decided = true
+		cw.discard = true
+		header := cw.w.Header()
+		header.Del("Content-Encoding")
+		header.Del("Content-Length")
+		http.Error(cw.w, errBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	header := cw.w.Header()
+	if !cw.eligible() {
+		cw.decide(false)
+		return
+	}
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		if !cw.h.allowedType(contentType) {
+			cw.decide(false)
+			return
+		}
+		addVary(header)
+	}
+	if size := header.Get("Content-Length"); size != "" {
+		if length, err := strconv.ParseInt(size, 10, 64); err == nil && length < cw.h.minBytes {
+			cw.decide(false)
+			return
+		}
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.discard {
+		return len(p), nil
+	}
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(p)
+		}
+		return cw.w.Write(p)
+	}
+	cw.buf.Write(p)
+	if int64(cw.buf.Len()) >= cw.h.minBytes {
+		cw.decide(true)
+	}
+	return len(p), nil
+}
+
+// Flush sends what the response has so far to the client. A streamed
+// response is compressed regardless of its size, since it can not be known.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish sends what is held back and completes the compressed stream.
+func (cw *compressWriter) finish() {
+	if !cw.wroteHeader {
+		return
+	}
+	if !cw.decided {
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+		putEncoder(cw.encoding, cw.enc)
+		cw.enc = nil
+	}
+}
+
+// decide sends the response header and what is held back of the body. The
+// response is compressed if it may be and its content type allows it.
+func (cw *compressWriter) decide(compress bool) {
+	cw.decided = true
+	header := cw.w.Header()
+	if compress && cw.eligible() {
+		contentType := header.Get("Content-Type")
+		if contentType == "" {
+			// Sniff the type now, the server would sniff compressed data.
+			contentType = http.DetectContentType(cw.buf.Bytes())
+			header.Set("Content-Type", contentType)
+			compress = cw.h.allowedType(contentType)
+			if compress {
+				addVary(header)
+			}
+		}
+		compress = compress && cw.encoding != ""
+	} else {
+		compress = false
+	}
+	if compress {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		// The compressed representation is not byte for byte the same.
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			header.Set("ETag", "W/"+etag)
+		}
+		cw.enc = getEncoder(cw.encoding, cw.w)
+	}
+	cw.w.WriteHeader(cw.status)
+	if cw.buf.Len() == 0 {
+		return
+	}
+	if cw.enc != nil {
+		cw.enc.Write(cw.buf.Bytes())
+	} else {
+		cw.w.Write(cw.buf.Bytes())
+	}
+	cw.buf = bytes.Buffer{}
+}
+
+// eligible tells whether the response may be compressed regardless of its
+// content type and size.
+func (cw *compressWriter) eligible() bool {
+	switch cw.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent, http.StatusSwitchingProtocols:
+		return false
+	}
+	header := cw.w.Header()
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	for _, v := range header.Values("Cache-Control") {
+		if strings.Contains(strings.ToLower(v), "no-transform") {
+			return false
+		}
+	}
+	return true
+}
+
+// allowedType tells whether a response with the content type should be
+// compressed. Content that is compressed by its format, e.g. images, is
+// never compressed again.
+func (h *handler) allowedType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if alreadyCompressed(mediaType) {
+		return false
+	}
+	for _, t := range h.contentTypes {
+		t = strings.ToLower(t)
+		if strings.HasSuffix(t, "/") {
+			if strings.HasPrefix(mediaType, t) {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// compressedTypes are formats that are compressed by themselves.
+var compressedTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/pdf":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+func alreadyCompressed(mediaType string) bool {
+	if compressedTypes[mediaType] {
+		return true
+	}
+	if strings.HasPrefix(mediaType, "image/") {
+		return mediaType != "image/svg+xml" && mediaType != "image/bmp"
+	}
+	return strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/")
+}
+
+func addVary(header http.Header) {
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" || strings.EqualFold(name, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
@@ -0,0 +1,177 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "cors"
+
+var (
+	// DefaultAllowedMethods are methods allowed by default.
+	DefaultAllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	// DefaultAllowedHeaders are request headers allowed by default.
+	DefaultAllowedHeaders = []string{"Accept", "Content-Type", "X-Requested-With"}
+)
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// CORS implements Cross-Origin Resource Sharing, see
+// https://fetch.spec.whatwg.org/#http-cors-protocol. It answers preflight
+// requests itself and adds CORS headers to responses for allowed origins.
+type CORS struct {
+	// AllowedOrigins are origins allowed to make requests, e.g.
+	// "https://example.com". An origin can have a single wildcard, e.g.
+	// "https://*.example.com", and "*" allows any origin.
+	AllowedOrigins []string
+	// AllowedOriginRegexps are regular expressions that match allowed
+	// origins as a whole.
+	AllowedOriginRegexps []string
+	// AllowedMethods are methods allowed in requests, GET, HEAD and POST by
+	// default.
+	AllowedMethods []string
+	// AllowedHeaders are headers allowed in requests, Accept, Content-Type
+	// and X-Requested-With by default. "*" allows any header.
+	AllowedHeaders []string
+	// ExposedHeaders are response headers that clients are allowed to read.
+	ExposedHeaders []string
+	// AllowCredentials allows requests with cookies and HTTP authentication.
+	AllowCredentials bool
+	// MaxAge is how many seconds clients can cache results of a preflight
+	// request for, not told if 0.
+	MaxAge int
+}
+
+// NewCORS validates settings and returns a CORS middleware.
+func NewCORS(c CORS) (*CORS, error) {
+	if len(c.AllowedOrigins) == 0 && len(c.AllowedOriginRegexps) == 0 {
+		return nil, fmt.Errorf("at least one allowed origin is required")
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "" || strings.Count(o, "*") > 1 {
+			return nil, fmt.Errorf("invalid origin %q, expected an origin with at most one wildcard", o)
+		}
+		// Reflecting any origin with credentials would let any site act on
+		// behalf of users.
+		if o == "*" && c.AllowCredentials {
+			return nil, fmt.Errorf("credentials can not be allowed for any origin")
+		}
+	}
+	for _, expr := range c.AllowedOriginRegexps {
+		if _, err := regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("invalid origin regexp %q: %v", expr, err)
+		}
+	}
+	for _, m := range c.AllowedMethods {
+		if m == "" || strings.ContainsAny(m, " ,") {
+			return nil, fmt.Errorf("invalid method %q", m)
+		}
+	}
+	for _, h := range append(append([]string{}, c.AllowedHeaders...), c.ExposedHeaders...) {
+		if h == "" || strings.ContainsAny(h, " ,") {
+			return nil, fmt.Errorf("invalid header %q", h)
+		}
+	}
+	if c.MaxAge < 0 {
+		return nil, fmt.Errorf("max age should be >= 0, got %d", c.MaxAge)
+	}
+	return &c, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (c *CORS) NewHandler(next http.Handler) (http.Handler, error) {
+	h := &handler{
+		next:             next,
+		allowedMethods:   map[string]bool{},
+		allowedHeaders:   map[string]bool{},
+		exposedHeaders:   strings.Join(c.ExposedHeaders, ", "),
+		allowCredentials: c.AllowCredentials,
+		maxAge:           c.MaxAge,
+	}
+	for _, o := range c.AllowedOrigins {
+		o = strings.ToLower(o)
+		switch {
+		case o == "*":
+			h.anyOrigin = true
+		case strings.Contains(o, "*"):
+			i := strings.IndexByte(o, '*')
+			h.wildcards = append(h.wildcards, wildcard{prefix: o[:i], suffix: o[i+1:]})
+		default:
+			h.origins = append(h.origins, o)
+		}
+	}
+	for _, expr := range c.AllowedOriginRegexps {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, err
+		}
+		h.regexps = append(h.regexps, re)
+	}
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = DefaultAllowedMethods
+	}
+	for _, m := range methods {
+		h.allowedMethods[strings.ToUpper(m)] = true
+	}
+	h.methods = strings.Join(methods, ", ")
+	headers := c.AllowedHeaders
+	if len(headers) == 0 {
+		headers = DefaultAllowedHeaders
+	}
+	for _, name := range headers {
+		if name == "*" {
+			h.anyHeader = true
+			continue
+		}
+		h.allowedHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	return h, nil
+}
+
+func (c *CORS) String() string {
+	return fmt.Sprintf("origins=%s, originRegexps=%s, methods=%s, headers=%s, exposedHeaders=%s, credentials=%t, maxAge=%d",
+		strings.Join(c.AllowedOrigins, ","), strings.Join(c.AllowedOriginRegexps, ","), strings.Join(c.AllowedMethods, ","),
+		strings.Join(c.AllowedHeaders, ","), strings.Join(c.ExposedHeaders, ","), c.AllowCredentials, c.MaxAge)
+}
+
+func FromOther(c CORS) (plugin.Middleware, error) {
+	return NewCORS(c)
+}
+
+// FromCli constructs the middleware from the command line.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	return NewCORS(CORS{
+		AllowedOrigins:       c.StringSlice("origin"),
+		AllowedOriginRegexps: c.StringSlice("originRegexp"),
+		AllowedMethods:       c.StringSlice("method"),
+		AllowedHeaders:       c.StringSlice("header"),
+		ExposedHeaders:       c.StringSlice("exposeHeader"),
+		AllowCredentials:     c.Bool("credentials"),
+		MaxAge:               c.Int("maxAge"),
+	})
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{Name: "origin", Value: &cli.StringSlice{}, Usage: "allowed origin, e.g. https://example.com, https://*.example.com or *"},
+		cli.StringSliceFlag{Name: "originRegexp", Value: &cli.StringSlice{}, Usage: "regular expression that matches allowed origins"},
+		cli.StringSliceFlag{Name: "method", Value: &cli.StringSlice{}, Usage: "allowed method, GET, HEAD and POST by default"},
+		cli.StringSliceFlag{Name: "header", Value: &cli.StringSlice{}, Usage: "allowed request header, * allows any"},
+		cli.StringSliceFlag{Name: "exposeHeader", Value: &cli.StringSlice{}, Usage: "response header that clients are allowed to read"},
+		cli.BoolFlag{Name: "credentials", Usage: "allow requests with cookies and HTTP authentication"},
+		cli.IntFlag{Name: "maxAge", Usage: "how many seconds clients can cache preflight results for"},
+	}
+}
@@ -0,0 +1,211 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestCORS(t *testing.T) { TestingT(t) }
+
+type CORSSuite struct{}
+
+var _ = Suite(&CORSSuite{})
+
+// Make sure the spec is compatible and will be accepted by middleware registry
+func (s *CORSSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *CORSSuite) TestNewCORSBadParams(c *C) {
+	tcs := []CORS{
+		{},
+		{AllowedOrigins: []string{""}},
+		{AllowedOrigins: []string{"https://*.*.example.com"}},
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowedOriginRegexps: []string{"https://(.*"}},
+		{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET, POST"}},
+		{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{""}},
+		{AllowedOrigins: []string{"*"}, ExposedHeaders: []string{"X A"}},
+		{AllowedOrigins: []string{"*"}, MaxAge: -1},
+	}
+	for _, tc := range tcs {
+		_, err := NewCORS(tc)
+		c.Assert(err, NotNil, Commentf("%#v", tc))
+	}
+}
+
+func (s *CORSSuite) TestNewCORSFromOther(c *C) {
+	cr, err := NewCORS(CORS{
+		AllowedOrigins:       []string{"https://example.com"},
+		AllowedOriginRegexps: []string{`https://.*\.example\.org`},
+		AllowedMethods:       []string{"GET", "PUT"},
+		AllowedHeaders:       []string{"Authorization"},
+		ExposedHeaders:       []string{"X-Total"},
+		AllowCredentials:     true,
+		MaxAge:               600,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(cr.String(), Not(Equals), "")
+
+	out, err := FromOther(*cr)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, cr)
+}
+
+func (s *CORSSuite) TestNewCORSFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		cr := out.(*CORS)
+		c.Assert(cr.AllowedOrigins, DeepEquals, []string{"https://example.com", "https://*.example.com"})
+		c.Assert(cr.AllowedOriginRegexps, DeepEquals, []string{`https://.*\.example\.org`})
+		c.Assert(cr.AllowedMethods, DeepEquals, []string{"GET", "DELETE"})
+		c.Assert(cr.AllowedHeaders, DeepEquals, []string{"Authorization"})
+		c.Assert(cr.ExposedHeaders, DeepEquals, []string{"X-Total"})
+		c.Assert(cr.AllowCredentials, Equals, true)
+		c.Assert(cr.MaxAge, Equals, 600)
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test",
+		"--origin=https://example.com", "--origin=https://*.example.com", `--originRegexp=https://.*\.example\.org`,
+		"--method=GET", "--method=DELETE", "--header=Authorization", "--exposeHeader=X-Total",
+		"--credentials", "--maxAge=600"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *CORSSuite) TestOrigins(c *C) {
+	h := newHandler(c, CORS{
+		AllowedOrigins:       []string{"https://example.com", "https://*.example.net"},
+		AllowedOriginRegexps: []string{`https://(a|b)\.example\.org`},
+	})
+	tcs := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://example.com", true},
+		{"HTTPS://EXAMPLE.COM", true},
+		{"http://example.com", false},
+		{"https://example.com.evil.com", false},
+		{"https://app.example.net", true},
+		{"https://example.net", false},
+		{"https://a.example.org", true},
+		{"https://c.example.org", false},
+		{"https://a.example.org.evil.com", false},
+	}
+	for _, tc := range tcs {
+		re := serve(h, request(http.MethodGet, tc.origin))
+		c.Assert(re.Code, Equals, http.StatusOK)
+		if tc.allowed {
+			c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, tc.origin, Commentf(tc.origin))
+		} else {
+			c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, "", Commentf(tc.origin))
+		}
+		c.Assert(re.Header().Get("Vary"), Equals, "Origin")
+	}
+}
+
+func (s *CORSSuite) TestActualRequest(c *C) {
+	h := newHandler(c, CORS{AllowedOrigins: []string{"*"}, ExposedHeaders: []string{"X-Total", "X-Page"}})
+	re := serve(h, request(http.MethodGet, "https://example.com"))
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Body.String(), Equals, "backend")
+	c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, "*")
+	c.Assert(re.Header().Get("Access-Control-Expose-Headers"), Equals, "X-Total, X-Page")
+	c.Assert(re.Header().Get("Access-Control-Allow-Credentials"), Equals, "")
+
+	// Requests that are not cross-origin are left alone
+	re = serve(h, request(http.MethodGet, ""))
+	c.Assert(re.Body.String(), Equals, "backend")
+	c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+}
+
+func (s *CORSSuite) TestCredentials(c *C) {
+	h := newHandler(c, CORS{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true})
+	re := serve(h, request(http.MethodGet, "https://app.example.com"))
+	c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Assert(re.Header().Get("Access-Control-Allow-Credentials"), Equals, "true")
+}
+
+func (s *CORSSuite) TestPreflight(c *C) {
+	h := newHandler(c, CORS{
+		AllowedOrigins: []string{"https://example.com"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Content-Type", "X-Token"},
+		MaxAge:         600,
+	})
+
+	r := request(http.MethodOptions, "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "PUT")
+	r.Header.Set("Access-Control-Request-Headers", "content-type, x-token")
+	re := serve(h, r)
+	c.Assert(re.Code, Equals, http.StatusNoContent)
+	c.Assert(re.Body.String(), Equals, "")
+	c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, "https://example.com")
+	c.Assert(re.Header().Get("Access-Control-Allow-Methods"), Equals, "GET, PUT")
+	c.Assert(re.Header().Get("Access-Control-Allow-Headers"), Equals, "Content-Type, X-Token")
+	c.Assert(re.Header().Get("Access-Control-Max-Age"), Equals, "600")
+	c.Assert(re.Header()["Vary"], DeepEquals, []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"})
+
+	forbidden := []func(r *http.Request){
+		func(r *http.Request) { r.Header.Set("Origin", "https://evil.com") },
+		func(r *http.Request) { r.Header.Set("Access-Control-Request-Method", "DELETE") },
+		func(r *http.Request) { r.Header.Set("Access-Control-Request-Headers", "X-Other") },
+	}
+	for i, f := range forbidden {
+		r := request(http.MethodOptions, "https://example.com")
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		f(r)
+		re := serve(h, r)
+		c.Assert(re.Code, Equals, http.StatusForbidden, Commentf("case %d", i))
+		c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, "", Commentf("case %d", i))
+	}
+
+	// OPTIONS requests that are not preflights reach the backend
+	re = serve(h, request(http.MethodOptions, "https://example.com"))
+	c.Assert(re.Body.String(), Equals, "backend")
+}
+
+func (s *CORSSuite) TestAnyHeader(c *C) {
+	h := newHandler(c, CORS{AllowedOrigins: []string{"https://example.com"}, AllowedHeaders: []string{"*"}})
+	r := request(http.MethodOptions, "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", "X-Anything")
+	re := serve(h, r)
+	c.Assert(re.Code, Equals, http.StatusNoContent)
+	c.Assert(re.Header().Get("Access-Control-Allow-Headers"), Equals, "X-Anything")
+}
+
+func newHandler(c *C, cfg CORS) http.Handler {
+	cr, err := NewCORS(cfg)
+	c.Assert(err, IsNil)
+	h, err := cr.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	c.Assert(err, IsNil)
+	return h
+}
+
+func request(method, origin string) *http.Request {
+	r := httptest.NewRequest(method, "http://api.example.com/users", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	return r
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, r)
+	return re
+}
@@ -0,0 +1,139 @@
+package cors
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type handler struct {
+	next             http.Handler
+	anyOrigin        bool
+	origins          []string
+	wildcards        []wildcard
+	regexps          []*regexp.Regexp
+	methods          string
+	allowedMethods   map[string]bool
+	anyHeader        bool
+	allowedHeaders   map[string]bool
+	exposedHeaders   string
+	allowCredentials bool
+	maxAge           int
+}
+
+// wildcard matches origins that start with the prefix and end with the
+// suffix, e.g. https://*.example.com.
+type wildcard struct {
+	prefix string
+	suffix string
+}
+
+func (w wildcard) match(origin string) bool {
+	return len(origin) > len(w.prefix)+len(w.suffix) && strings.HasPrefix(origin, w.prefix) && strings.HasSuffix(origin, w.suffix)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		h.preflight(w, r, origin)
+		return
+	}
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	if h.allowedOrigin(origin) {
+		h.setOrigin(header, origin)
+		if h.exposedHeaders != "" {
+			header.Set("Access-Control-Expose-Headers", h.exposedHeaders)
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// preflight answers a request that asks whether the actual request is
+// allowed. Requests that are not allowed get no CORS headers, which tells
+// the browser to not make the actual request.
+func (h *handler) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	method := strings.ToUpper(strings.TrimSpace(r.Header.Get("Access-Control-Request-Method")))
+	requested := requestedHeaders(r)
+	if !h.allowedOrigin(origin) || !h.allowedMethods[method] || !h.allowHeaders(requested) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	h.setOrigin(header, origin)
+	header.Set("Access-Control-Allow-Methods", h.methods)
+	if len(requested) != 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if h.maxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(h.maxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) setOrigin(header http.Header, origin string) {
+	if h.anyOrigin && !h.allowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if h.allowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (h *handler) allowedOrigin(origin string) bool {
+	if h.anyOrigin {
+		return true
+	}
+	lower := strings.ToLower(origin)
+	for _, o := range h.origins {
+		if o == lower {
+			return true
+		}
+	}
+	for _, w := range h.wildcards {
+		if w.match(lower) {
+			return true
+		}
+	}
+	for _, re := range h.regexps {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handler) allowHeaders(requested []string) bool {
+	if h.anyHeader {
+		return true
+	}
+	for _, name := range requested {
+		if !h.allowedHeaders[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func requestedHeaders(r *http.Request) []string {
+	var names []string
+	for _, v := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
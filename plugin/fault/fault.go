@@ -0,0 +1,231 @@
+// Package fault implements a middleware that injects faults into requests for
+// chaos testing: latency, aborts with chosen status codes and connection
+// resets. Faults can be turned off in all fault middlewares at once with the
+// kill switch, which is kept in the engine and applied to every vulcand
+// process with SetEnabled.
+package fault
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "fault"
+
+// Distributions of injected latency.
+const (
+	DistributionUniform = "uniform"
+	DistributionNormal  = "normal"
+)
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// disabled is the kill switch of all fault middlewares of the process.
+var disabled int32
+
+// SetEnabled turns injection of faults on or off in all fault middlewares of
+// the process. Requests go through untouched while faults are off. Vulcand
+// calls it when the kill switch changes in the engine.
+func SetEnabled(enabled bool) {
+	var v int32
+	if !enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&disabled, v)
+}
+
+// Enabled tells whether fault middlewares inject faults.
+func Enabled() bool {
+	return atomic.LoadInt32(&disabled) == 0
+}
+
+// Fault injects faults into a percentage of requests. A faulty request is
+// delayed, if there is a delay, and then either aborted with one of the abort
+// codes or has its connection reset, if either is set.
+type Fault struct {
+	// Percentage of requests to inject faults into, from 0 to 100, all
+	// requests by default.
+	Percentage float64 `json:",omitempty"`
+	// Header and HeaderValue target faults at requests with the header, e.g.
+	// X-Chaos, so that only tagged test traffic is affected. Requests with
+	// any value of the header are targeted if HeaderValue is not set.
+	Header      string `json:",omitempty"`
+	HeaderValue string `json:",omitempty"`
+	// Delay is the latency to inject, e.g. "200ms".
+	Delay string `json:",omitempty"`
+	// DelayJitter distributes the latency around the delay, e.g. "50ms".
+	DelayJitter string `json:",omitempty"`
+	// DelayDistribution is 'uniform' (the default) for latency anywhere within
+	// the jitter of the delay, or 'normal' for the jitter to be the standard
+	// deviation.
+	DelayDistribution string `json:",omitempty"`
+	// AbortCodes are status codes to abort requests with, one picked at
+	// random for every request.
+	AbortCodes []int `json:",omitempty"`
+	// Reset closes connections of requests without a response.
+	Reset bool `json:",omitempty"`
+
+	delay  time.Duration
+	jitter time.Duration
+	clock  timetools.TimeProvider
+	rand   random
+}
+
+// random is the source of randomness, it is satisfied by *rand.Rand.
+type random interface {
+	Float64() float64
+	NormFloat64() float64
+	Intn(n int) int
+}
+
+// globalRand uses the top level source of the math/rand package, which is
+// safe for concurrent use.
+type globalRand struct{}
+
+func (globalRand) Float64() float64     { return rand.Float64() }
+func (globalRand) NormFloat64() float64 { return rand.NormFloat64() }
+func (globalRand) Intn(n int) int       { return rand.Intn(n) }
+
+// NewFault validates settings and returns a fault injection middleware.
+func NewFault(f Fault) (*Fault, error) {
+	if f.Percentage == 0 {
+		f.Percentage = 100
+	}
+	if f.Percentage < 0 || f.Percentage > 100 {
+		return nil, fmt.Errorf("percentage should be between 0 and 100, got %v", f.Percentage)
+	}
+	if f.HeaderValue != "" && f.Header == "" {
+		return nil, fmt.Errorf("header value is set without a header")
+	}
+	var err error
+	if f.delay, err = parseDuration("delay", f.Delay); err != nil {
+		return nil, err
+	}
+	if f.jitter, err = parseDuration("delay jitter", f.DelayJitter); err != nil {
+		return nil, err
+	}
+	if f.jitter != 0 && f.delay == 0 {
+		return nil, fmt.Errorf("delay jitter is set without a delay")
+	}
+	switch f.DelayDistribution {
+	case "":
+		if f.jitter != 0 {
+			f.DelayDistribution = DistributionUniform
+		}
+	case DistributionUniform, DistributionNormal:
+	default:
+		return nil, fmt.Errorf("unsupported delay distribution %q, expected %s or %s", f.DelayDistribution, DistributionUniform, DistributionNormal)
+	}
+	for _, code := range f.AbortCodes {
+		if code < 200 || code > 599 {
+			return nil, fmt.Errorf("abort code should be between 200 and 599, got %d", code)
+		}
+	}
+	if len(f.AbortCodes) != 0 && f.Reset {
+		return nil, fmt.Errorf("requests can be either aborted or reset, not both")
+	}
+	if f.delay == 0 && len(f.AbortCodes) == 0 && !f.Reset {
+		return nil, fmt.Errorf("at least one of delay, abort codes or reset is required")
+	}
+	if f.clock == nil {
+		f.clock = &timetools.RealTime{}
+	}
+	if f.rand == nil {
+		f.rand = globalRand{}
+	}
+	return &f, nil
+}
+
+func parseDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s should be a duration >= 0, got %q", name, value)
+	}
+	return d, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (f *Fault) NewHandler(next http.Handler) (http.Handler, error) {
+	return f.NewHandlerWithEnv(next, plugin.Env{})
+}
+
+// NewHandlerWithEnv returns a handler that counts injected faults in the
+// "delayed", "aborted" and "reset" counters of the middleware.
+func (f *Fault) NewHandlerWithEnv(next http.Handler, env plugin.Env) (http.Handler, error) {
+	return &handler{next: next, config: f, env: env}, nil
+}
+
+func (f *Fault) String() string {
+	var out []string
+	out = append(out, fmt.Sprintf("percentage=%v", f.Percentage))
+	if f.Header != "" {
+		out = append(out, fmt.Sprintf("header=%s:%s", f.Header, f.HeaderValue))
+	}
+	if f.delay != 0 {
+		out = append(out, fmt.Sprintf("delay=%v", f.delay))
+	}
+	if f.jitter != 0 {
+		out = append(out, fmt.Sprintf("jitter=%v(%s)", f.jitter, f.DelayDistribution))
+	}
+	if len(f.AbortCodes) != 0 {
+		out = append(out, fmt.Sprintf("abort=%v", f.AbortCodes))
+	}
+	if f.Reset {
+		out = append(out, "reset")
+	}
+	return strings.Join(out, ", ")
+}
+
+func FromOther(f Fault) (plugin.Middleware, error) {
+	return NewFault(f)
+}
+
+// FromCli constructs a middleware instance from the command line parameters.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	f := Fault{
+		Percentage:        c.Float64("percentage"),
+		Header:            c.String("header"),
+		HeaderValue:       c.String("headerValue"),
+		DelayDistribution: c.String("delayDistribution"),
+		AbortCodes:        c.IntSlice("abortCode"),
+		Reset:             c.Bool("reset"),
+	}
+	if d := c.Duration("delay"); d != 0 {
+		f.Delay = d.String()
+	}
+	if d := c.Duration("delayJitter"); d != 0 {
+		f.DelayJitter = d.String()
+	}
+	return NewFault(f)
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.Float64Flag{Name: "percentage", Usage: "percentage of requests to inject faults into, 100 by default"},
+		cli.StringFlag{Name: "header", Usage: "inject faults only into requests with the header, e.g. X-Chaos"},
+		cli.StringFlag{Name: "headerValue", Usage: "value of the header, any value if not set"},
+		cli.DurationFlag{Name: "delay", Usage: "latency to inject"},
+		cli.DurationFlag{Name: "delayJitter", Usage: "jitter of the injected latency"},
+		cli.StringFlag{Name: "delayDistribution", Usage: "distribution of the latency within the jitter: uniform or normal"},
+		cli.IntSliceFlag{Name: "abortCode", Usage: "status code to abort requests with, can be repeated"},
+		cli.BoolFlag{Name: "reset", Usage: "reset connections of requests"},
+	}
+}
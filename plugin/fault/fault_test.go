@@ -0,0 +1,192 @@
+package fault
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestFault(t *testing.T) { TestingT(t) }
+
+type FaultSuite struct {
+	clock *timetools.FreezedTime
+	rand  *fixedRand
+}
+
+var _ = Suite(&FaultSuite{})
+
+func (s *FaultSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	s.rand = &fixedRand{}
+	SetEnabled(true)
+}
+
+// fixedRand returns the values it is told to.
+type fixedRand struct {
+	float float64
+	norm  float64
+	n     int
+}
+
+func (r *fixedRand) Float64() float64     { return r.float }
+func (r *fixedRand) NormFloat64() float64 { return r.norm }
+func (r *fixedRand) Intn(n int) int       { return r.n }
+
+func (s *FaultSuite) newHandler(c *C, f Fault) http.Handler {
+	f.clock = s.clock
+	f.rand = s.rand
+	out, err := NewFault(f)
+	c.Assert(err, IsNil)
+	h, err := out.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	c.Assert(err, IsNil)
+	return h
+}
+
+func get(h http.Handler, header http.Header) int {
+	re := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	h.ServeHTTP(re, r)
+	return re.Code
+}
+
+func (s *FaultSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *FaultSuite) TestNew(c *C) {
+	f, err := NewFault(Fault{AbortCodes: []int{503}})
+	c.Assert(err, IsNil)
+	c.Assert(fmt.Sprint(f), Equals, "percentage=100, abort=[503]")
+
+	f, err = NewFault(Fault{Percentage: 5, Header: "X-Chaos", Delay: "1s", DelayJitter: "100ms", Reset: true})
+	c.Assert(err, IsNil)
+	c.Assert(fmt.Sprint(f), Equals, "percentage=5, header=X-Chaos:, delay=1s, jitter=100ms(uniform), reset")
+}
+
+func (s *FaultSuite) TestFromOtherBadParams(c *C) {
+	tcs := []Fault{
+		{},
+		{Percentage: -1, Reset: true},
+		{Percentage: 101, Reset: true},
+		{HeaderValue: "yes", Reset: true},
+		{Delay: "soon"},
+		{Delay: "-1s"},
+		{DelayJitter: "1s", Reset: true},
+		{Delay: "1s", DelayJitter: "1s", DelayDistribution: "poisson"},
+		{AbortCodes: []int{99}},
+		{AbortCodes: []int{600}},
+		{AbortCodes: []int{503}, Reset: true},
+	}
+	for i, tc := range tcs {
+		comment := Commentf("test case #%d: %v", i, tc)
+		_, err := FromOther(tc)
+		c.Assert(err, NotNil, comment)
+	}
+}
+
+func (s *FaultSuite) TestFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	app.Flags = CliFlags()
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+		f := out.(*Fault)
+		c.Assert(f.Percentage, Equals, 10.0)
+		c.Assert(f.Header, Equals, "X-Chaos")
+		c.Assert(f.HeaderValue, Equals, "on")
+		c.Assert(f.Delay, Equals, "200ms")
+		c.Assert(f.DelayJitter, Equals, "50ms")
+		c.Assert(f.DelayDistribution, Equals, DistributionNormal)
+		c.Assert(f.AbortCodes, DeepEquals, []int{500, 503})
+		return nil
+	}
+	app.Run([]string{"test", "--percentage=10", "--header=X-Chaos", "--headerValue=on", "--delay=200ms", "--delayJitter=50ms",
+		"--delayDistribution=normal", "--abortCode=500", "--abortCode=503"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *FaultSuite) TestAbort(c *C) {
+	h := s.newHandler(c, Fault{AbortCodes: []int{500, 503}})
+	c.Assert(get(h, nil), Equals, http.StatusInternalServerError)
+	s.rand.n = 1
+	c.Assert(get(h, nil), Equals, http.StatusServiceUnavailable)
+}
+
+func (s *FaultSuite) TestPercentage(c *C) {
+	h := s.newHandler(c, Fault{Percentage: 25, AbortCodes: []int{503}})
+	s.rand.float = 0.2
+	c.Assert(get(h, nil), Equals, http.StatusServiceUnavailable)
+	s.rand.float = 0.3
+	c.Assert(get(h, nil), Equals, http.StatusOK)
+}
+
+func (s *FaultSuite) TestHeader(c *C) {
+	h := s.newHandler(c, Fault{Header: "X-Chaos", AbortCodes: []int{503}})
+	c.Assert(get(h, nil), Equals, http.StatusOK)
+	c.Assert(get(h, http.Header{"X-Chaos": {"anything"}}), Equals, http.StatusServiceUnavailable)
+
+	h = s.newHandler(c, Fault{Header: "x-chaos", HeaderValue: "on", AbortCodes: []int{503}})
+	c.Assert(get(h, http.Header{"X-Chaos": {"off"}}), Equals, http.StatusOK)
+	c.Assert(get(h, http.Header{"X-Chaos": {"off", "on"}}), Equals, http.StatusServiceUnavailable)
+}
+
+func (s *FaultSuite) TestDelay(c *C) {
+	start := s.clock.CurrentTime
+	h := s.newHandler(c, Fault{Delay: "200ms"})
+	c.Assert(get(h, nil), Equals, http.StatusOK)
+	c.Assert(s.clock.CurrentTime.Sub(start), Equals, 200*time.Millisecond)
+
+	// Uniform jitter spreads the delay evenly on both sides
+	start = s.clock.CurrentTime
+	h = s.newHandler(c, Fault{Delay: "200ms", DelayJitter: "100ms"})
+	s.rand.float = 0.75
+	get(h, nil)
+	c.Assert(s.clock.CurrentTime.Sub(start), Equals, 250*time.Millisecond)
+
+	// Normal jitter is the standard deviation, the delay is never negative
+	start = s.clock.CurrentTime
+	h = s.newHandler(c, Fault{Delay: "200ms", DelayJitter: "100ms", DelayDistribution: DistributionNormal, AbortCodes: []int{504}})
+	s.rand.norm = -3
+	c.Assert(get(h, nil), Equals, http.StatusGatewayTimeout)
+	c.Assert(s.clock.CurrentTime, Equals, start)
+}
+
+func (s *FaultSuite) TestReset(c *C) {
+	f, err := NewFault(Fault{Reset: true})
+	c.Assert(err, IsNil)
+	h, err := f.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	c.Assert(err, IsNil)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	_, err = http.Get(srv.URL)
+	c.Assert(err, NotNil)
+}
+
+func (s *FaultSuite) TestKillSwitch(c *C) {
+	h := s.newHandler(c, Fault{AbortCodes: []int{503}})
+	SetEnabled(false)
+	c.Assert(Enabled(), Equals, false)
+	c.Assert(get(h, nil), Equals, http.StatusOK)
+
+	SetEnabled(true)
+	c.Assert(Enabled(), Equals, true)
+	c.Assert(get(h, nil), Equals, http.StatusServiceUnavailable)
+}
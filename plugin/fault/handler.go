@@ -0,0 +1,102 @@
+package fault
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/vulcand/vulcand/plugin"
+)
+
+type handler struct {
+	next   http.Handler
+	config *Fault
+	env    plugin.Env
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !Enabled() || !h.targeted(r) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	f := h.config
+	if f.delay != 0 {
+		h.env.IncCounter("delayed", 1)
+		select {
+		case <-f.clock.After(h.delay()):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	switch {
+	case len(f.AbortCodes) != 0:
+		code := f.AbortCodes[f.rand.Intn(len(f.AbortCodes))]
+		plugin.RequestLog(r).Debugf("Aborted request to %s with %d", r.URL, code)
+		h.env.IncCounter("aborted", 1)
+		http.Error(w, http.StatusText(code), code)
+	case f.Reset:
+		plugin.RequestLog(r).Debugf("Reset connection of request to %s", r.URL)
+		h.env.IncCounter("reset", 1)
+		reset(w)
+	default:
+		h.next.ServeHTTP(w, r)
+	}
+}
+
+// targeted tells whether to inject faults into the request.
+func (h *handler) targeted(r *http.Request) bool {
+	f := h.config
+	if f.Header != "" {
+		values, ok := r.Header[http.CanonicalHeaderKey(f.Header)]
+		if !ok {
+			return false
+		}
+		if f.HeaderValue != "" && !contains(values, f.HeaderValue) {
+			return false
+		}
+	}
+	return f.Percentage >= 100 || f.rand.Float64()*100 < f.Percentage
+}
+
+// delay returns the latency to inject into a request.
+func (h *handler) delay() time.Duration {
+	f := h.config
+	d := f.delay
+	switch f.DelayDistribution {
+	case DistributionUniform:
+		d += time.Duration((2*f.rand.Float64() - 1) * float64(f.jitter))
+	case DistributionNormal:
+		d += time.Duration(f.rand.NormFloat64() * float64(f.jitter))
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// reset closes the connection of the request abruptly. Closing a TCP
+// connection with no linger time sends RST to the client. Connections that
+// can not be hijacked, e.g. HTTP/2 ones, are aborted by the server instead.
+func reset(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package forwardauth
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "forwardauth"
+
+const (
+	// DefaultTimeout is how long to wait for the auth service by default.
+	DefaultTimeout = 5 * time.Second
+	// DefaultCacheSize is how many decisions are cached by default.
+	DefaultCacheSize = 1024
+)
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// ForwardAuth asks an external auth service whether to let requests through.
+// The auth service gets a GET request with headers of the original request,
+// and X-Forwarded-Method, X-Forwarded-Proto, X-Forwarded-Host,
+// X-Forwarded-Uri and X-Forwarded-For that describe it. A 2xx response lets
+// the request through, any other response is returned to the client as is.
+type ForwardAuth struct {
+	// Address is the URL of the auth service.
+	Address string
+	// Timeout is how long to wait for the auth service, e.g. "2s".
+	Timeout string
+	// RequestHeaders are headers of the original request sent to the auth
+	// service, all headers are sent if empty.
+	RequestHeaders []string
+	// ResponseHeaders are headers of a 2xx response of the auth service that
+	// are copied to the request, e.g. "X-User-Id". Headers with these names
+	// are removed from requests.
+	ResponseHeaders []string
+	// CacheTTL is how long decisions are cached for, e.g. "30s". Decisions
+	// are not cached if it is not set.
+	CacheTTL string
+	// CacheKeyHeaders are headers of the request to the auth service that
+	// decisions are cached by, e.g. "Authorization". RequestHeaders are used
+	// if empty, one of them should be set to cache decisions. The request id
+	// header is never a part of the key, X-Forwarded-Method,
+	// X-Forwarded-Host and X-Forwarded-Uri always are.
+	CacheKeyHeaders []string
+	// CacheByCredentialsOnly leaves X-Forwarded-Method, X-Forwarded-Host and
+	// X-Forwarded-Uri out of the cache key, so that a decision is reused for
+	// any method, host and path. It is only safe if the auth service never
+	// decides by them.
+	CacheByCredentialsOnly bool
+	// CacheSize is how many decisions are cached at most.
+	CacheSize int
+	// FailOpen lets requests through when the auth service fails or times
+	// out. They are rejected with 503 Service Unavailable otherwise.
+	FailOpen bool
+
+	timeout  time.Duration
+	cacheTTL time.Duration
+	clock    timetools.TimeProvider
+}
+
+// NewForwardAuth validates settings and returns a forward auth middleware.
+func NewForwardAuth(f ForwardAuth) (*ForwardAuth, error) {
+	u, err := url.Parse(f.Address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("address should be an absolute http(s) URL, got %q", f.Address)
+	}
+	if f.timeout, err = parseDuration("timeout", f.Timeout, DefaultTimeout); err != nil {
+		return nil, err
+	}
+	if f.timeout == 0 {
+		return nil, fmt.Errorf("timeout should be > 0")
+	}
+	if f.cacheTTL, err = parseDuration("cache TTL", f.CacheTTL, 0); err != nil {
+		return nil, err
+	}
+	if f.CacheSize < 0 {
+		return nil, fmt.Errorf("cache size should be >= 0, got %d", f.CacheSize)
+	}
+	for _, h := range append(append(append([]string{}, f.RequestHeaders...), f.ResponseHeaders...), f.CacheKeyHeaders...) {
+		if h == "" || strings.ContainsAny(h, " :") {
+			return nil, fmt.Errorf("invalid header name %q", h)
+		}
+	}
+	// Requests always differ in some of the headers, e.g. X-Forwarded-For,
+	// so a key of all of them would never match, and a key of the headers
+	// that only describe the request would share decisions between clients.
+	if f.cacheTTL != 0 && len(f.credentialHeaders("")) == 0 {
+		return nil, fmt.Errorf("cache TTL needs request headers or cache key headers other than %s to cache decisions by",
+			strings.Join(requestKeyHeaders, ", "))
+	}
+	if f.clock == nil {
+		f.clock = &timetools.RealTime{}
+	}
+	return &f, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (f *ForwardAuth) NewHandler(next http.Handler) (http.Handler, error) {
+	return f.NewHandlerWithEnv(next, plugin.Env{})
+}
+
+// requestKeyHeaders are headers of the request to the auth service that
+// describe the original request, they are a part of cache keys so that a
+// decision for one method, host or path is not reused for another.
+var requestKeyHeaders = []string{"X-Forwarded-Host", "X-Forwarded-Method", "X-Forwarded-Uri"}
+
+// credentialHeaders returns canonical names of the headers that decisions are
+// cached by, leaving out the request id header, since every request has an id
+// of its own, and the headers that describe the request.
+func (f *ForwardAuth) credentialHeaders(requestIdHeader string) []string {
+	names := f.CacheKeyHeaders
+	if len(names) == 0 {
+		names = f.RequestHeaders
+	}
+	var out []string
+	for _, name := range names {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if requestIdHeader != "" && name == textproto.CanonicalMIMEHeaderKey(requestIdHeader) {
+			continue
+		}
+		if isRequestKeyHeader(name) {
+			continue
+		}
+		out = append(out, name)
+	}
+	return out
+}
+
+func isRequestKeyHeader(name string) bool {
+	for _, h := range requestKeyHeaders {
+		if name == h {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHandlerWithEnv returns a handler that leaves the request id header out
+// of cache keys, since every request has an id of its own.
+func (f *ForwardAuth) NewHandlerWithEnv(next http.Handler, env plugin.Env) (http.Handler, error) {
+	h := &handler{
+		next:     next,
+		address:  f.Address,
+		failOpen: f.FailOpen,
+		cacheTTL: f.cacheTTL,
+		clock:    f.clock,
+		client: &http.Client{
+			Timeout: f.timeout,
+			// Redirects are answers of the auth service, e.g. to a login page.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	for _, name := range f.RequestHeaders {
+		h.requestHeaders = append(h.requestHeaders, textproto.CanonicalMIMEHeaderKey(name))
+	}
+	for _, name := range f.ResponseHeaders {
+		h.responseHeaders = append(h.responseHeaders, textproto.CanonicalMIMEHeaderKey(name))
+	}
+	h.cacheKeyHeaders = f.credentialHeaders(env.RequestIdHeader)
+	if f.cacheTTL != 0 && len(h.cacheKeyHeaders) == 0 {
+		return nil, fmt.Errorf("cache key headers leave nothing but the request id header %s to cache decisions by", env.RequestIdHeader)
+	}
+	if !f.CacheByCredentialsOnly {
+		h.cacheKeyHeaders = append(h.cacheKeyHeaders, requestKeyHeaders...)
+	}
+	sort.Strings(h.cacheKeyHeaders)
+	if f.cacheTTL != 0 {
+		size := f.CacheSize
+		if size == 0 {
+			size = DefaultCacheSize
+		}
+		cache, err := ttlmap.NewConcurrent(size, ttlmap.Clock(f.clock))
+		if err != nil {
+			return nil, err
+		}
+		h.cache = cache
+	}
+	return h, nil
+}
+
+func (f *ForwardAuth) String() string {
+	return fmt.Sprintf("address=%s, timeout=%s, requestHeaders=%s, responseHeaders=%s, cacheTTL=%s, cacheKeyHeaders=%s, cacheByCredentialsOnly=%t, cacheSize=%d, failOpen=%t",
+		f.Address, f.timeout, strings.Join(f.RequestHeaders, ","), strings.Join(f.ResponseHeaders, ","),
+		f.cacheTTL, strings.Join(f.CacheKeyHeaders, ","), f.CacheByCredentialsOnly, f.CacheSize, f.FailOpen)
+}
+
+func FromOther(f ForwardAuth) (plugin.Middleware, error) {
+	return NewForwardAuth(f)
+}
+
+// FromCli constructs the middleware from the command line.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	f := ForwardAuth{
+		Address:         c.String("address"),
+		RequestHeaders:  c.StringSlice("requestHeader"),
+		ResponseHeaders: c.StringSlice("responseHeader"),
+		CacheKeyHeaders: c.StringSlice("cacheKeyHeader"),
+		CacheSize:       c.Int("cacheSize"),
+		FailOpen:        c.Bool("failOpen"),
+
+		CacheByCredentialsOnly: c.Bool("cacheByCredentialsOnly"),
+	}
+	if d := c.Duration("timeout"); d != 0 {
+		f.Timeout = d.String()
+	}
+	if d := c.Duration("cacheTTL"); d != 0 {
+		f.CacheTTL = d.String()
+	}
+	return NewForwardAuth(f)
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "address", Usage: "URL of the auth service"},
+		cli.DurationFlag{Name: "timeout", Usage: "how long to wait for the auth service"},
+		cli.StringSliceFlag{Name: "requestHeader", Value: &cli.StringSlice{}, Usage: "request header sent to the auth service, all headers are sent if not set"},
+		cli.StringSliceFlag{Name: "responseHeader", Value: &cli.StringSlice{}, Usage: "auth service response header copied to the request"},
+		cli.DurationFlag{Name: "cacheTTL", Usage: "how long decisions are cached for"},
+		cli.StringSliceFlag{Name: "cacheKeyHeader", Value: &cli.StringSlice{}, Usage: "header of the auth request that decisions are cached by along with the method, host and URI, request headers are used if not set"},
+		cli.BoolFlag{Name: "cacheByCredentialsOnly", Usage: "reuse cached decisions for any method, host and URI, only safe if the auth service never decides by them"},
+		cli.IntFlag{Name: "cacheSize", Usage: "how many decisions are cached at most"},
+		cli.BoolFlag{Name: "failOpen", Usage: "let requests through when the auth service fails"},
+	}
+}
+
+func parseDuration(name, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s should be >= 0, got %s", name, value)
+	}
+	return d, nil
+}
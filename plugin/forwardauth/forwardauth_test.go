@@ -0,0 +1,349 @@
+package forwardauth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestForwardAuth(t *testing.T) { TestingT(t) }
+
+type ForwardAuthSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&ForwardAuthSuite{})
+
+func (s *ForwardAuthSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{CurrentTime: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+// Make sure the spec is compatible and will be accepted by middleware registry
+func (s *ForwardAuthSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *ForwardAuthSuite) TestNewForwardAuthBadParams(c *C) {
+	tcs := []ForwardAuth{
+		{},
+		{Address: "/auth"},
+		{Address: "ftp://auth.example.com"},
+		{Address: "http://auth", Timeout: "soon"},
+		{Address: "http://auth", Timeout: "0s"},
+		{Address: "http://auth", CacheTTL: "-1s"},
+		{Address: "http://auth", CacheSize: -1},
+		{Address: "http://auth", RequestHeaders: []string{""}},
+		{Address: "http://auth", ResponseHeaders: []string{"X User"}},
+		{Address: "http://auth", CacheKeyHeaders: []string{"X:User"}},
+		// Caching needs headers to cache decisions by
+		{Address: "http://auth", CacheTTL: "30s"},
+		// Headers that describe the request do not tell clients apart
+		{Address: "http://auth", CacheTTL: "30s", CacheKeyHeaders: []string{"X-Forwarded-Uri", "x-forwarded-host"}},
+	}
+	for _, tc := range tcs {
+		_, err := NewForwardAuth(tc)
+		c.Assert(err, NotNil, Commentf("%#v", tc))
+	}
+}
+
+func (s *ForwardAuthSuite) TestNewForwardAuthFromOther(c *C) {
+	f, err := NewForwardAuth(ForwardAuth{
+		Address:         "https://auth.example.com/check",
+		Timeout:         "2s",
+		RequestHeaders:  []string{"Authorization", "Cookie"},
+		ResponseHeaders: []string{"X-User-Id"},
+		CacheTTL:        "30s",
+		CacheKeyHeaders: []string{"Authorization", "X-Forwarded-Uri"},
+		CacheSize:       100,
+		FailOpen:        true,
+
+		CacheByCredentialsOnly: true,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(f.String(), Not(Equals), "")
+
+	out, err := FromOther(*f)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+}
+
+func (s *ForwardAuthSuite) TestNewForwardAuthFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		f := out.(*ForwardAuth)
+		c.Assert(f.Address, Equals, "http://auth/check")
+		c.Assert(f.Timeout, Equals, "2s")
+		c.Assert(f.RequestHeaders, DeepEquals, []string{"Authorization"})
+		c.Assert(f.ResponseHeaders, DeepEquals, []string{"X-User-Id", "X-Roles"})
+		c.Assert(f.CacheTTL, Equals, "1m0s")
+		c.Assert(f.CacheKeyHeaders, DeepEquals, []string{"Authorization", "X-Forwarded-Method"})
+		c.Assert(f.CacheSize, Equals, 10)
+		c.Assert(f.FailOpen, Equals, true)
+		c.Assert(f.CacheByCredentialsOnly, Equals, true)
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--address=http://auth/check", "--timeout=2s", "--requestHeader=Authorization",
+		"--responseHeader=X-User-Id", "--responseHeader=X-Roles", "--cacheTTL=1m",
+		"--cacheKeyHeader=Authorization", "--cacheKeyHeader=X-Forwarded-Method", "--cacheSize=10", "--failOpen", "--cacheByCredentialsOnly"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *ForwardAuthSuite) TestAllowed(c *C) {
+	var authReq *http.Request
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authReq = r
+		w.Header().Set("X-User-Id", "user-1")
+		w.Header().Set("X-Internal", "secret")
+	}))
+	defer auth.Close()
+
+	var received http.Header
+	h := s.newHandler(c, ForwardAuth{Address: auth.URL, ResponseHeaders: []string{"x-user-id"}},
+		func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header.Clone()
+			w.Write([]byte("backend"))
+		})
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/orders?id=1", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set("Authorization", "Bearer token")
+	r.Header.Set("X-User-Id", "admin")
+	r.Header.Set("Connection", "close")
+	re := serve(h, r)
+
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Body.String(), Equals, "backend")
+	c.Assert(received.Get("X-User-Id"), Equals, "user-1")
+	c.Assert(received.Get("X-Internal"), Equals, "")
+
+	c.Assert(authReq.Method, Equals, http.MethodGet)
+	c.Assert(authReq.Header.Get("Authorization"), Equals, "Bearer token")
+	c.Assert(authReq.Header.Get("X-User-Id"), Equals, "")
+	c.Assert(authReq.Header.Get("X-Forwarded-Method"), Equals, http.MethodPost)
+	c.Assert(authReq.Header.Get("X-Forwarded-Proto"), Equals, "http")
+	c.Assert(authReq.Header.Get("X-Forwarded-Host"), Equals, "example.com")
+	c.Assert(authReq.Header.Get("X-Forwarded-Uri"), Equals, "/orders?id=1")
+	c.Assert(authReq.Header.Get("X-Forwarded-For"), Equals, "10.0.0.1")
+}
+
+func (s *ForwardAuthSuite) TestRequestHeaders(c *C) {
+	var authReq *http.Request
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authReq = r
+	}))
+	defer auth.Close()
+
+	h := s.newHandler(c, ForwardAuth{Address: auth.URL, RequestHeaders: []string{"cookie"}}, ok)
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("Cookie", "session=1")
+	r.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	c.Assert(serve(h, r).Code, Equals, http.StatusOK)
+	c.Assert(authReq.Header.Get("Cookie"), Equals, "session=1")
+	c.Assert(authReq.Header.Get("Authorization"), Equals, "")
+	c.Assert(authReq.Header.Get("X-Forwarded-For"), Equals, "1.2.3.4, 192.0.2.1")
+}
+
+func (s *ForwardAuthSuite) TestDenied(c *C) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") == "" {
+			http.Redirect(w, r, "https://login.example.com", http.StatusFound)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("who are you?"))
+	}))
+	defer auth.Close()
+
+	h := s.newHandler(c, ForwardAuth{Address: auth.URL}, func(w http.ResponseWriter, r *http.Request) {
+		c.Fatalf("request should not be forwarded")
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("Cookie", "session=1")
+	re := serve(h, r)
+	c.Assert(re.Code, Equals, http.StatusUnauthorized)
+	c.Assert(re.Header().Get("WWW-Authenticate"), Equals, `Basic realm="test"`)
+	c.Assert(re.Body.String(), Equals, "who are you?")
+
+	// Redirects are returned to the client, not followed
+	re = serve(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+	c.Assert(re.Header().Get("Location"), Equals, "https://login.example.com")
+}
+
+func (s *ForwardAuthSuite) TestCache(c *C) {
+	var calls int64
+	status := int64(http.StatusOK)
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.WriteHeader(int(atomic.LoadInt64(&status)))
+	}))
+	defer auth.Close()
+
+	h := s.newHandler(c, ForwardAuth{Address: auth.URL, CacheTTL: "1500ms", CacheKeyHeaders: []string{"Authorization", "X-Forwarded-Uri"}}, ok)
+	get := func(path, token string) int {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		r.Header.Set("Authorization", token)
+		return serve(h, r).Code
+	}
+
+	c.Assert(get("/a", "t1"), Equals, http.StatusOK)
+	c.Assert(get("/a", "t1"), Equals, http.StatusOK)
+	c.Assert(atomic.LoadInt64(&calls), Equals, int64(1))
+
+	// Other paths and credentials get decisions of their own
+	c.Assert(get("/b", "t1"), Equals, http.StatusOK)
+	c.Assert(get("/a", "t2"), Equals, http.StatusOK)
+	c.Assert(atomic.LoadInt64(&calls), Equals, int64(3))
+
+	// Decisions expire
+	atomic.StoreInt64(&status, http.StatusForbidden)
+	s.clock.Sleep(time.Second)
+	c.Assert(get("/a", "t1"), Equals, http.StatusOK)
+	s.clock.Sleep(time.Second)
+	c.Assert(get("/a", "t1"), Equals, http.StatusForbidden)
+	c.Assert(get("/a", "t1"), Equals, http.StatusForbidden)
+	c.Assert(atomic.LoadInt64(&calls), Equals, int64(4))
+
+	// Server errors are not cached
+	atomic.StoreInt64(&status, http.StatusInternalServerError)
+	c.Assert(get("/c", "t1"), Equals, http.StatusInternalServerError)
+	c.Assert(get("/c", "t1"), Equals, http.StatusInternalServerError)
+	c.Assert(atomic.LoadInt64(&calls), Equals, int64(6))
+}
+
+func (s *ForwardAuthSuite) TestCacheKey(c *C) {
+	var calls int64
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+	}))
+	defer auth.Close()
+
+	f, err := NewForwardAuth(ForwardAuth{Address: auth.URL, CacheTTL: "1m", RequestHeaders: []string{"Authorization", "X-Request-Id"}, clock: s.clock})
+	c.Assert(err, IsNil)
+	h, err := f.NewHandlerWithEnv(http.HandlerFunc(ok), plugin.Env{RequestIdHeader: "X-Request-Id"})
+	c.Assert(err, IsNil)
+	get := func(path, token, id, ip string) int {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		r.RemoteAddr = ip + ":1234"
+		r.Header.Set("Authorization", token)
+		r.Header.Set("X-Request-Id", id)
+		return serve(h, r).Code
+	}
+
+	// Requests with the same credentials to the same path share a decision,
+	// whatever their ids and addresses are
+	c.Assert(get("/a", "t1", "id-1", "10.0.0.1"), Equals, http.StatusOK)
+	c.Assert(get("/a", "t1", "id-2", "10.0.0.1"), Equals, http.StatusOK)
+	c.Assert(get("/a", "t1", "id-3", "10.0.0.2"), Equals, http.StatusOK)
+	c.Assert(atomic.LoadInt64(&calls), Equals, int64(1))
+
+	c.Assert(get("/a", "t2", "id-4", "10.0.0.1"), Equals, http.StatusOK)
+	c.Assert(get("/b", "t1", "id-5", "10.0.0.1"), Equals, http.StatusOK)
+	c.Assert(atomic.LoadInt64(&calls), Equals, int64(3))
+
+	// A key of nothing but the request id would share one decision between
+	// all requests.
+	f, err = NewForwardAuth(ForwardAuth{Address: auth.URL, CacheTTL: "1m", CacheKeyHeaders: []string{"X-Request-Id"}})
+	c.Assert(err, IsNil)
+	_, err = f.NewHandlerWithEnv(http.HandlerFunc(ok), plugin.Env{RequestIdHeader: "X-Request-Id"})
+	c.Assert(err, NotNil)
+}
+
+// Auth services that decide by the path must not have their decisions for
+// one path reused for another.
+func (s *ForwardAuthSuite) TestCacheKeyRequest(c *C) {
+	var calls int64
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		if r.Header.Get("X-Forwarded-Uri") != "/public" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer auth.Close()
+
+	serveAll := func(h http.Handler) []int {
+		var codes []int
+		for _, target := range []string{"http://example.com/public", "http://example.com/admin", "http://other.com/public"} {
+			for _, method := range []string{http.MethodGet, http.MethodDelete} {
+				r := httptest.NewRequest(method, target, nil)
+				r.Header.Set("Authorization", "t1")
+				codes = append(codes, serve(h, r).Code)
+			}
+		}
+		return codes
+	}
+
+	h := s.newHandler(c, ForwardAuth{Address: auth.URL, CacheTTL: "1m", CacheKeyHeaders: []string{"Authorization"}}, ok)
+	c.Assert(serveAll(h), DeepEquals, []int{
+		http.StatusOK, http.StatusOK,
+		http.StatusForbidden, http.StatusForbidden,
+		http.StatusOK, http.StatusOK,
+	})
+	c.Assert(atomic.LoadInt64(&calls), Equals, int64(6))
+
+	// Unless the method, host and path are left out of the key on purpose.
+	atomic.StoreInt64(&calls, 0)
+	h = s.newHandler(c, ForwardAuth{Address: auth.URL, CacheTTL: "1m", CacheKeyHeaders: []string{"Authorization"}, CacheByCredentialsOnly: true}, ok)
+	c.Assert(serveAll(h), DeepEquals, []int{
+		http.StatusOK, http.StatusOK,
+		http.StatusOK, http.StatusOK,
+		http.StatusOK, http.StatusOK,
+	})
+	c.Assert(atomic.LoadInt64(&calls), Equals, int64(1))
+}
+
+func (s *ForwardAuthSuite) TestFailure(c *C) {
+	block := make(chan struct{})
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer auth.Close()
+	defer close(block)
+
+	closed := s.newHandler(c, ForwardAuth{Address: auth.URL, Timeout: "50ms"}, ok)
+	re := serve(closed, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusServiceUnavailable)
+
+	open := s.newHandler(c, ForwardAuth{Address: auth.URL, Timeout: "50ms", FailOpen: true}, ok)
+	re = serve(open, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusOK)
+	body, _ := ioutil.ReadAll(re.Body)
+	c.Assert(string(body), Equals, "ok")
+}
+
+func (s *ForwardAuthSuite) newHandler(c *C, cfg ForwardAuth, next http.HandlerFunc) http.Handler {
+	cfg.clock = s.clock
+	f, err := NewForwardAuth(cfg)
+	c.Assert(err, IsNil)
+	h, err := f.NewHandler(next)
+	c.Assert(err, IsNil)
+	return h
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, r)
+	return re
+}
@@ -0,0 +1,181 @@
+package forwardauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// maxBodyBytes is the max size of an auth service response body returned to
+// clients.
+const maxBodyBytes = 64 * 1024
+
+// hopHeaders are not passed between the client, vulcand and the auth service.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+}
+
+type handler struct {
+	next            http.Handler
+	address         string
+	requestHeaders  []string
+	responseHeaders []string
+	failOpen        bool
+	cacheTTL        time.Duration
+	cacheKeyHeaders []string
+	cache           *ttlmap.TtlMap
+	clock           timetools.TimeProvider
+	client          *http.Client
+}
+
+// decision is a response of the auth service.
+type decision struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (d *decision) allowed() bool {
+	return d.status >= 200 && d.status < 300
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Clients must not be able to pass headers the auth service sets.
+	for _, name := range h.responseHeaders {
+		r.Header.Del(name)
+	}
+	req := h.authRequest(r)
+	d, err := h.decide(req)
+	if err != nil {
+		plugin.RequestLog(r).Warnf("Auth service %s failed for %s: %v", h.address, r.URL, err)
+		if h.failOpen {
+			h.next.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if !d.allowed() {
+		for name, values := range d.header {
+			w.Header()[name] = append([]string{}, values...)
+		}
+		w.WriteHeader(d.status)
+		w.Write(d.body)
+		return
+	}
+	for _, name := range h.responseHeaders {
+		for _, v := range d.header[name] {
+			r.Header.Add(name, v)
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// authRequest returns the request to the auth service that describes the
+// original request.
+func (h *handler) authRequest(r *http.Request) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, h.address, nil)
+	req = req.WithContext(r.Context())
+	if len(h.requestHeaders) == 0 {
+		for name, values := range r.Header {
+			req.Header[name] = append([]string{}, values...)
+		}
+		removeHopHeaders(req.Header)
+	} else {
+		for _, name := range h.requestHeaders {
+			if values, ok := r.Header[name]; ok {
+				req.Header[name] = append([]string{}, values...)
+			}
+		}
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	return req
+}
+
+// decide returns a cached decision for the request if there is one, or asks
+// the auth service. Errors of the auth service are not cached.
+func (h *handler) decide(req *http.Request) (*decision, error) {
+	var key string
+	if h.cache != nil {
+		key = h.cacheKey(req)
+		if v, ok := h.cache.Get(key); ok {
+			if d := v.(*decision); h.clock.UtcNow().Before(d.expires) {
+				return d, nil
+			}
+		}
+	}
+	re, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer re.Body.Close()
+	d := &decision{status: re.StatusCode, header: re.Header}
+	removeHopHeaders(d.header)
+	if !d.allowed() {
+		if d.body, err = ioutil.ReadAll(io.LimitReader(re.Body, maxBodyBytes)); err != nil {
+			return nil, err
+		}
+	}
+	if h.cache != nil && d.status < 500 {
+		d.expires = h.clock.UtcNow().Add(h.cacheTTL)
+		// The map expires entries with a precision of seconds, the
+		// decision keeps the exact time.
+		ttl := int((h.cacheTTL + time.Second - 1) / time.Second)
+		if err := h.cache.Set(key, d, ttl); err != nil {
+			plugin.RequestLog(req).Warnf("Failed to cache auth decision: %v", err)
+		}
+	}
+	return d, nil
+}
+
+// cacheKey identifies requests that get the same decision: requests to the
+// auth service with the same values of cache key headers.
+func (h *handler) cacheKey(req *http.Request) string {
+	hash := sha256.New()
+	for _, name := range h.cacheKeyHeaders {
+		for _, v := range req.Header[name] {
+			io.WriteString(hash, name)
+			hash.Write([]byte{0})
+			io.WriteString(hash, v)
+			hash.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
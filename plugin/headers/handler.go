@@ -0,0 +1,130 @@
+package headers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/vulcand/vulcand/plugin"
+)
+
+type handler struct {
+	next     http.Handler
+	request  []*rule
+	response []*rule
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Response rules see the request as it came in, before request rules
+	// change it.
+	var changes []change
+	if len(h.response) != 0 {
+		changes = evaluate(h.response, r)
+	}
+	if len(h.request) != 0 {
+		for _, c := range evaluate(h.request, r) {
+			c.apply(r.Header)
+			if c.name == "Host" && c.action != ActionRemove {
+				r.Host = r.Header.Get("Host")
+				r.Header.Del("Host")
+			}
+		}
+	}
+	if len(changes) == 0 {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	rw := &responseWriter{ResponseWriter: w, changes: changes}
+	h.next.ServeHTTP(rw, r)
+	// Handlers that write nothing get an implicit 200 OK from the server,
+	// which should have the headers changed too.
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// change is a rule rendered for a request.
+type change struct {
+	action string
+	name   string
+	value  string
+}
+
+func (c change) apply(header http.Header) {
+	switch c.action {
+	case ActionAdd:
+		header.Add(c.name, c.value)
+	case ActionSet:
+		header.Set(c.name, c.value)
+	case ActionRemove:
+		header.Del(c.name)
+	}
+}
+
+// evaluate renders rules whose conditions the request matches. Rules that
+// fail to render are skipped.
+func evaluate(rules []*rule, r *http.Request) []change {
+	var changes []change
+	for _, rl := range rules {
+		if rl.condition != nil {
+			if matched, err := rl.condition.Route(r); err != nil || matched == nil {
+				continue
+			}
+		}
+		c := change{action: rl.action, name: rl.name}
+		if rl.value != nil {
+			out := &bytes.Buffer{}
+			if err := rl.value.Execute(out, r); err != nil {
+				plugin.RequestLog(r).Warnf("Failed to render header %s for %s: %v", rl.name, r.URL, err)
+				continue
+			}
+			c.value = out.String()
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// responseWriter changes response headers right before they are sent.
+type responseWriter struct {
+	http.ResponseWriter
+	changes     []change
+	wroteHeader bool
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader && (status >= http.StatusOK || status == http.StatusSwitchingProtocols) {
+		rw.wroteHeader = true
+		for _, c := range rw.changes {
+			c.apply(rw.ResponseWriter.Header())
+		}
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *responseWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", rw.ResponseWriter)
+	}
+	rw.wroteHeader = true
+	return hj.Hijack()
+}
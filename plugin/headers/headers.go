@@ -0,0 +1,230 @@
+package headers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/urfave/cli"
+	"github.com/vulcand/route"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/rewrite"
+)
+
+const Type = "headers"
+
+// Actions that rules can take on headers.
+const (
+	ActionAdd    = "add"
+	ActionSet    = "set"
+	ActionRemove = "remove"
+)
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// Headers adds, sets or removes headers of requests before they are
+// forwarded, and of responses before they are sent to clients.
+type Headers struct {
+	Request  []Rule
+	Response []Rule
+}
+
+// Rule changes a header if the request matches the condition.
+type Rule struct {
+	// Action is one of "add", "set" and "remove".
+	Action string
+	Name   string
+	// Value is a template that is rendered with the request, see the
+	// rewrite package for available variables. It is ignored by remove.
+	Value string
+	// Condition is a route expression that the request should match for the
+	// rule to apply, e.g. `PathRegexp("/api/.*")`. Rules without conditions
+	// always apply.
+	Condition string
+}
+
+// NewHeaders validates rules and returns a header manipulation middleware.
+func NewHeaders(h Headers) (*Headers, error) {
+	for _, rules := range [][]Rule{h.Request, h.Response} {
+		for _, r := range rules {
+			if _, err := compileRule(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &h, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (h *Headers) NewHandler(next http.Handler) (http.Handler, error) {
+	request, err := compileRules(h.Request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := compileRules(h.Response)
+	if err != nil {
+		return nil, err
+	}
+	return &handler{next: next, request: request, response: response}, nil
+}
+
+func (h *Headers) String() string {
+	return fmt.Sprintf("request=[%s], response=[%s]", formatRules(h.Request), formatRules(h.Response))
+}
+
+func (r Rule) String() string {
+	s := r.Action + " " + r.Name
+	if r.Action != ActionRemove {
+		s += ": " + r.Value
+	}
+	if r.Condition != "" {
+		s += " if " + r.Condition
+	}
+	return s
+}
+
+func formatRules(rules []Rule) string {
+	out := make([]string, len(rules))
+	for i, r := range rules {
+		out[i] = r.String()
+	}
+	return strings.Join(out, ", ")
+}
+
+func FromOther(h Headers) (plugin.Middleware, error) {
+	return NewHeaders(h)
+}
+
+// FromCli constructs the middleware from the command line. Headers are given
+// as "Name: value" for add and set, and as names for remove. The condition
+// applies to every rule.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	condition := c.String("condition")
+	var h Headers
+	for _, f := range []struct {
+		flag   string
+		action string
+		rules  *[]Rule
+	}{
+		{"requestAdd", ActionAdd, &h.Request},
+		{"requestSet", ActionSet, &h.Request},
+		{"requestRemove", ActionRemove, &h.Request},
+		{"responseAdd", ActionAdd, &h.Response},
+		{"responseSet", ActionSet, &h.Response},
+		{"responseRemove", ActionRemove, &h.Response},
+	} {
+		for _, v := range c.StringSlice(f.flag) {
+			r := Rule{Action: f.action, Name: strings.TrimSpace(v), Condition: condition}
+			if f.action != ActionRemove {
+				i := strings.IndexByte(v, ':')
+				if i < 0 {
+					return nil, fmt.Errorf("expected 'Name: value' for --%s, got %q", f.flag, v)
+				}
+				r.Name, r.Value = strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:])
+			}
+			*f.rules = append(*f.rules, r)
+		}
+	}
+	return NewHeaders(h)
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{Name: "requestAdd", Value: &cli.StringSlice{}, Usage: "request header to add, as 'Name: value template'"},
+		cli.StringSliceFlag{Name: "requestSet", Value: &cli.StringSlice{}, Usage: "request header to set, as 'Name: value template'"},
+		cli.StringSliceFlag{Name: "requestRemove", Value: &cli.StringSlice{}, Usage: "name of a request header to remove"},
+		cli.StringSliceFlag{Name: "responseAdd", Value: &cli.StringSlice{}, Usage: "response header to add, as 'Name: value template'"},
+		cli.StringSliceFlag{Name: "responseSet", Value: &cli.StringSlice{}, Usage: "response header to set, as 'Name: value template'"},
+		cli.StringSliceFlag{Name: "responseRemove", Value: &cli.StringSlice{}, Usage: "name of a response header to remove"},
+		cli.StringFlag{Name: "condition", Usage: "route expression that requests should match for headers to change"},
+	}
+}
+
+// EnvPrefix is the prefix of environment variables that header value
+// templates can read. Other variables, e.g. keys that vulcand is started
+// with, are never sent to backends or clients.
+const EnvPrefix = "VULCAND_HEADER_"
+
+// funcs are functions that header value templates can use on top of the
+// standard ones.
+var funcs = template.FuncMap{
+	"env": env,
+}
+
+// env returns the value of an environment variable of vulcand, or an empty
+// string if the variable name does not start with EnvPrefix.
+func env(name string) string {
+	if !strings.HasPrefix(name, EnvPrefix) {
+		return ""
+	}
+	return os.Getenv(name)
+}
+
+// rule is a validated rule that is ready to apply.
+type rule struct {
+	action    string
+	name      string
+	value     *rewrite.Template
+	condition route.Router
+}
+
+func compileRules(rules []Rule) ([]*rule, error) {
+	out := make([]*rule, len(rules))
+	for i, r := range rules {
+		cr, err := compileRule(r)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = cr
+	}
+	return out, nil
+}
+
+func compileRule(r Rule) (*rule, error) {
+	switch r.Action {
+	case ActionAdd, ActionSet, ActionRemove:
+	default:
+		return nil, fmt.Errorf("unsupported action %q, supported are %s, %s and %s", r.Action, ActionAdd, ActionSet, ActionRemove)
+	}
+	if !validName(r.Name) {
+		return nil, fmt.Errorf("invalid header name %q", r.Name)
+	}
+	cr := &rule{action: r.Action, name: http.CanonicalHeaderKey(r.Name)}
+	if r.Action != ActionRemove {
+		t, err := rewrite.NewTemplateFuncs(r.Value, funcs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of header %s: %v", r.Name, err)
+		}
+		cr.value = t
+	}
+	if r.Condition != "" {
+		cr.condition = route.New()
+		if err := cr.condition.AddRoute(r.Condition, true); err != nil {
+			return nil, fmt.Errorf("invalid condition %q: %v", r.Condition, err)
+		}
+	}
+	return cr, nil
+}
+
+// validName tells whether the name is an HTTP token, see RFC 7230 section
+// 3.2.6.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package headers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestHeaders(t *testing.T) { TestingT(t) }
+
+type HeadersSuite struct{}
+
+var _ = Suite(&HeadersSuite{})
+
+// Make sure the spec is compatible and will be accepted by middleware registry
+func (s *HeadersSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *HeadersSuite) TestNewHeadersBadParams(c *C) {
+	tcs := []Rule{
+		{Action: "replace", Name: "X-A", Value: "a"},
+		{Action: ActionSet, Name: "", Value: "a"},
+		{Action: ActionSet, Name: "X A", Value: "a"},
+		{Action: ActionSet, Name: "X-A", Value: "{{.Request.Host"},
+		{Action: ActionSet, Name: "X-A", Value: "a", Condition: `Path("/a"`},
+	}
+	for _, r := range tcs {
+		_, err := NewHeaders(Headers{Request: []Rule{r}})
+		c.Assert(err, NotNil, Commentf("%v", r))
+		_, err = NewHeaders(Headers{Response: []Rule{r}})
+		c.Assert(err, NotNil, Commentf("%v", r))
+	}
+}
+
+func (s *HeadersSuite) TestNewHeadersFromOther(c *C) {
+	h, err := NewHeaders(Headers{
+		Request:  []Rule{{Action: ActionSet, Name: "X-Client", Value: "{{.ClientIP}}"}},
+		Response: []Rule{{Action: ActionRemove, Name: "Server", Condition: `PathRegexp("/api/.*")`}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(h.String(), Not(Equals), "")
+
+	out, err := FromOther(*h)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, h)
+}
+
+func (s *HeadersSuite) TestNewHeadersFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		h := out.(*Headers)
+		cond := `Path("/a")`
+		c.Assert(h.Request, DeepEquals, []Rule{
+			{Action: ActionAdd, Name: "X-A", Value: "{{.ClientIP}}", Condition: cond},
+			{Action: ActionSet, Name: "X-B", Value: "b: c", Condition: cond},
+			{Action: ActionRemove, Name: "X-C", Condition: cond},
+		})
+		c.Assert(h.Response, DeepEquals, []Rule{
+			{Action: ActionSet, Name: "X-D", Value: "d", Condition: cond},
+			{Action: ActionRemove, Name: "Server", Condition: cond},
+		})
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test",
+		"--requestAdd=X-A: {{.ClientIP}}", "--requestSet=X-B: b: c", "--requestRemove=X-C",
+		"--responseSet=X-D: d", "--responseRemove=Server", `--condition=Path("/a")`})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *HeadersSuite) TestRequestHeaders(c *C) {
+	os.Setenv("VULCAND_HEADER_TEST", "prod")
+	defer os.Unsetenv("VULCAND_HEADER_TEST")
+	os.Setenv("VULCAND_SECRET_TEST", "secret")
+	defer os.Unsetenv("VULCAND_SECRET_TEST")
+
+	var received http.Header
+	var host string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		host = r.Host
+	})
+	h := newHandler(c, Headers{Request: []Rule{
+		{Action: ActionAdd, Name: "X-Forwarded-Tag", Value: "b"},
+		{Action: ActionSet, Name: "X-Client", Value: "{{.ClientIP}} {{.Request.Method}}"},
+		{Action: ActionSet, Name: "X-Env", Value: `{{env "VULCAND_HEADER_TEST"}}`},
+		{Action: ActionSet, Name: "X-Other-Env", Value: `[{{env "VULCAND_SECRET_TEST"}}]`},
+		{Action: ActionRemove, Name: "X-Secret"},
+		{Action: ActionSet, Name: "Host", Value: "backend.local"},
+	}}, next)
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/a", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-Tag", "a")
+	r.Header.Set("X-Secret", "s")
+	serve(h, r)
+
+	c.Assert(received["X-Forwarded-Tag"], DeepEquals, []string{"a", "b"})
+	c.Assert(received.Get("X-Client"), Equals, "10.0.0.1 GET")
+	c.Assert(received.Get("X-Env"), Equals, "prod")
+	c.Assert(received.Get("X-Other-Env"), Equals, "[]")
+	c.Assert(received.Get("X-Secret"), Equals, "")
+	c.Assert(received.Get("Host"), Equals, "")
+	c.Assert(host, Equals, "backend.local")
+}
+
+func (s *HeadersSuite) TestResponseHeaders(c *C) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "backend/1.0")
+		w.Header().Set("X-Powered-By", "php")
+		w.Write([]byte("hello"))
+	})
+	h := newHandler(c, Headers{Response: []Rule{
+		{Action: ActionRemove, Name: "X-Powered-By"},
+		{Action: ActionSet, Name: "Server", Value: "vulcand"},
+		{Action: ActionAdd, Name: "X-Request-Path", Value: "{{.Request.URL.Path}}"},
+	}}, next)
+
+	re := serve(h, httptest.NewRequest(http.MethodGet, "http://example.com/a", nil))
+	c.Assert(re.Body.String(), Equals, "hello")
+	c.Assert(re.Header().Get("Server"), Equals, "vulcand")
+	c.Assert(re.Header().Get("X-Powered-By"), Equals, "")
+	c.Assert(re.Header().Get("X-Request-Path"), Equals, "/a")
+
+	// Headers are changed even if the handler writes nothing
+	h = newHandler(c, Headers{Response: []Rule{{Action: ActionSet, Name: "X-A", Value: "a"}}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	re = serve(h, httptest.NewRequest(http.MethodGet, "http://example.com/a", nil))
+	c.Assert(re.Header().Get("X-A"), Equals, "a")
+}
+
+func (s *HeadersSuite) TestConditions(c *C) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen", r.Header.Get("X-Api"))
+	})
+	h := newHandler(c, Headers{
+		Request:  []Rule{{Action: ActionSet, Name: "X-Api", Value: "yes", Condition: `PathRegexp("/api/.*")`}},
+		Response: []Rule{{Action: ActionSet, Name: "Cache-Control", Value: "no-store", Condition: `Method("POST") && PathRegexp("/api/.*")`}},
+	}, next)
+
+	re := serve(h, httptest.NewRequest(http.MethodGet, "http://example.com/api/users", nil))
+	c.Assert(re.Header().Get("X-Seen"), Equals, "yes")
+	c.Assert(re.Header().Get("Cache-Control"), Equals, "")
+
+	re = serve(h, httptest.NewRequest(http.MethodPost, "http://example.com/api/users", nil))
+	c.Assert(re.Header().Get("X-Seen"), Equals, "yes")
+	c.Assert(re.Header().Get("Cache-Control"), Equals, "no-store")
+
+	re = serve(h, httptest.NewRequest(http.MethodPost, "http://example.com/static", nil))
+	c.Assert(re.Header().Get("X-Seen"), Equals, "")
+	c.Assert(re.Header().Get("Cache-Control"), Equals, "")
+}
+
+func newHandler(c *C, cfg Headers, next http.Handler) http.Handler {
+	h, err := NewHeaders(cfg)
+	c.Assert(err, IsNil)
+	out, err := h.NewHandler(next)
+	c.Assert(err, IsNil)
+	return out
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, r)
+	return re
+}
@@ -0,0 +1,128 @@
+package hmacauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+type verifyHandler struct {
+	next        http.Handler
+	signer      *signer
+	header      string
+	clients     map[string][]byte
+	maxSkew     time.Duration
+	nonces      *ttlmap.TtlMap
+	maxBodySize int64
+	clock       timetools.TimeProvider
+	env         plugin.Env
+}
+
+func (h *verifyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, err := parseParams(r.Header.Get(h.header))
+	if err != nil {
+		h.reject(w, r, err)
+		return
+	}
+	secret, ok := h.clients[p.keyId]
+	if !ok {
+		h.reject(w, r, fmt.Errorf("unknown client %q", p.keyId))
+		return
+	}
+	if p.algorithm != "" && p.algorithm != h.signer.name {
+		h.reject(w, r, fmt.Errorf("unexpected algorithm %q", p.algorithm))
+		return
+	}
+	skew := h.clock.UtcNow().Sub(time.Unix(p.created, 0))
+	if skew > h.maxSkew || skew < -h.maxSkew {
+		h.reject(w, r, fmt.Errorf("timestamp is %s away from the clock", skew))
+		return
+	}
+	digest, err := digestBody(r, h.maxBodySize)
+	if err != nil {
+		h.bodyError(w, r, err)
+		return
+	}
+	if !hmac.Equal(h.signer.sign(secret, r, digest, p), p.signature) {
+		h.reject(w, r, fmt.Errorf("signature mismatch for client %q", p.keyId))
+		return
+	}
+	// Nonces are remembered after signatures are checked, so that only
+	// clients can fill the cache. A nonce outlives the requests it can
+	// be used in, that are at most max skew away on either side.
+	seen, err := h.nonces.Increment(p.keyId+"/"+p.nonce, 1, ttlSeconds(2*h.maxSkew))
+	if err != nil || seen > 1 {
+		h.reject(w, r, fmt.Errorf("replayed nonce %q of client %q", p.nonce, p.keyId))
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func (h *verifyHandler) reject(w http.ResponseWriter, r *http.Request, err error) {
+	plugin.RequestLog(r).Debugf("Rejected request to %s: %v", r.URL, err)
+	h.env.IncCounter("rejected", 1)
+	w.Header().Set("WWW-Authenticate", scheme)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func (h *verifyHandler) bodyError(w http.ResponseWriter, r *http.Request, err error) {
+	h.env.IncCounter("rejected", 1)
+	writeBodyError(w, r, err)
+}
+
+type signHandler struct {
+	next        http.Handler
+	signer      *signer
+	header      string
+	keyId       string
+	secret      []byte
+	maxBodySize int64
+	clock       timetools.TimeProvider
+}
+
+func (h *signHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	digest, err := digestBody(r, h.maxBodySize)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		plugin.RequestLog(r).Errorf("Failed to generate nonce: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	p := &params{
+		keyId:     h.keyId,
+		algorithm: h.signer.name,
+		created:   h.clock.UtcNow().Unix(),
+		nonce:     hex.EncodeToString(nonce),
+	}
+	p.signature = h.signer.sign(h.secret, r, digest, p)
+	r.Header.Set(h.header, p.String())
+	h.next.ServeHTTP(w, r)
+}
+
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errBodyTooLarge {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	plugin.RequestLog(r).Debugf("Failed to read body of request to %s: %v", r.URL, err)
+	http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+}
+
+func ttlSeconds(d time.Duration) int {
+	s := int((d + time.Second - 1) / time.Second)
+	if s < 1 {
+		return 1
+	}
+	return s
+}
@@ -0,0 +1,308 @@
+package hmacauth
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "hmacauth"
+
+const (
+	// ModeVerify checks signatures of incoming requests.
+	ModeVerify = "verify"
+	// ModeSign signs requests forwarded to backends.
+	ModeSign = "sign"
+)
+
+const (
+	// DefaultHeader carries signatures by default.
+	DefaultHeader = "Authorization"
+	// DefaultMaxSkew is how far timestamps of signed requests can be from
+	// the clock of vulcand by default.
+	DefaultMaxSkew = 5 * time.Minute
+	// DefaultNonceCacheSize is how many nonces are remembered by default.
+	DefaultNonceCacheSize = 100000
+	// DefaultMaxBodySize is the size of the largest body that is signed by
+	// default.
+	DefaultMaxBodySize = 1 << 20
+)
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// HMACAuth checks HMAC signatures of incoming requests, or signs requests
+// forwarded to backends. Signatures cover the method, the path and query,
+// selected headers, the digest of the body, a timestamp and a nonce, so
+// signed requests can not be altered or replayed.
+type HMACAuth struct {
+	// Mode is "verify" (the default) or "sign".
+	Mode string
+	// Clients maps ids of clients to their secrets, signatures of incoming
+	// requests are checked with the secret of the client that made them.
+	// Engines that can encrypt data store secrets in SealedSecrets.
+	Clients map[string]string `json:",omitempty"`
+	// KeyId and Secret sign requests to backends.
+	KeyId         string
+	Secret        string `json:",omitempty"`
+	SealedSecrets []byte `json:",omitempty"`
+	// Algorithm is "hmac-sha256" (the default) or "hmac-sha512".
+	Algorithm string
+	// Canonicalization is how requests are turned into the signed string,
+	// "http-signatures" (the default) or "lines".
+	Canonicalization string
+	// Header carries the signature, Authorization by default.
+	Header string
+	// SignedHeaders are request headers covered by signatures, e.g. "Host"
+	// and "Content-Type".
+	SignedHeaders []string
+	// MaxSkew is how far the timestamp of a request can be from the clock,
+	// e.g. "1m". Nonces are remembered for twice as long to reject replays.
+	MaxSkew string
+	// NonceCacheSize is how many nonces are remembered at most, it should
+	// hold all requests made within the skew window.
+	NonceCacheSize int
+	// MaxBodySize is the size of the largest body that is signed, larger
+	// requests are rejected.
+	MaxBodySize int64
+
+	maxSkew time.Duration
+	clock   timetools.TimeProvider
+}
+
+// secrets are sealed together by engines.
+type secrets struct {
+	Clients map[string]string
+	Secret  string
+}
+
+// NewHMACAuth validates settings and returns an HMAC middleware.
+func NewHMACAuth(a HMACAuth) (*HMACAuth, error) {
+	sealed := len(a.SealedSecrets) != 0
+	if sealed && (len(a.Clients) != 0 || a.Secret != "") {
+		return nil, fmt.Errorf("secrets and sealed secrets can not be both set")
+	}
+	switch a.Mode {
+	case "", ModeVerify:
+		if len(a.Clients) == 0 && !sealed {
+			return nil, fmt.Errorf("at least one client is required")
+		}
+		for id, s := range a.Clients {
+			if id == "" || strings.ContainsAny(id, `",`) || s == "" {
+				return nil, fmt.Errorf("invalid client %q, ids can not have quotes or commas and secrets can not be empty", id)
+			}
+		}
+	case ModeSign:
+		if a.KeyId == "" || strings.ContainsAny(a.KeyId, `",`) {
+			return nil, fmt.Errorf("invalid key id %q", a.KeyId)
+		}
+		if a.Secret == "" && !sealed {
+			return nil, fmt.Errorf("secret is required to sign requests")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported mode %q, expected %q or %q", a.Mode, ModeVerify, ModeSign)
+	}
+	if _, ok := algorithms[algorithmOrDefault(a.Algorithm)]; !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q, expected hmac-sha256 or hmac-sha512", a.Algorithm)
+	}
+	if _, ok := canonicalizations[canonicalizationOrDefault(a.Canonicalization)]; !ok {
+		return nil, fmt.Errorf("unsupported canonicalization %q, expected http-signatures or lines", a.Canonicalization)
+	}
+	if strings.ContainsAny(a.Header, " :") {
+		return nil, fmt.Errorf("invalid header name %q", a.Header)
+	}
+	for _, h := range a.SignedHeaders {
+		if h == "" || strings.ContainsAny(h, " :") {
+			return nil, fmt.Errorf("invalid header name %q", h)
+		}
+	}
+	if a.MaxSkew == "" {
+		a.maxSkew = DefaultMaxSkew
+	} else {
+		d, err := time.ParseDuration(a.MaxSkew)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("max skew should be a duration > 0, got %q", a.MaxSkew)
+		}
+		a.maxSkew = d
+	}
+	if a.NonceCacheSize < 0 {
+		return nil, fmt.Errorf("nonce cache size should be >= 0, got %d", a.NonceCacheSize)
+	}
+	if a.MaxBodySize < 0 {
+		return nil, fmt.Errorf("max body size should be >= 0, got %d", a.MaxBodySize)
+	}
+	if a.clock == nil {
+		a.clock = &timetools.RealTime{}
+	}
+	return &a, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (a *HMACAuth) NewHandler(next http.Handler) (http.Handler, error) {
+	return a.NewHandlerWithEnv(next, plugin.Env{})
+}
+
+// NewHandlerWithEnv returns a handler that counts rejected requests.
+func (a *HMACAuth) NewHandlerWithEnv(next http.Handler, env plugin.Env) (http.Handler, error) {
+	if len(a.SealedSecrets) != 0 {
+		return nil, fmt.Errorf("secrets are sealed, vulcand needs the seal key to open them")
+	}
+	s := &signer{
+		name:             algorithmOrDefault(a.Algorithm),
+		algorithm:        algorithms[algorithmOrDefault(a.Algorithm)],
+		canonicalization: canonicalizations[canonicalizationOrDefault(a.Canonicalization)],
+	}
+	for _, name := range a.SignedHeaders {
+		s.headers = append(s.headers, textproto.CanonicalMIMEHeaderKey(name))
+	}
+	header := DefaultHeader
+	if a.Header != "" {
+		header = textproto.CanonicalMIMEHeaderKey(a.Header)
+	}
+	maxBodySize := a.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	if a.Mode == ModeSign {
+		return &signHandler{
+			next:        next,
+			signer:      s,
+			header:      header,
+			keyId:       a.KeyId,
+			secret:      []byte(a.Secret),
+			maxBodySize: maxBodySize,
+			clock:       a.clock,
+		}, nil
+	}
+	size := a.NonceCacheSize
+	if size == 0 {
+		size = DefaultNonceCacheSize
+	}
+	nonces, err := ttlmap.NewConcurrent(size, ttlmap.Clock(a.clock))
+	if err != nil {
+		return nil, err
+	}
+	h := &verifyHandler{
+		next:        next,
+		signer:      s,
+		header:      header,
+		clients:     make(map[string][]byte, len(a.Clients)),
+		maxSkew:     a.maxSkew,
+		nonces:      nonces,
+		maxBodySize: maxBodySize,
+		clock:       a.clock,
+		env:         env,
+	}
+	for id, secret := range a.Clients {
+		h.clients[id] = []byte(secret)
+	}
+	return h, nil
+}
+
+// Seal returns a copy of the middleware with secrets sealed.
+func (a *HMACAuth) Seal(seal func(val interface{}) ([]byte, error)) (plugin.Middleware, error) {
+	if len(a.Clients) == 0 && a.Secret == "" {
+		return a, nil
+	}
+	sealed, err := seal(secrets{Clients: a.Clients, Secret: a.Secret})
+	if err != nil {
+		return nil, err
+	}
+	out := *a
+	out.Clients, out.Secret = nil, ""
+	out.SealedSecrets = sealed
+	return &out, nil
+}
+
+// Open returns a copy of the middleware with sealed secrets opened.
+func (a *HMACAuth) Open(open func(sealed []byte, val interface{}) error) (plugin.Middleware, error) {
+	if len(a.SealedSecrets) == 0 {
+		return a, nil
+	}
+	var s secrets
+	if err := open(a.SealedSecrets, &s); err != nil {
+		return nil, err
+	}
+	out := *a
+	out.Clients, out.Secret = s.Clients, s.Secret
+	out.SealedSecrets = nil
+	return NewHMACAuth(out)
+}
+
+func (a *HMACAuth) String() string {
+	mode := a.Mode
+	if mode == "" {
+		mode = ModeVerify
+	}
+	clients := make([]string, 0, len(a.Clients))
+	for id := range a.Clients {
+		clients = append(clients, id)
+	}
+	sort.Strings(clients)
+	return fmt.Sprintf("mode=%s, clients=%s, keyId=%s, algorithm=%s, canonicalization=%s, header=%s, signedHeaders=%s, maxSkew=%s, sealed=%t",
+		mode, strings.Join(clients, ","), a.KeyId, algorithmOrDefault(a.Algorithm), canonicalizationOrDefault(a.Canonicalization),
+		a.Header, strings.Join(a.SignedHeaders, ","), a.maxSkew, len(a.SealedSecrets) != 0)
+}
+
+func FromOther(a HMACAuth) (plugin.Middleware, error) {
+	return NewHMACAuth(a)
+}
+
+// FromCli constructs the middleware from the command line.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	a := HMACAuth{
+		Mode:             c.String("mode"),
+		KeyId:            c.String("keyId"),
+		Secret:           c.String("secret"),
+		Algorithm:        c.String("algorithm"),
+		Canonicalization: c.String("canonicalization"),
+		Header:           c.String("header"),
+		SignedHeaders:    c.StringSlice("signedHeader"),
+		NonceCacheSize:   c.Int("nonceCacheSize"),
+		MaxBodySize:      c.Int64("maxBodySize"),
+	}
+	for _, client := range c.StringSlice("client") {
+		i := strings.Index(client, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("client should be in form id:secret, got %q", client)
+		}
+		if a.Clients == nil {
+			a.Clients = make(map[string]string)
+		}
+		a.Clients[client[:i]] = client[i+1:]
+	}
+	if d := c.Duration("maxSkew"); d != 0 {
+		a.MaxSkew = d.String()
+	}
+	return NewHMACAuth(a)
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "mode", Usage: "verify signatures of incoming requests, or sign requests to backends: verify or sign"},
+		cli.StringSliceFlag{Name: "client", Value: &cli.StringSlice{}, Usage: "client allowed to make requests, in form id:secret"},
+		cli.StringFlag{Name: "keyId", Usage: "key id that signs requests to backends"},
+		cli.StringFlag{Name: "secret", Usage: "secret that signs requests to backends"},
+		cli.StringFlag{Name: "algorithm", Usage: "signature algorithm: hmac-sha256 or hmac-sha512"},
+		cli.StringFlag{Name: "canonicalization", Usage: "how requests are turned into the signed string: http-signatures or lines"},
+		cli.StringFlag{Name: "header", Usage: "header that carries the signature"},
+		cli.StringSliceFlag{Name: "signedHeader", Value: &cli.StringSlice{}, Usage: "request header covered by signatures"},
+		cli.DurationFlag{Name: "maxSkew", Usage: "how far the timestamp of a request can be from the clock"},
+		cli.IntFlag{Name: "nonceCacheSize", Usage: "how many nonces are remembered to reject replays"},
+		cli.Int64Flag{Name: "maxBodySize", Usage: "size of the largest body that is signed"},
+	}
+}
@@ -0,0 +1,345 @@
+package hmacauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/secret"
+	. "gopkg.in/check.v1"
+)
+
+func TestHMACAuth(t *testing.T) { TestingT(t) }
+
+type HMACAuthSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&HMACAuthSuite{})
+
+func (s *HMACAuthSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{CurrentTime: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+// Make sure the spec is compatible and will be accepted by middleware registry
+func (s *HMACAuthSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *HMACAuthSuite) TestNewHMACAuthBadParams(c *C) {
+	clients := map[string]string{"c1": "secret"}
+	tcs := []HMACAuth{
+		{},
+		{Mode: "check", Clients: clients},
+		{Clients: map[string]string{"": "secret"}},
+		{Clients: map[string]string{"c,1": "secret"}},
+		{Clients: map[string]string{"c1": ""}},
+		{Clients: clients, SealedSecrets: []byte("sealed")},
+		{Mode: ModeSign, Secret: "secret"},
+		{Mode: ModeSign, KeyId: "c1"},
+		{Mode: ModeSign, KeyId: `"c1"`, Secret: "secret"},
+		{Clients: clients, Algorithm: "hmac-md5"},
+		{Clients: clients, Canonicalization: "json"},
+		{Clients: clients, Header: "X Signature"},
+		{Clients: clients, SignedHeaders: []string{""}},
+		{Clients: clients, MaxSkew: "soon"},
+		{Clients: clients, MaxSkew: "0s"},
+		{Clients: clients, NonceCacheSize: -1},
+		{Clients: clients, MaxBodySize: -1},
+	}
+	for _, tc := range tcs {
+		_, err := NewHMACAuth(tc)
+		c.Assert(err, NotNil, Commentf("%#v", tc))
+	}
+}
+
+func (s *HMACAuthSuite) TestNewHMACAuthFromOther(c *C) {
+	a, err := NewHMACAuth(HMACAuth{
+		Clients:          map[string]string{"c1": "secret1", "c2": "secret2"},
+		Algorithm:        "hmac-sha512",
+		Canonicalization: "lines",
+		Header:           "X-Signature",
+		SignedHeaders:    []string{"Host", "Content-Type"},
+		MaxSkew:          "1m",
+		NonceCacheSize:   1000,
+		MaxBodySize:      4096,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(a.String(), Not(Equals), "")
+	c.Assert(strings.Contains(a.String(), "secret1"), Equals, false)
+
+	out, err := FromOther(*a)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, a)
+}
+
+func (s *HMACAuthSuite) TestNewHMACAuthFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		a := out.(*HMACAuth)
+		c.Assert(a.Clients, DeepEquals, map[string]string{"c1": "secret:1", "c2": "secret2"})
+		c.Assert(a.Algorithm, Equals, "hmac-sha512")
+		c.Assert(a.Canonicalization, Equals, "lines")
+		c.Assert(a.Header, Equals, "X-Signature")
+		c.Assert(a.SignedHeaders, DeepEquals, []string{"Host", "Date"})
+		c.Assert(a.MaxSkew, Equals, "1m0s")
+		c.Assert(a.NonceCacheSize, Equals, 10)
+		c.Assert(a.MaxBodySize, Equals, int64(2048))
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--client=c1:secret:1", "--client=c2:secret2", "--algorithm=hmac-sha512", "--canonicalization=lines",
+		"--header=X-Signature", "--signedHeader=Host", "--signedHeader=Date", "--maxSkew=1m", "--nonceCacheSize=10", "--maxBodySize=2048"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *HMACAuthSuite) TestSignAndVerify(c *C) {
+	for _, tc := range []HMACAuth{
+		{},
+		{Algorithm: "hmac-sha512", Canonicalization: "lines", Header: "X-Signature", SignedHeaders: []string{"Host", "Content-Type"}},
+	} {
+		var body string
+		verify := s.newVerifier(c, tc, func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			body = string(data)
+		})
+		sign := s.newSigner(c, tc, verify)
+
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/messages?to=1&from=2", strings.NewReader("hello"))
+		req.Header.Set("Content-Type", "text/plain")
+		re := serve(sign, req)
+		c.Assert(re.Code, Equals, http.StatusOK, Commentf("%#v", tc))
+		c.Assert(body, Equals, "hello")
+	}
+}
+
+func (s *HMACAuthSuite) TestHTTPSignaturesFormat(c *C) {
+	var header string
+	sign := s.newSigner(c, HMACAuth{SignedHeaders: []string{"Host"}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+	}))
+	serve(sign, httptest.NewRequest(http.MethodPut, "http://example.com/a%20b?x=1", strings.NewReader("data")))
+
+	p, err := parseParams(header)
+	c.Assert(err, IsNil)
+	c.Assert(p.keyId, Equals, "c1")
+	c.Assert(p.algorithm, Equals, "hmac-sha256")
+	c.Assert(p.created, Equals, s.clock.CurrentTime.Unix())
+
+	digest := sha256.Sum256([]byte("data"))
+	signed := "(request-target): put /a%20b?x=1\n" +
+		"(created): 1767268800\n" +
+		"(nonce): " + p.nonce + "\n" +
+		"host: example.com\n" +
+		"digest: SHA-256=" + base64.StdEncoding.EncodeToString(digest[:])
+	mac := hmac.New(sha256.New, []byte("secret1"))
+	mac.Write([]byte(signed))
+	c.Assert(p.signature, DeepEquals, mac.Sum(nil))
+}
+
+func (s *HMACAuthSuite) TestTampered(c *C) {
+	cfg := HMACAuth{SignedHeaders: []string{"X-Account"}}
+	tcs := []func(r *http.Request){
+		func(r *http.Request) { r.Method = http.MethodDelete },
+		func(r *http.Request) { r.URL.Path = "/other" },
+		func(r *http.Request) { r.URL.RawQuery = "to=2" },
+		func(r *http.Request) { r.Header.Set("X-Account", "other") },
+		func(r *http.Request) { r.Body = ioutil.NopCloser(strings.NewReader("goodbye")) },
+		func(r *http.Request) {
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "c1", "c2", 1))
+		},
+		func(r *http.Request) { r.Header.Del("Authorization") },
+	}
+	for i, tamper := range tcs {
+		verify := s.newVerifier(c, cfg, ok)
+		sign := s.newSigner(c, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tamper(r)
+			verify.ServeHTTP(w, r)
+		}))
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/messages?to=1", strings.NewReader("hello"))
+		req.Header.Set("X-Account", "a1")
+		re := serve(sign, req)
+		c.Assert(re.Code, Equals, http.StatusUnauthorized, Commentf("case %d", i))
+		c.Assert(re.Header().Get("WWW-Authenticate"), Equals, "HMAC")
+	}
+}
+
+func (s *HMACAuthSuite) TestUnknownClient(c *C) {
+	verify := s.newVerifier(c, HMACAuth{}, ok)
+	signer, err := NewHMACAuth(HMACAuth{Mode: ModeSign, KeyId: "c3", Secret: "secret1"})
+	c.Assert(err, IsNil)
+	sign, err := signer.NewHandler(verify)
+	c.Assert(err, IsNil)
+
+	re := serve(sign, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusUnauthorized)
+}
+
+func (s *HMACAuthSuite) TestReplay(c *C) {
+	var header string
+	sign := s.newSigner(c, HMACAuth{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+	}))
+	serve(sign, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+	verify := s.newVerifier(c, HMACAuth{MaxSkew: "1m"}, ok)
+	replay := func() int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("Authorization", header)
+		return serve(verify, req).Code
+	}
+	c.Assert(replay(), Equals, http.StatusOK)
+	c.Assert(replay(), Equals, http.StatusUnauthorized)
+
+	// When the nonce is forgotten, the timestamp is too old to be accepted
+	s.clock.Sleep(121 * time.Second)
+	c.Assert(replay(), Equals, http.StatusUnauthorized)
+}
+
+func (s *HMACAuthSuite) TestSkew(c *C) {
+	verify := s.newVerifier(c, HMACAuth{MaxSkew: "1m"}, ok)
+	signerClock := &timetools.FreezedTime{CurrentTime: s.clock.CurrentTime}
+	signer, err := NewHMACAuth(HMACAuth{Mode: ModeSign, KeyId: "c1", Secret: "secret1", clock: signerClock})
+	c.Assert(err, IsNil)
+	sign, err := signer.NewHandler(verify)
+	c.Assert(err, IsNil)
+
+	for _, tc := range []struct {
+		offset time.Duration
+		code   int
+	}{
+		{-59 * time.Second, http.StatusOK},
+		{59 * time.Second, http.StatusOK},
+		{-61 * time.Second, http.StatusUnauthorized},
+		{61 * time.Second, http.StatusUnauthorized},
+	} {
+		signerClock.CurrentTime = s.clock.CurrentTime.Add(tc.offset)
+		re := serve(sign, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		c.Assert(re.Code, Equals, tc.code, Commentf("offset %s", tc.offset))
+	}
+}
+
+func (s *HMACAuthSuite) TestBodyTooLarge(c *C) {
+	verify := s.newVerifier(c, HMACAuth{MaxBodySize: 4}, ok)
+	sign := s.newSigner(c, HMACAuth{}, verify)
+	re := serve(sign, httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("hello")))
+	c.Assert(re.Code, Equals, http.StatusRequestEntityTooLarge)
+
+	sign = s.newSigner(c, HMACAuth{MaxBodySize: 4}, verify)
+	re = serve(sign, httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("hello")))
+	c.Assert(re.Code, Equals, http.StatusRequestEntityTooLarge)
+}
+
+func (s *HMACAuthSuite) TestSealedSecrets(c *C) {
+	keyString, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+	box, err := secret.NewBoxFromKeyString(keyString)
+	c.Assert(err, IsNil)
+	seal := func(val interface{}) ([]byte, error) {
+		data, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := box.Seal(data)
+		if err != nil {
+			return nil, err
+		}
+		return secret.SealedValueToJSON(sealed)
+	}
+	open := func(data []byte, val interface{}) error {
+		sealed, err := secret.SealedValueFromJSON(data)
+		if err != nil {
+			return err
+		}
+		out, err := box.Open(sealed)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(out, val)
+	}
+
+	a, err := NewHMACAuth(HMACAuth{Clients: map[string]string{"c1": "client-secret"}})
+	c.Assert(err, IsNil)
+	sealed, err := a.Seal(seal)
+	c.Assert(err, IsNil)
+	data, err := json.Marshal(sealed)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), "client-secret"), Equals, false)
+
+	stored, err := GetSpec().FromJSON(data)
+	c.Assert(err, IsNil)
+	_, err = stored.NewHandler(nil)
+	c.Assert(err, NotNil)
+
+	opened, err := stored.(plugin.SealedMiddleware).Open(open)
+	c.Assert(err, IsNil)
+	c.Assert(opened.(*HMACAuth).Clients, DeepEquals, map[string]string{"c1": "client-secret"})
+	_, err = opened.NewHandler(nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *HMACAuthSuite) TestParseParams(c *C) {
+	for _, value := range []string{
+		"",
+		"Bearer token",
+		`HMAC keyId="c1"`,
+		`HMAC keyId="c1",created="now",nonce="n",signature="c2ln"`,
+		`HMAC keyId="c1",created="1",nonce="n",signature="!"`,
+		`HMAC keyId=c1,created="1",nonce="n",signature="c2ln"`,
+		`HMAC keyId="c1",created="1",nonce="",signature="c2ln"`,
+	} {
+		_, err := parseParams(value)
+		c.Assert(err, NotNil, Commentf("%q", value))
+	}
+	p, err := parseParams(`HMAC keyId="c1", created="1", nonce="n", signature="c2ln", extra="x"`)
+	c.Assert(err, IsNil)
+	c.Assert(p, DeepEquals, &params{keyId: "c1", created: 1, nonce: "n", signature: []byte("sig")})
+}
+
+func (s *HMACAuthSuite) newVerifier(c *C, cfg HMACAuth, next http.HandlerFunc) http.Handler {
+	cfg.Clients = map[string]string{"c1": "secret1", "c2": "secret2"}
+	cfg.clock = s.clock
+	a, err := NewHMACAuth(cfg)
+	c.Assert(err, IsNil)
+	h, err := a.NewHandler(next)
+	c.Assert(err, IsNil)
+	return h
+}
+
+func (s *HMACAuthSuite) newSigner(c *C, cfg HMACAuth, next http.Handler) http.Handler {
+	cfg.Mode = ModeSign
+	cfg.KeyId = "c1"
+	cfg.Secret = "secret1"
+	cfg.clock = s.clock
+	a, err := NewHMACAuth(cfg)
+	c.Assert(err, IsNil)
+	h, err := a.NewHandler(next)
+	c.Assert(err, IsNil)
+	return h
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, r)
+	return re
+}
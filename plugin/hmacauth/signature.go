@@ -0,0 +1,190 @@
+package hmacauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const scheme = "HMAC"
+
+var algorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// canonicalization turns a request into the string that is signed.
+type canonicalization func(r *http.Request, headers []string, digest []byte, p *params) []byte
+
+var canonicalizations = map[string]canonicalization{
+	"http-signatures": httpSignatures,
+	"lines":           lines,
+}
+
+var errBodyTooLarge = errors.New("request body is too large")
+
+// params are sent in the signature header, e.g.
+//
+//	HMAC keyId="c1",algorithm="hmac-sha256",created="1600000000",nonce="d2f3",signature="base64"
+type params struct {
+	keyId     string
+	algorithm string
+	created   int64
+	nonce     string
+	signature []byte
+}
+
+func (p *params) String() string {
+	return fmt.Sprintf(`%s keyId="%s",algorithm="%s",created="%d",nonce="%s",signature="%s"`,
+		scheme, p.keyId, p.algorithm, p.created, p.nonce, base64.StdEncoding.EncodeToString(p.signature))
+}
+
+func parseParams(value string) (*params, error) {
+	if !strings.HasPrefix(value, scheme+" ") {
+		return nil, fmt.Errorf("missing %s signature", scheme)
+	}
+	p := &params{}
+	for _, kv := range strings.Split(value[len(scheme)+1:], ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("malformed signature parameter %q", kv)
+		}
+		k, v := strings.TrimSpace(kv[:i]), strings.TrimSpace(kv[i+1:])
+		if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+			return nil, fmt.Errorf("malformed signature parameter %q", kv)
+		}
+		v = v[1 : len(v)-1]
+		var err error
+		switch k {
+		case "keyId":
+			p.keyId = v
+		case "algorithm":
+			p.algorithm = v
+		case "created":
+			p.created, err = strconv.ParseInt(v, 10, 64)
+		case "nonce":
+			p.nonce = v
+		case "signature":
+			p.signature, err = base64.StdEncoding.DecodeString(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed signature parameter %q", kv)
+		}
+	}
+	if p.keyId == "" || p.created == 0 || p.nonce == "" || len(p.nonce) > 128 || len(p.signature) == 0 {
+		return nil, fmt.Errorf("signature should have keyId, created, nonce and signature")
+	}
+	return p, nil
+}
+
+type signer struct {
+	name             string
+	algorithm        func() hash.Hash
+	canonicalization canonicalization
+	headers          []string
+}
+
+func (s *signer) sign(secret []byte, r *http.Request, digest []byte, p *params) []byte {
+	mac := hmac.New(s.algorithm, secret)
+	mac.Write(s.canonicalization(r, s.headers, digest, p))
+	return mac.Sum(nil)
+}
+
+// httpSignatures signs lines in the format of HTTP message signatures:
+//
+//	(request-target): post /v1/messages?to=1
+//	(created): 1600000000
+//	(nonce): d2f3
+//	content-type: application/json
+//	digest: SHA-256=base64
+func httpSignatures(r *http.Request, headers []string, digest []byte, p *params) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "(request-target): %s %s\n", strings.ToLower(r.Method), r.URL.RequestURI())
+	fmt.Fprintf(&b, "(created): %d\n", p.created)
+	fmt.Fprintf(&b, "(nonce): %s\n", p.nonce)
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%s: %s\n", strings.ToLower(h), headerValue(r, h))
+	}
+	fmt.Fprintf(&b, "digest: SHA-256=%s", base64.StdEncoding.EncodeToString(digest))
+	return b.Bytes()
+}
+
+// lines signs values only, with the query sorted by key:
+//
+//	POST
+//	/v1/messages
+//	to=1
+//	1600000000
+//	d2f3
+//	application/json
+//	hex of the SHA-256 of the body
+func lines(r *http.Request, headers []string, digest []byte, p *params) []byte {
+	values := []string{
+		strings.ToUpper(r.Method),
+		r.URL.EscapedPath(),
+		r.URL.Query().Encode(),
+		strconv.FormatInt(p.created, 10),
+		p.nonce,
+	}
+	for _, h := range headers {
+		values = append(values, headerValue(r, h))
+	}
+	values = append(values, hex.EncodeToString(digest))
+	return []byte(strings.Join(values, "\n"))
+}
+
+func headerValue(r *http.Request, name string) string {
+	if name == "Host" {
+		return r.Host
+	}
+	var values []string
+	for _, v := range r.Header.Values(name) {
+		values = append(values, strings.TrimSpace(v))
+	}
+	return strings.Join(values, ", ")
+}
+
+// digestBody returns the SHA-256 of the body and replaces the body with a
+// copy, so it can be read again.
+func digestBody(r *http.Request, maxSize int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		sum := sha256.Sum256(nil)
+		return sum[:], nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, errBodyTooLarge
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	return sum[:], nil
+}
+
+func algorithmOrDefault(name string) string {
+	if name == "" {
+		return "hmac-sha256"
+	}
+	return name
+}
+
+func canonicalizationOrDefault(name string) string {
+	if name == "" {
+		return "http-signatures"
+	}
+	return name
+}
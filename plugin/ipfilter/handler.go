@@ -0,0 +1,68 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vulcand/vulcand/plugin"
+)
+
+type handler struct {
+	next    http.Handler
+	trusted *tree
+	lists   *lists
+	env     plugin.Env
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip := h.clientIP(r)
+	if ip == nil || !h.lists.get().allowed(ip) {
+		plugin.RequestLog(r).Debugf("Rejected request from %s (%v) to %s", r.RemoteAddr, ip, r.URL)
+		h.env.IncCounter("rejected", 1)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// clientIP returns the IP of the client. Requests from trusted proxies are
+// from the last IP in X-Forwarded-For that is not a trusted proxy.
+func (h *handler) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || h.trusted.lookup(ip) != allow {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		s := strings.TrimSpace(forwarded[i])
+		if s == "" {
+			continue
+		}
+		prev := net.ParseIP(s)
+		if prev == nil {
+			// The header is malformed past this point, the last proxy
+			// is the closest to the client that can be trusted.
+			return ip
+		}
+		ip = prev
+		if h.trusted.lookup(ip) != allow {
+			return ip
+		}
+	}
+	return ip
+}
+
+func (r *rules) allowed(ip net.IP) bool {
+	switch r.tree.lookup(ip) {
+	case allow:
+		return true
+	case deny:
+		return false
+	}
+	return !r.allowList
+}
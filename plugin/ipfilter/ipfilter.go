@@ -0,0 +1,169 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "ipfilter"
+
+// DefaultReloadInterval is how often list files and engine keys are checked
+// for changes by default.
+const DefaultReloadInterval = 10 * time.Second
+
+var valueKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// IPFilter lets through or rejects requests by the IP of the client. Allow
+// and deny lists are networks in CIDR notation or single IPs, given inline,
+// in files, or in engine keys. Files and keys have a network per line, and
+// lines starting with # are comments. They are checked for changes
+// periodically and applied without rebuilding the frontend.
+//
+// The most specific network the client IP belongs to decides. If the IP is in
+// no network, the request is let through unless there is an allow list.
+type IPFilter struct {
+	Allow []string
+	Deny  []string
+	// AllowFile and DenyFile are paths of list files.
+	AllowFile string
+	DenyFile  string
+	// AllowKey and DenyKey are keys of lists kept in the engine, e.g.
+	// "office" for /vulcand/values/office in Etcd.
+	AllowKey string
+	DenyKey  string
+	// ReloadInterval is how often files and keys are checked for changes,
+	// e.g. "30s".
+	ReloadInterval string
+	// TrustedProxies are networks of proxies in front of vulcand. The client
+	// IP of requests from them is taken from X-Forwarded-For.
+	TrustedProxies []string
+
+	reloadInterval time.Duration
+	clock          timetools.TimeProvider
+}
+
+// NewIPFilter validates settings and returns an IP filter middleware.
+func NewIPFilter(f IPFilter) (*IPFilter, error) {
+	if len(f.Allow) == 0 && len(f.Deny) == 0 && f.AllowFile == "" && f.DenyFile == "" && f.AllowKey == "" && f.DenyKey == "" {
+		return nil, fmt.Errorf("at least one allow or deny list is required")
+	}
+	for _, list := range [][]string{f.Allow, f.Deny, f.TrustedProxies} {
+		for _, s := range list {
+			if _, err := parseNetwork(s); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, key := range []string{f.AllowKey, f.DenyKey} {
+		if key != "" && !valueKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("invalid key %q, expected letters, digits, '_', '.' or '-'", key)
+		}
+	}
+	if f.ReloadInterval == "" {
+		f.reloadInterval = DefaultReloadInterval
+	} else {
+		d, err := time.ParseDuration(f.ReloadInterval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("reload interval should be a duration > 0, got %q", f.ReloadInterval)
+		}
+		f.reloadInterval = d
+	}
+	if f.clock == nil {
+		f.clock = &timetools.RealTime{}
+	}
+	return &f, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (f *IPFilter) NewHandler(next http.Handler) (http.Handler, error) {
+	return f.NewHandlerWithEnv(next, plugin.Env{})
+}
+
+// NewHandlerWithEnv returns a handler that reads lists from the engine.
+func (f *IPFilter) NewHandlerWithEnv(next http.Handler, env plugin.Env) (http.Handler, error) {
+	trusted := &tree{}
+	for _, s := range f.TrustedProxies {
+		n, _ := parseNetwork(s)
+		trusted.insert(n, allow)
+	}
+	var sources []*source
+	if f.AllowFile != "" {
+		sources = append(sources, &source{action: allow, reader: fileReader(f.AllowFile)})
+	}
+	if f.DenyFile != "" {
+		sources = append(sources, &source{action: deny, reader: fileReader(f.DenyFile)})
+	}
+	for _, s := range []struct {
+		key    string
+		action action
+	}{{f.AllowKey, allow}, {f.DenyKey, deny}} {
+		if s.key == "" {
+			continue
+		}
+		if env.ValueStore == nil {
+			return nil, fmt.Errorf("the engine does not keep values, list key %q can not be read", s.key)
+		}
+		sources = append(sources, &source{action: s.action, reader: keyReader(env.ValueStore, s.key)})
+	}
+	l, err := newLists(f.Allow, f.Deny, sources, f.AllowFile != "" || f.AllowKey != "", f.reloadInterval, f.clock)
+	if err != nil {
+		return nil, err
+	}
+	return &handler{next: next, trusted: trusted, lists: l, env: env}, nil
+}
+
+func (f *IPFilter) String() string {
+	return fmt.Sprintf("allow=%s, deny=%s, allowFile=%s, denyFile=%s, allowKey=%s, denyKey=%s, reloadInterval=%s, trustedProxies=%s",
+		strings.Join(f.Allow, ","), strings.Join(f.Deny, ","), f.AllowFile, f.DenyFile, f.AllowKey, f.DenyKey,
+		f.reloadInterval, strings.Join(f.TrustedProxies, ","))
+}
+
+func FromOther(f IPFilter) (plugin.Middleware, error) {
+	return NewIPFilter(f)
+}
+
+// FromCli constructs the middleware from the command line.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	f := IPFilter{
+		Allow:          c.StringSlice("allow"),
+		Deny:           c.StringSlice("deny"),
+		AllowFile:      c.String("allowFile"),
+		DenyFile:       c.String("denyFile"),
+		AllowKey:       c.String("allowKey"),
+		DenyKey:        c.String("denyKey"),
+		TrustedProxies: c.StringSlice("trustedProxy"),
+	}
+	if d := c.Duration("reloadInterval"); d != 0 {
+		f.ReloadInterval = d.String()
+	}
+	return NewIPFilter(f)
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{Name: "allow", Value: &cli.StringSlice{}, Usage: "allowed network, e.g. 10.0.0.0/8"},
+		cli.StringSliceFlag{Name: "deny", Value: &cli.StringSlice{}, Usage: "denied network, e.g. 192.0.2.1"},
+		cli.StringFlag{Name: "allowFile", Usage: "file with allowed networks, a network per line"},
+		cli.StringFlag{Name: "denyFile", Usage: "file with denied networks, a network per line"},
+		cli.StringFlag{Name: "allowKey", Usage: "engine key of allowed networks, a network per line"},
+		cli.StringFlag{Name: "denyKey", Usage: "engine key of denied networks, a network per line"},
+		cli.DurationFlag{Name: "reloadInterval", Usage: "how often files and keys are checked for changes"},
+		cli.StringSliceFlag{Name: "trustedProxy", Value: &cli.StringSlice{}, Usage: "network of proxies that set X-Forwarded-For"},
+	}
+}
@@ -0,0 +1,317 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestIPFilter(t *testing.T) { TestingT(t) }
+
+type IPFilterSuite struct {
+	clock *timetools.FreezedTime
+	dir   string
+}
+
+var _ = Suite(&IPFilterSuite{})
+
+func (s *IPFilterSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{CurrentTime: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	s.dir = c.MkDir()
+}
+
+// Make sure the spec is compatible and will be accepted by middleware registry
+func (s *IPFilterSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *IPFilterSuite) TestNewIPFilterBadParams(c *C) {
+	tcs := []IPFilter{
+		{},
+		{TrustedProxies: []string{"10.0.0.0/8"}},
+		{Allow: []string{"10.0.0.0/33"}},
+		{Deny: []string{"example.com"}},
+		{Allow: []string{"10.0.0.1"}, TrustedProxies: []string{"proxy"}},
+		{AllowKey: "lists/office"},
+		{DenyKey: "a b"},
+		{Deny: []string{"10.0.0.1"}, ReloadInterval: "0s"},
+		{Deny: []string{"10.0.0.1"}, ReloadInterval: "often"},
+	}
+	for _, tc := range tcs {
+		_, err := NewIPFilter(tc)
+		c.Assert(err, NotNil, Commentf("%#v", tc))
+	}
+}
+
+func (s *IPFilterSuite) TestNewIPFilterFromOther(c *C) {
+	f, err := NewIPFilter(IPFilter{
+		Allow:          []string{"10.0.0.0/8"},
+		Deny:           []string{"10.1.0.0/16", "2001:db8::1"},
+		AllowFile:      "/etc/vulcand/allow.txt",
+		DenyFile:       "/etc/vulcand/deny.txt",
+		AllowKey:       "office",
+		DenyKey:        "blocked",
+		ReloadInterval: "1m",
+		TrustedProxies: []string{"192.168.0.0/16"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(f.String(), Not(Equals), "")
+
+	out, err := FromOther(*f)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+}
+
+func (s *IPFilterSuite) TestNewIPFilterFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		f := out.(*IPFilter)
+		c.Assert(f.Allow, DeepEquals, []string{"10.0.0.0/8", "::1"})
+		c.Assert(f.Deny, DeepEquals, []string{"10.1.0.0/16"})
+		c.Assert(f.AllowFile, Equals, "/tmp/allow")
+		c.Assert(f.DenyFile, Equals, "/tmp/deny")
+		c.Assert(f.AllowKey, Equals, "office")
+		c.Assert(f.DenyKey, Equals, "blocked")
+		c.Assert(f.ReloadInterval, Equals, "30s")
+		c.Assert(f.TrustedProxies, DeepEquals, []string{"192.168.0.0/16"})
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--allow=10.0.0.0/8", "--allow=::1", "--deny=10.1.0.0/16", "--allowFile=/tmp/allow",
+		"--denyFile=/tmp/deny", "--allowKey=office", "--denyKey=blocked", "--reloadInterval=30s", "--trustedProxy=192.168.0.0/16"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *IPFilterSuite) TestTree(c *C) {
+	t := &tree{}
+	for _, tc := range []struct {
+		network string
+		action  action
+	}{
+		{"10.0.0.0/8", allow},
+		{"10.1.0.0/16", deny},
+		{"10.1.2.3", allow},
+		{"10.1.2.0/24", deny},
+		{"192.168.1.0/24", allow},
+		{"192.168.1.0/24", deny},
+		{"2001:db8::/32", allow},
+		{"2001:db8:bad::/48", deny},
+		{"::ffff:172.16.0.0/108", deny},
+	} {
+		n, err := parseNetwork(tc.network)
+		c.Assert(err, IsNil)
+		t.insert(n, tc.action)
+	}
+	for _, tc := range []struct {
+		ip     string
+		action action
+	}{
+		{"10.200.0.1", allow},
+		{"10.1.200.1", deny},
+		{"10.1.2.4", deny},
+		{"10.1.2.3", allow},
+		{"11.0.0.1", none},
+		{"192.168.1.1", deny},
+		{"2001:db8::1", allow},
+		{"2001:db8:bad::1", deny},
+		{"2001:db9::1", none},
+		{"172.16.1.1", deny},
+		{"::ffff:10.1.2.3", allow},
+	} {
+		c.Assert(t.lookup(net.ParseIP(tc.ip)), Equals, tc.action, Commentf(tc.ip))
+	}
+}
+
+func (s *IPFilterSuite) TestLargeList(c *C) {
+	t := &tree{}
+	for i := 0; i < 1<<16; i++ {
+		t.insert(&net.IPNet{IP: net.IPv4(10, 0, byte(i>>8), byte(i)).To4(), Mask: net.CIDRMask(32, 32)}, deny)
+	}
+	c.Assert(t.lookup(net.ParseIP("10.0.200.17")), Equals, deny)
+	c.Assert(t.lookup(net.ParseIP("10.1.0.0")), Equals, none)
+	c.Assert(countNodes(t.v4) < 1<<17, Equals, true)
+}
+
+func (s *IPFilterSuite) TestInline(c *C) {
+	h := s.newHandler(c, IPFilter{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}}, plugin.Env{})
+	c.Assert(request(h, "10.2.0.1:1234", ""), Equals, http.StatusOK)
+	c.Assert(request(h, "10.1.0.1:1234", ""), Equals, http.StatusForbidden)
+	c.Assert(request(h, "192.0.2.1:1234", ""), Equals, http.StatusForbidden)
+
+	// Without an allow list everything that is not denied is let through
+	h = s.newHandler(c, IPFilter{Deny: []string{"10.1.0.0/16"}}, plugin.Env{})
+	c.Assert(request(h, "192.0.2.1:1234", ""), Equals, http.StatusOK)
+	c.Assert(request(h, "10.1.0.1:1234", ""), Equals, http.StatusForbidden)
+}
+
+func (s *IPFilterSuite) TestTrustedProxies(c *C) {
+	h := s.newHandler(c, IPFilter{Deny: []string{"203.0.113.0/24"}, TrustedProxies: []string{"10.0.0.0/8"}}, plugin.Env{})
+
+	// The client IP is taken from X-Forwarded-For of trusted proxies only
+	c.Assert(request(h, "10.0.0.1:80", "203.0.113.5"), Equals, http.StatusForbidden)
+	c.Assert(request(h, "192.0.2.1:80", "203.0.113.5"), Equals, http.StatusOK)
+	c.Assert(request(h, "203.0.113.5:80", "192.0.2.1"), Equals, http.StatusForbidden)
+
+	// Clients can not hide behind addresses they add to the header
+	c.Assert(request(h, "10.0.0.1:80", "192.0.2.1, 203.0.113.5, 10.0.0.2"), Equals, http.StatusForbidden)
+	c.Assert(request(h, "10.0.0.1:80", "203.0.113.5, 192.0.2.1"), Equals, http.StatusOK)
+	c.Assert(request(h, "10.0.0.1:80", "junk, 10.0.0.2"), Equals, http.StatusOK)
+}
+
+func (s *IPFilterSuite) TestFile(c *C) {
+	path := filepath.Join(s.dir, "deny.txt")
+	s.writeFile(c, path, "# bad actors\n203.0.113.0/24\n\n198.51.100.7 # scanner\n")
+
+	h := s.newHandler(c, IPFilter{DenyFile: path, ReloadInterval: "10s"}, plugin.Env{})
+	c.Assert(request(h, "203.0.113.5:80", ""), Equals, http.StatusForbidden)
+	c.Assert(request(h, "198.51.100.7:80", ""), Equals, http.StatusForbidden)
+	c.Assert(request(h, "192.0.2.1:80", ""), Equals, http.StatusOK)
+
+	// Changes are picked up after the reload interval
+	s.writeFile(c, path, "192.0.2.0/24\n")
+	c.Assert(request(h, "192.0.2.1:80", ""), Equals, http.StatusOK)
+	s.clock.Sleep(10 * time.Second)
+	waitFor(c, func() bool { return request(h, "192.0.2.1:80", "") == http.StatusForbidden })
+	c.Assert(request(h, "203.0.113.5:80", ""), Equals, http.StatusOK)
+
+	// Broken lists do not replace working ones
+	s.writeFile(c, path, "192.0.2.0/24\nnot an ip\n")
+	s.clock.Sleep(10 * time.Second)
+	request(h, "192.0.2.1:80", "")
+	waitFor(c, func() bool { return !h.(*handler).lists.isReloading() })
+	c.Assert(request(h, "192.0.2.1:80", ""), Equals, http.StatusForbidden)
+
+	// Missing files are configuration errors
+	f, err := NewIPFilter(IPFilter{AllowFile: filepath.Join(s.dir, "missing.txt")})
+	c.Assert(err, IsNil)
+	_, err = f.NewHandler(http.HandlerFunc(ok))
+	c.Assert(err, NotNil)
+}
+
+func (s *IPFilterSuite) TestKey(c *C) {
+	store := &valueStore{values: map[string][]byte{"office": []byte("10.0.0.0/8\n")}}
+	h := s.newHandler(c, IPFilter{AllowKey: "office", DenyKey: "blocked"}, plugin.Env{ValueStore: store})
+	c.Assert(request(h, "10.0.0.1:80", ""), Equals, http.StatusOK)
+	c.Assert(request(h, "192.0.2.1:80", ""), Equals, http.StatusForbidden)
+
+	store.set("blocked", "10.0.0.1")
+	store.set("office", "10.0.0.0/8\n192.0.2.0/24")
+	s.clock.Sleep(DefaultReloadInterval)
+	waitFor(c, func() bool { return request(h, "192.0.2.1:80", "") == http.StatusOK })
+	c.Assert(request(h, "10.0.0.1:80", ""), Equals, http.StatusForbidden)
+
+	// Removed keys are empty lists
+	store.set("office", "")
+	s.clock.Sleep(DefaultReloadInterval)
+	waitFor(c, func() bool { return request(h, "192.0.2.1:80", "") == http.StatusForbidden })
+
+	// Keys need an engine that keeps values
+	f, err := NewIPFilter(IPFilter{AllowKey: "office"})
+	c.Assert(err, IsNil)
+	_, err = f.NewHandler(http.HandlerFunc(ok))
+	c.Assert(err, NotNil)
+}
+
+func (s *IPFilterSuite) TestParseList(c *C) {
+	networks, err := parseList([]byte("10.0.0.0/8\r\n  2001:db8::/32  \n# comment\n192.0.2.1"))
+	c.Assert(err, IsNil)
+	c.Assert(len(networks), Equals, 3)
+	c.Assert(networks[2].String(), Equals, "192.0.2.1/32")
+
+	_, err = parseList([]byte("10.0.0.0/8\n10.0.0.0/99"))
+	c.Assert(err, ErrorMatches, "line 2: .*")
+}
+
+func (s *IPFilterSuite) newHandler(c *C, cfg IPFilter, env plugin.Env) http.Handler {
+	cfg.clock = s.clock
+	f, err := NewIPFilter(cfg)
+	c.Assert(err, IsNil)
+	h, err := f.NewHandlerWithEnv(http.HandlerFunc(ok), env)
+	c.Assert(err, IsNil)
+	return h
+}
+
+func (s *IPFilterSuite) writeFile(c *C, path, data string) {
+	c.Assert(ioutil.WriteFile(path, []byte(data), 0600), IsNil)
+	// Make sure the file looks modified even on file systems with coarse
+	// modification times.
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(time.Second)
+	c.Assert(os.Chtimes(path, s.clock.CurrentTime, s.clock.CurrentTime), IsNil)
+}
+
+func (l *lists) isReloading() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reloading
+}
+
+type valueStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (s *valueStore) GetValue(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key], nil
+}
+
+func (s *valueStore) set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value == "" {
+		delete(s.values, key)
+		return
+	}
+	s.values[key] = []byte(value)
+}
+
+func countNodes(n *node) int {
+	if n == nil {
+		return 0
+	}
+	return 1 + countNodes(n.child[0]) + countNodes(n.child[1])
+}
+
+func request(h http.Handler, remoteAddr, forwardedFor string) int {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, r)
+	return re.Code
+}
+
+func waitFor(c *C, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for condition")
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
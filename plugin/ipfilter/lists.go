@@ -0,0 +1,223 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// reader returns the list and its version. It returns no data if the version
+// is the same as the last one.
+type reader func(last string) (data []byte, version string, err error)
+
+// fileReader reads lists from a file, the version is the modification time
+// and the size of the file.
+func fileReader(path string) reader {
+	return func(last string) ([]byte, string, error) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, "", err
+		}
+		version := fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size())
+		if version == last {
+			return nil, version, nil
+		}
+		data, err := ioutil.ReadFile(path)
+		return data, version, err
+	}
+}
+
+// keyReader reads lists from the engine, the version is the hash of the list.
+// A missing key is an empty list.
+func keyReader(store plugin.ValueStore, key string) reader {
+	return func(last string) ([]byte, string, error) {
+		data, err := store.GetValue(key)
+		if err != nil {
+			return nil, "", err
+		}
+		if data == nil {
+			return nil, "", nil
+		}
+		sum := sha256.Sum256(data)
+		version := hex.EncodeToString(sum[:])
+		if version == last {
+			return nil, version, nil
+		}
+		return data, version, nil
+	}
+}
+
+// source is a list that can change.
+type source struct {
+	action   action
+	reader   reader
+	version  string
+	networks []*net.IPNet
+}
+
+// rules are networks of all lists.
+type rules struct {
+	tree      *tree
+	allowList bool
+}
+
+// lists keeps rules up to date with sources. Sources are checked when rules
+// are needed and the reload interval has passed, in the background, so
+// requests do not wait for files or the engine.
+type lists struct {
+	allow     []*net.IPNet
+	deny      []*net.IPNet
+	sources   []*source
+	allowList bool
+	interval  time.Duration
+	clock     timetools.TimeProvider
+
+	mu        sync.Mutex
+	checked   time.Time
+	reloading bool
+
+	rules atomic.Value
+}
+
+func newLists(allow, deny []string, sources []*source, allowSource bool, interval time.Duration, clock timetools.TimeProvider) (*lists, error) {
+	l := &lists{
+		sources:   sources,
+		allowList: len(allow) != 0 || allowSource,
+		interval:  interval,
+		clock:     clock,
+		checked:   clock.UtcNow(),
+	}
+	for _, s := range allow {
+		n, err := parseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		l.allow = append(l.allow, n)
+	}
+	for _, s := range deny {
+		n, err := parseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		l.deny = append(l.deny, n)
+	}
+	for _, s := range sources {
+		if _, err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	l.build()
+	return l, nil
+}
+
+// get returns the current rules, and starts reloading sources if it is time.
+func (l *lists) get() *rules {
+	if len(l.sources) != 0 {
+		l.check()
+	}
+	return l.rules.Load().(*rules)
+}
+
+func (l *lists) check() {
+	l.mu.Lock()
+	now := l.clock.UtcNow()
+	if l.reloading || now.Sub(l.checked) < l.interval {
+		l.mu.Unlock()
+		return
+	}
+	l.reloading = true
+	l.checked = now
+	l.mu.Unlock()
+
+	go func() {
+		l.reload()
+		l.mu.Lock()
+		l.reloading = false
+		l.mu.Unlock()
+	}()
+}
+
+// reload loads sources that have changed, and keeps the previous version of
+// sources that fail to load.
+func (l *lists) reload() {
+	changed := false
+	for _, s := range l.sources {
+		ok, err := s.load()
+		if err != nil {
+			log.Warnf("Failed to reload IP list: %v", err)
+			continue
+		}
+		changed = changed || ok
+	}
+	if changed {
+		l.build()
+	}
+}
+
+func (l *lists) build() {
+	t := &tree{}
+	for _, n := range l.allow {
+		t.insert(n, allow)
+	}
+	for _, n := range l.deny {
+		t.insert(n, deny)
+	}
+	for _, s := range l.sources {
+		for _, n := range s.networks {
+			t.insert(n, s.action)
+		}
+	}
+	l.rules.Store(&rules{tree: t, allowList: l.allowList})
+}
+
+// load reads the source and returns true if it has changed.
+func (s *source) load() (bool, error) {
+	data, version, err := s.reader(s.version)
+	if err != nil {
+		return false, err
+	}
+	if version == s.version {
+		return false, nil
+	}
+	networks, err := parseList(data)
+	if err != nil {
+		return false, err
+	}
+	s.version, s.networks = version, networks
+	return true, nil
+}
+
+// parseList parses a network per line, skipping empty lines and comments.
+func parseList(data []byte) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		s := scanner.Text()
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		n, err := parseNetwork(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		out = append(out, n)
+	}
+	return out, scanner.Err()
+}
@@ -0,0 +1,162 @@
+package ipfilter
+
+import (
+	"fmt"
+	"math/bits"
+	"net"
+	"strings"
+)
+
+type action int8
+
+const (
+	none action = iota
+	allow
+	deny
+)
+
+// tree is a radix tree of networks that finds the most specific network an
+// IP belongs to. IPv4 and IPv6 networks are kept in trees of their own.
+type tree struct {
+	v4 *node
+	v6 *node
+}
+
+// node is a network, nodes only branch where their children differ, so the
+// tree has at most twice as many nodes as networks.
+type node struct {
+	ip     []byte
+	bits   int
+	action action
+	child  [2]*node
+}
+
+// insert adds the network to the tree. A network that is both allowed and
+// denied is denied.
+func (t *tree) insert(n *net.IPNet, a action) {
+	ip, bits := normalize(n)
+	root := &t.v6
+	if len(ip) == net.IPv4len {
+		root = &t.v4
+	}
+	insert(root, ip, bits, a)
+}
+
+func insert(np **node, ip []byte, bits int, a action) {
+	for {
+		n := *np
+		if n == nil {
+			*np = &node{ip: mask(ip, bits), bits: bits, action: a}
+			return
+		}
+		common := commonBits(n.ip, ip, min(n.bits, bits))
+		switch {
+		case common == n.bits && common == bits:
+			if n.action != deny {
+				n.action = a
+			}
+			return
+		case common == n.bits:
+			np = &n.child[bit(ip, n.bits)]
+		case common == bits:
+			parent := &node{ip: mask(ip, bits), bits: bits, action: a}
+			parent.child[bit(n.ip, bits)] = n
+			*np = parent
+			return
+		default:
+			parent := &node{ip: mask(ip, common), bits: common}
+			parent.child[bit(n.ip, common)] = n
+			parent.child[bit(ip, common)] = &node{ip: mask(ip, bits), bits: bits, action: a}
+			*np = parent
+			return
+		}
+	}
+}
+
+// lookup returns the action of the most specific network the IP belongs to.
+func (t *tree) lookup(ip net.IP) action {
+	n := t.v6
+	if v4 := ip.To4(); v4 != nil {
+		ip, n = v4, t.v4
+	}
+	found := none
+	for n != nil && commonBits(n.ip, ip, n.bits) == n.bits {
+		if n.action != none {
+			found = n.action
+		}
+		if n.bits == len(ip)*8 {
+			break
+		}
+		n = n.child[bit(ip, n.bits)]
+	}
+	return found
+}
+
+// parseNetwork parses a network in CIDR notation, or a single IP.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// normalize returns the network IP in 4 bytes for IPv4 networks, including
+// IPv4 networks in IPv6 notation, e.g. ::ffff:10.0.0.0/104.
+func normalize(n *net.IPNet) ([]byte, int) {
+	ones, size := n.Mask.Size()
+	if v4 := n.IP.To4(); v4 != nil {
+		if size == 128 {
+			ones -= 96
+			if ones < 0 {
+				ones = 0
+			}
+		}
+		return v4, ones
+	}
+	return n.IP.To16(), ones
+}
+
+// bit returns the i-th bit of the IP, counting from the most significant.
+func bit(ip []byte, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// commonBits returns how many leading bits, up to max, the IPs share.
+func commonBits(a, b []byte, max int) int {
+	n := 0
+	for i := 0; i < len(a) && n < max; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			n += bits.LeadingZeros8(x)
+			break
+		}
+		n += 8
+	}
+	return min(n, max)
+}
+
+func mask(ip []byte, bits int) []byte {
+	out := make([]byte, len(ip))
+	copy(out, ip)
+	for i := bits; i < len(out)*8; i++ {
+		out[i/8] &^= 1 << (7 - uint(i%8))
+	}
+	return out
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
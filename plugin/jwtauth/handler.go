@@ -0,0 +1,232 @@
+package jwtauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+var (
+	errNoToken      = errors.New("no bearer token")
+	errNoKey        = errors.New("no key to verify the token")
+	errInvalidToken = errors.New("invalid token")
+)
+
+type handler struct {
+	next           http.Handler
+	issuer         string
+	audiences      []string
+	requiredClaims []string
+	claimHeaders   map[string]string
+	leeway         time.Duration
+	clock          timetools.TimeProvider
+	keys           []verifyKey
+	jwks           *jwks
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Clients must not be able to pass claims of their own.
+	for _, header := range h.claimHeaders {
+		r.Header.Del(header)
+	}
+	claims, err := h.authenticate(r)
+	if err != nil {
+		plugin.RequestLog(r).Debugf("Rejected request to %s: %v", r.URL, err)
+		if err == errNoToken {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	for claim, header := range h.claimHeaders {
+		if v, ok := ClaimValue(claims, claim); ok {
+			r.Header.Set(header, v)
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func (h *handler) authenticate(r *http.Request) (jwt.MapClaims, error) {
+	raw, ok := bearerToken(r)
+	if !ok {
+		return nil, errNoToken
+	}
+	claims, err := h.verify(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verify checks the signature of the token with keys that match its key id
+// and algorithm.
+func (h *handler) verify(raw string) (jwt.MapClaims, error) {
+	return verifyToken(raw, h.keys, h.jwks)
+}
+
+func verifyToken(raw string, static []verifyKey, set *jwks) (jwt.MapClaims, error) {
+	parser := jwt.NewParser(jwt.WithoutClaimsValidation(), jwt.WithJSONNumber())
+	unverified, _, err := parser.ParseUnverified(raw, jwt.MapClaims{})
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	alg := unverified.Method.Alg()
+	kid, _ := unverified.Header["kid"].(string)
+
+	keys := static
+	if set != nil {
+		keys = append(append([]verifyKey{}, keys...), set.get(kid)...)
+	}
+	var candidates []verifyKey
+	for _, k := range keys {
+		if k.supports(alg) && (kid == "" || k.id == kid) {
+			candidates = append(candidates, k)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errNoKey
+	}
+	parser = jwt.NewParser(jwt.WithoutClaimsValidation(), jwt.WithJSONNumber(), jwt.WithValidMethods([]string{alg}))
+	for _, k := range candidates {
+		claims := jwt.MapClaims{}
+		key := k.key
+		if _, err := parser.ParseWithClaims(raw, claims, func(*jwt.Token) (interface{}, error) { return key, nil }); err == nil {
+			return claims, nil
+		}
+	}
+	return nil, errInvalidToken
+}
+
+// validate checks registered claims of a token with a valid signature.
+func (h *handler) validate(claims jwt.MapClaims) error {
+	now := h.clock.UtcNow()
+	exp, ok, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("token does not expire")
+	}
+	if !now.Before(exp.Add(h.leeway)) {
+		return fmt.Errorf("token expired at %s", exp)
+	}
+	nbf, ok, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(h.leeway).Before(nbf) {
+		return fmt.Errorf("token is not valid before %s", nbf)
+	}
+	if h.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != h.issuer {
+			return fmt.Errorf("unexpected issuer %q", iss)
+		}
+	}
+	if len(h.audiences) != 0 && !h.validAudience(claims["aud"]) {
+		return fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+	for _, name := range h.requiredClaims {
+		if v, ok := claims[name]; !ok || v == nil {
+			return fmt.Errorf("token does not have claim %q", name)
+		}
+	}
+	return nil
+}
+
+func (h *handler) validAudience(aud interface{}) bool {
+	var values []string
+	switch v := aud.(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	for _, v := range values {
+		for _, a := range h.audiences {
+			if v == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func numericDate(claims jwt.MapClaims, name string) (time.Time, bool, error) {
+	v, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("claim %q is not a number", name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("claim %q is not a number", name)
+	}
+	return time.Unix(0, int64(f*float64(time.Second))).UTC(), true, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(auth[7:])
+	return token, token != ""
+}
+
+// ClaimValue returns a claim as a header value. Nested claims are addressed
+// with dots, lists are joined with commas and objects are JSON encoded.
+func ClaimValue(claims jwt.MapClaims, path string) (string, bool) {
+	var v interface{} = map[string]interface{}(claims)
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[name]; !ok || v == nil {
+			return "", false
+		}
+	}
+	switch val := v.(type) {
+	case string:
+		return val, true
+	case json.Number:
+		return val.String(), true
+	case bool:
+		return fmt.Sprint(val), true
+	case []interface{}:
+		parts := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				parts = append(parts, s)
+				continue
+			}
+			data, _ := json.Marshal(item)
+			parts = append(parts, string(data))
+		}
+		return strings.Join(parts, ","), true
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
@@ -0,0 +1,170 @@
+package jwtauth
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// minRefetch is how long after a fetch the JWKS document can be fetched
+	// again because a token has a key id that is not in it, which happens
+	// when keys are rotated.
+	minRefetch = 10 * time.Second
+	// maxJWKSBytes is the max size of a JWKS document.
+	maxJWKSBytes = 1 << 20
+	jwksTimeout  = 10 * time.Second
+)
+
+// keySets keeps key sets of a middleware by URL, so that handlers built again
+// when the frontend is rebuilt, e.g. after a server is upserted, use the keys
+// fetched before instead of waiting for the document to be fetched again.
+type keySets struct {
+	mu   sync.Mutex
+	sets map[string]*jwks
+}
+
+func (ks *keySets) get(url string, refresh time.Duration, clock timetools.TimeProvider) *jwks {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.sets == nil {
+		ks.sets = make(map[string]*jwks)
+	}
+	j, ok := ks.sets[url]
+	if !ok {
+		j = newJWKS(url, refresh, clock)
+		ks.sets[url] = j
+	}
+	return j
+}
+
+// jwks keeps keys from a JWKS document. The document is fetched when keys are
+// needed the first time, and then refreshed in the background when keys are
+// needed and the refresh interval has passed.
+type jwks struct {
+	url     string
+	refresh time.Duration
+	clock   timetools.TimeProvider
+	client  *http.Client
+
+	// fetchMu makes sure only one fetch is in flight.
+	fetchMu sync.Mutex
+
+	mu         sync.Mutex
+	keys       []verifyKey
+	fetched    time.Time
+	refreshing bool
+}
+
+func newJWKS(url string, refresh time.Duration, clock timetools.TimeProvider) *jwks {
+	return &jwks{
+		url:     url,
+		refresh: refresh,
+		clock:   clock,
+		client:  &http.Client{Timeout: jwksTimeout},
+	}
+}
+
+// get returns the current keys. It fetches the document first if there are
+// no keys yet, or if there is no key with the id and the keys may have been
+// rotated.
+func (j *jwks) get(kid string) []verifyKey {
+	j.mu.Lock()
+	keys, fetched := j.keys, j.fetched
+	j.mu.Unlock()
+
+	age := j.clock.UtcNow().Sub(fetched)
+	switch {
+	case fetched.IsZero():
+		return j.fetchNow(fetched)
+	case (len(keys) == 0 || (kid != "" && !hasKey(keys, kid))) && age >= minRefetch:
+		return j.fetchNow(fetched)
+	case age >= j.refresh:
+		j.refreshAsync()
+	}
+	return keys
+}
+
+// fetchNow fetches the document unless it has been fetched since the moment
+// the caller saw.
+func (j *jwks) fetchNow(seen time.Time) []verifyKey {
+	j.fetchMu.Lock()
+	defer j.fetchMu.Unlock()
+
+	j.mu.Lock()
+	if !j.fetched.Equal(seen) {
+		keys := j.keys
+		j.mu.Unlock()
+		return keys
+	}
+	j.mu.Unlock()
+	return j.update()
+}
+
+func (j *jwks) refreshAsync() {
+	j.mu.Lock()
+	if j.refreshing {
+		j.mu.Unlock()
+		return
+	}
+	j.refreshing = true
+	j.mu.Unlock()
+
+	go func() {
+		j.fetchMu.Lock()
+		j.update()
+		j.fetchMu.Unlock()
+
+		j.mu.Lock()
+		j.refreshing = false
+		j.mu.Unlock()
+	}()
+}
+
+// update fetches the document, and keeps the old keys if it fails.
+func (j *jwks) update() []verifyKey {
+	keys, err := j.fetch()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fetched = j.clock.UtcNow()
+	if err != nil {
+		log.Warnf("Failed to fetch JWKS from %s: %v", j.url, err)
+		return j.keys
+	}
+	j.keys = keys
+	return keys
+}
+
+func (j *jwks) fetch() ([]verifyKey, error) {
+	re, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", re.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(re.Body, maxJWKSBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxJWKSBytes {
+		return nil, fmt.Errorf("document is larger than %d bytes", maxJWKSBytes)
+	}
+	return parseJWKS(data)
+}
+
+func hasKey(keys []verifyKey, kid string) bool {
+	for _, k := range keys {
+		if k.id == kid {
+			return true
+		}
+	}
+	return false
+}
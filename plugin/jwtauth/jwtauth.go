@@ -0,0 +1,284 @@
+package jwtauth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "jwtauth"
+
+// DefaultJWKSRefresh is how often the JWKS document is fetched by default.
+const DefaultJWKSRefresh = 5 * time.Minute
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// JWTAuth only lets through requests with a valid JSON Web Token in the
+// Authorization header, e.g. "Authorization: Bearer <token>". Tokens are
+// verified with static keys, or keys from a JWKS document that is fetched
+// periodically. Tokens should not be expired, and are checked against the
+// issuer, audiences and required claims if they are set.
+type JWTAuth struct {
+	// Issuer is the expected "iss" claim.
+	Issuer string
+	// Audiences are accepted values of the "aud" claim, a token should have
+	// at least one of them.
+	Audiences []string
+	// JWKSURL is the address of a JWKS document with keys to verify tokens.
+	JWKSURL string
+	// JWKSRefresh is how often the JWKS document is fetched, e.g. "10m".
+	JWKSRefresh string
+	// Keys are static keys to verify tokens.
+	Keys []Key `json:",omitempty"`
+	// RequiredClaims are claims that tokens should have.
+	RequiredClaims []string
+	// ClaimHeaders maps claims to request headers they are forwarded in,
+	// e.g. {"sub": "X-User-Id"}. Nested claims are addressed with dots, e.g.
+	// "realm.roles". Headers with these names are removed from requests.
+	ClaimHeaders map[string]string
+	// Leeway is how much clock skew is tolerated when checking expiry, e.g.
+	// "30s".
+	Leeway string
+
+	jwksRefresh time.Duration
+	leeway      time.Duration
+	clock       timetools.TimeProvider
+	keySets     *keySets
+}
+
+// Key is a static key that verifies tokens.
+type Key struct {
+	// Id is matched against the "kid" header of tokens. Tokens without
+	// "kid" are verified with every key of their algorithm.
+	Id string
+	// Algorithm is the algorithm of tokens the key verifies, e.g. "RS256",
+	// "ES256", "EdDSA" or "HS256".
+	Algorithm string
+	// PublicKey is a PEM encoded public key for asymmetric algorithms.
+	PublicKey string `json:",omitempty"`
+	// Secret is a base64 encoded secret for HMAC algorithms. Engines that
+	// can encrypt data store it in SealedSecret, public keys are stored as
+	// they are.
+	Secret       string `json:",omitempty"`
+	SealedSecret []byte `json:",omitempty"`
+}
+
+// NewJWTAuth validates settings and returns a JWT validation middleware.
+func NewJWTAuth(j JWTAuth) (*JWTAuth, error) {
+	if len(j.Keys) == 0 && j.JWKSURL == "" {
+		return nil, fmt.Errorf("either keys or JWKS URL are required")
+	}
+	if j.JWKSURL != "" {
+		u, err := url.Parse(j.JWKSURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("JWKS URL should be an absolute http(s) URL, got %q", j.JWKSURL)
+		}
+	}
+	for _, k := range j.Keys {
+		if len(k.SealedSecret) != 0 {
+			if k.Secret != "" {
+				return nil, fmt.Errorf("key %q: secret and sealed secret can not be both set", k.Id)
+			}
+			continue
+		}
+		if _, err := k.verifyKey(); err != nil {
+			return nil, err
+		}
+	}
+	for claim, header := range j.ClaimHeaders {
+		if claim == "" || header == "" || strings.ContainsAny(header, " :") {
+			return nil, fmt.Errorf("invalid claim header %q: %q", claim, header)
+		}
+	}
+	var err error
+	if j.jwksRefresh, err = parseDuration("JWKS refresh", j.JWKSRefresh, DefaultJWKSRefresh); err != nil {
+		return nil, err
+	}
+	if j.jwksRefresh == 0 {
+		return nil, fmt.Errorf("JWKS refresh should be > 0")
+	}
+	if j.leeway, err = parseDuration("leeway", j.Leeway, 0); err != nil {
+		return nil, err
+	}
+	if j.clock == nil {
+		j.clock = &timetools.RealTime{}
+	}
+	if j.keySets == nil {
+		j.keySets = &keySets{}
+	}
+	return &j, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (j *JWTAuth) NewHandler(next http.Handler) (http.Handler, error) {
+	h := &handler{
+		next:           next,
+		issuer:         j.Issuer,
+		audiences:      j.Audiences,
+		requiredClaims: j.RequiredClaims,
+		claimHeaders:   j.ClaimHeaders,
+		leeway:         j.leeway,
+		clock:          j.clock,
+	}
+	for _, k := range j.Keys {
+		if len(k.SealedSecret) != 0 {
+			return nil, fmt.Errorf("key %q: secret is sealed, vulcand needs the seal key to open it", k.Id)
+		}
+		vk, err := k.verifyKey()
+		if err != nil {
+			return nil, err
+		}
+		h.keys = append(h.keys, vk)
+	}
+	if j.JWKSURL != "" {
+		h.jwks = j.keySets.get(j.JWKSURL, j.jwksRefresh, j.clock)
+	}
+	return h, nil
+}
+
+// Seal returns a copy of the middleware with HMAC secrets of static keys
+// sealed. Middlewares with public keys only are returned as they are.
+func (j *JWTAuth) Seal(seal func(val interface{}) ([]byte, error)) (plugin.Middleware, error) {
+	if !j.hasKeys(func(k Key) bool { return k.Secret != "" }) {
+		return j, nil
+	}
+	out := *j
+	out.Keys = make([]Key, len(j.Keys))
+	for i, k := range j.Keys {
+		if k.Secret != "" {
+			sealed, err := seal(k.Secret)
+			if err != nil {
+				return nil, err
+			}
+			k.Secret, k.SealedSecret = "", sealed
+		}
+		out.Keys[i] = k
+	}
+	return &out, nil
+}
+
+// Open returns a copy of the middleware with sealed secrets opened.
+func (j *JWTAuth) Open(open func(sealed []byte, val interface{}) error) (plugin.Middleware, error) {
+	if !j.hasKeys(func(k Key) bool { return len(k.SealedSecret) != 0 }) {
+		return j, nil
+	}
+	out := *j
+	out.Keys = make([]Key, len(j.Keys))
+	for i, k := range j.Keys {
+		if len(k.SealedSecret) != 0 {
+			if err := open(k.SealedSecret, &k.Secret); err != nil {
+				return nil, err
+			}
+			k.SealedSecret = nil
+		}
+		out.Keys[i] = k
+	}
+	return NewJWTAuth(out)
+}
+
+func (j *JWTAuth) hasKeys(pred func(Key) bool) bool {
+	for _, k := range j.Keys {
+		if pred(k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *JWTAuth) String() string {
+	claims := make([]string, 0, len(j.ClaimHeaders))
+	for claim, header := range j.ClaimHeaders {
+		claims = append(claims, claim+"="+header)
+	}
+	sort.Strings(claims)
+	return fmt.Sprintf("issuer=%s, audiences=%s, jwksURL=%s, jwksRefresh=%s, keys=%d, requiredClaims=%s, claimHeaders=%s, leeway=%s",
+		j.Issuer, strings.Join(j.Audiences, ","), j.JWKSURL, j.jwksRefresh, len(j.Keys),
+		strings.Join(j.RequiredClaims, ","), strings.Join(claims, ","), j.leeway)
+}
+
+func FromOther(j JWTAuth) (plugin.Middleware, error) {
+	return NewJWTAuth(j)
+}
+
+// FromCli constructs the middleware from the command line. A static key can
+// be given as a PEM file or an HMAC secret.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	j := JWTAuth{
+		Issuer:         c.String("issuer"),
+		Audiences:      c.StringSlice("audience"),
+		JWKSURL:        c.String("jwksURL"),
+		RequiredClaims: c.StringSlice("requireClaim"),
+	}
+	if d := c.Duration("jwksRefresh"); d != 0 {
+		j.JWKSRefresh = d.String()
+	}
+	if d := c.Duration("leeway"); d != 0 {
+		j.Leeway = d.String()
+	}
+	for _, v := range c.StringSlice("claimHeader") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected claim=Header for --claimHeader, got %q", v)
+		}
+		if j.ClaimHeaders == nil {
+			j.ClaimHeaders = map[string]string{}
+		}
+		j.ClaimHeaders[parts[0]] = parts[1]
+	}
+	if path := c.String("keyFile"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		j.Keys = append(j.Keys, Key{Id: c.String("keyId"), Algorithm: c.String("keyAlgorithm"), PublicKey: string(data)})
+	}
+	if secret := c.String("hmacSecret"); secret != "" {
+		j.Keys = append(j.Keys, Key{Id: c.String("keyId"), Algorithm: c.String("keyAlgorithm"), Secret: secret})
+	}
+	return NewJWTAuth(j)
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "issuer", Usage: "expected issuer of tokens"},
+		cli.StringSliceFlag{Name: "audience", Value: &cli.StringSlice{}, Usage: "accepted audience of tokens"},
+		cli.StringFlag{Name: "jwksURL", Usage: "address of a JWKS document with keys to verify tokens"},
+		cli.DurationFlag{Name: "jwksRefresh", Usage: "how often the JWKS document is fetched"},
+		cli.StringFlag{Name: "keyFile", Usage: "PEM file with a public key to verify tokens"},
+		cli.StringFlag{Name: "hmacSecret", Usage: "base64 encoded secret to verify tokens, vulcand should run with -sealKey to store it"},
+		cli.StringFlag{Name: "keyId", Usage: "id of the static key, matched against the kid header of tokens"},
+		cli.StringFlag{Name: "keyAlgorithm", Usage: "algorithm of the static key, e.g. RS256 or HS256"},
+		cli.StringSliceFlag{Name: "requireClaim", Value: &cli.StringSlice{}, Usage: "claim that tokens should have"},
+		cli.StringSliceFlag{Name: "claimHeader", Value: &cli.StringSlice{}, Usage: "claim to forward in a request header, as claim=Header"},
+		cli.DurationFlag{Name: "leeway", Usage: "tolerated clock skew"},
+	}
+}
+
+func parseDuration(name, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s should be >= 0, got %s", name, value)
+	}
+	return d, nil
+}
@@ -0,0 +1,515 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/secret"
+	. "gopkg.in/check.v1"
+)
+
+func TestJWTAuth(t *testing.T) { TestingT(t) }
+
+type JWTAuthSuite struct {
+	clock  *timetools.FreezedTime
+	rsaKey *rsa.PrivateKey
+	hmac   []byte
+}
+
+var _ = Suite(&JWTAuthSuite{})
+
+func (s *JWTAuthSuite) SetUpSuite(c *C) {
+	var err error
+	s.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	s.hmac = []byte("0123456789abcdef0123456789abcdef")
+}
+
+func (s *JWTAuthSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{CurrentTime: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+// Make sure the spec is compatible and will be accepted by middleware registry
+func (s *JWTAuthSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *JWTAuthSuite) TestNewJWTAuthBadParams(c *C) {
+	tcs := []JWTAuth{
+		{},
+		{JWKSURL: "/jwks.json"},
+		{JWKSURL: "ftp://example.com/jwks.json"},
+		{Keys: []Key{{Algorithm: "none"}}},
+		{Keys: []Key{{Algorithm: "RS256", PublicKey: "not a key"}}},
+		{Keys: []Key{{Algorithm: "HS256", Secret: "!!"}}},
+		{Keys: []Key{{Algorithm: "HS256", Secret: s.secret(), SealedSecret: []byte("sealed")}}},
+		{Keys: []Key{{Algorithm: "HS256", Secret: s.secret()}}, ClaimHeaders: map[string]string{"sub": "X User"}},
+		{Keys: []Key{{Algorithm: "HS256", Secret: s.secret()}}, Leeway: "soon"},
+		{JWKSURL: "https://example.com/jwks.json", JWKSRefresh: "0s"},
+	}
+	for i, tc := range tcs {
+		_, err := NewJWTAuth(tc)
+		c.Assert(err, NotNil, Commentf("case %d", i))
+	}
+}
+
+func (s *JWTAuthSuite) TestNewJWTAuthFromOther(c *C) {
+	j, err := NewJWTAuth(JWTAuth{
+		Issuer:         "https://issuer.example.com",
+		Audiences:      []string{"api"},
+		JWKSURL:        "https://issuer.example.com/jwks.json",
+		JWKSRefresh:    "1m",
+		Keys:           []Key{{Id: "k1", Algorithm: "RS256", PublicKey: s.rsaPEM(c)}},
+		RequiredClaims: []string{"sub"},
+		ClaimHeaders:   map[string]string{"sub": "X-User-Id"},
+		Leeway:         "30s",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(j.String(), Not(Equals), "")
+
+	out, err := FromOther(*j)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, j)
+}
+
+func (s *JWTAuthSuite) TestNewJWTAuthFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		j := out.(*JWTAuth)
+		c.Assert(j.Issuer, Equals, "iss")
+		c.Assert(j.Audiences, DeepEquals, []string{"a", "b"})
+		c.Assert(j.JWKSURL, Equals, "https://example.com/jwks.json")
+		c.Assert(j.JWKSRefresh, Equals, "1m0s")
+		c.Assert(j.Keys, DeepEquals, []Key{{Id: "k1", Algorithm: "HS256", Secret: s.secret()}})
+		c.Assert(j.RequiredClaims, DeepEquals, []string{"sub"})
+		c.Assert(j.ClaimHeaders, DeepEquals, map[string]string{"sub": "X-User-Id", "org.id": "X-Org"})
+		c.Assert(j.Leeway, Equals, "5s")
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--issuer=iss", "--audience=a", "--audience=b",
+		"--jwksURL=https://example.com/jwks.json", "--jwksRefresh=1m",
+		"--hmacSecret=" + s.secret(), "--keyId=k1", "--keyAlgorithm=HS256",
+		"--requireClaim=sub", "--claimHeader=sub=X-User-Id", "--claimHeader=org.id=X-Org", "--leeway=5s"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *JWTAuthSuite) TestValidToken(c *C) {
+	var received http.Header
+	h := s.newHandler(c, JWTAuth{
+		Keys:         []Key{{Algorithm: "HS256", Secret: s.secret()}},
+		ClaimHeaders: map[string]string{"sub": "X-User-Id", "org.id": "X-Org", "roles": "X-Roles", "admin": "X-Admin"},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	})
+
+	token := s.sign(c, jwt.SigningMethodHS256, s.hmac, "", jwt.MapClaims{
+		"sub":   "user-1",
+		"org":   map[string]interface{}{"id": 42},
+		"roles": []string{"reader", "writer"},
+		"exp":   s.clock.UtcNow().Add(time.Minute).Unix(),
+	})
+	r := request(token)
+	r.Header.Set("X-Admin", "true")
+	re := serve(h, r)
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(received.Get("X-User-Id"), Equals, "user-1")
+	c.Assert(received.Get("X-Org"), Equals, "42")
+	c.Assert(received.Get("X-Roles"), Equals, "reader,writer")
+	// Headers of claims that the token does not have can not be spoofed
+	c.Assert(received.Get("X-Admin"), Equals, "")
+}
+
+func (s *JWTAuthSuite) TestRejectsTokens(c *C) {
+	h := s.newHandler(c, JWTAuth{
+		Issuer:         "https://issuer.example.com",
+		Audiences:      []string{"api", "admin"},
+		Keys:           []Key{{Algorithm: "HS256", Secret: s.secret()}},
+		RequiredClaims: []string{"sub"},
+		Leeway:         "10s",
+	}, ok)
+
+	now := s.clock.UtcNow()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "https://issuer.example.com",
+			"aud": "api",
+			"sub": "user-1",
+			"exp": now.Add(time.Minute).Unix(),
+		}
+	}
+	re := serve(h, request(s.sign(c, jwt.SigningMethodHS256, s.hmac, "", valid())))
+	c.Assert(re.Code, Equals, http.StatusOK)
+
+	tcs := []struct {
+		name   string
+		change func(jwt.MapClaims)
+	}{
+		{"expired", func(cl jwt.MapClaims) { cl["exp"] = now.Add(-time.Minute).Unix() }},
+		{"no expiry", func(cl jwt.MapClaims) { delete(cl, "exp") }},
+		{"not yet valid", func(cl jwt.MapClaims) { cl["nbf"] = now.Add(time.Minute).Unix() }},
+		{"wrong issuer", func(cl jwt.MapClaims) { cl["iss"] = "https://evil.example.com" }},
+		{"wrong audience", func(cl jwt.MapClaims) { cl["aud"] = []string{"other"} }},
+		{"no audience", func(cl jwt.MapClaims) { delete(cl, "aud") }},
+		{"no required claim", func(cl jwt.MapClaims) { delete(cl, "sub") }},
+	}
+	for _, tc := range tcs {
+		claims := valid()
+		tc.change(claims)
+		re := serve(h, request(s.sign(c, jwt.SigningMethodHS256, s.hmac, "", claims)))
+		c.Assert(re.Code, Equals, http.StatusUnauthorized, Commentf(tc.name))
+		c.Assert(re.Header().Get("WWW-Authenticate"), Equals, `Bearer error="invalid_token"`, Commentf(tc.name))
+	}
+
+	// Leeway tolerates clock skew
+	claims := valid()
+	claims["exp"] = now.Add(-5 * time.Second).Unix()
+	claims["aud"] = []string{"other", "admin"}
+	re = serve(h, request(s.sign(c, jwt.SigningMethodHS256, s.hmac, "", claims)))
+	c.Assert(re.Code, Equals, http.StatusOK)
+
+	// Bad signature
+	re = serve(h, request(s.sign(c, jwt.SigningMethodHS256, []byte("another secret"), "", valid())))
+	c.Assert(re.Code, Equals, http.StatusUnauthorized)
+
+	// Garbage
+	re = serve(h, request("not.a.token"))
+	c.Assert(re.Code, Equals, http.StatusUnauthorized)
+
+	// No token
+	re = serve(h, request(""))
+	c.Assert(re.Code, Equals, http.StatusUnauthorized)
+	c.Assert(re.Header().Get("WWW-Authenticate"), Equals, "Bearer")
+}
+
+func (s *JWTAuthSuite) TestAlgorithmConfusion(c *C) {
+	pemKey := s.rsaPEM(c)
+	h := s.newHandler(c, JWTAuth{Keys: []Key{{Algorithm: "RS256", PublicKey: pemKey}}}, ok)
+
+	claims := jwt.MapClaims{"exp": s.clock.UtcNow().Add(time.Minute).Unix()}
+	re := serve(h, request(s.sign(c, jwt.SigningMethodRS256, s.rsaKey, "", claims)))
+	c.Assert(re.Code, Equals, http.StatusOK)
+
+	// A token signed with the public key as an HMAC secret must be rejected
+	re = serve(h, request(s.sign(c, jwt.SigningMethodHS256, []byte(pemKey), "", claims)))
+	c.Assert(re.Code, Equals, http.StatusUnauthorized)
+}
+
+func (s *JWTAuthSuite) TestStaticECKey(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	c.Assert(err, IsNil)
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	h := s.newHandler(c, JWTAuth{Keys: []Key{
+		{Id: "hmac", Algorithm: "HS256", Secret: s.secret()},
+		{Id: "ec", Algorithm: "ES256", PublicKey: pemKey},
+	}}, ok)
+	claims := jwt.MapClaims{"exp": s.clock.UtcNow().Add(time.Minute).Unix()}
+	re := serve(h, request(s.sign(c, jwt.SigningMethodES256, key, "ec", claims)))
+	c.Assert(re.Code, Equals, http.StatusOK)
+
+	// The key id has to match
+	re = serve(h, request(s.sign(c, jwt.SigningMethodES256, key, "hmac", claims)))
+	c.Assert(re.Code, Equals, http.StatusUnauthorized)
+}
+
+func (s *JWTAuthSuite) TestJWKS(c *C) {
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	srv := newJWKSServer()
+	defer srv.Close()
+	srv.setKeys(map[string]*rsa.PublicKey{"k1": &s.rsaKey.PublicKey})
+
+	h := s.newHandler(c, JWTAuth{JWKSURL: srv.URL, JWKSRefresh: "1m"}, ok)
+	claims := jwt.MapClaims{"exp": s.clock.UtcNow().Add(time.Hour).Unix()}
+
+	re := serve(h, request(s.sign(c, jwt.SigningMethodRS256, s.rsaKey, "k1", claims)))
+	c.Assert(re.Code, Equals, http.StatusOK)
+	re = serve(h, request(s.sign(c, jwt.SigningMethodRS256, s.rsaKey, "k1", claims)))
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(srv.fetches(), Equals, int64(1))
+
+	// Keys are rotated, tokens with a new key id make the document fetched
+	// again, but not too often
+	srv.setKeys(map[string]*rsa.PublicKey{"k1": &s.rsaKey.PublicKey, "k2": &rotated.PublicKey})
+	re = serve(h, request(s.sign(c, jwt.SigningMethodRS256, rotated, "k2", claims)))
+	c.Assert(re.Code, Equals, http.StatusUnauthorized)
+	c.Assert(srv.fetches(), Equals, int64(1))
+
+	s.clock.Sleep(minRefetch)
+	re = serve(h, request(s.sign(c, jwt.SigningMethodRS256, rotated, "k2", claims)))
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(srv.fetches(), Equals, int64(2))
+
+	// Keys are refreshed in the background once the refresh interval passes
+	srv.setKeys(map[string]*rsa.PublicKey{"k2": &rotated.PublicKey})
+	s.clock.Sleep(time.Minute)
+	re = serve(h, request(s.sign(c, jwt.SigningMethodRS256, s.rsaKey, "k1", claims)))
+	c.Assert(re.Code, Equals, http.StatusOK)
+	waitFor(c, func() bool { return srv.fetches() == 3 })
+	waitFor(c, func() bool {
+		return serve(h, request(s.sign(c, jwt.SigningMethodRS256, s.rsaKey, "k1", claims))).Code == http.StatusUnauthorized
+	})
+}
+
+// Frontends are rebuilt on unrelated changes, handlers built again must not
+// wait for the document to be fetched again.
+func (s *JWTAuthSuite) TestJWKSReusedByHandlers(c *C) {
+	srv := newJWKSServer()
+	defer srv.Close()
+	srv.setKeys(map[string]*rsa.PublicKey{"k1": &s.rsaKey.PublicKey})
+
+	j, err := NewJWTAuth(JWTAuth{JWKSURL: srv.URL, JWKSRefresh: "1m", clock: s.clock})
+	c.Assert(err, IsNil)
+	claims := jwt.MapClaims{"exp": s.clock.UtcNow().Add(time.Hour).Unix()}
+	for i := 0; i < 3; i++ {
+		h, err := j.NewHandler(http.HandlerFunc(ok))
+		c.Assert(err, IsNil)
+		re := serve(h, request(s.sign(c, jwt.SigningMethodRS256, s.rsaKey, "k1", claims)))
+		c.Assert(re.Code, Equals, http.StatusOK)
+	}
+	c.Assert(srv.fetches(), Equals, int64(1))
+}
+
+func (s *JWTAuthSuite) TestJWKSUnavailable(c *C) {
+	srv := newJWKSServer()
+	srv.Close()
+
+	h := s.newHandler(c, JWTAuth{JWKSURL: srv.URL}, ok)
+	claims := jwt.MapClaims{"exp": s.clock.UtcNow().Add(time.Hour).Unix()}
+	re := serve(h, request(s.sign(c, jwt.SigningMethodRS256, s.rsaKey, "k1", claims)))
+	c.Assert(re.Code, Equals, http.StatusUnauthorized)
+}
+
+func (s *JWTAuthSuite) TestParseJWKS(c *C) {
+	keys, err := parseJWKS([]byte(`{"keys": [
+		{"kty": "oct", "kid": "s", "k": "c2VjcmV0", "alg": "HS256"},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "OKP", "crv": "X25519", "x": "AAAA"},
+		{"kty": "unknown"}
+	]}`))
+	c.Assert(err, IsNil)
+	c.Assert(len(keys), Equals, 1)
+	c.Assert(keys[0].id, Equals, "s")
+	c.Assert(keys[0].algorithms, DeepEquals, []string{"HS256"})
+
+	// Malformed keys are skipped, the rest are used
+	keys, err = parseJWKS([]byte(`{"keys": [
+		{"kty": "oct", "kid": "bad-alg", "k": "c2VjcmV0", "alg": "RS256"},
+		{"kty": "EC", "kid": "off-curve", "crv": "P-256", "x": "AQ", "y": "AQ"},
+		{"kty": ["RSA"]},
+		{"kty": "oct", "kid": "s", "k": "c2VjcmV0", "alg": "HS256"}
+	]}`))
+	c.Assert(err, IsNil)
+	c.Assert(len(keys), Equals, 1)
+	c.Assert(keys[0].id, Equals, "s")
+
+	_, err = parseJWKS([]byte(`not json`))
+	c.Assert(err, NotNil)
+}
+
+func (s *JWTAuthSuite) TestSealedKeys(c *C) {
+	keyString, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+	box, err := secret.NewBoxFromKeyString(keyString)
+	c.Assert(err, IsNil)
+	seal := func(val interface{}) ([]byte, error) {
+		data, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := box.Seal(data)
+		if err != nil {
+			return nil, err
+		}
+		return secret.SealedValueToJSON(sealed)
+	}
+	open := func(data []byte, val interface{}) error {
+		sealed, err := secret.SealedValueFromJSON(data)
+		if err != nil {
+			return err
+		}
+		out, err := box.Open(sealed)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(out, val)
+	}
+
+	rsaPEM := s.rsaPEM(c)
+	j, err := NewJWTAuth(JWTAuth{Keys: []Key{
+		{Id: "hs", Algorithm: "HS256", Secret: s.secret()},
+		{Id: "rs", Algorithm: "RS256", PublicKey: rsaPEM},
+	}})
+	c.Assert(err, IsNil)
+	var m plugin.Middleware = j
+	sm, ok := m.(plugin.SealedMiddleware)
+	c.Assert(ok, Equals, true)
+
+	// Only HMAC secrets are sealed, public keys are not secret
+	sealed, err := sm.Seal(seal)
+	c.Assert(err, IsNil)
+	c.Assert(sealed.(*JWTAuth).Keys[0].Secret, Equals, "")
+	c.Assert(sealed.(*JWTAuth).Keys[1], DeepEquals, j.Keys[1])
+	data, err := json.Marshal(sealed)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), s.secret()), Equals, false)
+
+	// The sealed middleware is read back as it is stored by engines
+	stored, err := GetSpec().FromJSON(data)
+	c.Assert(err, IsNil)
+	_, err = stored.NewHandler(nil)
+	c.Assert(err, NotNil)
+
+	opened, err := stored.(plugin.SealedMiddleware).Open(open)
+	c.Assert(err, IsNil)
+	c.Assert(opened.(*JWTAuth).Keys, DeepEquals, j.Keys)
+	_, err = opened.NewHandler(nil)
+	c.Assert(err, IsNil)
+
+	// Middlewares without secrets need no seal key, e.g. ones with public
+	// keys only or a JWKS URL
+	noSealKey := func(interface{}) ([]byte, error) { return nil, fmt.Errorf("no seal key") }
+	for _, cfg := range []JWTAuth{
+		{Keys: []Key{{Id: "rs", Algorithm: "RS256", PublicKey: rsaPEM}}},
+		{JWKSURL: "https://example.com/jwks.json"},
+	} {
+		j, err = NewJWTAuth(cfg)
+		c.Assert(err, IsNil)
+		out, err := j.Seal(noSealKey)
+		c.Assert(err, IsNil)
+		c.Assert(out, Equals, j)
+		_, err = out.NewHandler(nil)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *JWTAuthSuite) newHandler(c *C, cfg JWTAuth, next http.HandlerFunc) http.Handler {
+	cfg.clock = s.clock
+	j, err := NewJWTAuth(cfg)
+	c.Assert(err, IsNil)
+	h, err := j.NewHandler(next)
+	c.Assert(err, IsNil)
+	return h
+}
+
+func (s *JWTAuthSuite) sign(c *C, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		t.Header["kid"] = kid
+	}
+	out, err := t.SignedString(key)
+	c.Assert(err, IsNil)
+	return out
+}
+
+func (s *JWTAuthSuite) secret() string {
+	return base64.StdEncoding.EncodeToString(s.hmac)
+}
+
+func (s *JWTAuthSuite) rsaPEM(c *C) string {
+	der, err := x509.MarshalPKIXPublicKey(&s.rsaKey.PublicKey)
+	c.Assert(err, IsNil)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// jwksServer is a local stand-in for an identity provider that serves a JWKS
+// document.
+type jwksServer struct {
+	*httptest.Server
+	count int64
+	mu    sync.Mutex
+	doc   []byte
+}
+
+func newJWKSServer() *jwksServer {
+	s := &jwksServer{doc: []byte(`{"keys": []}`)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.count, 1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(s.doc)
+	}))
+	return s
+}
+
+func (s *jwksServer) setKeys(keys map[string]*rsa.PublicKey) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, k := range keys {
+		doc.Keys = append(doc.Keys, jwk{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		})
+	}
+	data, _ := json.Marshal(doc)
+	s.mu.Lock()
+	s.doc = data
+	s.mu.Unlock()
+}
+
+func (s *jwksServer) fetches() int64 {
+	return atomic.LoadInt64(&s.count)
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func waitFor(c *C, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for condition")
+}
+
+func request(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/api", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, r)
+	return re
+}
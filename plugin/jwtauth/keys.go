@@ -0,0 +1,188 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// verifyKey is a key ready to verify tokens of one or more algorithms.
+type verifyKey struct {
+	id         string
+	algorithms []string
+	key        interface{}
+}
+
+func (k verifyKey) supports(alg string) bool {
+	for _, a := range k.algorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func (k Key) verifyKey() (verifyKey, error) {
+	vk := verifyKey{id: k.Id, algorithms: []string{k.Algorithm}}
+	var err error
+	switch k.Algorithm {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		vk.key, err = jwt.ParseRSAPublicKeyFromPEM([]byte(k.PublicKey))
+	case "ES256", "ES384", "ES512":
+		vk.key, err = jwt.ParseECPublicKeyFromPEM([]byte(k.PublicKey))
+	case "EdDSA":
+		vk.key, err = jwt.ParseEdPublicKeyFromPEM([]byte(k.PublicKey))
+	case "HS256", "HS384", "HS512":
+		var secret []byte
+		secret, err = base64.StdEncoding.DecodeString(k.Secret)
+		if err == nil && len(secret) == 0 {
+			err = fmt.Errorf("secret is empty")
+		}
+		vk.key = secret
+	default:
+		return verifyKey{}, fmt.Errorf("key %q: unsupported algorithm %q", k.Id, k.Algorithm)
+	}
+	if err != nil {
+		return verifyKey{}, fmt.Errorf("key %q: %v", k.Id, err)
+	}
+	return vk, nil
+}
+
+// jwk is a JSON Web Key, see RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// Symmetric
+	K string `json:"k"`
+}
+
+// parseJWKS parses a JWKS document. Keys that are not for signatures, of
+// unsupported types or malformed are skipped, so that a key the middleware
+// can not use does not break the ones it can.
+func parseJWKS(data []byte) ([]verifyKey, error) {
+	var doc struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS document: %v", err)
+	}
+	var keys []verifyKey
+	for _, raw := range doc.Keys {
+		var k jwk
+		if err := json.Unmarshal(raw, &k); err != nil {
+			log.Warnf("Skipping invalid JWK: %v", err)
+			continue
+		}
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		vk, err := k.verifyKey()
+		if err != nil {
+			log.Warnf("Skipping JWK %q: %v", k.Kid, err)
+			continue
+		}
+		if vk.key == nil {
+			continue
+		}
+		keys = append(keys, vk)
+	}
+	return keys, nil
+}
+
+func (k jwk) verifyKey() (verifyKey, error) {
+	vk := verifyKey{id: k.Kid}
+	var algorithms []string
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return vk, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return vk, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return vk, fmt.Errorf("invalid RSA exponent")
+		}
+		vk.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		algorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, algorithms = elliptic.P256(), []string{"ES256"}
+		case "P-384":
+			curve, algorithms = elliptic.P384(), []string{"ES384"}
+		case "P-521":
+			curve, algorithms = elliptic.P521(), []string{"ES512"}
+		default:
+			return vk, nil
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return vk, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return vk, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return vk, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		vk.key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return vk, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return vk, fmt.Errorf("invalid Ed25519 key")
+		}
+		vk.key = ed25519.PublicKey(x)
+		algorithms = []string{"EdDSA"}
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return vk, fmt.Errorf("invalid symmetric key")
+		}
+		vk.key = secret
+		algorithms = []string{"HS256", "HS384", "HS512"}
+	default:
+		return vk, nil
+	}
+	vk.algorithms = algorithms
+	// The key is only good for the algorithm it tells.
+	if k.Alg != "" {
+		if !vk.supports(k.Alg) {
+			return vk, fmt.Errorf("algorithm %q does not match key type %q", k.Alg, k.Kty)
+		}
+		vk.algorithms = []string{k.Alg}
+	}
+	return vk, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid base64url number %q", s)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,29 @@
+package jwtauth
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mailgun/timetools"
+)
+
+// KeySet verifies signatures of tokens with keys from a JWKS document, the
+// same way the middleware does. It is meant for other middlewares that get
+// tokens from identity providers. Claims are not validated.
+type KeySet struct {
+	jwks *jwks
+}
+
+// NewKeySet returns a key set that fetches the JWKS document from the URL
+// when keys are first needed and refreshes it with the given interval.
+func NewKeySet(url string, refresh time.Duration, clock timetools.TimeProvider) *KeySet {
+	if clock == nil {
+		clock = &timetools.RealTime{}
+	}
+	return &KeySet{jwks: newJWKS(url, refresh, clock)}
+}
+
+// Verify checks the signature of the token and returns its claims.
+func (k *KeySet) Verify(raw string) (jwt.MapClaims, error) {
+	return verifyToken(raw, nil, k.jwks)
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"strings"
 
+	"github.com/mailgun/metrics"
 	"github.com/urfave/cli"
 	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/roundrobin"
@@ -51,6 +53,107 @@ type Middleware interface {
 	NewHandler(http.Handler) (http.Handler, error)
 }
 
+// Env holds vulcand facilities that middlewares may need to create handlers.
+type Env struct {
+	// CacheProvider stores data that should outlive handlers or be shared
+	// between vulcand instances.
+	CacheProvider cacheprovider.T
+	// MetricsClient emits metrics. It is nil if vulcand does not emit any.
+	MetricsClient metrics.Client
+	// ValueStore reads values kept in the engine. It is nil if the engine
+	// does not keep values.
+	ValueStore ValueStore
+	// FrontendId and MiddlewareId identify the middleware that a handler is
+	// created for.
+	FrontendId   string
+	MiddlewareId string
+	// RequestIdHeader is the header that carries request ids, it is empty if
+	// request ids are disabled. The id of a request is given by RequestId.
+	RequestIdHeader string
+}
+
+// ValueStore is implemented by engines that keep values under keys of their
+// own, e.g. lists that are too large or change too often to be a part of
+// middleware settings. Middlewares read values when they need them, so values
+// can change without the frontend being rebuilt.
+type ValueStore interface {
+	// GetValue returns the value stored under the key, or nil if there is no
+	// such key.
+	GetValue(key string) ([]byte, error)
+}
+
+// IncCounter increments a counter of the middleware if vulcand emits metrics.
+// The counter is named frontend.<frontend id>.middleware.<middleware id>.<name>.
+func (e Env) IncCounter(name string, value int64) {
+	if e.MetricsClient == nil {
+		return
+	}
+	e.MetricsClient.Inc(e.metric(name), value, 1)
+}
+
+// SetGauge sets a gauge of the middleware if vulcand emits metrics. The gauge
+// is named the same way as counters.
+func (e Env) SetGauge(name string, value int64) {
+	if e.MetricsClient == nil {
+		return
+	}
+	e.MetricsClient.Gauge(e.metric(name), value, 1)
+}
+
+func (e Env) metric(name string) metrics.Metric {
+	return e.MetricsClient.Metric("frontend", strings.Replace(e.FrontendId, ".", "_", -1),
+		"middleware", strings.Replace(e.MiddlewareId, ".", "_", -1), name)
+}
+
+// EnvMiddleware is implemented by middlewares that need vulcand facilities to
+// create handlers.
+type EnvMiddleware interface {
+	Middleware
+	NewHandlerWithEnv(next http.Handler, env Env) (http.Handler, error)
+}
+
+// NewHandler creates a middleware handler, providing the middleware with the
+// environment if it needs one.
+func NewHandler(m Middleware, next http.Handler, env Env) (http.Handler, error) {
+	if em, ok := m.(EnvMiddleware); ok {
+		return em.NewHandlerWithEnv(next, env)
+	}
+	return m.NewHandler(next)
+}
+
+// StatefulMiddleware is implemented by middlewares that keep state under the
+// frontend and middleware ids, so that it outlives handlers. Frontends
+// release the state when the middleware or the frontend is deleted, or when
+// the middleware settings change, so that a middleware created again under
+// the same ids starts afresh.
+type StatefulMiddleware interface {
+	Middleware
+	// Release drops the state kept for the middleware identified by the env.
+	Release(env Env)
+}
+
+// Release drops the state that the middleware keeps for the env if it keeps
+// any.
+func Release(m Middleware, env Env) {
+	if sm, ok := m.(StatefulMiddleware); ok {
+		sm.Release(env)
+	}
+}
+
+// SealedMiddleware is implemented by middlewares with settings that should
+// only be stored encrypted, e.g. signing keys. Engines that can encrypt data
+// seal the settings before storing a middleware and open them after reading
+// it back.
+type SealedMiddleware interface {
+	Middleware
+	// Seal returns a copy of the middleware with secret settings replaced by
+	// what the seal function returns for them.
+	Seal(seal func(val interface{}) ([]byte, error)) (Middleware, error)
+	// Open returns a copy of the middleware with secret settings restored by
+	// the open function from what Seal stored.
+	Open(open func(sealed []byte, val interface{}) error) (Middleware, error)
+}
+
 // Reader constructs the middleware from the CLI interface
 type CliReader func(c *cli.Context) (Middleware, error)
 
@@ -0,0 +1,361 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/jwtauth"
+)
+
+// clockSkew is tolerated when checking expiry of ID tokens.
+const clockSkew = time.Minute
+
+type handler struct {
+	next            http.Handler
+	provider        *provider
+	clientId        string
+	clientSecret    string
+	scopes          []string
+	callbackPath    string
+	logoutPath      string
+	cookies         *cookies
+	sessionTTL      time.Duration
+	claimHeaders    map[string]string
+	passAccessToken bool
+	clock           timetools.TimeProvider
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case h.callbackPath:
+		h.callback(w, r)
+		return
+	case h.logoutPath:
+		h.logout(w, r)
+		return
+	}
+	s, ok := h.cookies.getSession(r)
+	if ok {
+		var err error
+		if s, ok, err = h.renew(w, r, s); err != nil {
+			sessionFailed(w, r, err)
+			return
+		}
+	}
+	if !ok {
+		h.login(w, r)
+		return
+	}
+
+	// Clients must not be able to pass identity headers of their own.
+	for _, header := range h.claimHeaders {
+		r.Header.Del(header)
+	}
+	for header, v := range s.Headers {
+		r.Header.Set(header, v)
+	}
+	if h.passAccessToken {
+		r.Header.Set("Authorization", "Bearer "+s.AccessToken)
+	}
+	h.cookies.strip(r)
+	h.next.ServeHTTP(w, r)
+}
+
+// renew checks that the session has not ended, and refreshes the access token
+// if it has expired. It returns false if users should log in again, and an
+// error if the renewed session can not be kept.
+func (h *handler) renew(w http.ResponseWriter, r *http.Request, s *session) (*session, bool, error) {
+	now := h.clock.UtcNow()
+	if !now.Before(s.Ends) {
+		return nil, false, nil
+	}
+	if now.Before(s.Expiry) {
+		return s, true, nil
+	}
+	if s.RefreshToken == "" {
+		// Backends do not see the access token, so the session lasts
+		// until it ends.
+		return s, !h.passAccessToken, nil
+	}
+	config, keys, err := h.provider.get()
+	if err != nil {
+		plugin.RequestLog(r).Warnf("Failed to refresh session: %v", err)
+		return nil, false, nil
+	}
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {s.RefreshToken}}
+	t, err := h.provider.token(config, form, h.clientId, h.clientSecret)
+	if err != nil {
+		plugin.RequestLog(r).Infof("Failed to refresh session: %v", err)
+		return nil, false, nil
+	}
+	renewed := *s
+	if t.IdToken != "" {
+		claims, err := h.verifyIdToken(config, keys, t.IdToken, "")
+		if err != nil {
+			plugin.RequestLog(r).Warnf("Failed to refresh session: %v", err)
+			return nil, false, nil
+		}
+		renewed.Headers = h.headers(claims)
+	}
+	h.updateTokens(&renewed, t, now)
+	if err := h.cookies.setSession(w, r, &renewed); err != nil {
+		return nil, false, err
+	}
+	return &renewed, true, nil
+}
+
+// login sends users to the provider. Requests that browsers do not navigate
+// with, e.g. API calls, are answered with 401 Unauthorized instead.
+func (h *handler) login(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("X-Requested-With") != "" {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	config, _, err := h.provider.get()
+	if err != nil {
+		plugin.RequestLog(r).Warnf("Failed to log in: %v", err)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	l := &login{State: randomString(), Nonce: randomString(), Verifier: randomString(), Return: r.URL.RequestURI()}
+	if err := h.cookies.setLogin(w, r, l, h.clock.UtcNow().Add(loginTTL)); err != nil {
+		plugin.RequestLog(r).Errorf("Failed to set login cookie: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	challenge := sha256.Sum256([]byte(l.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {h.clientId},
+		"redirect_uri":          {h.redirectURL(r)},
+		"scope":                 {strings.Join(h.scopes, " ")},
+		"state":                 {l.State},
+		"nonce":                 {l.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, addParams(config.AuthorizationEndpoint, params), http.StatusFound)
+}
+
+// callback finishes the login when the provider sends users back with a code.
+func (h *handler) callback(w http.ResponseWriter, r *http.Request) {
+	s, returnTo, err := h.exchange(r)
+	if err != nil {
+		plugin.RequestLog(r).Infof("Failed to log in: %v", err)
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	h.cookies.clear(w, r, h.cookies.loginName())
+	if err := h.cookies.setSession(w, r, s); err != nil {
+		sessionFailed(w, r, err)
+		return
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// sessionFailed answers requests with a session that can not be kept.
+// Sending users to log in again would not help, so they are told why.
+func sessionFailed(w http.ResponseWriter, r *http.Request, err error) {
+	plugin.RequestLog(r).Errorf("Failed to set session cookie: %v", err)
+	if errors.Is(err, errSessionTooLarge) {
+		http.Error(w, "Login failed: the session is too large to keep in a cookie, "+
+			"forward fewer claims or do not pass the access token", http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+func (h *handler) exchange(r *http.Request) (*session, string, error) {
+	l, err := h.cookies.getLogin(r)
+	if err != nil {
+		return nil, "", err
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return nil, "", fmt.Errorf("provider returned %s: %s", e, q.Get("error_description"))
+	}
+	if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(l.State)) != 1 {
+		return nil, "", fmt.Errorf("state does not match")
+	}
+	code := q.Get("code")
+	if code == "" {
+		return nil, "", fmt.Errorf("no code")
+	}
+	config, keys, err := h.provider.get()
+	if err != nil {
+		return nil, "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {h.redirectURL(r)},
+		"code_verifier": {l.Verifier},
+	}
+	t, err := h.provider.token(config, form, h.clientId, h.clientSecret)
+	if err != nil {
+		return nil, "", err
+	}
+	if t.IdToken == "" {
+		return nil, "", fmt.Errorf("token response does not have an ID token")
+	}
+	claims, err := h.verifyIdToken(config, keys, t.IdToken, l.Nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	now := h.clock.UtcNow()
+	s := &session{Headers: h.headers(claims), Ends: now.Add(h.sessionTTL)}
+	h.updateTokens(s, t, now)
+	return s, safeReturn(l.Return), nil
+}
+
+// logout ends the session. It takes only POST requests from pages of the same
+// origin, so that other sites can not log users out.
+func (h *handler) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	h.cookies.clear(w, r, h.cookies.name)
+	target := "/"
+	if config, _, err := h.provider.get(); err == nil && config.EndSessionEndpoint != "" {
+		target = addParams(config.EndSessionEndpoint, url.Values{"client_id": {h.clientId}})
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// verifyIdToken checks the signature and claims of an ID token, see
+// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation.
+func (h *handler) verifyIdToken(config *providerConfig, keys *jwtauth.KeySet, raw, nonce string) (jwt.MapClaims, error) {
+	claims, err := keys.Verify(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != config.Issuer {
+		return nil, fmt.Errorf("ID token has unexpected issuer %q", iss)
+	}
+	if !hasAudience(claims["aud"], h.clientId) {
+		return nil, fmt.Errorf("ID token is not for client %q", h.clientId)
+	}
+	exp, ok := claims["exp"].(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("ID token does not expire")
+	}
+	seconds, err := exp.Int64()
+	if err != nil || !h.clock.UtcNow().Before(time.Unix(seconds, 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("ID token expired")
+	}
+	if nonce != "" {
+		if n, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+			return nil, fmt.Errorf("ID token nonce does not match")
+		}
+	}
+	return claims, nil
+}
+
+func (h *handler) headers(claims jwt.MapClaims) map[string]string {
+	headers := make(map[string]string, len(h.claimHeaders))
+	for claim, header := range h.claimHeaders {
+		if v, ok := jwtauth.ClaimValue(claims, claim); ok {
+			headers[header] = v
+		}
+	}
+	return headers
+}
+
+func (h *handler) updateTokens(s *session, t *tokenResponse, now time.Time) {
+	if h.passAccessToken {
+		s.AccessToken = t.AccessToken
+	}
+	if t.RefreshToken != "" {
+		s.RefreshToken = t.RefreshToken
+	}
+	s.Expiry = s.Ends
+	if t.ExpiresIn > 0 {
+		s.Expiry = now.Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+}
+
+func (h *handler) redirectURL(r *http.Request) string {
+	return requestScheme(r) + "://" + r.Host + h.callbackPath
+}
+
+// requestScheme is the scheme the client used, vulcand may be behind a load
+// balancer that terminates TLS.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" {
+		return proto
+	}
+	return "http"
+}
+
+// sameOrigin tells whether the request comes from a page of the origin it is
+// sent to, by the Origin header, or the Referer header if there is no Origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		u, err := url.Parse(r.Header.Get("Referer"))
+		if err != nil || u.Host == "" {
+			return false
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+	return strings.EqualFold(origin, requestScheme(r)+"://"+r.Host)
+}
+
+func hasAudience(aud interface{}, clientId string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientId
+	case []interface{}:
+		for _, a := range v {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// safeReturn makes sure users are only sent back to paths of this host.
+func safeReturn(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+func addParams(endpoint string, params url.Values) string {
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	return endpoint + sep + params.Encode()
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,272 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/secret"
+)
+
+const Type = "oidc"
+
+const (
+	// DefaultCallbackPath is where the identity provider sends users back to
+	// by default.
+	DefaultCallbackPath = "/oauth2/callback"
+	// DefaultLogoutPath is the path that ends sessions by default.
+	DefaultLogoutPath = "/oauth2/logout"
+	// DefaultCookieName is the name of the session cookie by default.
+	DefaultCookieName = "_vulcand_oidc"
+	// DefaultSessionTTL is how long sessions last by default.
+	DefaultSessionTTL = 12 * time.Hour
+)
+
+// DefaultScopes are scopes requested by default.
+var DefaultScopes = []string{"openid", "profile", "email"}
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// OIDC logs users in with an OpenID Connect identity provider using the
+// authorization code flow. Users without a session are redirected to the
+// provider, and sessions are kept in an encrypted cookie. Claims of the
+// user are forwarded to backends in headers.
+type OIDC struct {
+	// Issuer is the issuer URL of the provider, its configuration is
+	// discovered at <Issuer>/.well-known/openid-configuration.
+	Issuer string
+	// ClientId and ClientSecret are credentials of vulcand at the provider.
+	// Engines that can encrypt data store the secret and the cookie key in
+	// SealedSecrets.
+	ClientId     string
+	ClientSecret string `json:",omitempty"`
+	// CookieKey encrypts session cookies, it is generated with
+	// "vctl secret new_key".
+	CookieKey     string `json:",omitempty"`
+	SealedSecrets []byte `json:",omitempty"`
+	// Scopes are requested from the provider, "openid" is required.
+	Scopes []string
+	// CallbackPath is the path of the redirect URL registered at the
+	// provider.
+	CallbackPath string
+	// LogoutPath ends the session.
+	LogoutPath string
+	// CookieName is the name of the session cookie.
+	CookieName string
+	// CookieDomain is the domain of the session cookie, the host of the
+	// request if not set.
+	CookieDomain string
+	// SessionTTL is how long users stay logged in, e.g. "8h".
+	SessionTTL string
+	// ClaimHeaders maps claims of the ID token to request headers they are
+	// forwarded in, e.g. {"email": "X-Auth-Email"}. Headers with these names
+	// are removed from requests.
+	ClaimHeaders map[string]string
+	// PassAccessToken forwards the access token in the Authorization header.
+	PassAccessToken bool
+
+	sessionTTL time.Duration
+	clock      timetools.TimeProvider
+}
+
+// secrets are sealed together by engines.
+type secrets struct {
+	ClientSecret string
+	CookieKey    string
+}
+
+// NewOIDC validates settings and returns an OIDC login middleware.
+func NewOIDC(o OIDC) (*OIDC, error) {
+	u, err := url.Parse(o.Issuer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("issuer should be an absolute http(s) URL, got %q", o.Issuer)
+	}
+	if o.ClientId == "" {
+		return nil, fmt.Errorf("client id is required")
+	}
+	if len(o.SealedSecrets) != 0 {
+		if o.ClientSecret != "" || o.CookieKey != "" {
+			return nil, fmt.Errorf("secrets and sealed secrets can not be both set")
+		}
+	} else if _, err := secret.KeyFromString(o.CookieKey); err != nil {
+		return nil, fmt.Errorf("invalid cookie key: %v", err)
+	}
+	if len(o.Scopes) != 0 && !contains(o.Scopes, "openid") {
+		return nil, fmt.Errorf("scopes should include openid")
+	}
+	for _, p := range []string{o.CallbackPath, o.LogoutPath} {
+		if p != "" && !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("paths should start with /, got %q", p)
+		}
+	}
+	if o.CookieName != "" && strings.ContainsAny(o.CookieName, " ;=,") {
+		return nil, fmt.Errorf("invalid cookie name %q", o.CookieName)
+	}
+	for claim, header := range o.ClaimHeaders {
+		if claim == "" || header == "" || strings.ContainsAny(header, " :") {
+			return nil, fmt.Errorf("invalid claim header %q: %q", claim, header)
+		}
+	}
+	if o.SessionTTL == "" {
+		o.sessionTTL = DefaultSessionTTL
+	} else if o.sessionTTL, err = time.ParseDuration(o.SessionTTL); err != nil || o.sessionTTL <= 0 {
+		return nil, fmt.Errorf("session TTL should be a duration > 0, got %q", o.SessionTTL)
+	}
+	if o.clock == nil {
+		o.clock = &timetools.RealTime{}
+	}
+	return &o, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (o *OIDC) NewHandler(next http.Handler) (http.Handler, error) {
+	if len(o.SealedSecrets) != 0 {
+		return nil, fmt.Errorf("secrets are sealed, vulcand needs the seal key to open them")
+	}
+	box, err := secret.NewBoxFromKeyString(o.CookieKey)
+	if err != nil {
+		return nil, err
+	}
+	h := &handler{
+		next:            next,
+		provider:        newProvider(o.Issuer, o.clock),
+		clientId:        o.ClientId,
+		clientSecret:    o.ClientSecret,
+		scopes:          o.Scopes,
+		callbackPath:    o.CallbackPath,
+		logoutPath:      o.LogoutPath,
+		cookies:         &cookies{box: box, name: o.CookieName, domain: o.CookieDomain},
+		sessionTTL:      o.sessionTTL,
+		claimHeaders:    o.ClaimHeaders,
+		passAccessToken: o.PassAccessToken,
+		clock:           o.clock,
+	}
+	if len(h.scopes) == 0 {
+		h.scopes = DefaultScopes
+	}
+	if h.callbackPath == "" {
+		h.callbackPath = DefaultCallbackPath
+	}
+	if h.logoutPath == "" {
+		h.logoutPath = DefaultLogoutPath
+	}
+	if h.cookies.name == "" {
+		h.cookies.name = DefaultCookieName
+	}
+	return h, nil
+}
+
+// Seal returns a copy of the middleware with the client secret and the
+// cookie key sealed.
+func (o *OIDC) Seal(seal func(val interface{}) ([]byte, error)) (plugin.Middleware, error) {
+	if o.ClientSecret == "" && o.CookieKey == "" {
+		return o, nil
+	}
+	sealed, err := seal(secrets{ClientSecret: o.ClientSecret, CookieKey: o.CookieKey})
+	if err != nil {
+		return nil, err
+	}
+	out := *o
+	out.ClientSecret, out.CookieKey = "", ""
+	out.SealedSecrets = sealed
+	return &out, nil
+}
+
+// Open returns a copy of the middleware with sealed secrets opened.
+func (o *OIDC) Open(open func(sealed []byte, val interface{}) error) (plugin.Middleware, error) {
+	if len(o.SealedSecrets) == 0 {
+		return o, nil
+	}
+	var s secrets
+	if err := open(o.SealedSecrets, &s); err != nil {
+		return nil, err
+	}
+	out := *o
+	out.ClientSecret, out.CookieKey = s.ClientSecret, s.CookieKey
+	out.SealedSecrets = nil
+	return NewOIDC(out)
+}
+
+func (o *OIDC) String() string {
+	claims := make([]string, 0, len(o.ClaimHeaders))
+	for claim, header := range o.ClaimHeaders {
+		claims = append(claims, claim+"="+header)
+	}
+	sort.Strings(claims)
+	return fmt.Sprintf("issuer=%s, clientId=%s, scopes=%s, callbackPath=%s, logoutPath=%s, cookieName=%s, cookieDomain=%s, sessionTTL=%s, claimHeaders=%s, passAccessToken=%t",
+		o.Issuer, o.ClientId, strings.Join(o.Scopes, ","), o.CallbackPath, o.LogoutPath, o.CookieName, o.CookieDomain,
+		o.sessionTTL, strings.Join(claims, ","), o.PassAccessToken)
+}
+
+func FromOther(o OIDC) (plugin.Middleware, error) {
+	return NewOIDC(o)
+}
+
+// FromCli constructs the middleware from the command line.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	o := OIDC{
+		Issuer:          c.String("issuer"),
+		ClientId:        c.String("clientId"),
+		ClientSecret:    c.String("clientSecret"),
+		CookieKey:       c.String("cookieKey"),
+		Scopes:          c.StringSlice("scope"),
+		CallbackPath:    c.String("callbackPath"),
+		LogoutPath:      c.String("logoutPath"),
+		CookieName:      c.String("cookieName"),
+		CookieDomain:    c.String("cookieDomain"),
+		PassAccessToken: c.Bool("passAccessToken"),
+	}
+	if d := c.Duration("sessionTTL"); d != 0 {
+		o.SessionTTL = d.String()
+	}
+	for _, v := range c.StringSlice("claimHeader") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected claim=Header for --claimHeader, got %q", v)
+		}
+		if o.ClaimHeaders == nil {
+			o.ClaimHeaders = map[string]string{}
+		}
+		o.ClaimHeaders[parts[0]] = parts[1]
+	}
+	return NewOIDC(o)
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "issuer", Usage: "issuer URL of the identity provider"},
+		cli.StringFlag{Name: "clientId", Usage: "client id at the identity provider"},
+		cli.StringFlag{Name: "clientSecret", Usage: "client secret at the identity provider"},
+		cli.StringFlag{Name: "cookieKey", Usage: "key that encrypts session cookies, generated with 'vctl secret new_key'"},
+		cli.StringSliceFlag{Name: "scope", Value: &cli.StringSlice{}, Usage: "scope requested from the identity provider"},
+		cli.StringFlag{Name: "callbackPath", Usage: "path of the redirect URL registered at the identity provider"},
+		cli.StringFlag{Name: "logoutPath", Usage: "path that ends the session"},
+		cli.StringFlag{Name: "cookieName", Usage: "name of the session cookie"},
+		cli.StringFlag{Name: "cookieDomain", Usage: "domain of the session cookie"},
+		cli.DurationFlag{Name: "sessionTTL", Usage: "how long users stay logged in"},
+		cli.StringSliceFlag{Name: "claimHeader", Value: &cli.StringSlice{}, Usage: "claim to forward in a request header, as claim=Header"},
+		cli.BoolFlag{Name: "passAccessToken", Usage: "forward the access token in the Authorization header"},
+	}
+}
+
+func contains(values []string, v string) bool {
+	for _, val := range values {
+		if val == v {
+			return true
+		}
+	}
+	return false
+}
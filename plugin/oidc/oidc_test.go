@@ -0,0 +1,612 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/secret"
+	. "gopkg.in/check.v1"
+)
+
+func TestOIDC(t *testing.T) { TestingT(t) }
+
+type OIDCSuite struct {
+	key       *rsa.PrivateKey
+	cookieKey string
+	clock     *timetools.FreezedTime
+	idp       *mockIdP
+}
+
+var _ = Suite(&OIDCSuite{})
+
+func (s *OIDCSuite) SetUpSuite(c *C) {
+	var err error
+	s.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	s.cookieKey, err = secret.NewKeyString()
+	c.Assert(err, IsNil)
+}
+
+func (s *OIDCSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{CurrentTime: time.Now().UTC().Truncate(time.Second)}
+	s.idp = newMockIdP(s.key, s.clock)
+}
+
+func (s *OIDCSuite) TearDownTest(c *C) {
+	s.idp.Close()
+}
+
+// Make sure the spec is compatible and will be accepted by middleware registry
+func (s *OIDCSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *OIDCSuite) TestNewOIDCBadParams(c *C) {
+	valid := func() OIDC {
+		return OIDC{Issuer: "https://login.example.com", ClientId: "dash", CookieKey: s.cookieKey}
+	}
+	tcs := []func(*OIDC){
+		func(o *OIDC) { o.Issuer = "" },
+		func(o *OIDC) { o.Issuer = "login.example.com" },
+		func(o *OIDC) { o.ClientId = "" },
+		func(o *OIDC) { o.CookieKey = "" },
+		func(o *OIDC) { o.CookieKey = "abc" },
+		func(o *OIDC) { o.SealedSecrets = []byte("sealed") },
+		func(o *OIDC) { o.Scopes = []string{"email"} },
+		func(o *OIDC) { o.CallbackPath = "callback" },
+		func(o *OIDC) { o.LogoutPath = "logout" },
+		func(o *OIDC) { o.CookieName = "a b" },
+		func(o *OIDC) { o.ClaimHeaders = map[string]string{"email": "X Email"} },
+		func(o *OIDC) { o.SessionTTL = "0s" },
+		func(o *OIDC) { o.SessionTTL = "day" },
+	}
+	for i, change := range tcs {
+		o := valid()
+		change(&o)
+		_, err := NewOIDC(o)
+		c.Assert(err, NotNil, Commentf("case %d", i))
+	}
+	_, err := NewOIDC(valid())
+	c.Assert(err, IsNil)
+}
+
+func (s *OIDCSuite) TestNewOIDCFromOther(c *C) {
+	o, err := NewOIDC(OIDC{
+		Issuer:          "https://login.example.com",
+		ClientId:        "dash",
+		ClientSecret:    "secret",
+		CookieKey:       s.cookieKey,
+		Scopes:          []string{"openid", "email"},
+		CallbackPath:    "/auth/callback",
+		LogoutPath:      "/auth/logout",
+		CookieName:      "session",
+		CookieDomain:    "example.com",
+		SessionTTL:      "8h",
+		ClaimHeaders:    map[string]string{"email": "X-Email"},
+		PassAccessToken: true,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(o.String(), Not(Equals), "")
+	c.Assert(strings.Contains(o.String(), "secret"), Equals, false)
+
+	out, err := FromOther(*o)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, o)
+}
+
+func (s *OIDCSuite) TestNewOIDCFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		o := out.(*OIDC)
+		c.Assert(o.Issuer, Equals, "https://login.example.com")
+		c.Assert(o.ClientId, Equals, "dash")
+		c.Assert(o.ClientSecret, Equals, "secret")
+		c.Assert(o.CookieKey, Equals, s.cookieKey)
+		c.Assert(o.Scopes, DeepEquals, []string{"openid", "groups"})
+		c.Assert(o.CallbackPath, Equals, "/cb")
+		c.Assert(o.LogoutPath, Equals, "/bye")
+		c.Assert(o.CookieName, Equals, "sid")
+		c.Assert(o.CookieDomain, Equals, "example.com")
+		c.Assert(o.SessionTTL, Equals, "1h0m0s")
+		c.Assert(o.ClaimHeaders, DeepEquals, map[string]string{"email": "X-Email"})
+		c.Assert(o.PassAccessToken, Equals, true)
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--issuer=https://login.example.com", "--clientId=dash", "--clientSecret=secret",
+		"--cookieKey=" + s.cookieKey, "--scope=openid", "--scope=groups", "--callbackPath=/cb", "--logoutPath=/bye",
+		"--cookieName=sid", "--cookieDomain=example.com", "--sessionTTL=1h", "--claimHeader=email=X-Email", "--passAccessToken"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *OIDCSuite) TestLoginFlow(c *C) {
+	var received http.Header
+	h := s.newHandler(c, OIDC{
+		ClaimHeaders:    map[string]string{"email": "X-Email", "groups": "X-Groups", "missing": "X-Missing"},
+		PassAccessToken: true,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Write([]byte("dashboard"))
+	})
+	jar := newJar()
+
+	// Users without a session are sent to the provider
+	re := jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/dash?tab=1", nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+	location, err := url.Parse(re.Header().Get("Location"))
+	c.Assert(err, IsNil)
+	c.Assert(location.Path, Equals, "/authorize")
+	params := location.Query()
+	c.Assert(params.Get("client_id"), Equals, "dash")
+	c.Assert(params.Get("redirect_uri"), Equals, "http://example.com/oauth2/callback")
+	c.Assert(params.Get("scope"), Equals, "openid profile email")
+	c.Assert(params.Get("code_challenge_method"), Equals, "S256")
+
+	// The provider sends users back with a code
+	code := s.idp.authorize(params)
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/oauth2/callback?code="+code+"&state="+params.Get("state"), nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+	c.Assert(re.Header().Get("Location"), Equals, "/dash?tab=1")
+	c.Assert(jar.cookies[DefaultCookieName], Not(Equals), "")
+	c.Assert(jar.cookies[DefaultCookieName+"_login"], Equals, "")
+
+	// Requests with the session are forwarded with identity headers
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/dash", nil)
+	r.Header.Set("X-Email", "admin@example.com")
+	r.Header.Set("X-Missing", "spoofed")
+	r.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	re = jar.do(h, r)
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Body.String(), Equals, "dashboard")
+	c.Assert(received.Get("X-Email"), Equals, "jane@example.com")
+	c.Assert(received.Get("X-Groups"), Equals, "admins,devs")
+	c.Assert(received.Get("X-Missing"), Equals, "")
+	c.Assert(received.Get("Authorization"), Equals, "Bearer access-1")
+	c.Assert(received.Get("Cookie"), Equals, "theme=dark")
+
+	// Access tokens are refreshed when they expire
+	s.clock.Sleep(2 * time.Minute)
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/dash", nil))
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(received.Get("Authorization"), Equals, "Bearer access-2")
+	c.Assert(received.Get("X-Email"), Equals, "jane@example.com")
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/dash", nil))
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(received.Get("Authorization"), Equals, "Bearer access-2")
+	c.Assert(s.idp.refreshes, Equals, 1)
+
+	// Users have to log in again when refresh fails
+	s.idp.revoke()
+	s.clock.Sleep(2 * time.Minute)
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/dash", nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+	c.Assert(strings.HasPrefix(re.Header().Get("Location"), s.idp.URL+"/authorize"), Equals, true)
+}
+
+func (s *OIDCSuite) TestSessionEnds(c *C) {
+	h := s.newHandler(c, OIDC{SessionTTL: "1h"}, ok)
+	jar := s.logIn(c, h)
+
+	re := jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusOK)
+
+	// Sessions are refreshed with the provider, but last no longer than
+	// the session TTL
+	s.clock.Sleep(30 * time.Minute)
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(s.idp.refreshes, Equals, 1)
+
+	s.clock.Sleep(30 * time.Minute)
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+}
+
+func (s *OIDCSuite) TestUnauthenticated(c *C) {
+	h := s.newHandler(c, OIDC{}, ok)
+
+	// Non browser requests are not redirected
+	re := serve(h, httptest.NewRequest(http.MethodPost, "http://example.com/api", nil))
+	c.Assert(re.Code, Equals, http.StatusUnauthorized)
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/api", nil)
+	r.Header.Set("X-Requested-With", "XMLHttpRequest")
+	re = serve(h, r)
+	c.Assert(re.Code, Equals, http.StatusUnauthorized)
+
+	// Tampered cookies are ignored
+	jar := s.logIn(c, h)
+	value := jar.cookies[DefaultCookieName]
+	jar.cookies[DefaultCookieName] = value[:len(value)-2] + "AA"
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+
+	// Login cookies can not be used as sessions
+	jar = newJar()
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+	jar.cookies[DefaultCookieName] = jar.cookies[DefaultCookieName+"_login"]
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+}
+
+func (s *OIDCSuite) TestCallbackFailures(c *C) {
+	h := s.newHandler(c, OIDC{}, ok)
+
+	// No login in progress
+	re := serve(h, httptest.NewRequest(http.MethodGet, "http://example.com/oauth2/callback?code=x&state=y", nil))
+	c.Assert(re.Code, Equals, http.StatusForbidden)
+
+	start := func() (*cookieJar, url.Values) {
+		jar := newJar()
+		re := jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		location, err := url.Parse(re.Header().Get("Location"))
+		c.Assert(err, IsNil)
+		return jar, location.Query()
+	}
+	callback := func(jar *cookieJar, q url.Values) int {
+		return jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/oauth2/callback?"+q.Encode(), nil)).Code
+	}
+
+	// State does not match
+	jar, params := start()
+	c.Assert(callback(jar, url.Values{"code": {s.idp.authorize(params)}, "state": {"other"}}), Equals, http.StatusForbidden)
+
+	// Provider returned an error
+	jar, params = start()
+	c.Assert(callback(jar, url.Values{"error": {"access_denied"}, "state": {params.Get("state")}}), Equals, http.StatusForbidden)
+
+	// Unknown code
+	jar, params = start()
+	c.Assert(callback(jar, url.Values{"code": {"forged"}, "state": {params.Get("state")}}), Equals, http.StatusForbidden)
+
+	// Code verifier does not match the challenge
+	jar, params = start()
+	params.Set("code_challenge", "other")
+	c.Assert(callback(jar, url.Values{"code": {s.idp.authorize(params)}, "state": {params.Get("state")}}), Equals, http.StatusForbidden)
+
+	// Nonce of the ID token does not match
+	jar, params = start()
+	params.Set("nonce", "replayed")
+	c.Assert(callback(jar, url.Values{"code": {s.idp.authorize(params)}, "state": {params.Get("state")}}), Equals, http.StatusForbidden)
+
+	// Open redirects are not followed
+	jar = newJar()
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com//evil.com/path", nil))
+	location, err := url.Parse(re.Header().Get("Location"))
+	c.Assert(err, IsNil)
+	params = location.Query()
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/oauth2/callback?code="+s.idp.authorize(params)+"&state="+params.Get("state"), nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+	c.Assert(re.Header().Get("Location"), Equals, "/")
+}
+
+func (s *OIDCSuite) TestLogout(c *C) {
+	h := s.newHandler(c, OIDC{}, ok)
+	jar := s.logIn(c, h)
+
+	// Links and forms of other sites can not log users out
+	re := jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/oauth2/logout", nil))
+	c.Assert(re.Code, Equals, http.StatusMethodNotAllowed)
+	c.Assert(re.Header().Get("Allow"), Equals, http.MethodPost)
+	for _, header := range []string{"Origin", "Referer"} {
+		r := httptest.NewRequest(http.MethodPost, "http://example.com/oauth2/logout", nil)
+		r.Header.Set(header, "http://evil.com")
+		re = jar.do(h, r)
+		c.Assert(re.Code, Equals, http.StatusForbidden)
+	}
+	re = jar.do(h, httptest.NewRequest(http.MethodPost, "http://example.com/oauth2/logout", nil))
+	c.Assert(re.Code, Equals, http.StatusForbidden)
+	c.Assert(jar.cookies[DefaultCookieName], Not(Equals), "")
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/oauth2/logout", nil)
+	r.Header.Set("Referer", "http://example.com/dash")
+	re = jar.do(h, r)
+	c.Assert(re.Code, Equals, http.StatusSeeOther)
+	c.Assert(re.Header().Get("Location"), Equals, s.idp.URL+"/logout?client_id=dash")
+	c.Assert(jar.cookies[DefaultCookieName], Equals, "")
+
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+
+	jar = s.logIn(c, h)
+	r = httptest.NewRequest(http.MethodPost, "http://example.com/oauth2/logout", nil)
+	r.Header.Set("Origin", "http://example.com")
+	re = jar.do(h, r)
+	c.Assert(re.Code, Equals, http.StatusSeeOther)
+	c.Assert(jar.cookies[DefaultCookieName], Equals, "")
+}
+
+func (s *OIDCSuite) TestSessionTooLarge(c *C) {
+	h := s.newHandler(c, OIDC{ClaimHeaders: map[string]string{"groups": "X-Groups"}}, ok)
+	groups := make([]string, 500)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("group-%d", i)
+	}
+	s.idp.setGroups(groups)
+
+	// Users are told what went wrong instead of being sent to log in
+	// over and over again
+	jar := newJar()
+	re := jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+	location, err := url.Parse(re.Header().Get("Location"))
+	c.Assert(err, IsNil)
+	params := location.Query()
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/oauth2/callback?code="+s.idp.authorize(params)+"&state="+params.Get("state"), nil))
+	c.Assert(re.Code, Equals, http.StatusInternalServerError)
+	c.Assert(strings.Contains(re.Body.String(), "too large"), Equals, true)
+	c.Assert(jar.cookies[DefaultCookieName], Equals, "")
+
+	// The same goes for sessions that grow too large when they are
+	// refreshed
+	s.idp.setGroups(nil)
+	jar = s.logIn(c, h)
+	s.idp.setGroups(groups)
+	s.clock.Sleep(2 * time.Minute)
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusInternalServerError)
+	c.Assert(strings.Contains(re.Body.String(), "too large"), Equals, true)
+}
+
+func (s *OIDCSuite) TestProviderUnavailable(c *C) {
+	s.idp.Close()
+	h := s.newHandler(c, OIDC{}, ok)
+	re := serve(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusServiceUnavailable)
+}
+
+func (s *OIDCSuite) TestSealedSecrets(c *C) {
+	keyString, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+	box, err := secret.NewBoxFromKeyString(keyString)
+	c.Assert(err, IsNil)
+	seal := func(val interface{}) ([]byte, error) {
+		data, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := box.Seal(data)
+		if err != nil {
+			return nil, err
+		}
+		return secret.SealedValueToJSON(sealed)
+	}
+	open := func(data []byte, val interface{}) error {
+		sealed, err := secret.SealedValueFromJSON(data)
+		if err != nil {
+			return err
+		}
+		out, err := box.Open(sealed)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(out, val)
+	}
+
+	o, err := NewOIDC(OIDC{Issuer: s.idp.URL, ClientId: "dash", ClientSecret: "client-secret", CookieKey: s.cookieKey})
+	c.Assert(err, IsNil)
+	sealed, err := o.Seal(seal)
+	c.Assert(err, IsNil)
+	data, err := json.Marshal(sealed)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), "client-secret"), Equals, false)
+	c.Assert(strings.Contains(string(data), s.cookieKey), Equals, false)
+
+	stored, err := GetSpec().FromJSON(data)
+	c.Assert(err, IsNil)
+	_, err = stored.NewHandler(nil)
+	c.Assert(err, NotNil)
+
+	opened, err := stored.(plugin.SealedMiddleware).Open(open)
+	c.Assert(err, IsNil)
+	c.Assert(opened.(*OIDC).ClientSecret, Equals, "client-secret")
+	c.Assert(opened.(*OIDC).CookieKey, Equals, s.cookieKey)
+	_, err = opened.NewHandler(nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *OIDCSuite) newHandler(c *C, cfg OIDC, next http.HandlerFunc) http.Handler {
+	cfg.Issuer = s.idp.URL
+	cfg.ClientId = "dash"
+	cfg.ClientSecret = "client-secret"
+	cfg.CookieKey = s.cookieKey
+	cfg.clock = s.clock
+	o, err := NewOIDC(cfg)
+	c.Assert(err, IsNil)
+	h, err := o.NewHandler(next)
+	c.Assert(err, IsNil)
+	return h
+}
+
+func (s *OIDCSuite) logIn(c *C, h http.Handler) *cookieJar {
+	jar := newJar()
+	re := jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+	location, err := url.Parse(re.Header().Get("Location"))
+	c.Assert(err, IsNil)
+	params := location.Query()
+	re = jar.do(h, httptest.NewRequest(http.MethodGet, "http://example.com/oauth2/callback?code="+s.idp.authorize(params)+"&state="+params.Get("state"), nil))
+	c.Assert(re.Code, Equals, http.StatusFound)
+	return jar
+}
+
+// mockIdP is a minimal OpenID Connect provider.
+type mockIdP struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	clock timetools.TimeProvider
+
+	mu        sync.Mutex
+	codes     map[string]url.Values
+	refresh   string
+	issued    int
+	refreshes int
+	// groups overrides the groups claim if set.
+	groups []string
+}
+
+func newMockIdP(key *rsa.PrivateKey, clock timetools.TimeProvider) *mockIdP {
+	p := &mockIdP{key: key, clock: clock, codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+			"end_session_endpoint":   p.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// authorize plays the user logging in at the provider and returns the code
+// the provider sends them back with.
+func (p *mockIdP) authorize(params url.Values) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	code := "code-" + params.Get("state")
+	p.codes[code] = params
+	return code
+}
+
+func (p *mockIdP) setGroups(groups []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.groups = groups
+}
+
+func (p *mockIdP) revoke() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refresh = ""
+}
+
+func (p *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id, secret, ok := r.BasicAuth(); !ok || id != "dash" || secret != "client-secret" {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	r.ParseForm()
+	nonce := ""
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		params, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || params.Get("redirect_uri") != r.PostForm.Get("redirect_uri") ||
+			params.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		nonce = params.Get("nonce")
+	case "refresh_token":
+		if p.refresh == "" || r.PostForm.Get("refresh_token") != p.refresh {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		p.refreshes++
+	default:
+		http.Error(w, `{"error": "unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+	p.issued++
+	p.refresh = "refresh-" + big.NewInt(int64(p.issued)).String()
+	claims := jwt.MapClaims{
+		"iss":    p.URL,
+		"aud":    "dash",
+		"sub":    "jane",
+		"email":  "jane@example.com",
+		"groups": []string{"admins", "devs"},
+		"exp":    p.clock.UtcNow().Add(time.Minute).Unix(),
+	}
+	if p.groups != nil {
+		claims["groups"] = p.groups
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	t.Header["kid"] = "k1"
+	idToken, err := t.SignedString(p.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  "access-" + big.NewInt(int64(p.issued)).String(),
+		"token_type":    "Bearer",
+		"refresh_token": p.refresh,
+		"expires_in":    60,
+		"id_token":      idToken,
+	})
+}
+
+// cookieJar keeps cookies between requests.
+type cookieJar struct {
+	cookies map[string]string
+}
+
+func newJar() *cookieJar {
+	return &cookieJar{cookies: map[string]string{}}
+}
+
+func (j *cookieJar) do(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	for name, value := range j.cookies {
+		r.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	re := serve(h, r)
+	for _, cookie := range re.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(j.cookies, cookie.Name)
+		} else {
+			j.cookies[cookie.Name] = cookie.Value
+		}
+	}
+	return re
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, r)
+	return re
+}
@@ -0,0 +1,147 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin/jwtauth"
+)
+
+const (
+	providerTimeout = 10 * time.Second
+	// retryDiscovery is how long to wait before discovering the provider
+	// again after a failure.
+	retryDiscovery = 10 * time.Second
+	// keysRefresh is how often keys of the provider are refreshed.
+	keysRefresh      = 10 * time.Minute
+	maxResponseBytes = 1 << 20
+)
+
+// providerConfig is the part of the provider's discovery document, see
+// https://openid.net/specs/openid-connect-discovery-1_0.html.
+type providerConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	IdToken      string `json:"id_token"`
+}
+
+// provider discovers the configuration of the identity provider when it is
+// first needed, and talks to its token endpoint.
+type provider struct {
+	issuer string
+	clock  timetools.TimeProvider
+	client *http.Client
+
+	mu     sync.Mutex
+	config *providerConfig
+	keys   *jwtauth.KeySet
+	failed time.Time
+}
+
+func newProvider(issuer string, clock timetools.TimeProvider) *provider {
+	return &provider{
+		issuer: issuer,
+		clock:  clock,
+		client: &http.Client{Timeout: providerTimeout},
+	}
+}
+
+func (p *provider) get() (*providerConfig, *jwtauth.KeySet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config != nil {
+		return p.config, p.keys, nil
+	}
+	if !p.failed.IsZero() && p.clock.UtcNow().Sub(p.failed) < retryDiscovery {
+		return nil, nil, fmt.Errorf("provider %s is unavailable", p.issuer)
+	}
+	config, err := p.discover()
+	if err != nil {
+		p.failed = p.clock.UtcNow()
+		return nil, nil, err
+	}
+	p.config = config
+	p.keys = jwtauth.NewKeySet(config.JWKSURI, keysRefresh, p.clock)
+	return p.config, p.keys, nil
+}
+
+func (p *provider) discover() (*providerConfig, error) {
+	var config providerConfig
+	u := strings.TrimSuffix(p.issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.do(http.MethodGet, u, nil, "", "", &config); err != nil {
+		return nil, fmt.Errorf("failed to discover provider %s: %v", p.issuer, err)
+	}
+	if strings.TrimSuffix(config.Issuer, "/") != strings.TrimSuffix(p.issuer, "/") {
+		return nil, fmt.Errorf("provider says its issuer is %q, expected %q", config.Issuer, p.issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return nil, fmt.Errorf("provider %s does not have authorization, token or JWKS endpoints", p.issuer)
+	}
+	return &config, nil
+}
+
+// token requests tokens from the token endpoint. Confidential clients
+// authenticate with HTTP basic authentication, public clients send just
+// their id.
+func (p *provider) token(config *providerConfig, form url.Values, clientId, clientSecret string) (*tokenResponse, error) {
+	if clientSecret == "" {
+		form.Set("client_id", clientId)
+	}
+	var t tokenResponse
+	if err := p.do(http.MethodPost, config.TokenEndpoint, form, clientId, clientSecret, &t); err != nil {
+		return nil, err
+	}
+	if t.AccessToken == "" {
+		return nil, fmt.Errorf("token response does not have an access token")
+	}
+	return &t, nil
+}
+
+func (p *provider) do(method, u string, form url.Values, clientId, clientSecret string, out interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(clientId), url.QueryEscape(clientSecret))
+	}
+	re, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer re.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(re.Body, maxResponseBytes))
+	if err != nil {
+		return err
+	}
+	if re.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: unexpected status %d: %s", method, u, re.StatusCode, data)
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,194 @@
+package oidc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/secret"
+)
+
+const (
+	kindSession = "session"
+	kindLogin   = "login"
+	// loginTTL is how long users have to log in at the provider.
+	loginTTL = 10 * time.Minute
+	// maxCookieBytes is the size browsers are guaranteed to keep.
+	maxCookieBytes = 4096
+)
+
+// errSessionTooLarge is returned for sessions that browsers would not keep.
+var errSessionTooLarge = errors.New("session is too large to keep in a cookie")
+
+// session is kept in the session cookie.
+type session struct {
+	// Headers are forwarded to backends, they are taken from claims when
+	// users log in.
+	Headers      map[string]string `json:",omitempty"`
+	AccessToken  string            `json:",omitempty"`
+	RefreshToken string            `json:",omitempty"`
+	// Expiry is when the access token expires, and Ends is when users have
+	// to log in again.
+	Expiry time.Time
+	Ends   time.Time
+}
+
+// login is kept in a cookie while users log in at the provider.
+type login struct {
+	State    string
+	Nonce    string
+	Verifier string
+	// Return is where users go back to after they log in.
+	Return string
+}
+
+// envelope tells sessions from logins, so one can not be used as the other.
+type envelope struct {
+	Kind  string
+	Value json.RawMessage
+}
+
+// cookies seals values into cookies with the box.
+type cookies struct {
+	box    *secret.Box
+	name   string
+	domain string
+}
+
+func (c *cookies) loginName() string {
+	return c.name + "_login"
+}
+
+func (c *cookies) seal(kind string, val interface{}) (string, error) {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+	data, err = json.Marshal(envelope{Kind: kind, Value: data})
+	if err != nil {
+		return "", err
+	}
+	sealed, err := c.box.Seal(data)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sealed.Nonce) + "." + base64.RawURLEncoding.EncodeToString(sealed.Val), nil
+}
+
+func (c *cookies) open(kind, value string, val interface{}) error {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("malformed cookie")
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("malformed cookie")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed cookie")
+	}
+	data, err := c.box.Open(&secret.SealedBytes{Val: sealed, Nonce: nonce})
+	if err != nil {
+		return err
+	}
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	if e.Kind != kind {
+		return fmt.Errorf("expected %s cookie, got %s", kind, e.Kind)
+	}
+	return json.Unmarshal(e.Value, val)
+}
+
+func (c *cookies) getSession(r *http.Request) (*session, bool) {
+	cookie, err := r.Cookie(c.name)
+	if err != nil {
+		return nil, false
+	}
+	var s session
+	if err := c.open(kindSession, cookie.Value, &s); err != nil {
+		plugin.RequestLog(r).Debugf("Ignoring session cookie: %v", err)
+		return nil, false
+	}
+	return &s, true
+}
+
+func (c *cookies) setSession(w http.ResponseWriter, r *http.Request, s *session) error {
+	value, err := c.seal(kindSession, s)
+	if err != nil {
+		return err
+	}
+	// Browsers drop cookies that are too large, and users would be sent
+	// to log in over and over again.
+	cookie := c.cookie(r, c.name, value, s.Ends)
+	if size := len(cookie.String()); size > maxCookieBytes {
+		return fmt.Errorf("%w: cookie is %d bytes, browsers keep cookies up to %d bytes", errSessionTooLarge, size, maxCookieBytes)
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+func (c *cookies) getLogin(r *http.Request) (*login, error) {
+	cookie, err := r.Cookie(c.loginName())
+	if err != nil {
+		return nil, fmt.Errorf("no login cookie")
+	}
+	var l login
+	if err := c.open(kindLogin, cookie.Value, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (c *cookies) setLogin(w http.ResponseWriter, r *http.Request, l *login, expires time.Time) error {
+	value, err := c.seal(kindLogin, l)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, c.cookie(r, c.loginName(), value, expires))
+	return nil
+}
+
+func (c *cookies) clear(w http.ResponseWriter, r *http.Request, name string) {
+	cookie := c.cookie(r, name, "", time.Unix(0, 0))
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+func (c *cookies) cookie(r *http.Request, name, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   c.domain,
+		Expires:  expires,
+		Secure:   requestScheme(r) == "https",
+		HttpOnly: true,
+		// Lax sends cookies when users are redirected back from the
+		// provider.
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// strip removes cookies of the middleware from the request, so backends do
+// not see tokens.
+func (c *cookies) strip(r *http.Request) {
+	all := r.Cookies()
+	r.Header.Del("Cookie")
+	var kept []string
+	for _, cookie := range all {
+		if cookie.Name != c.name && cookie.Name != c.loginName() {
+			kept = append(kept, cookie.Name+"="+cookie.Value)
+		}
+	}
+	if len(kept) != 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
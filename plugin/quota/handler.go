@@ -0,0 +1,198 @@
+package quota
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// storeTimeout is how long to wait for the store.
+const storeTimeout = 500 * time.Millisecond
+
+type handler struct {
+	next   http.Handler
+	quota  *Quota
+	store  Store
+	prefix string
+	env    plugin.Env
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, _, err := h.quota.extract.Extract(r)
+	if err != nil {
+		plugin.RequestLog(r).Warnf("Failed to get the quota key of request to %s: %v", r.URL, err)
+		utils.DefaultHandler.ServeHTTP(w, r, err)
+		return
+	}
+	cost, err := requestCost(r, h.quota.CostHeader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := h.quota.clock.UtcNow()
+	start, end := h.quota.window(now)
+	c := &counter{key: counterKey(h.prefix, key, start), reset: end.Sub(now)}
+
+	if h.quota.ResponseCostHeader != "" {
+		h.serveResponseCost(w, r, c, cost)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	used, ok, err := h.store.Add(ctx, c.key, cost, h.quota.Limit, c.reset)
+	cancel()
+	if err != nil {
+		h.storeFailed(w, r, err)
+		return
+	}
+	h.setHeaders(w.Header(), used, c.reset)
+	if !ok {
+		h.reject(w, r, c.reset)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// serveResponseCost lets the request through if there is quota left and
+// counts the cost the backend reports once the response is written.
+func (h *handler) serveResponseCost(w http.ResponseWriter, r *http.Request, c *counter, cost int64) {
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	used, err := h.store.Get(ctx, c.key)
+	cancel()
+	if err != nil {
+		h.storeFailed(w, r, err)
+		return
+	}
+	if used >= h.quota.Limit {
+		h.setHeaders(w.Header(), used, c.reset)
+		h.reject(w, r, c.reset)
+		return
+	}
+	cw := &costWriter{ResponseWriter: w, h: h, r: r, used: used, cost: cost, reset: c.reset}
+	h.next.ServeHTTP(cw, r)
+
+	// The request is done, its context may be canceled already.
+	ctx, cancel = context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if _, _, err := h.store.Add(ctx, c.key, cw.cost, noLimit, c.reset); err != nil {
+		plugin.RequestLog(r).Errorf("Failed to count the cost of request to %s: %v", r.URL, err)
+	}
+}
+
+func (h *handler) storeFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if h.quota.FailOpen {
+		plugin.RequestLog(r).Warnf("Letting request to %s through, quota store failed: %v", r.URL, err)
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	plugin.RequestLog(r).Errorf("Quota store failed: %v", err)
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+func (h *handler) reject(w http.ResponseWriter, r *http.Request, reset time.Duration) {
+	plugin.RequestLog(r).Debugf("Rejected request to %s, quota exceeded", r.URL)
+	h.env.IncCounter("rejected", 1)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds(reset), 10))
+	http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+}
+
+func (h *handler) setHeaders(header http.Header, used int64, reset time.Duration) {
+	remaining := h.quota.Limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	header.Set("X-Quota-Limit", strconv.FormatInt(h.quota.Limit, 10))
+	header.Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+	header.Set("X-Quota-Reset", strconv.FormatInt(seconds(reset), 10))
+}
+
+// counter is the usage counter of the window a request is in.
+type counter struct {
+	key string
+	// reset is how long until the window ends, the counter is kept as long.
+	reset time.Duration
+}
+
+// requestCost returns the cost in the header, or 1 if there's no header.
+func requestCost(r *http.Request, header string) (int64, error) {
+	if header == "" {
+		return 1, nil
+	}
+	value := strings.TrimSpace(r.Header.Get(header))
+	if value == "" {
+		return 1, nil
+	}
+	cost, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || cost < 0 {
+		return 0, fmt.Errorf("%s should be a number >= 0, got %q", header, value)
+	}
+	return cost, nil
+}
+
+// seconds rounds the duration up to seconds.
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// costWriter reads the cost of the request from the response headers right
+// before they are sent, and replaces it with usage headers.
+type costWriter struct {
+	http.ResponseWriter
+	h           *handler
+	r           *http.Request
+	used        int64
+	cost        int64
+	reset       time.Duration
+	wroteHeader bool
+}
+
+func (cw *costWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		header := cw.ResponseWriter.Header()
+		if value := header.Get(cw.h.quota.ResponseCostHeader); value != "" {
+			cost, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil || cost < 0 {
+				plugin.RequestLog(cw.r).Warnf("Bad cost %q in %s, counting %d", value, cw.h.quota.ResponseCostHeader, cw.cost)
+			} else {
+				cw.cost = cost
+			}
+		}
+		header.Del(cw.h.quota.ResponseCostHeader)
+		cw.h.setHeaders(header, cw.used+cw.cost, cw.reset)
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *costWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *costWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *costWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", cw.ResponseWriter)
+	}
+	cw.wroteHeader = true
+	return hj.Hijack()
+}
@@ -0,0 +1,250 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
+)
+
+const Type = "quota"
+
+// Windows of quotas, they start at the beginning of the hour, day, ISO week
+// (on Monday) or month in the time zone of the quota.
+const (
+	WindowHour  = "hour"
+	WindowDay   = "day"
+	WindowWeek  = "week"
+	WindowMonth = "month"
+)
+
+// Stores of usage counters.
+const (
+	StoreMemory = "memory"
+	StoreEtcd   = "etcd"
+)
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// Quota limits how many requests each key, e.g. an API key, can make in a
+// calendar window, e.g. 10000 requests per month. Unlike rate limits, usage
+// is counted until the window ends and then starts over.
+//
+// Usage counters are kept in a store that has to be chosen explicitly: in
+// memory of the vulcand process, where usage is lost on restarts, or in Etcd,
+// where it survives restarts and is shared by all vulcand instances.
+type Quota struct {
+	// Variable is the key to count requests by, e.g. 'request.header.X-Api-Key'
+	Variable string
+	// Limit is how many requests, or cost units, a key can use in a window.
+	Limit int64
+	// Window is 'hour', 'day', 'week' or 'month'.
+	Window string
+	// TimeZone is the IANA time zone windows are aligned to, e.g.
+	// 'America/New_York'. It defaults to UTC.
+	TimeZone string `json:",omitempty"`
+	// Store is where usage is kept, 'etcd' or 'memory', which loses usage
+	// on restarts.
+	Store string `json:",omitempty"`
+	// CostHeader is the request header with the cost of the request, requests
+	// without it cost 1.
+	CostHeader string `json:",omitempty"`
+	// ResponseCostHeader is the response header the backend reports the cost
+	// of the request in. The cost is counted once the response is written and
+	// the header is removed from it. Requests are let through while there is
+	// quota left, so the last one can exceed the limit.
+	ResponseCostHeader string `json:",omitempty"`
+	// FailOpen lets requests through when the store fails, they are rejected
+	// otherwise.
+	FailOpen bool `json:",omitempty"`
+
+	extract  utils.SourceExtractor
+	location *time.Location
+	clock    timetools.TimeProvider
+}
+
+// Usage is the usage of a key in the current window.
+type Usage struct {
+	Key       string
+	Limit     int64
+	Used      int64
+	Remaining int64
+	// WindowStart and WindowEnd are the bounds of the current window.
+	WindowStart time.Time
+	WindowEnd   time.Time
+}
+
+// NewQuota validates settings and returns a quota middleware.
+func NewQuota(q Quota) (*Quota, error) {
+	if q.Limit <= 0 {
+		return nil, fmt.Errorf("limit should be > 0, got %d", q.Limit)
+	}
+	switch q.Window {
+	case WindowHour, WindowDay, WindowWeek, WindowMonth:
+	default:
+		return nil, fmt.Errorf("unsupported window %q, expected %s, %s, %s or %s", q.Window, WindowHour, WindowDay, WindowWeek, WindowMonth)
+	}
+	switch q.Store {
+	case StoreMemory, StoreEtcd:
+	case "":
+		// Usage that is silently lost on restarts is not much of a quota.
+		return nil, fmt.Errorf("store should be set, %s keeps usage across restarts and %s loses it", StoreEtcd, StoreMemory)
+	default:
+		return nil, fmt.Errorf("unsupported store %q, expected %s or %s", q.Store, StoreEtcd, StoreMemory)
+	}
+	extract, err := utils.NewExtractor(q.Variable)
+	if err != nil {
+		return nil, err
+	}
+	q.extract = extract
+	if q.location, err = time.LoadLocation(q.TimeZone); err != nil {
+		return nil, fmt.Errorf("bad time zone %q: %v", q.TimeZone, err)
+	}
+	if q.clock == nil {
+		q.clock = &timetools.RealTime{}
+	}
+	return &q, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (q *Quota) NewHandler(next http.Handler) (http.Handler, error) {
+	return q.NewHandlerWithEnv(next, plugin.Env{})
+}
+
+// NewHandlerWithEnv returns a handler that keeps usage in the store, usage
+// is kept per frontend and middleware, so that it survives their updates.
+func (q *Quota) NewHandlerWithEnv(next http.Handler, env plugin.Env) (http.Handler, error) {
+	store, err := q.store(env.CacheProvider)
+	if err != nil {
+		return nil, err
+	}
+	return &handler{
+		next:   next,
+		quota:  q,
+		store:  store,
+		prefix: keyPrefix(env.FrontendId, env.MiddlewareId),
+		env:    env,
+	}, nil
+}
+
+// Usage returns the usage of the key in the current window, given the vulcand
+// cache provider and ids of the frontend and the middleware.
+func (q *Quota) Usage(ctx context.Context, p cacheprovider.T, frontendId, middlewareId, key string) (*Usage, error) {
+	store, err := q.store(p)
+	if err != nil {
+		return nil, err
+	}
+	start, end := q.window(q.clock.UtcNow())
+	used, err := store.Get(ctx, counterKey(keyPrefix(frontendId, middlewareId), key, start))
+	if err != nil {
+		return nil, err
+	}
+	remaining := q.Limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &Usage{Key: key, Limit: q.Limit, Used: used, Remaining: remaining, WindowStart: start, WindowEnd: end}, nil
+}
+
+// Reset resets the usage of the key in the current window.
+func (q *Quota) Reset(ctx context.Context, p cacheprovider.T, frontendId, middlewareId, key string) error {
+	store, err := q.store(p)
+	if err != nil {
+		return err
+	}
+	now := q.clock.UtcNow()
+	start, end := q.window(now)
+	return store.Reset(ctx, counterKey(keyPrefix(frontendId, middlewareId), key, start), end.Sub(now))
+}
+
+func (q *Quota) store(p cacheprovider.T) (Store, error) {
+	if q.Store == StoreMemory {
+		return defaultStore, nil
+	}
+	sp, ok := p.(cacheprovider.SharedCacheProvider)
+	if !ok {
+		return nil, fmt.Errorf("the cache provider of vulcand does not keep shared data, use the Etcd cache provider")
+	}
+	return NewCacheStore(sp.GetSharedCache()), nil
+}
+
+// window returns the bounds of the window the time is in.
+func (q *Quota) window(now time.Time) (time.Time, time.Time) {
+	t := now.In(q.location)
+	y, m, d := t.Date()
+	switch q.Window {
+	case WindowHour:
+		start := time.Date(y, m, d, t.Hour(), 0, 0, 0, q.location)
+		return start, start.Add(time.Hour)
+	case WindowDay:
+		start := time.Date(y, m, d, 0, 0, 0, 0, q.location)
+		return start, start.AddDate(0, 0, 1)
+	case WindowWeek:
+		// Weeks start on Monday
+		offset := (int(t.Weekday()) + 6) % 7
+		start := time.Date(y, m, d-offset, 0, 0, 0, 0, q.location)
+		return start, start.AddDate(0, 0, 7)
+	default:
+		start := time.Date(y, m, 1, 0, 0, 0, 0, q.location)
+		return start, start.AddDate(0, 1, 0)
+	}
+}
+
+func (q *Quota) String() string {
+	return fmt.Sprintf("var=%s, limit=%d/%s, timeZone=%s, store=%s, costHeader=%s, responseCostHeader=%s, failOpen=%t",
+		q.Variable, q.Limit, q.Window, q.location, q.Store, q.CostHeader, q.ResponseCostHeader, q.FailOpen)
+}
+
+func keyPrefix(frontendId, middlewareId string) string {
+	return fmt.Sprintf("quota/%s/%s/", frontendId, middlewareId)
+}
+
+// counterKey returns the key of the usage counter of the window, counters of
+// past windows are left to expire.
+func counterKey(prefix, key string, start time.Time) string {
+	return prefix + key + "/" + start.Format("2006-01-02T15")
+}
+
+func FromOther(q Quota) (plugin.Middleware, error) {
+	return NewQuota(q)
+}
+
+// FromCli constructs a middleware instance from the command line parameters.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	return NewQuota(Quota{
+		Variable:           c.String("var"),
+		Limit:              int64(c.Int("limit")),
+		Window:             c.String("window"),
+		TimeZone:           c.String("timeZone"),
+		Store:              c.String("store"),
+		CostHeader:         c.String("costHeader"),
+		ResponseCostHeader: c.String("responseCostHeader"),
+		FailOpen:           c.Bool("failOpen"),
+	})
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "variable, var", Value: "client.ip", Usage: "variable to count requests by, e.g. client.ip or request.header.X-Api-Key"},
+		cli.IntFlag{Name: "limit", Usage: "requests, or cost units, allowed per window"},
+		cli.StringFlag{Name: "window", Value: WindowMonth, Usage: "window of the quota: hour, day, week or month"},
+		cli.StringFlag{Name: "timeZone", Usage: "time zone windows are aligned to, e.g. America/New_York, UTC by default"},
+		cli.StringFlag{Name: "store", Usage: "where usage is kept: etcd, or memory that loses usage on restarts"},
+		cli.StringFlag{Name: "costHeader", Usage: "request header with the cost of the request"},
+		cli.StringFlag{Name: "responseCostHeader", Usage: "response header the backend reports the cost of the request in"},
+		cli.BoolFlag{Name: "failOpen", Usage: "let requests through when the store fails"},
+	}
+}
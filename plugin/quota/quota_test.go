@@ -0,0 +1,361 @@
+package quota
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
+	"golang.org/x/crypto/acme/autocert"
+	. "gopkg.in/check.v1"
+)
+
+func TestQuota(t *testing.T) { TestingT(t) }
+
+type QuotaSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&QuotaSuite{})
+
+func (s *QuotaSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		// Thursday
+		CurrentTime: time.Date(2012, 3, 8, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *QuotaSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *QuotaSuite) TestFromOther(c *C) {
+	q := Quota{Variable: "request.header.X-Api-Key", Limit: 10000, Window: WindowMonth, TimeZone: "Europe/Berlin", Store: StoreEtcd, CostHeader: "X-Cost"}
+	out, err := FromOther(q)
+	c.Assert(err, IsNil)
+	c.Assert(out.(*Quota).Limit, Equals, int64(10000))
+	c.Assert(fmt.Sprint(out), Equals,
+		"var=request.header.X-Api-Key, limit=10000/month, timeZone=Europe/Berlin, store=etcd, costHeader=X-Cost, responseCostHeader=, failOpen=false")
+}
+
+func (s *QuotaSuite) TestFromOtherBadParams(c *C) {
+	tcs := []Quota{
+		{Variable: "client.ip", Window: WindowDay, Store: StoreMemory},
+		{Variable: "client.ip", Limit: -1, Window: WindowDay, Store: StoreMemory},
+		{Variable: "client.ip", Limit: 1, Store: StoreMemory},
+		{Variable: "client.ip", Limit: 1, Window: "year", Store: StoreMemory},
+		{Variable: "client.ip", Limit: 1, Window: WindowDay, TimeZone: "Mars/Olympus", Store: StoreMemory},
+		{Variable: "client.ip", Limit: 1, Window: WindowDay, Store: "redis"},
+		{Variable: "client", Limit: 1, Window: WindowDay, Store: StoreMemory},
+		// Usage lost on restarts has to be asked for
+		{Variable: "client.ip", Limit: 1, Window: WindowDay},
+	}
+	for _, tc := range tcs {
+		_, err := FromOther(tc)
+		c.Assert(err, NotNil, Commentf("%#v", tc))
+	}
+}
+
+func (s *QuotaSuite) TestFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	app.Flags = CliFlags()
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+		q := out.(*Quota)
+		c.Assert(q.Variable, Equals, "request.header.X-Api-Key")
+		c.Assert(q.Limit, Equals, int64(100))
+		c.Assert(q.Window, Equals, WindowWeek)
+		c.Assert(q.TimeZone, Equals, "UTC")
+		c.Assert(q.Store, Equals, StoreEtcd)
+		c.Assert(q.CostHeader, Equals, "X-Cost")
+		c.Assert(q.ResponseCostHeader, Equals, "X-Response-Cost")
+		c.Assert(q.FailOpen, Equals, true)
+		return nil
+	}
+	app.Run([]string{"test", "--var=request.header.X-Api-Key", "--limit=100", "--window=week", "--timeZone=UTC",
+		"--store=etcd", "--costHeader=X-Cost", "--responseCostHeader=X-Response-Cost", "--failOpen"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *QuotaSuite) TestWindows(c *C) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	c.Assert(err, IsNil)
+	tcs := []struct {
+		window     string
+		timeZone   string
+		start, end time.Time
+	}{
+		{WindowHour, "", time.Date(2012, 3, 8, 5, 0, 0, 0, time.UTC), time.Date(2012, 3, 8, 6, 0, 0, 0, time.UTC)},
+		{WindowDay, "", time.Date(2012, 3, 8, 0, 0, 0, 0, time.UTC), time.Date(2012, 3, 9, 0, 0, 0, 0, time.UTC)},
+		{WindowWeek, "", time.Date(2012, 3, 5, 0, 0, 0, 0, time.UTC), time.Date(2012, 3, 12, 0, 0, 0, 0, time.UTC)},
+		{WindowMonth, "", time.Date(2012, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2012, 4, 1, 0, 0, 0, 0, time.UTC)},
+		// It is still March 7 in Los Angeles
+		{WindowDay, "America/Los_Angeles", time.Date(2012, 3, 7, 0, 0, 0, 0, la), time.Date(2012, 3, 8, 0, 0, 0, 0, la)},
+		// The week is an hour shorter, daylight saving time starts on March 11
+		{WindowWeek, "America/Los_Angeles", time.Date(2012, 3, 5, 0, 0, 0, 0, la), time.Date(2012, 3, 12, 0, 0, 0, 0, la)},
+	}
+	for _, tc := range tcs {
+		q, err := NewQuota(Quota{Variable: "client.ip", Limit: 1, Window: tc.window, TimeZone: tc.timeZone, Store: StoreMemory})
+		c.Assert(err, IsNil)
+		start, end := q.window(s.clock.UtcNow())
+		c.Assert(start.Equal(tc.start), Equals, true, Commentf("%s %s: %v", tc.window, tc.timeZone, start))
+		c.Assert(end.Equal(tc.end), Equals, true, Commentf("%s %s: %v", tc.window, tc.timeZone, end))
+	}
+}
+
+func (s *QuotaSuite) TestLimit(c *C) {
+	h := s.newHandler(c, Quota{Limit: 2, Window: WindowDay}, plugin.Env{})
+
+	re := s.get(h, "k1", nil)
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Header().Get("X-Quota-Limit"), Equals, "2")
+	c.Assert(re.Header().Get("X-Quota-Remaining"), Equals, "1")
+	// Until midnight
+	c.Assert(re.Header().Get("X-Quota-Reset"), Equals, "68033")
+
+	c.Assert(s.get(h, "k1", nil).Code, Equals, http.StatusOK)
+	re = s.get(h, "k1", nil)
+	c.Assert(re.Code, Equals, http.StatusTooManyRequests)
+	c.Assert(re.Header().Get("X-Quota-Remaining"), Equals, "0")
+	c.Assert(re.Header().Get("Retry-After"), Equals, "68033")
+
+	// Keys have quotas of their own
+	c.Assert(s.get(h, "k2", nil).Code, Equals, http.StatusOK)
+
+	// Usage starts over in the next window
+	s.clock.Sleep(19 * time.Hour)
+	c.Assert(s.get(h, "k1", nil).Code, Equals, http.StatusOK)
+}
+
+// Usage survives updates of the middleware.
+func (s *QuotaSuite) TestUsageSurvivesUpdates(c *C) {
+	env := plugin.Env{FrontendId: "f1", MiddlewareId: "updated"}
+	h := s.newHandler(c, Quota{Limit: 2, Window: WindowMonth}, env)
+	c.Assert(s.get(h, "k1", nil).Code, Equals, http.StatusOK)
+
+	h = s.newHandler(c, Quota{Limit: 3, Window: WindowMonth}, env)
+	c.Assert(s.get(h, "k1", nil).Code, Equals, http.StatusOK)
+	c.Assert(s.get(h, "k1", nil).Code, Equals, http.StatusOK)
+	c.Assert(s.get(h, "k1", nil).Code, Equals, http.StatusTooManyRequests)
+}
+
+func (s *QuotaSuite) TestCostHeader(c *C) {
+	h := s.newHandler(c, Quota{Limit: 10, Window: WindowDay, CostHeader: "X-Cost"}, plugin.Env{})
+
+	re := s.get(h, "k1", map[string]string{"X-Cost": "7"})
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Header().Get("X-Quota-Remaining"), Equals, "3")
+
+	// Requests that cost more than is left are rejected and not counted
+	c.Assert(s.get(h, "k1", map[string]string{"X-Cost": "4"}).Code, Equals, http.StatusTooManyRequests)
+	c.Assert(s.get(h, "k1", nil).Code, Equals, http.StatusOK)
+	c.Assert(s.get(h, "k1", map[string]string{"X-Cost": "0"}).Code, Equals, http.StatusOK)
+
+	c.Assert(s.get(h, "k1", map[string]string{"X-Cost": "-1"}).Code, Equals, http.StatusBadRequest)
+	c.Assert(s.get(h, "k1", map[string]string{"X-Cost": "a lot"}).Code, Equals, http.StatusBadRequest)
+}
+
+func (s *QuotaSuite) TestResponseCostHeader(c *C) {
+	q, err := NewQuota(Quota{Variable: "request.header.X-Api-Key", Limit: 10, Window: WindowDay, Store: StoreMemory, ResponseCostHeader: "X-Cost"})
+	c.Assert(err, IsNil)
+	q.clock = s.clock
+	cost := "6"
+	h, err := q.NewHandlerWithEnv(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cost", cost)
+		w.Write([]byte("hello"))
+	}), plugin.Env{MiddlewareId: c.TestName()})
+	c.Assert(err, IsNil)
+
+	re := s.get(h, "k1", nil)
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Header().Get("X-Cost"), Equals, "")
+	c.Assert(re.Header().Get("X-Quota-Remaining"), Equals, "4")
+
+	// The last request can exceed the quota
+	c.Assert(s.get(h, "k1", nil).Code, Equals, http.StatusOK)
+	re = s.get(h, "k1", nil)
+	c.Assert(re.Code, Equals, http.StatusTooManyRequests)
+	c.Assert(re.Body.String(), Equals, "quota exceeded\n")
+
+	// Bad costs count as the request cost
+	cost = "many"
+	re = s.get(h, "k2", nil)
+	c.Assert(re.Header().Get("X-Quota-Remaining"), Equals, "9")
+}
+
+func (s *QuotaSuite) TestEtcdStore(c *C) {
+	cache := &memSharedCache{data: make(map[string][]byte)}
+	env := plugin.Env{CacheProvider: &sharedCacheProvider{cache}, FrontendId: "f1", MiddlewareId: "q1"}
+	q, err := NewQuota(Quota{Variable: "request.header.X-Api-Key", Limit: 2, Window: WindowMonth, Store: StoreEtcd})
+	c.Assert(err, IsNil)
+	q.clock = s.clock
+
+	// Instances share usage
+	for i := 0; i < 2; i++ {
+		h, err := q.NewHandlerWithEnv(ok, env)
+		c.Assert(err, IsNil)
+		c.Assert(s.get(h, "k1", nil).Code, Equals, http.StatusOK)
+	}
+	c.Assert(string(cache.data["quota/f1/q1/k1/2012-03-01T00"]), Equals, "2")
+	c.Assert(cache.ttls["quota/f1/q1/k1/2012-03-01T00"], Equals, time.Date(2012, 4, 1, 0, 0, 0, 0, time.UTC).Sub(s.clock.UtcNow()))
+
+	usage, err := q.Usage(context.Background(), env.CacheProvider, "f1", "q1", "k1")
+	c.Assert(err, IsNil)
+	c.Assert(usage, DeepEquals, &Usage{
+		Key:         "k1",
+		Limit:       2,
+		Used:        2,
+		Remaining:   0,
+		WindowStart: time.Date(2012, 3, 1, 0, 0, 0, 0, time.UTC),
+		WindowEnd:   time.Date(2012, 4, 1, 0, 0, 0, 0, time.UTC),
+	})
+
+	c.Assert(q.Reset(context.Background(), env.CacheProvider, "f1", "q1", "k1"), IsNil)
+	usage, err = q.Usage(context.Background(), env.CacheProvider, "f1", "q1", "k1")
+	c.Assert(err, IsNil)
+	c.Assert(usage.Used, Equals, int64(0))
+
+	// The etcd store needs a cache provider that keeps shared data
+	_, err = q.NewHandler(ok)
+	c.Assert(err, NotNil)
+}
+
+func (s *QuotaSuite) TestStoreFailure(c *C) {
+	cache := &memSharedCache{data: make(map[string][]byte), err: fmt.Errorf("connection refused")}
+	env := plugin.Env{CacheProvider: &sharedCacheProvider{cache}}
+	for _, tc := range []struct {
+		failOpen bool
+		code     int
+	}{
+		{false, http.StatusServiceUnavailable},
+		{true, http.StatusOK},
+	} {
+		q, err := NewQuota(Quota{Variable: "request.header.X-Api-Key", Limit: 2, Window: WindowMonth, Store: StoreEtcd, FailOpen: tc.failOpen})
+		c.Assert(err, IsNil)
+		h, err := q.NewHandlerWithEnv(ok, env)
+		c.Assert(err, IsNil)
+		c.Assert(s.get(h, "k1", nil).Code, Equals, tc.code)
+	}
+}
+
+func (s *QuotaSuite) TestMemoryStore(c *C) {
+	clock := &timetools.FreezedTime{CurrentTime: s.clock.UtcNow()}
+	store := newMemoryStore(clock)
+	ctx := context.Background()
+
+	used, ok, err := store.Add(ctx, "k", 3, 5, time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(used, Equals, int64(3))
+	c.Assert(ok, Equals, true)
+
+	used, ok, err = store.Add(ctx, "k", 3, 5, time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(used, Equals, int64(3))
+	c.Assert(ok, Equals, false)
+
+	used, ok, err = store.Add(ctx, "k", 3, noLimit, time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(used, Equals, int64(6))
+	c.Assert(ok, Equals, true)
+
+	// Counters expire
+	clock.Sleep(2 * time.Minute)
+	used, err = store.Get(ctx, "k")
+	c.Assert(err, IsNil)
+	c.Assert(used, Equals, int64(0))
+	store.Add(ctx, "other", 1, 5, time.Minute)
+	c.Assert(store.counters["k"], IsNil)
+}
+
+func (s *QuotaSuite) newHandler(c *C, q Quota, env plugin.Env) http.Handler {
+	q.Variable = "request.header.X-Api-Key"
+	q.Store = StoreMemory
+	out, err := NewQuota(q)
+	c.Assert(err, IsNil)
+	out.clock = s.clock
+	if env.MiddlewareId == "" {
+		// Tests do not share usage kept in memory
+		env.MiddlewareId = c.TestName()
+	}
+	h, err := out.NewHandlerWithEnv(ok, env)
+	c.Assert(err, IsNil)
+	return h
+}
+
+func (s *QuotaSuite) get(h http.Handler, key string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-Api-Key", key)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, req)
+	return re
+}
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("hello"))
+})
+
+type sharedCacheProvider struct {
+	cache cacheprovider.SharedCache
+}
+
+func (p *sharedCacheProvider) GetAutoCertCache() autocert.Cache {
+	return nil
+}
+
+func (p *sharedCacheProvider) GetSharedCache() cacheprovider.SharedCache {
+	return p.cache
+}
+
+// memSharedCache is a shared cache in memory, values do not expire.
+type memSharedCache struct {
+	mutex sync.Mutex
+	data  map[string][]byte
+	ttls  map[string]time.Duration
+	err   error
+}
+
+func (m *memSharedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	data, ok := m.data[key]
+	if !ok {
+		return nil, cacheprovider.ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (m *memSharedCache) CompareAndSwap(ctx context.Context, key string, old, data []byte, ttl time.Duration) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err != nil {
+		return false, m.err
+	}
+	current, ok := m.data[key]
+	if ok == (old == nil) || !bytes.Equal(current, old) {
+		return false, nil
+	}
+	m.data[key] = data
+	if m.ttls == nil {
+		m.ttls = make(map[string]time.Duration)
+	}
+	m.ttls[key] = ttl
+	return true, nil
+}
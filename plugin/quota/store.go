@@ -0,0 +1,184 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
+)
+
+// Store keeps usage counters of quotas.
+type Store interface {
+	// Add adds the cost to the counter under the key unless the counter would
+	// exceed the limit. It returns the counter and whether the cost was added.
+	// Counters expire after the ttl.
+	Add(ctx context.Context, key string, cost, limit int64, ttl time.Duration) (int64, bool, error)
+	// Get returns the counter under the key, or 0 if there's no such counter.
+	Get(ctx context.Context, key string) (int64, error)
+	// Reset sets the counter under the key to 0.
+	Reset(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// noLimit is passed to Add to add the cost whatever the counter is.
+const noLimit = math.MaxInt64
+
+// maxSwapAttempts is how many times counters updated by other instances at
+// the same time are read again.
+const maxSwapAttempts = 10
+
+var errContended = errors.New("usage counter is updated by other instances too often")
+
+// defaultStore keeps usage in memory of the process, so that it survives
+// updates of frontends and middlewares, but not restarts. It is used only
+// when the memory store is chosen explicitly.
+var defaultStore = newMemoryStore(&timetools.RealTime{})
+
+type memoryStore struct {
+	mutex    sync.Mutex
+	counters map[string]*memoryCounter
+	clock    timetools.TimeProvider
+	// lastSweep is when expired counters were last removed.
+	lastSweep time.Time
+}
+
+type memoryCounter struct {
+	value   int64
+	expires time.Time
+}
+
+func newMemoryStore(clock timetools.TimeProvider) *memoryStore {
+	return &memoryStore{counters: make(map[string]*memoryCounter), clock: clock}
+}
+
+func (s *memoryStore) Add(ctx context.Context, key string, cost, limit int64, ttl time.Duration) (int64, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.clock.UtcNow()
+	s.sweep(now)
+	c := s.counter(key, now)
+	if c == nil {
+		c = &memoryCounter{}
+		s.counters[key] = c
+	}
+	if c.value > limit-cost {
+		return c.value, false, nil
+	}
+	c.value += cost
+	c.expires = now.Add(ttl)
+	return c.value, true, nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if c := s.counter(key, s.clock.UtcNow()); c != nil {
+		return c.value, nil
+	}
+	return 0, nil
+}
+
+func (s *memoryStore) Reset(ctx context.Context, key string, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.counters, key)
+	return nil
+}
+
+// counter returns the counter under the key unless it has expired.
+func (s *memoryStore) counter(key string, now time.Time) *memoryCounter {
+	c, ok := s.counters[key]
+	if !ok || now.After(c.expires) {
+		return nil
+	}
+	return c
+}
+
+// sweep removes expired counters once a minute.
+func (s *memoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, c := range s.counters {
+		if now.After(c.expires) {
+			delete(s.counters, key)
+		}
+	}
+}
+
+// NewCacheStore returns a store that keeps usage in a shared cache, e.g.
+// Etcd. Counters are updated with compare and swap, so that vulcand
+// instances can share them.
+func NewCacheStore(cache cacheprovider.SharedCache) Store {
+	return &cacheStore{cache: cache}
+}
+
+type cacheStore struct {
+	cache cacheprovider.SharedCache
+}
+
+func (s *cacheStore) Add(ctx context.Context, key string, cost, limit int64, ttl time.Duration) (int64, bool, error) {
+	for i := 0; i < maxSwapAttempts; i++ {
+		old, value, err := s.get(ctx, key)
+		if err != nil {
+			return 0, false, err
+		}
+		if value > limit-cost {
+			return value, false, nil
+		}
+		value += cost
+		ok, err := s.cache.CompareAndSwap(ctx, key, old, []byte(strconv.FormatInt(value, 10)), ttl)
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			return value, true, nil
+		}
+	}
+	return 0, false, errContended
+}
+
+func (s *cacheStore) Get(ctx context.Context, key string) (int64, error) {
+	_, value, err := s.get(ctx, key)
+	return value, err
+}
+
+func (s *cacheStore) Reset(ctx context.Context, key string, ttl time.Duration) error {
+	for i := 0; i < maxSwapAttempts; i++ {
+		old, value, err := s.get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if old == nil || value == 0 {
+			return nil
+		}
+		ok, err := s.cache.CompareAndSwap(ctx, key, old, []byte("0"), ttl)
+		if err != nil || ok {
+			return err
+		}
+	}
+	return errContended
+}
+
+// get returns the raw counter under the key, which is nil if there's no such
+// counter, and its value.
+func (s *cacheStore) get(ctx context.Context, key string) ([]byte, int64, error) {
+	data, err := s.cache.Get(ctx, key)
+	if err == cacheprovider.ErrCacheMiss {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	value, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		// Counters that can't be read are taken as unused and overwritten.
+		return data, 0, nil
+	}
+	return data, value, nil
+}
@@ -98,6 +98,15 @@ func (tb *tokenBucket) update(rate *rate) error {
 	return nil
 }
 
+// status returns the state of the bucket after the last consumption.
+func (tb *tokenBucket) status() RateStatus {
+	reset := time.Duration(tb.burst-tb.availableTokens)*tb.timePerToken - tb.clock.UtcNow().Sub(tb.lastRefresh)
+	if reset < 0 {
+		reset = 0
+	}
+	return RateStatus{Limit: tb.burst, Remaining: tb.availableTokens, Reset: reset}
+}
+
 // timeTillAvailable returns the number of nanoseconds that we need to
 // wait until the specified number of tokens becomes available for consumption.
 func (tb *tokenBucket) timeTillAvailable(tokens int64) time.Duration {
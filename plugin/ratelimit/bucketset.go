@@ -3,6 +3,7 @@ package ratelimit
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"sort"
@@ -10,22 +11,83 @@ import (
 	"github.com/mailgun/timetools"
 )
 
+// bucket is a token bucket kept in the process or in a store.
+type bucket interface {
+	consume(tokens int64) (time.Duration, error)
+	rollback()
+	update(rate *rate) error
+	status() RateStatus
+}
+
+// refiller is implemented by buckets that take tokens from a store. Tokens
+// are taken while the set is not locked, so that requests do not queue up
+// behind the store round trips of each other.
+type refiller interface {
+	// startRefill returns the refill that the bucket needs before it can
+	// consume tokens, or nil if it has enough of them. Requests that get a
+	// refill in flight wait for it instead of asking the store themselves,
+	// owner tells whether the request should run the refill.
+	startRefill(tokens int64) (r *refill, owner bool)
+	// finishRefill keeps the tokens that the refill took.
+	finishRefill(r *refill)
+}
+
+// refill is a batch of tokens being taken from a store.
+type refill struct {
+	bucket refiller
+	// run takes tokens from the store, it is called without the set
+	// locked. done is closed when the bucket keeps the tokens.
+	run  func()
+	done chan struct{}
+
+	taken     int64
+	remaining int64
+	delay     time.Duration
+	err       error
+}
+
+// RateStatus is the state of a token bucket, it tells clients how many
+// requests they can make.
+type RateStatus struct {
+	// Limit is how many tokens the bucket holds.
+	Limit int64
+	// Remaining is how many tokens are left in the bucket.
+	Remaining int64
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
 // TokenBucketSet represents a set of TokenBucket covering different time periods.
 type TokenBucketSet struct {
-	buckets   map[time.Duration]*tokenBucket
+	mutex     sync.Mutex
+	buckets   map[time.Duration]bucket
 	maxPeriod time.Duration
-	clock     timetools.TimeProvider
+	newBucket func(rate *rate) bucket
 }
 
 // NewTokenBucketSet creates a `TokenBucketSet` from the specified `rates`.
 func NewTokenBucketSet(rates *RateSet, clock timetools.TimeProvider) *TokenBucketSet {
+	return newTokenBucketSet(rates, func(rate *rate) bucket {
+		return newTokenBucket(rate, clock)
+	})
+}
+
+// NewSharedTokenBucketSet creates a `TokenBucketSet` from the specified
+// `rates` with buckets kept in the store under the key. Tokens are taken from
+// the store in batches of the specified size.
+func NewSharedTokenBucketSet(rates *RateSet, store BucketStore, key string, batch int64, clock timetools.TimeProvider) *TokenBucketSet {
+	return newTokenBucketSet(rates, func(rate *rate) bucket {
+		return newSharedBucket(store, fmt.Sprintf("%s/%d", key, rate.period), rate, batch, clock)
+	})
+}
+
+func newTokenBucketSet(rates *RateSet, newBucket func(rate *rate) bucket) *TokenBucketSet {
 	tbs := new(TokenBucketSet)
-	tbs.clock = clock
+	tbs.newBucket = newBucket
 	// In the majority of cases we will have only one bucket.
-	tbs.buckets = make(map[time.Duration]*tokenBucket, len(rates.m))
+	tbs.buckets = make(map[time.Duration]bucket, len(rates.m))
 	for _, rate := range rates.m {
-		newBucket := newTokenBucket(rate, clock)
-		tbs.buckets[rate.period] = newBucket
+		tbs.buckets[rate.period] = newBucket(rate)
 		tbs.maxPeriod = maxDuration(tbs.maxPeriod, rate.period)
 	}
 	return tbs
@@ -33,30 +95,94 @@ func NewTokenBucketSet(rates *RateSet, clock timetools.TimeProvider) *TokenBucke
 
 // Update brings the buckets in the set in accordance with the provided `rates`.
 func (tbs *TokenBucketSet) Update(rates *RateSet) {
+	tbs.mutex.Lock()
+	defer tbs.mutex.Unlock()
 	// Update existing buckets and delete those that have no corresponding spec.
-	for _, bucket := range tbs.buckets {
-		if rate, ok := rates.m[bucket.period]; ok {
+	for period, bucket := range tbs.buckets {
+		if rate, ok := rates.m[period]; ok {
 			bucket.update(rate)
 		} else {
-			delete(tbs.buckets, bucket.period)
+			delete(tbs.buckets, period)
 		}
 	}
 	// Add missing buckets.
 	for _, rate := range rates.m {
 		if _, ok := tbs.buckets[rate.period]; !ok {
-			newBucket := newTokenBucket(rate, tbs.clock)
-			tbs.buckets[rate.period] = newBucket
+			tbs.buckets[rate.period] = tbs.newBucket(rate)
 		}
 	}
 	// Identify the maximum period in the set
 	tbs.maxPeriod = 0
-	for _, bucket := range tbs.buckets {
-		tbs.maxPeriod = maxDuration(tbs.maxPeriod, bucket.period)
+	for period := range tbs.buckets {
+		tbs.maxPeriod = maxDuration(tbs.maxPeriod, period)
 	}
 }
 
 // Consume consume tokens
 func (tbs *TokenBucketSet) Consume(tokens int64) (time.Duration, error) {
+	tbs.mutex.Lock()
+	defer tbs.mutex.Unlock()
+	return tbs.refillAndConsume(tokens)
+}
+
+// ConsumeWithStatus consumes tokens and returns the status of the bucket that
+// has the least tokens left afterwards.
+func (tbs *TokenBucketSet) ConsumeWithStatus(tokens int64) (time.Duration, RateStatus, error) {
+	tbs.mutex.Lock()
+	defer tbs.mutex.Unlock()
+	delay, err := tbs.refillAndConsume(tokens)
+	var status RateStatus
+	first := true
+	for _, bucket := range tbs.buckets {
+		s := bucket.status()
+		if first || s.Remaining < status.Remaining || (s.Remaining == status.Remaining && s.Reset > status.Reset) {
+			status, first = s, false
+		}
+	}
+	return delay, status, err
+}
+
+// refillAndConsume makes sure that buckets kept in a store have enough tokens
+// reserved, then consumes tokens. The set is unlocked while tokens are taken
+// from the store, and refills run again if other requests consumed the
+// tokens in the meantime.
+func (tbs *TokenBucketSet) refillAndConsume(tokens int64) (time.Duration, error) {
+	for {
+		r, owner := tbs.startRefill(tokens)
+		if r == nil {
+			return tbs.consume(tokens)
+		}
+		tbs.mutex.Unlock()
+		if owner {
+			r.run()
+		} else {
+			<-r.done
+		}
+		tbs.mutex.Lock()
+		if owner {
+			r.bucket.finishRefill(r)
+		}
+		if r.err != nil {
+			return UndefinedDelay, r.err
+		}
+		if r.delay > 0 {
+			return r.delay, nil
+		}
+	}
+}
+
+func (tbs *TokenBucketSet) startRefill(tokens int64) (*refill, bool) {
+	for _, b := range tbs.buckets {
+		if rb, ok := b.(refiller); ok {
+			if r, owner := rb.startRefill(tokens); r != nil {
+				return r, owner
+			}
+		}
+	}
+	return nil, false
+}
+
+func (tbs *TokenBucketSet) consume(tokens int64) (time.Duration, error) {
 	var maxDelay time.Duration = UndefinedDelay
 	var firstErr error
 	for _, tokenBucket := range tbs.buckets {
@@ -84,6 +210,8 @@ func (tbs *TokenBucketSet) Consume(tokens int64) (time.Duration, error) {
 
 // GetMaxPeriod returns the max period
 func (tbs *TokenBucketSet) GetMaxPeriod() time.Duration {
+	tbs.mutex.Lock()
+	defer tbs.mutex.Unlock()
 	return tbs.maxPeriod
 }
 
@@ -97,8 +225,12 @@ func (tbs *TokenBucketSet) debugState() string {
 	sort.Sort(periods)
 	bucketRepr := make([]string, 0, len(tbs.buckets))
 	for _, period := range periods {
-		bucket := tbs.buckets[time.Duration(period)]
-		bucketRepr = append(bucketRepr, fmt.Sprintf("{%v: %v}", bucket.period, bucket.availableTokens))
+		switch bucket := tbs.buckets[time.Duration(period)].(type) {
+		case *tokenBucket:
+			bucketRepr = append(bucketRepr, fmt.Sprintf("{%v: %v}", bucket.period, bucket.availableTokens))
+		case *sharedBucket:
+			bucketRepr = append(bucketRepr, fmt.Sprintf("{%v: %v}", bucket.rate.Period, bucket.reserved))
+		}
 	}
 	return strings.Join(bucketRepr, ", ")
 }
@@ -3,6 +3,7 @@ package ratelimit
 import (
 	"encoding/json"
 	"fmt"
+	"mime"
 	"net/http"
 	"strings"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"github.com/urfave/cli"
 	"github.com/vulcand/oxy/utils"
 	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
 )
 
 // Spec is an entry point of a plugin and will be called to register this middleware plugin withing vulcand
@@ -21,6 +23,14 @@ func GetSpec() *plugin.MiddlewareSpec {
 		cli.IntFlag{Name: "burst", Value: 1, Usage: "allowed burst"},
 		cli.StringFlag{Name: "variable, var", Value: "client.ip", Usage: "variable to rate against, e.g. client.ip, request.host or request.header.X-Header"},
 		cli.StringFlag{Name: "rateVar", Value: "", Usage: "variable to retrieve rates from, e.g. request.header.X-Rates"},
+		cli.StringFlag{Name: "store", Usage: "where buckets are kept: memory, etcd or redis"},
+		cli.StringFlag{Name: "redisUrl", Usage: "URL of the Redis server, e.g. redis://:password@localhost:6379/0"},
+		cli.IntFlag{Name: "batch", Usage: "how many tokens are taken from the store at once"},
+		cli.DurationFlag{Name: "storeTimeout", Usage: "how long to wait for the store"},
+		cli.BoolFlag{Name: "failOpen", Usage: "let requests through when the store is unreachable"},
+		cli.StringFlag{Name: "rejectBody", Usage: "body of responses to requests that exceed rates"},
+		cli.StringFlag{Name: "rejectContentType", Usage: "content type of the reject body, e.g. application/json"},
+		cli.BoolFlag{Name: "dryRun", Usage: "only log and count requests that exceed rates, let them through"},
 	}
 	return &plugin.MiddlewareSpec{
 		Type:      "ratelimit",
@@ -48,6 +58,34 @@ func FromOther(o RateLimit) (plugin.Middleware, error) {
 	if err != nil {
 		return nil, err
 	}
+	switch o.Store {
+	case "", StoreMemory, StoreEtcd:
+		if o.RedisURL != "" {
+			return nil, fmt.Errorf("redis URL is only used by the redis store")
+		}
+	case StoreRedis:
+		if _, err := newRedisCache(o.RedisURL); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported store %q, expected %s, %s or %s", o.Store, StoreMemory, StoreEtcd, StoreRedis)
+	}
+	if o.Batch < 0 {
+		return nil, fmt.Errorf("batch should be >= 0, got %d", o.Batch)
+	}
+	if o.StoreTimeout == "" {
+		o.storeTimeout = DefaultStoreTimeout
+	} else if o.storeTimeout, err = time.ParseDuration(o.StoreTimeout); err != nil || o.storeTimeout <= 0 {
+		return nil, fmt.Errorf("store timeout should be a duration > 0, got %q", o.StoreTimeout)
+	}
+	if o.RejectContentType != "" {
+		if o.RejectBody == "" {
+			return nil, fmt.Errorf("reject content type is only used with a reject body")
+		}
+		if _, _, err := mime.ParseMediaType(o.RejectContentType); err != nil {
+			return nil, fmt.Errorf("bad reject content type %q: %v", o.RejectContentType, err)
+		}
+	}
 
 	o.extract = extract
 	o.extractRates = extractRates
@@ -56,13 +94,25 @@ func FromOther(o RateLimit) (plugin.Middleware, error) {
 
 // FromCli constructs a middleware instance from the command line parameters.
 func FromCli(c *cli.Context) (plugin.Middleware, error) {
-	return FromOther(
-		RateLimit{
-			PeriodSeconds: int64(c.Int("period")),
-			Requests:      int64(c.Int("requests")),
-			Burst:         int64(c.Int("burst")),
-			Variable:      c.String("var"),
-			RateVar:       c.String("rateVar")})
+	r := RateLimit{
+		PeriodSeconds: int64(c.Int("period")),
+		Requests:      int64(c.Int("requests")),
+		Burst:         int64(c.Int("burst")),
+		Variable:      c.String("var"),
+		RateVar:       c.String("rateVar"),
+		Store:         c.String("store"),
+		RedisURL:      c.String("redisUrl"),
+		Batch:         int64(c.Int("batch")),
+		FailOpen:      c.Bool("failOpen"),
+
+		RejectBody:        c.String("rejectBody"),
+		RejectContentType: c.String("rejectContentType"),
+		DryRun:            c.Bool("dryRun"),
+	}
+	if d := c.Duration("storeTimeout"); d != 0 {
+		r.StoreTimeout = d.String()
+	}
+	return FromOther(r)
 }
 
 // Rate controls how many requests per period of time is allowed for a location.
@@ -79,25 +129,107 @@ type RateLimit struct {
 	// RateVar defines the source of rates configuration that should be used to
 	// process a particular request. E.g. 'request.header.X-Rates'
 	RateVar string
+	// Store defines where buckets are kept: 'memory' (the default) in each
+	// vulcand process, 'etcd' in the cache provider of vulcand or 'redis' in
+	// a Redis server, so that rates apply to all vulcand instances.
+	Store string
+	// RedisURL is the URL of the Redis server, e.g. 'redis://:password@localhost:6379/0'
+	RedisURL string `json:",omitempty"`
+	// Batch is how many tokens are taken from the store at once, tokens that
+	// are not consumed right away are kept for the next requests.
+	Batch int64 `json:",omitempty"`
+	// StoreTimeout is how long to wait for the store, e.g. '200ms'
+	StoreTimeout string `json:",omitempty"`
+	// FailOpen lets requests through when the store is unreachable, they are
+	// rejected otherwise.
+	FailOpen bool `json:",omitempty"`
+	// RejectBody is the body of responses to requests that exceed rates, it
+	// defaults to a message with the time to wait.
+	RejectBody string `json:",omitempty"`
+	// RejectContentType is the content type of RejectBody, e.g. 'application/json'
+	RejectContentType string `json:",omitempty"`
+	// DryRun lets requests that exceed rates through, they are only logged
+	// and counted.
+	DryRun bool `json:",omitempty"`
 
 	extract      utils.SourceExtractor
 	extractRates RateExtractor
+	storeTimeout time.Duration
 	clock        timetools.TimeProvider
 }
 
+// Stores of token buckets.
+const (
+	StoreMemory = "memory"
+	StoreEtcd   = "etcd"
+	StoreRedis  = "redis"
+)
+
 // Returns vulcan library compatible middleware
 func (r *RateLimit) NewHandler(next http.Handler) (http.Handler, error) {
+	return r.NewHandlerWithEnv(next, plugin.Env{})
+}
+
+// NewHandlerWithEnv returns a handler that keeps buckets in the store, buckets
+// of the same middleware are shared by all vulcand instances.
+func (r *RateLimit) NewHandlerWithEnv(next http.Handler, env plugin.Env) (http.Handler, error) {
 	defaultRates := NewRateSet()
 	if err := defaultRates.Add(time.Duration(r.PeriodSeconds)*time.Second, r.Requests, r.Burst); err != nil {
 		return nil, err
 	}
-	return New(next, r.extract, defaultRates,
-		ExtractRates(r.extractRates), Clock(r.clock))
+	clock := r.clock
+	if clock == nil {
+		clock = &timetools.RealTime{}
+	}
+	counter := "rejected"
+	if r.DryRun {
+		counter = "dry_run_rejected"
+	}
+	opts := []TokenLimiterOption{
+		ExtractRates(r.extractRates),
+		Clock(clock),
+		FailOpen(r.FailOpen),
+		DryRun(r.DryRun),
+		Rejected(func(*http.Request) { env.IncCounter(counter, 1) }),
+	}
+	if r.RejectBody != "" {
+		opts = append(opts, ErrorHandler(&RateErrHandler{Body: r.RejectBody, ContentType: r.RejectContentType}))
+	}
+	if r.Batch > 0 {
+		opts = append(opts, Batch(r.Batch))
+	}
+	var cache cacheprovider.SharedCache
+	switch r.Store {
+	case StoreEtcd:
+		p, ok := env.CacheProvider.(cacheprovider.SharedCacheProvider)
+		if !ok {
+			return nil, fmt.Errorf("the cache provider of vulcand does not keep shared data, use it with Etcd")
+		}
+		cache = p.GetSharedCache()
+	case StoreRedis:
+		c, err := redisCacheFor(r.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		cache = c
+	}
+	if cache != nil {
+		prefix := fmt.Sprintf("ratelimit/%s/%s/", env.FrontendId, env.MiddlewareId)
+		opts = append(opts, Store(NewCacheStore(cache, r.storeTimeout, clock), prefix))
+	}
+	return New(next, r.extract, defaultRates, opts...)
 }
 
 func (rl *RateLimit) String() string {
-	return fmt.Sprintf("reqs/%s=%d, burst=%d, var=%s, rateVar=%s",
+	out := fmt.Sprintf("reqs/%s=%d, burst=%d, var=%s, rateVar=%s",
 		time.Duration(rl.PeriodSeconds)*time.Second, rl.Requests, rl.Burst, rl.Variable, rl.RateVar)
+	if rl.Store != "" && rl.Store != StoreMemory {
+		out += fmt.Sprintf(", store=%s, batch=%d, failOpen=%t", rl.Store, rl.Batch, rl.FailOpen)
+	}
+	if rl.DryRun {
+		out += ", dryRun"
+	}
+	return out
 }
 
 func makeRateExtractor(variable string) (RateExtractor, error) {
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/urfave/cli"
+	"github.com/mailgun/metrics"
 	"github.com/mailgun/timetools"
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/vulcand/plugin"
@@ -148,6 +149,137 @@ func (s *RateLimitSuite) TestFromCli(c *C) {
 	c.Assert(executed, Equals, true)
 }
 
+func (s *RateLimitSuite) TestFromOtherBadStore(c *C) {
+	tcs := []RateLimit{
+		{Store: "memcached"},
+		{Store: StoreRedis},
+		{Store: StoreRedis, RedisURL: "localhost:6379"},
+		{Store: StoreEtcd, RedisURL: "redis://localhost"},
+		{Store: StoreEtcd, Batch: -1},
+		{Store: StoreEtcd, StoreTimeout: "soon"},
+		{Store: StoreEtcd, StoreTimeout: "0s"},
+	}
+	for _, tc := range tcs {
+		tc.PeriodSeconds, tc.Requests, tc.Burst, tc.Variable = 1, 1, 1, "client.ip"
+		_, err := FromOther(tc)
+		c.Assert(err, NotNil, Commentf("%#v", tc))
+	}
+}
+
+func (s *RateLimitSuite) TestFromCliStore(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	app.Flags = GetSpec().CliFlags
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		rl := out.(*RateLimit)
+		c.Assert(rl.Store, Equals, StoreRedis)
+		c.Assert(rl.RedisURL, Equals, "redis://localhost:6379/1")
+		c.Assert(rl.Batch, Equals, int64(10))
+		c.Assert(rl.StoreTimeout, Equals, "200ms")
+		c.Assert(rl.FailOpen, Equals, true)
+		c.Assert(fmt.Sprint(rl), Equals, "reqs/4s=10, burst=3, var=client.ip, rateVar=, store=redis, batch=10, failOpen=true")
+		return nil
+	}
+	app.Run([]string{"test", "--var=client.ip", "--requests=10", "--burst=3", "--period=4",
+		"--store=redis", "--redisUrl=redis://localhost:6379/1", "--batch=10", "--storeTimeout=200ms", "--failOpen"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *RateLimitSuite) TestFromOtherBadReject(c *C) {
+	tcs := []RateLimit{
+		{RejectContentType: "application/json"},
+		{RejectBody: "{}", RejectContentType: "application/json; charset"},
+	}
+	for _, tc := range tcs {
+		tc.PeriodSeconds, tc.Requests, tc.Burst, tc.Variable = 1, 1, 1, "client.ip"
+		_, err := FromOther(tc)
+		c.Assert(err, NotNil, Commentf("%#v", tc))
+	}
+}
+
+func (s *RateLimitSuite) TestFromCliReject(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	app.Flags = GetSpec().CliFlags
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		rl := out.(*RateLimit)
+		c.Assert(rl.RejectBody, Equals, `{"error":"slow down"}`)
+		c.Assert(rl.RejectContentType, Equals, "application/json")
+		c.Assert(rl.DryRun, Equals, true)
+		c.Assert(fmt.Sprint(rl), Equals, "reqs/4s=10, burst=3, var=client.ip, rateVar=, dryRun")
+		return nil
+	}
+	app.Run([]string{"test", "--var=client.ip", "--requests=10", "--burst=3", "--period=4",
+		`--rejectBody={"error":"slow down"}`, "--rejectContentType=application/json", "--dryRun"})
+	c.Assert(executed, Equals, true)
+}
+
+// Rejected requests are counted in metrics of the middleware.
+func (s *RateLimitSuite) TestRejectedCounter(c *C) {
+	for _, dryRun := range []bool{false, true} {
+		rl, err := FromOther(RateLimit{
+			PeriodSeconds:     1,
+			Requests:          1,
+			Burst:             1,
+			Variable:          "request.header.Source",
+			RejectBody:        "slow down",
+			RejectContentType: "text/plain",
+			DryRun:            dryRun,
+			clock:             s.clock,
+		})
+		c.Assert(err, IsNil)
+		client := &countingClient{Client: metrics.NewNop()}
+		h, err := rl.(plugin.EnvMiddleware).NewHandlerWithEnv(ok, plugin.Env{MetricsClient: client, FrontendId: "f1", MiddlewareId: "r1"})
+		c.Assert(err, IsNil)
+
+		get(h, "s1")
+		re := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("Source", "s1")
+		h.ServeHTTP(re, req)
+		if dryRun {
+			c.Assert(re.Code, Equals, http.StatusOK)
+			c.Assert(client.counters, DeepEquals, map[string]int64{"frontend.f1.middleware.r1.dry_run_rejected": 1})
+		} else {
+			c.Assert(re.Code, Equals, http.StatusTooManyRequests)
+			c.Assert(re.Body.String(), Equals, "slow down")
+			c.Assert(client.counters, DeepEquals, map[string]int64{"frontend.f1.middleware.r1.rejected": 1})
+		}
+	}
+}
+
+// countingClient counts metrics instead of sending them.
+type countingClient struct {
+	metrics.Client
+	counters map[string]int64
+}
+
+func (m *countingClient) Inc(stat interface{}, value int64, rate float32) error {
+	if m.counters == nil {
+		m.counters = make(map[string]int64)
+	}
+	m.counters[fmt.Sprint(stat)] += value
+	return nil
+}
+
+// The etcd store needs a cache provider that keeps shared data.
+func (s *RateLimitSuite) TestEtcdStoreWithoutProvider(c *C) {
+	rl, err := FromOther(RateLimit{PeriodSeconds: 1, Requests: 1, Burst: 1, Variable: "client.ip", Store: StoreEtcd})
+	c.Assert(err, IsNil)
+	_, err = rl.NewHandler(nil)
+	c.Assert(err, NotNil)
+}
+
 // Middleware instance created by the factory is using rates configuration
 // from the respective request header.
 func (s *RateLimitSuite) TestRequestProcessing(c *C) {
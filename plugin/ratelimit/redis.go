@@ -0,0 +1,257 @@
+package ratelimit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
+)
+
+// redisPoolSize is how many idle connections are kept to each Redis server.
+const redisPoolSize = 16
+
+var (
+	redisMutex  sync.Mutex
+	redisCaches = make(map[string]*redisCache)
+)
+
+// redisCacheFor returns the cache of the Redis server at the URL, e.g.
+// redis://:password@localhost:6379/0. Middlewares that use the same server
+// share connections.
+func redisCacheFor(rawURL string) (*redisCache, error) {
+	redisMutex.Lock()
+	defer redisMutex.Unlock()
+	if c, ok := redisCaches[rawURL]; ok {
+		return c, nil
+	}
+	c, err := newRedisCache(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	redisCaches[rawURL] = c
+	return c, nil
+}
+
+// redisCache is a shared cache kept in Redis, or in a server that speaks its
+// protocol. Values are swapped in optimistic transactions.
+type redisCache struct {
+	addr     string
+	password string
+	db       int
+	pool     chan *redisConn
+}
+
+func newRedisCache(rawURL string) (*redisCache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("redis URL should be in form redis://[:password@]host:port[/db], got %q", rawURL)
+	}
+	c := &redisCache{addr: u.Host, pool: make(chan *redisConn, redisPoolSize)}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		c.addr = net.JoinHostPort(u.Host, "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis database should be a number, got %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Get returns data stored under the key.
+// If there's no such key, or the data has expired, Get returns ErrCacheMiss.
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := c.do(ctx, func(conn *redisConn) error {
+		reply, err := conn.call("GET", key)
+		if err != nil {
+			return err
+		}
+		data, _ = reply.([]byte)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, cacheprovider.ErrCacheMiss
+	}
+	return data, nil
+}
+
+// CompareAndSwap stores the data under the key for the ttl if the key holds
+// old data, or if there's no such key and old is nil.
+func (c *redisCache) CompareAndSwap(ctx context.Context, key string, old, data []byte, ttl time.Duration) (bool, error) {
+	swapped := false
+	err := c.do(ctx, func(conn *redisConn) error {
+		if _, err := conn.call("WATCH", key); err != nil {
+			return err
+		}
+		reply, err := conn.call("GET", key)
+		if err != nil {
+			return err
+		}
+		current, _ := reply.([]byte)
+		if (current == nil) != (old == nil) || !bytes.Equal(current, old) {
+			_, err := conn.call("UNWATCH")
+			return err
+		}
+		ms := int64(ttl / time.Millisecond)
+		if ms < 1 {
+			ms = 1
+		}
+		if _, err := conn.call("MULTI"); err != nil {
+			return err
+		}
+		if _, err := conn.call("SET", key, string(data), "PX", strconv.FormatInt(ms, 10)); err != nil {
+			return err
+		}
+		// EXEC replies with nil if the key has changed since WATCH.
+		reply, err = conn.call("EXEC")
+		if err != nil {
+			return err
+		}
+		swapped = reply != nil
+		return nil
+	})
+	return swapped, err
+}
+
+// do runs f on a pooled connection. Connections are closed when f fails,
+// since they may be in the middle of a reply or a transaction.
+func (c *redisCache) do(ctx context.Context, f func(conn *redisConn) error) error {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return err
+	}
+	// Connections without a deadline in the context have none.
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if err := f(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	c.put(conn)
+	return nil
+}
+
+func (c *redisCache) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if c.password != "" {
+		if _, err := conn.call("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.call("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisCache) put(conn *redisConn) {
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// call sends the command and reads the reply, which is a string, an int64,
+// []byte, []interface{} or nil.
+func (c *redisConn) call(args ...string) (interface{}, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			// Errors of queued commands are returned as elements.
+			if out[i], err = readReply(r); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				out[i] = err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("malformed redis reply %q", line)
+}
@@ -0,0 +1,292 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
+	. "gopkg.in/check.v1"
+)
+
+type RedisSuite struct {
+	redis *fakeRedis
+	clock *timetools.FreezedTime
+	ctx   context.Context
+}
+
+var _ = Suite(&RedisSuite{})
+
+func (s *RedisSuite) SetUpTest(c *C) {
+	s.redis = newFakeRedis(c, "secret")
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	s.ctx = context.Background()
+}
+
+func (s *RedisSuite) TearDownTest(c *C) {
+	s.redis.Close()
+}
+
+func (s *RedisSuite) TestCompareAndSwap(c *C) {
+	rc, err := newRedisCache(s.redis.URL())
+	c.Assert(err, IsNil)
+
+	_, err = rc.Get(s.ctx, "k")
+	c.Assert(err, Equals, cacheprovider.ErrCacheMiss)
+
+	ok, err := rc.CompareAndSwap(s.ctx, "k", nil, []byte("1"), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(s.redis.ttl("k"), Equals, "1000")
+
+	ok, err = rc.CompareAndSwap(s.ctx, "k", nil, []byte("2"), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+
+	ok, err = rc.CompareAndSwap(s.ctx, "k", []byte("3"), []byte("2"), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+
+	ok, err = rc.CompareAndSwap(s.ctx, "k", []byte("1"), []byte("2"), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+
+	data, err := rc.Get(s.ctx, "k")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "2")
+}
+
+// Keys changed by others between the read and the write are not swapped.
+func (s *RedisSuite) TestCompareAndSwapConflict(c *C) {
+	rc, err := newRedisCache(s.redis.URL())
+	c.Assert(err, IsNil)
+	ok, err := rc.CompareAndSwap(s.ctx, "k", nil, []byte("1"), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+
+	s.redis.beforeExec = func() { s.redis.set("k", "5") }
+	ok, err = rc.CompareAndSwap(s.ctx, "k", []byte("1"), []byte("2"), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+	c.Assert(s.redis.get("k"), Equals, "5")
+}
+
+func (s *RedisSuite) TestBadPassword(c *C) {
+	rc, err := newRedisCache(strings.Replace(s.redis.URL(), "secret", "wrong", 1))
+	c.Assert(err, IsNil)
+	_, err = rc.Get(s.ctx, "k")
+	c.Assert(err, NotNil)
+}
+
+func (s *RedisSuite) TestBadURL(c *C) {
+	for _, u := range []string{"", "localhost:6379", "http://localhost", "redis://", "redis://localhost/db"} {
+		_, err := newRedisCache(u)
+		c.Assert(err, NotNil, Commentf("%q", u))
+	}
+	rc, err := newRedisCache("redis://localhost/2")
+	c.Assert(err, IsNil)
+	c.Assert(rc.addr, Equals, "localhost:6379")
+	c.Assert(rc.db, Equals, 2)
+}
+
+func (s *RedisSuite) TestRateLimit(c *C) {
+	var handlers []http.Handler
+	for i := 0; i < 2; i++ {
+		rl, err := FromOther(RateLimit{
+			PeriodSeconds: 1,
+			Requests:      2,
+			Burst:         2,
+			Variable:      "request.header.Source",
+			Store:         StoreRedis,
+			RedisURL:      s.redis.URL(),
+			clock:         s.clock,
+		})
+		c.Assert(err, IsNil)
+		h, err := rl.(plugin.EnvMiddleware).NewHandlerWithEnv(ok, plugin.Env{FrontendId: "f1", MiddlewareId: "r1"})
+		c.Assert(err, IsNil)
+		handlers = append(handlers, h)
+	}
+	c.Assert(get(handlers[0], "s1"), Equals, http.StatusOK)
+	c.Assert(get(handlers[1], "s1"), Equals, http.StatusOK)
+	c.Assert(get(handlers[0], "s1"), Equals, http.StatusTooManyRequests)
+
+	s.clock.Sleep(time.Second)
+	c.Assert(get(handlers[1], "s1"), Equals, http.StatusOK)
+}
+
+func (s *RedisSuite) TestUnreachable(c *C) {
+	s.redis.Close()
+	for _, tc := range []struct {
+		failOpen bool
+		code     int
+	}{
+		{false, http.StatusServiceUnavailable},
+		{true, http.StatusOK},
+	} {
+		rl, err := FromOther(RateLimit{
+			PeriodSeconds: 1,
+			Requests:      2,
+			Burst:         2,
+			Variable:      "request.header.Source",
+			Store:         StoreRedis,
+			RedisURL:      s.redis.URL(),
+			StoreTimeout:  "100ms",
+			FailOpen:      tc.failOpen,
+			clock:         s.clock,
+		})
+		c.Assert(err, IsNil)
+		h, err := rl.NewHandler(ok)
+		c.Assert(err, IsNil)
+		c.Assert(get(h, "s1"), Equals, tc.code)
+	}
+}
+
+// fakeRedis speaks enough of the Redis protocol for the rate limiter.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mutex      sync.Mutex
+	data       map[string]string
+	ttls       map[string]string
+	versions   map[string]int
+	beforeExec func()
+}
+
+func newFakeRedis(c *C, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	f := &fakeRedis{
+		listener: l,
+		password: password,
+		data:     make(map[string]string),
+		ttls:     make(map[string]string),
+		versions: make(map[string]int),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) URL() string {
+	return fmt.Sprintf("redis://:%s@%s/1", f.password, f.listener.Addr())
+}
+
+func (f *fakeRedis) Close() {
+	f.listener.Close()
+}
+
+func (f *fakeRedis) get(key string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.data[key]
+}
+
+func (f *fakeRedis) ttl(key string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.ttls[key]
+}
+
+func (f *fakeRedis) set(key, value string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.data[key] = value
+	f.versions[key]++
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := false
+	var watched map[string]int
+	var queue [][]string
+	multi := false
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "AUTH":
+			if len(args) != 2 || args[1] != f.password {
+				fmt.Fprintf(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authenticated = true
+			fmt.Fprintf(conn, "+OK\r\n")
+		case !authenticated:
+			fmt.Fprintf(conn, "-NOAUTH Authentication required.\r\n")
+		case cmd == "SELECT":
+			fmt.Fprintf(conn, "+OK\r\n")
+		case cmd == "WATCH":
+			f.mutex.Lock()
+			watched = map[string]int{args[1]: f.versions[args[1]]}
+			f.mutex.Unlock()
+			fmt.Fprintf(conn, "+OK\r\n")
+		case cmd == "UNWATCH":
+			watched = nil
+			fmt.Fprintf(conn, "+OK\r\n")
+		case cmd == "MULTI":
+			multi = true
+			fmt.Fprintf(conn, "+OK\r\n")
+		case cmd == "EXEC":
+			if f.beforeExec != nil {
+				f.beforeExec()
+			}
+			f.mutex.Lock()
+			changed := false
+			for key, version := range watched {
+				changed = changed || f.versions[key] != version
+			}
+			if changed {
+				fmt.Fprintf(conn, "*-1\r\n")
+			} else {
+				fmt.Fprintf(conn, "*%d\r\n", len(queue))
+				for _, q := range queue {
+					f.data[q[1]] = q[2]
+					f.ttls[q[1]] = q[4]
+					f.versions[q[1]]++
+					fmt.Fprintf(conn, "+OK\r\n")
+				}
+			}
+			f.mutex.Unlock()
+			watched, queue, multi = nil, nil, false
+		case cmd == "SET" && multi:
+			queue = append(queue, args)
+			fmt.Fprintf(conn, "+QUEUED\r\n")
+		case cmd == "GET":
+			f.mutex.Lock()
+			value, ok := f.data[args[1]]
+			f.mutex.Unlock()
+			if !ok {
+				fmt.Fprintf(conn, "$-1\r\n")
+			} else {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
+)
+
+// Rate is the rate of a token bucket kept in a store.
+type Rate struct {
+	Period  time.Duration
+	Average int64
+	Burst   int64
+}
+
+// BucketStore keeps token buckets shared by vulcand instances, so that rates
+// apply to the whole cluster rather than to each instance.
+type BucketStore interface {
+	// Take takes at least min and at most max tokens from the bucket under
+	// the key and returns how many were taken. If there are less than min
+	// tokens, nothing is taken and Take returns how long to wait until there
+	// are enough. Take also returns how many tokens are left in the bucket.
+	Take(key string, rate Rate, min, max int64) (taken, remaining int64, delay time.Duration, err error)
+}
+
+// StoreError is returned when the bucket store fails, e.g. when the server
+// that keeps buckets is unreachable.
+type StoreError struct {
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("rate limit store failed: %v", e.Err)
+}
+
+const (
+	// DefaultStoreTimeout is how long to wait for the store by default.
+	DefaultStoreTimeout = 500 * time.Millisecond
+	// storeRetryAfter is how long the store is not used after it fails, so
+	// that requests do not wait for a store that is down.
+	storeRetryAfter = time.Second
+	// maxSwapAttempts is how many times Take tries to update a bucket that
+	// other instances update at the same time.
+	maxSwapAttempts = 5
+)
+
+var errContended = errors.New("bucket is updated by other instances too often to take tokens")
+
+// NewCacheStore returns a store that keeps buckets in a shared cache, e.g.
+// Etcd or Redis.
+//
+// Buckets are kept as the theoretical arrival time of the next token (GCRA),
+// a single timestamp that instances update with compare and swap.
+func NewCacheStore(cache cacheprovider.SharedCache, timeout time.Duration, clock timetools.TimeProvider) BucketStore {
+	return &cacheStore{cache: cache, timeout: timeout, clock: clock}
+}
+
+type cacheStore struct {
+	cache   cacheprovider.SharedCache
+	timeout time.Duration
+	clock   timetools.TimeProvider
+
+	mutex     sync.Mutex
+	failed    time.Time
+	lastError error
+}
+
+func (s *cacheStore) Take(key string, rate Rate, min, max int64) (int64, int64, time.Duration, error) {
+	if err := s.down(); err != nil {
+		return 0, 0, UndefinedDelay, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	taken, remaining, delay, err := s.take(ctx, key, rate, min, max)
+	if err != nil {
+		// The store works when buckets are only contended.
+		if err != errContended {
+			s.fail(err)
+		}
+		return 0, 0, UndefinedDelay, &StoreError{Err: err}
+	}
+	return taken, remaining, delay, nil
+}
+
+func (s *cacheStore) take(ctx context.Context, key string, rate Rate, min, max int64) (int64, int64, time.Duration, error) {
+	interval := int64(rate.Period) / rate.Average
+	tolerance := interval * rate.Burst
+	for i := 0; i < maxSwapAttempts; i++ {
+		now := s.clock.UtcNow().UnixNano()
+		old, err := s.cache.Get(ctx, key)
+		if err == cacheprovider.ErrCacheMiss {
+			old = nil
+		} else if err != nil {
+			return 0, 0, UndefinedDelay, err
+		}
+		tat := now
+		if old != nil {
+			if t, err := strconv.ParseInt(string(old), 10, 64); err == nil && t > now {
+				tat = t
+			}
+		}
+		available := (now + tolerance - tat) / interval
+		if available < min {
+			return 0, available, time.Duration(tat + min*interval - now - tolerance), nil
+		}
+		taken := available
+		if taken > max {
+			taken = max
+		}
+		tat += taken * interval
+		// The bucket is full again once the arrival time has passed, there
+		// is no need to keep it longer.
+		ok, err := s.cache.CompareAndSwap(ctx, key, old, []byte(strconv.FormatInt(tat, 10)), time.Duration(tat-now))
+		if err != nil {
+			return 0, 0, UndefinedDelay, err
+		}
+		if ok {
+			return taken, available - taken, 0, nil
+		}
+	}
+	return 0, 0, UndefinedDelay, errContended
+}
+
+func (s *cacheStore) down() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.lastError != nil && s.clock.UtcNow().Sub(s.failed) < storeRetryAfter {
+		return &StoreError{Err: s.lastError}
+	}
+	return nil
+}
+
+func (s *cacheStore) fail(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failed, s.lastError = s.clock.UtcNow(), err
+}
+
+// sharedBucket is a token bucket kept in a store. Tokens are taken from the
+// store in batches and kept locally until they are consumed, so that most
+// requests do not wait for the store.
+type sharedBucket struct {
+	store BucketStore
+	key   string
+	rate  Rate
+	batch int64
+	clock timetools.TimeProvider
+
+	// Tokens taken from the store, they are kept for a period of the rate
+	// at most so that an instance does not save up for bursts.
+	reserved     int64
+	reserveUntil time.Time
+	lastConsumed int64
+
+	// Tokens left in the store when it was last used.
+	storeRemaining int64
+	storeChecked   time.Time
+
+	// refilling is the refill in flight, if any.
+	refilling *refill
+}
+
+func newSharedBucket(store BucketStore, key string, r *rate, batch int64, clock timetools.TimeProvider) *sharedBucket {
+	return &sharedBucket{
+		store: store,
+		key:   key,
+		rate:  Rate{Period: r.period, Average: r.average, Burst: r.burst},
+		batch: batch,
+		clock: clock,
+	}
+}
+
+func (b *sharedBucket) startRefill(tokens int64) (*refill, bool) {
+	if tokens > b.rate.Burst {
+		// consume rejects the request.
+		return nil, false
+	}
+	if !b.clock.UtcNow().Before(b.reserveUntil) {
+		b.reserved = 0
+	}
+	if b.reserved >= tokens {
+		return nil, false
+	}
+	if b.refilling != nil {
+		return b.refilling, false
+	}
+	need := tokens - b.reserved
+	max := b.batch
+	if max < need {
+		max = need
+	}
+	store, key, rate := b.store, b.key, b.rate
+	r := &refill{bucket: b, done: make(chan struct{})}
+	r.run = func() {
+		r.taken, r.remaining, r.delay, r.err = store.Take(key, rate, need, max)
+	}
+	b.refilling = r
+	return r, true
+}
+
+func (b *sharedBucket) finishRefill(r *refill) {
+	defer close(r.done)
+	b.refilling = nil
+	if r.err != nil {
+		return
+	}
+	now := b.clock.UtcNow()
+	b.storeRemaining, b.storeChecked = r.remaining, now
+	if r.delay > 0 {
+		return
+	}
+	if !now.Before(b.reserveUntil) {
+		b.reserved = 0
+	}
+	if b.reserved == 0 {
+		b.reserveUntil = now.Add(b.rate.Period)
+	}
+	b.reserved += r.taken
+}
+
+// consume takes tokens from the local reserve, that startRefill filled up.
+func (b *sharedBucket) consume(tokens int64) (time.Duration, error) {
+	b.lastConsumed = 0
+	if tokens > b.rate.Burst {
+		return UndefinedDelay, fmt.Errorf("Requested tokens larger than max tokens")
+	}
+	if b.reserved < tokens {
+		return UndefinedDelay, fmt.Errorf("%d tokens are not reserved", tokens)
+	}
+	b.reserved -= tokens
+	b.lastConsumed = tokens
+	return 0, nil
+}
+
+// rollback returns consumed tokens to the local reserve.
+func (b *sharedBucket) rollback() {
+	b.reserved += b.lastConsumed
+	b.lastConsumed = 0
+}
+
+// status estimates the state of the bucket in the store from the tokens that
+// were left in it when it was last used and the tokens reserved locally.
+func (b *sharedBucket) status() RateStatus {
+	interval := b.rate.Period / time.Duration(b.rate.Average)
+	now := b.clock.UtcNow()
+	remaining := b.rate.Burst
+	if !b.storeChecked.IsZero() {
+		remaining = b.storeRemaining + int64(now.Sub(b.storeChecked)/interval)
+	}
+	if now.Before(b.reserveUntil) {
+		remaining += b.reserved
+	}
+	if remaining > b.rate.Burst {
+		remaining = b.rate.Burst
+	}
+	return RateStatus{
+		Limit:     b.rate.Burst,
+		Remaining: remaining,
+		Reset:     time.Duration(b.rate.Burst-remaining) * interval,
+	}
+}
+
+func (b *sharedBucket) update(r *rate) error {
+	if r.period != b.rate.Period {
+		return fmt.Errorf("Period mismatch: %v != %v", b.rate.Period, r.period)
+	}
+	b.rate.Average, b.rate.Burst = r.average, r.burst
+	return nil
+}
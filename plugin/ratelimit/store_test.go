@@ -0,0 +1,320 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
+	. "gopkg.in/check.v1"
+)
+
+type StoreSuite struct {
+	clock *timetools.FreezedTime
+	cache *memSharedCache
+}
+
+var _ = Suite(&StoreSuite{})
+
+func (s *StoreSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	s.cache = &memSharedCache{data: make(map[string][]byte)}
+}
+
+func (s *StoreSuite) TestTake(c *C) {
+	store := NewCacheStore(s.cache, time.Second, s.clock)
+	rate := Rate{Period: time.Second, Average: 10, Burst: 5}
+
+	// A new bucket is full
+	taken, _, delay, err := store.Take("k", rate, 1, 3)
+	c.Assert(err, IsNil)
+	c.Assert(taken, Equals, int64(3))
+	c.Assert(delay, Equals, time.Duration(0))
+
+	// Less than max tokens are taken when there are not enough of them
+	taken, _, _, err = store.Take("k", rate, 1, 3)
+	c.Assert(err, IsNil)
+	c.Assert(taken, Equals, int64(2))
+
+	// Nothing is taken when there are less than min tokens
+	taken, _, delay, err = store.Take("k", rate, 2, 2)
+	c.Assert(err, IsNil)
+	c.Assert(taken, Equals, int64(0))
+	c.Assert(delay, Equals, 200*time.Millisecond)
+
+	// Tokens come back with time, up to the burst
+	s.clock.Sleep(200 * time.Millisecond)
+	taken, _, _, err = store.Take("k", rate, 2, 2)
+	c.Assert(err, IsNil)
+	c.Assert(taken, Equals, int64(2))
+
+	s.clock.Sleep(time.Hour)
+	taken, _, _, err = store.Take("k", rate, 1, 100)
+	c.Assert(err, IsNil)
+	c.Assert(taken, Equals, int64(5))
+}
+
+// Instances that share a store share rates.
+func (s *StoreSuite) TestShared(c *C) {
+	store := NewCacheStore(s.cache, time.Second, s.clock)
+	a := s.newLimiter(c, Store(store, "fe/m/"))
+	b := s.newLimiter(c, Store(store, "fe/m/"))
+
+	c.Assert(get(a, "s1"), Equals, http.StatusOK)
+	c.Assert(get(b, "s1"), Equals, http.StatusOK)
+	c.Assert(get(a, "s1"), Equals, http.StatusTooManyRequests)
+	c.Assert(get(b, "s1"), Equals, http.StatusTooManyRequests)
+
+	// Sources have buckets of their own
+	c.Assert(get(b, "s2"), Equals, http.StatusOK)
+
+	s.clock.Sleep(time.Second)
+	c.Assert(get(b, "s1"), Equals, http.StatusOK)
+	c.Assert(get(b, "s1"), Equals, http.StatusOK)
+	c.Assert(get(a, "s1"), Equals, http.StatusTooManyRequests)
+}
+
+// Tokens are taken in batches, so that most requests do not wait for the store.
+func (s *StoreSuite) TestBatch(c *C) {
+	store := NewCacheStore(s.cache, time.Second, s.clock)
+	rates := NewRateSet()
+	rates.Add(time.Second, 10, 10)
+	l, err := New(ok, headerLimit, rates, Clock(s.clock), Store(store, "fe/m/"), Batch(4))
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 10; i++ {
+		c.Assert(get(l, "s1"), Equals, http.StatusOK, Commentf("request %d", i))
+	}
+	c.Assert(get(l, "s1"), Equals, http.StatusTooManyRequests)
+	c.Assert(s.cache.swaps, Equals, 3)
+}
+
+// Tokens of rates that are not exceeded are kept for the next requests.
+func (s *StoreSuite) TestRollback(c *C) {
+	store := NewCacheStore(s.cache, time.Second, s.clock)
+	rates := NewRateSet()
+	rates.Add(time.Second, 10, 10)
+	rates.Add(time.Minute, 2, 2)
+	tbs := NewSharedTokenBucketSet(rates, store, "k", 5, s.clock)
+
+	delay, err := tbs.Consume(1)
+	c.Assert(err, IsNil)
+	c.Assert(delay, Equals, time.Duration(0))
+	c.Assert(tbs.debugState(), Equals, "{1s: 4}, {1m0s: 1}")
+
+	delay, err = tbs.Consume(2)
+	c.Assert(err, IsNil)
+	c.Assert(delay > 0, Equals, true)
+	c.Assert(tbs.debugState(), Equals, "{1s: 4}, {1m0s: 1}")
+
+	// Reserved tokens are dropped after a period of their rate
+	s.clock.Sleep(time.Second)
+	delay, err = tbs.Consume(1)
+	c.Assert(err, IsNil)
+	c.Assert(delay, Equals, time.Duration(0))
+	c.Assert(tbs.debugState(), Equals, "{1s: 4}, {1m0s: 0}")
+}
+
+// The status of shared buckets counts tokens left in the store and reserved locally.
+func (s *StoreSuite) TestStatus(c *C) {
+	store := NewCacheStore(s.cache, time.Second, s.clock)
+	rates := NewRateSet()
+	rates.Add(time.Second, 10, 10)
+	tbs := NewSharedTokenBucketSet(rates, store, "k", 4, s.clock)
+
+	_, status, err := tbs.ConsumeWithStatus(1)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, RateStatus{Limit: 10, Remaining: 9, Reset: 100 * time.Millisecond})
+
+	// Tokens taken by other instances are seen once the store is used again
+	_, _, _, err = store.Take("k/1000000000", Rate{Period: time.Second, Average: 10, Burst: 10}, 6, 6)
+	c.Assert(err, IsNil)
+	_, status, err = tbs.ConsumeWithStatus(3)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, RateStatus{Limit: 10, Remaining: 6, Reset: 400 * time.Millisecond})
+	_, status, err = tbs.ConsumeWithStatus(1)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, RateStatus{Limit: 10, Remaining: 0, Reset: time.Second})
+
+	s.clock.Sleep(500 * time.Millisecond)
+	_, status, err = tbs.ConsumeWithStatus(0)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, RateStatus{Limit: 10, Remaining: 5, Reset: 500 * time.Millisecond})
+}
+
+func (s *StoreSuite) TestFailure(c *C) {
+	s.cache.err = fmt.Errorf("connection refused")
+	store := NewCacheStore(s.cache, time.Second, s.clock)
+
+	closed := s.newLimiter(c, Store(store, "fe/m/"))
+	c.Assert(get(closed, "s1"), Equals, http.StatusServiceUnavailable)
+
+	open := s.newLimiter(c, Store(store, "fe/m/"), FailOpen(true))
+	c.Assert(get(open, "s1"), Equals, http.StatusOK)
+	c.Assert(get(open, "s1"), Equals, http.StatusOK)
+
+	// The store is not used for a while after it fails
+	c.Assert(s.cache.gets, Equals, 1)
+
+	s.cache.err = nil
+	s.clock.Sleep(time.Second)
+	c.Assert(get(closed, "s1"), Equals, http.StatusOK)
+	c.Assert(get(closed, "s1"), Equals, http.StatusOK)
+	c.Assert(get(closed, "s1"), Equals, http.StatusTooManyRequests)
+}
+
+func (s *StoreSuite) TestConcurrent(c *C) {
+	store := NewCacheStore(s.cache, time.Second, s.clock)
+	rates := NewRateSet()
+	rates.Add(time.Second, 100, 100)
+	var limiters []http.Handler
+	for i := 0; i < 4; i++ {
+		l, err := New(ok, headerLimit, rates, Clock(s.clock), Store(store, "fe/m/"), Batch(3))
+		c.Assert(err, IsNil)
+		limiters = append(limiters, l)
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	allowed := 0
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(l http.Handler) {
+			defer wg.Done()
+			if get(l, "s1") == http.StatusOK {
+				mutex.Lock()
+				allowed++
+				mutex.Unlock()
+			}
+		}(limiters[i%len(limiters)])
+	}
+	wg.Wait()
+	// Tokens reserved by instances and not consumed are lost
+	c.Assert(allowed <= 100, Equals, true, Commentf("allowed %d", allowed))
+	c.Assert(allowed >= 100-len(limiters)*2, Equals, true, Commentf("allowed %d", allowed))
+}
+
+// The set is not locked while tokens are taken from the store, and requests
+// that need tokens at the same time share a single round trip.
+func (s *StoreSuite) TestSlowStore(c *C) {
+	store := &blockingStore{
+		BucketStore: NewCacheStore(s.cache, time.Second, s.clock),
+		entered:     make(chan struct{}, 10),
+		unblock:     make(chan struct{}),
+	}
+	rates := NewRateSet()
+	rates.Add(time.Second, 10, 10)
+	tbs := NewSharedTokenBucketSet(rates, store, "k", 5, s.clock)
+
+	results := make(chan error, 3)
+	consume := func() {
+		_, err := tbs.Consume(1)
+		results <- err
+	}
+	go consume()
+	<-store.entered
+
+	// The set is usable while the store is slow
+	period := make(chan time.Duration, 1)
+	go func() { period <- tbs.GetMaxPeriod() }()
+	select {
+	case p := <-period:
+		c.Assert(p, Equals, time.Second)
+	case <-time.After(time.Second):
+		close(store.unblock)
+		c.Fatalf("The set is locked while tokens are taken from the store")
+	}
+
+	go consume()
+	go consume()
+	select {
+	case <-store.entered:
+		c.Fatalf("Requests should wait for the refill in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(store.unblock)
+	for i := 0; i < 3; i++ {
+		c.Assert(<-results, IsNil)
+	}
+	c.Assert(len(store.entered), Equals, 0)
+	c.Assert(tbs.debugState(), Equals, "{1s: 2}")
+}
+
+func (s *StoreSuite) newLimiter(c *C, opts ...TokenLimiterOption) http.Handler {
+	rates := NewRateSet()
+	rates.Add(time.Second, 2, 2)
+	l, err := New(ok, headerLimit, rates, append([]TokenLimiterOption{Clock(s.clock)}, opts...)...)
+	c.Assert(err, IsNil)
+	return l
+}
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("hello"))
+})
+
+func get(h http.Handler, source string) int {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Source", source)
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, req)
+	return re.Code
+}
+
+// memSharedCache is a shared cache in memory, values do not expire.
+type memSharedCache struct {
+	mutex sync.Mutex
+	data  map[string][]byte
+	err   error
+	gets  int
+	swaps int
+}
+
+func (m *memSharedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.gets++
+	if m.err != nil {
+		return nil, m.err
+	}
+	data, ok := m.data[key]
+	if !ok {
+		return nil, cacheprovider.ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (m *memSharedCache) CompareAndSwap(ctx context.Context, key string, old, data []byte, ttl time.Duration) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.swaps++
+	if m.err != nil {
+		return false, m.err
+	}
+	current, ok := m.data[key]
+	if ok == (old == nil) || !bytes.Equal(current, old) {
+		return false, nil
+	}
+	m.data[key] = data
+	return true, nil
+}
+
+// blockingStore blocks takes until it is told to go on.
+type blockingStore struct {
+	BucketStore
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingStore) Take(key string, rate Rate, min, max int64) (int64, int64, time.Duration, error) {
+	b.entered <- struct{}{}
+	<-b.unblock
+	return b.BucketStore.Take(key, rate, min, max)
+}
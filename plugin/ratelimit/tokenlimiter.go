@@ -4,6 +4,7 @@ package ratelimit
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 	"github.com/mailgun/ttlmap"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/plugin"
 )
 
 // DefaultCapacity default capacity
@@ -72,6 +74,12 @@ type TokenLimiter struct {
 	errHandler   utils.ErrorHandler
 	capacity     int
 	next         http.Handler
+	store        BucketStore
+	keyPrefix    string
+	batch        int64
+	failOpen     bool
+	dryRun       bool
+	rejected     func(req *http.Request)
 
 	log *log.Logger
 }
@@ -128,40 +136,85 @@ func (tl *TokenLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := tl.consumeRates(req, source, amount); err != nil {
-		tl.log.Warnf("limiting request %v %v, limit: %v", req.Method, req.URL, err)
-		tl.errHandler.ServeHTTP(w, req, err)
-		return
+	status, err := tl.consumeRates(req, source, amount)
+	if status != nil {
+		setRateHeaders(w.Header(), status)
+	}
+	if err != nil {
+		_, limited := err.(*MaxRateError)
+		if limited && tl.rejected != nil {
+			tl.rejected(req)
+		}
+		if limited && tl.dryRun {
+			tl.log.WithFields(plugin.RequestLogFields(req)).Warnf("would limit request %v %v, limit: %v", req.Method, req.URL, err)
+		} else {
+			tl.log.WithFields(plugin.RequestLogFields(req)).Warnf("limiting request %v %v, limit: %v", req.Method, req.URL, err)
+			tl.errHandler.ServeHTTP(w, req, err)
+			return
+		}
 	}
 
 	tl.next.ServeHTTP(w, req)
 }
 
-func (tl *TokenLimiter) consumeRates(req *http.Request, source string, amount int64) error {
-	tl.mutex.Lock()
-	defer tl.mutex.Unlock()
-
+// consumeRates consumes tokens of the source and returns the status of its
+// buckets, or nil if the status is not known because the store has failed.
+func (tl *TokenLimiter) consumeRates(req *http.Request, source string, amount int64) (*RateStatus, error) {
 	effectiveRates := tl.resolveRates(req)
-	bucketSetI, exists := tl.bucketSets.Get(source)
-	var bucketSet *TokenBucketSet
+	bucketSet := tl.bucketSet(source, effectiveRates)
+	delay, status, err := bucketSet.ConsumeWithStatus(amount)
+	if err != nil {
+		if _, ok := err.(*StoreError); ok {
+			if tl.failOpen {
+				tl.log.WithFields(plugin.RequestLogFields(req)).Warnf("letting request %v %v through: %v", req.Method, req.URL, err)
+				return nil, nil
+			}
+			return nil, err
+		}
+		return &status, err
+	}
+	if delay > 0 {
+		return &status, &MaxRateError{delay: delay}
+	}
+	return &status, nil
+}
 
-	if exists {
-		bucketSet = bucketSetI.(*TokenBucketSet)
-		bucketSet.Update(effectiveRates)
-	} else {
-		bucketSet = NewTokenBucketSet(effectiveRates, tl.clock)
+// setRateHeaders sets rate limit headers defined by the IETF draft
+// "RateLimit header fields for HTTP".
+func setRateHeaders(h http.Header, s *RateStatus) {
+	h.Set("RateLimit-Limit", strconv.FormatInt(s.Limit, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(s.Remaining, 10))
+	h.Set("RateLimit-Reset", strconv.FormatInt(seconds(s.Reset), 10))
+}
+
+// seconds rounds the duration up to seconds.
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// bucketSet returns buckets of the source, buckets are locked on their own so
+// that sources do not wait for each other when buckets are kept in a store.
+func (tl *TokenLimiter) bucketSet(source string, effectiveRates *RateSet) *TokenBucketSet {
+	tl.mutex.Lock()
+	bucketSetI, exists := tl.bucketSets.Get(source)
+	if !exists {
+		var bucketSet *TokenBucketSet
+		if tl.store != nil {
+			bucketSet = NewSharedTokenBucketSet(effectiveRates, tl.store, tl.keyPrefix+source, tl.batch, tl.clock)
+		} else {
+			bucketSet = NewTokenBucketSet(effectiveRates, tl.clock)
+		}
 		// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
 		// the counters for this ip will expire after 10 seconds of inactivity
 		tl.bucketSets.Set(source, bucketSet, int(bucketSet.maxPeriod/time.Second)*10+1)
+		tl.mutex.Unlock()
+		return bucketSet
 	}
-	delay, err := bucketSet.Consume(amount)
-	if err != nil {
-		return err
-	}
-	if delay > 0 {
-		return &MaxRateError{delay: delay}
-	}
-	return nil
+	tl.mutex.Unlock()
+
+	bucketSet := bucketSetI.(*TokenBucketSet)
+	bucketSet.Update(effectiveRates)
+	return bucketSet
 }
 
 // effectiveRates retrieves rates to be applied to the request.
@@ -196,13 +249,35 @@ func (m *MaxRateError) Error() string {
 }
 
 // RateErrHandler error handler
-type RateErrHandler struct{}
+type RateErrHandler struct {
+	// Body is sent to clients that exceed rates, it defaults to the error.
+	Body string
+	// ContentType is the content type of the body.
+	ContentType string
+}
 
 func (e *RateErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
 	if rerr, ok := err.(*MaxRateError); ok {
+		retryAfter := seconds(rerr.delay)
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
 		w.Header().Set("X-Retry-In", rerr.delay.String())
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		if e.ContentType != "" {
+			w.Header().Set("Content-Type", e.ContentType)
+		}
 		w.WriteHeader(429)
-		w.Write([]byte(err.Error()))
+		if e.Body != "" {
+			w.Write([]byte(e.Body))
+		} else {
+			w.Write([]byte(err.Error()))
+		}
+		return
+	}
+	if _, ok := err.(*StoreError); ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
 		return
 	}
 	utils.DefaultHandler.ServeHTTP(w, req, err)
@@ -246,6 +321,53 @@ func Capacity(cap int) TokenLimiterOption {
 	}
 }
 
+// Store keeps buckets in the store under keys with the prefix, so that rates
+// are shared by all instances that use the store.
+func Store(store BucketStore, keyPrefix string) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		cl.store = store
+		cl.keyPrefix = keyPrefix
+		return nil
+	}
+}
+
+// Batch sets how many tokens are taken from the store at once. Tokens that
+// are not consumed right away are kept locally for the next requests.
+func Batch(size int64) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if size <= 0 {
+			return fmt.Errorf("bad batch size: %v", size)
+		}
+		cl.batch = size
+		return nil
+	}
+}
+
+// FailOpen lets requests through when the store fails.
+func FailOpen(failOpen bool) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		cl.failOpen = failOpen
+		return nil
+	}
+}
+
+// DryRun lets requests that exceed rates through, they are only logged.
+func DryRun(dryRun bool) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		cl.dryRun = dryRun
+		return nil
+	}
+}
+
+// Rejected sets the function called for requests that exceed rates, including
+// requests let through in dry run mode.
+func Rejected(f func(req *http.Request)) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		cl.rejected = f
+		return nil
+	}
+}
+
 var defaultErrHandler = &RateErrHandler{}
 
 func setDefaults(tl *TokenLimiter) {
@@ -258,4 +380,7 @@ func setDefaults(tl *TokenLimiter) {
 	if tl.errHandler == nil {
 		tl.errHandler = defaultErrHandler
 	}
+	if tl.batch <= 0 {
+		tl.batch = 1
+	}
 }
@@ -323,3 +323,72 @@ func faultyExtractor(req *http.Request) (string, int64, error) {
 
 var headerLimit = utils.ExtractorFunc(headerLimiter)
 var faultyExtract = utils.ExtractorFunc(faultyExtractor)
+
+// Responses tell clients how many requests they can make.
+func (s *LimiterSuite) TestRateHeaders(c *C) {
+	rates := NewRateSet()
+	rates.Add(time.Second, 2, 2)
+	rates.Add(time.Minute, 10, 3)
+	l, err := New(ok, headerLimit, rates, Clock(s.clock))
+	c.Assert(err, IsNil)
+
+	re := s.serve(l, "headers")
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Header().Get("RateLimit-Limit"), Equals, "2")
+	c.Assert(re.Header().Get("RateLimit-Remaining"), Equals, "1")
+	c.Assert(re.Header().Get("RateLimit-Reset"), Equals, "1")
+	c.Assert(re.Header().Get("Retry-After"), Equals, "")
+
+	s.serve(l, "headers")
+	re = s.serve(l, "headers")
+	c.Assert(re.Code, Equals, http.StatusTooManyRequests)
+	c.Assert(re.Header().Get("RateLimit-Remaining"), Equals, "0")
+	c.Assert(re.Header().Get("Retry-After"), Equals, "1")
+	c.Assert(re.Header().Get("X-Retry-In"), Equals, "500ms")
+
+	// The bucket with the least tokens left is reported
+	s.clock.Sleep(time.Second)
+	re = s.serve(l, "headers")
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Header().Get("RateLimit-Limit"), Equals, "3")
+	c.Assert(re.Header().Get("RateLimit-Remaining"), Equals, "0")
+	c.Assert(re.Header().Get("RateLimit-Reset"), Equals, "17")
+}
+
+func (s *LimiterSuite) TestRejectBody(c *C) {
+	rates := NewRateSet()
+	rates.Add(time.Second, 1, 1)
+	l, err := New(ok, headerLimit, rates, Clock(s.clock),
+		ErrorHandler(&RateErrHandler{Body: `{"error":"slow down"}`, ContentType: "application/json"}))
+	c.Assert(err, IsNil)
+
+	c.Assert(s.serve(l, "body").Code, Equals, http.StatusOK)
+	re := s.serve(l, "body")
+	c.Assert(re.Code, Equals, http.StatusTooManyRequests)
+	c.Assert(re.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(re.Body.String(), Equals, `{"error":"slow down"}`)
+}
+
+// Requests that exceed rates are let through and counted in dry run mode.
+func (s *LimiterSuite) TestDryRun(c *C) {
+	rates := NewRateSet()
+	rates.Add(time.Second, 1, 1)
+	rejected := 0
+	l, err := New(ok, headerLimit, rates, Clock(s.clock), DryRun(true),
+		Rejected(func(*http.Request) { rejected++ }))
+	c.Assert(err, IsNil)
+
+	c.Assert(s.serve(l, "dry").Code, Equals, http.StatusOK)
+	re := s.serve(l, "dry")
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Header().Get("RateLimit-Remaining"), Equals, "0")
+	c.Assert(rejected, Equals, 1)
+}
+
+func (s *LimiterSuite) serve(h http.Handler, source string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Source", source)
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, req)
+	return re
+}
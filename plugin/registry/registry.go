@@ -3,10 +3,24 @@ package registry
 
 import (
 	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/adaptivelimit"
+	"github.com/vulcand/vulcand/plugin/cache"
 	"github.com/vulcand/vulcand/plugin/cbreaker"
+	"github.com/vulcand/vulcand/plugin/collapse"
+	"github.com/vulcand/vulcand/plugin/compress"
 	"github.com/vulcand/vulcand/plugin/connlimit"
+	"github.com/vulcand/vulcand/plugin/cors"
+	"github.com/vulcand/vulcand/plugin/fault"
+	"github.com/vulcand/vulcand/plugin/forwardauth"
+	"github.com/vulcand/vulcand/plugin/headers"
+	"github.com/vulcand/vulcand/plugin/hmacauth"
+	"github.com/vulcand/vulcand/plugin/ipfilter"
+	"github.com/vulcand/vulcand/plugin/jwtauth"
+	"github.com/vulcand/vulcand/plugin/oidc"
+	"github.com/vulcand/vulcand/plugin/quota"
 	"github.com/vulcand/vulcand/plugin/ratelimit"
 	"github.com/vulcand/vulcand/plugin/rewrite"
+	"github.com/vulcand/vulcand/plugin/subset"
 	"github.com/vulcand/vulcand/plugin/trace"
 )
 
@@ -19,6 +33,20 @@ func GetRegistry() *plugin.Registry {
 		rewrite.GetSpec(),
 		cbreaker.GetSpec(),
 		trace.GetSpec(),
+		subset.GetSpec(),
+		cache.GetSpec(),
+		collapse.GetSpec(),
+		compress.GetSpec(),
+		headers.GetSpec(),
+		cors.GetSpec(),
+		jwtauth.GetSpec(),
+		forwardauth.GetSpec(),
+		oidc.GetSpec(),
+		ipfilter.GetSpec(),
+		hmacauth.GetSpec(),
+		quota.GetSpec(),
+		adaptivelimit.GetSpec(),
+		fault.GetSpec(),
 	}
 
 	for _, spec := range specs {
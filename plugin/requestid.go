@@ -0,0 +1,48 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestIdLogField is the field that log lines written while a request is
+// handled carry the request id in.
+const RequestIdLogField = "request-id"
+
+type requestIdKey struct{}
+
+// WithRequestId returns a shallow copy of the request that carries the id.
+// The request id handler of listeners in proxy/server calls it as soon as a
+// request comes in, and the cache middleware calls it so that background
+// revalidations keep the id of the request that started them.
+func WithRequestId(r *http.Request, id string) *http.Request {
+	if id == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id))
+}
+
+// RequestId returns the id of the request, or an empty string if it has none.
+func RequestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// RequestLogFields returns log fields that tie a log line to the request, or
+// nil if the request has no id.
+func RequestLogFields(r *http.Request) log.Fields {
+	id := RequestId(r)
+	if id == "" {
+		return nil
+	}
+	return log.Fields{RequestIdLogField: id}
+}
+
+// RequestLog returns a log entry that ties log lines to the request. Log
+// lines written while a request is handled should go through it, so that
+// e.g. a 502 in the logs can be traced back to the request.
+func RequestLog(r *http.Request) *log.Entry {
+	return log.WithFields(RequestLogFields(r))
+}
@@ -11,7 +11,6 @@ import (
 	"strings"
 
 	"github.com/urfave/cli"
-	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/oxy/utils"
 	"github.com/vulcand/vulcand/plugin"
 )
@@ -109,7 +108,7 @@ func (rw *rewriteHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	rw.next.ServeHTTP(bw, req)
 
 	if err := Apply(bw.buffer, newBody, req); err != nil {
-		log.Errorf("While rewriting response body for '%s': %v", req.RequestURI, err)
+		plugin.RequestLog(req).Errorf("While rewriting response body for '%s': %v", req.RequestURI, err)
 	}
 
 	utils.CopyHeaders(w.Header(), bw.Header())
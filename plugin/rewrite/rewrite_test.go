@@ -4,7 +4,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/urfave/cli"
@@ -331,6 +333,29 @@ func (s *RewriteSuite) TestRewriteResponseBody(c *C) {
 	c.Assert(string(body), Equals, `{"foo": "bar"}`)
 }
 
+func (s *RewriteSuite) TestRewriteResponseBodyNoEnv(c *C) {
+	os.Setenv("VULCAND_REWRITE_TEST", "secret")
+	defer os.Unsetenv("VULCAND_REWRITE_TEST")
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"foo": "{{env "VULCAND_REWRITE_TEST"}}"}`))
+	})
+
+	rh, err := newRewriteHandler(handler, &Rewrite{"", "", true, false})
+	c.Assert(rh, NotNil)
+	c.Assert(err, IsNil)
+
+	srv := httptest.NewServer(rh)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL, testutils.Host("localhost"))
+
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(strings.Contains(string(body), "secret"), Equals, false)
+}
+
 func (s *RewriteSuite) TestDontRewriteResponseBody(c *C) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte(`{"foo": "{{.Request.Header.Get "X-Header"}}"}`))
@@ -1,8 +1,10 @@
 package rewrite
 
 import (
+	"crypto/tls"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"text/template"
 )
@@ -10,6 +12,52 @@ import (
 // data represents template data that is available to use in templates.
 type data struct {
 	Request *http.Request
+	// ClientIP is the address of the client that the connection came from.
+	ClientIP string
+	// TLS describes the connection, its fields are empty if it is plain.
+	TLS TLSInfo
+}
+
+// TLSInfo describes a TLS connection of a request.
+type TLSInfo struct {
+	Enabled    bool
+	Version    string
+	Cipher     string
+	ServerName string
+	// ClientSubject and ClientIssuer are set if the client presented a
+	// certificate.
+	ClientSubject string
+	ClientIssuer  string
+}
+
+// Template is a parsed template that can be applied to requests many times.
+type Template struct {
+	t *template.Template
+}
+
+// NewTemplate parses a template string.
+//
+// Template is standard Go's http://golang.org/pkg/text/template/.
+func NewTemplate(in string) (*Template, error) {
+	return NewTemplateFuncs(in, nil)
+}
+
+// NewTemplateFuncs parses a template string that can use the functions on
+// top of the standard ones. Response bodies are templates as well, so only
+// templates that come from the configuration should get functions that
+// reveal anything about vulcand.
+func NewTemplateFuncs(in string, funcs template.FuncMap) (*Template, error) {
+	t, err := template.New("t").Funcs(funcs).Parse(in)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{t: t}, nil
+}
+
+// Execute applies variables from the provided request object to the template
+// and writes the result into the provided writer.
+func (t *Template) Execute(out io.Writer, request *http.Request) error {
+	return t.t.Execute(out, newData(request))
 }
 
 // Apply reads a template string from the provided reader, applies variables
@@ -31,14 +79,49 @@ func Apply(in io.Reader, out io.Writer, request *http.Request) error {
 //
 // Template is standard Go's http://golang.org/pkg/text/template/.
 func ApplyString(in string, out io.Writer, request *http.Request) error {
-	t, err := template.New("t").Parse(in)
+	t, err := NewTemplate(in)
 	if err != nil {
 		return err
 	}
 
-	if err = t.Execute(out, data{request}); err != nil {
-		return err
+	return t.Execute(out, request)
+}
+
+func newData(request *http.Request) data {
+	d := data{Request: request}
+	if request == nil {
+		return d
+	}
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		d.ClientIP = host
+	} else {
+		d.ClientIP = request.RemoteAddr
+	}
+	if cs := request.TLS; cs != nil {
+		d.TLS = TLSInfo{
+			Enabled:    true,
+			Version:    tlsVersion(cs.Version),
+			Cipher:     tls.CipherSuiteName(cs.CipherSuite),
+			ServerName: cs.ServerName,
+		}
+		if len(cs.PeerCertificates) != 0 {
+			d.TLS.ClientSubject = cs.PeerCertificates[0].Subject.String()
+			d.TLS.ClientIssuer = cs.PeerCertificates[0].Issuer.String()
+		}
 	}
+	return d
+}
 
-	return nil
+func tlsVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return ""
 }
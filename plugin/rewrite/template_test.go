@@ -2,8 +2,11 @@ package rewrite
 
 import (
 	"bytes"
+	"crypto/tls"
 	"net/http"
+	"os"
 	"strings"
+	"text/template"
 
 	. "gopkg.in/check.v1"
 )
@@ -54,3 +57,44 @@ func (s *TemplateSuite) TestNonexistentVariable(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(out.String(), Equals, "foo ")
 }
+
+func (s *TemplateSuite) TestClientAndTLS(c *C) {
+	request, _ := http.NewRequest("GET", "https://foo", nil)
+	request.RemoteAddr = "10.0.0.1:5000"
+
+	t, err := NewTemplate(`{{.ClientIP}} {{if .TLS.Enabled}}tls{{else}}plain{{end}}`)
+	c.Assert(err, IsNil)
+	out := &bytes.Buffer{}
+	c.Assert(t.Execute(out, request), IsNil)
+	c.Assert(out.String(), Equals, "10.0.0.1 plain")
+
+	request.TLS = &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, ServerName: "foo"}
+	t, err = NewTemplate(`{{.TLS.Version}} {{.TLS.Cipher}} {{.TLS.ServerName}}`)
+	c.Assert(err, IsNil)
+	out.Reset()
+	c.Assert(t.Execute(out, request), IsNil)
+	c.Assert(out.String(), Equals, "1.2 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 foo")
+}
+
+func (s *TemplateSuite) TestFuncs(c *C) {
+	request, _ := http.NewRequest("GET", "http://foo", nil)
+
+	t, err := NewTemplateFuncs(`foo {{upper "bar"}}`, template.FuncMap{"upper": strings.ToUpper})
+	c.Assert(err, IsNil)
+	out := &bytes.Buffer{}
+	c.Assert(t.Execute(out, request), IsNil)
+	c.Assert(out.String(), Equals, "foo BAR")
+}
+
+// Response bodies are templates too, they must not be able to read the
+// environment.
+func (s *TemplateSuite) TestNoEnv(c *C) {
+	os.Setenv("VULCAND_TEMPLATE_TEST", "baz")
+	defer os.Unsetenv("VULCAND_TEMPLATE_TEST")
+	request, _ := http.NewRequest("GET", "http://foo", nil)
+
+	out := &bytes.Buffer{}
+	err := ApplyString(`foo {{env "VULCAND_TEMPLATE_TEST"}}`, out, request)
+	c.Assert(err, NotNil)
+	c.Assert(out.String(), Equals, "")
+}
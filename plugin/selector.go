@@ -0,0 +1,133 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// ServerSelector selects backend servers by their labels. It maps label names
+// to values that servers must have. A value is either a literal, or a request
+// variable, e.g. request.header.X-Version, in which case it is taken from a
+// request being routed.
+type ServerSelector struct {
+	literals  map[string]string
+	variables map[string]utils.SourceExtractor
+}
+
+// NewServerSelector creates a server selector from a map of label names to
+// either literal values or request variables.
+func NewServerSelector(selector map[string]string) (*ServerSelector, error) {
+	s := &ServerSelector{
+		literals:  make(map[string]string),
+		variables: make(map[string]utils.SourceExtractor),
+	}
+	for label, value := range selector {
+		if label == "" {
+			return nil, fmt.Errorf("selector label name can not be empty")
+		}
+		if !IsRequestVariable(value) {
+			s.literals[label] = value
+			continue
+		}
+		extract, err := utils.NewExtractor(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid variable for label %s: %v", label, err)
+		}
+		s.variables[label] = extract
+	}
+	return s, nil
+}
+
+// IsEmpty tells whether the selector selects all servers no matter what.
+func (s *ServerSelector) IsEmpty() bool {
+	return len(s.literals) == 0 && len(s.variables) == 0
+}
+
+// Resolve returns label values that servers must have to handle the request.
+// Labels with request variables that resolve to empty values are omitted.
+func (s *ServerSelector) Resolve(r *http.Request) (map[string]string, error) {
+	if s.IsEmpty() {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(s.literals)+len(s.variables))
+	for label, value := range s.literals {
+		labels[label] = value
+	}
+	for label, extract := range s.variables {
+		value, _, err := extract.Extract(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve label %s: %v", label, err)
+		}
+		if value != "" {
+			labels[label] = value
+		}
+	}
+	return labels, nil
+}
+
+// IsRequestVariable tells whether a selector value should be taken from a
+// request rather than used as is.
+func IsRequestVariable(value string) bool {
+	return strings.HasPrefix(value, "request.") || strings.HasPrefix(value, "client.")
+}
+
+// ParseLabels parses labels given in form of key=value pairs, e.g. as they
+// come from the command line.
+func ParseLabels(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		for _, kv := range strings.Split(pair, ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, fmt.Errorf("invalid label '%s', expected key=value", kv)
+			}
+			labels[parts[0]] = parts[1]
+		}
+	}
+	return labels, nil
+}
+
+// FormatLabels returns labels as a comma separated list of key=value pairs
+// sorted by key.
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+type serverSelectorKey struct{}
+
+// WithServerLabels returns a shallow copy of the request that tells the load
+// balancer to only pick backend servers that have the specified labels. Labels
+// that have already been set for the request are overridden.
+func WithServerLabels(r *http.Request, labels map[string]string) *http.Request {
+	if len(labels) == 0 {
+		return r
+	}
+	merged := make(map[string]string)
+	for k, v := range ServerLabels(r) {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return r.WithContext(context.WithValue(r.Context(), serverSelectorKey{}, merged))
+}
+
+// ServerLabels returns labels that backend servers must have to handle the
+// request, as they were set by middlewares with WithServerLabels.
+func ServerLabels(r *http.Request) map[string]string {
+	labels, _ := r.Context().Value(serverSelectorKey{}).(map[string]string)
+	return labels
+}
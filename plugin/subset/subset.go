@@ -0,0 +1,89 @@
+package subset
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "subset"
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// Subset limits load balancing of requests to backend servers that have
+// labels matching the selector. Selector values are either literals or request
+// variables, e.g. 'request.header.X-Version'.
+type Subset struct {
+	Selector map[string]string
+}
+
+// NewSubset creates a subset middleware spec.
+func NewSubset(selector map[string]string) (*Subset, error) {
+	s, err := plugin.NewServerSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	if s.IsEmpty() {
+		return nil, fmt.Errorf("selector can not be empty")
+	}
+	return &Subset{Selector: selector}, nil
+}
+
+// NewHandler returns a vulcan library compatible middleware.
+func (s *Subset) NewHandler(next http.Handler) (http.Handler, error) {
+	selector, err := plugin.NewServerSelector(s.Selector)
+	if err != nil {
+		return nil, err
+	}
+	return &handler{selector: selector, next: next}, nil
+}
+
+func (s *Subset) String() string {
+	return fmt.Sprintf("selector=%s", plugin.FormatLabels(s.Selector))
+}
+
+func FromOther(s Subset) (plugin.Middleware, error) {
+	return NewSubset(s.Selector)
+}
+
+// FromCli constructs the middleware from the command line.
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	selector, err := plugin.ParseLabels(c.StringSlice("selector"))
+	if err != nil {
+		return nil, err
+	}
+	return NewSubset(selector)
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "selector, sel",
+			Value: &cli.StringSlice{},
+			Usage: "server labels to select, e.g. version=request.header.X-Version,tier=gold",
+		},
+	}
+}
+
+type handler struct {
+	selector *plugin.ServerSelector
+	next     http.Handler
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	labels, err := h.selector.Resolve(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.next.ServeHTTP(w, plugin.WithServerLabels(r, labels))
+}
@@ -0,0 +1,81 @@
+package subset
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/urfave/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestSubset(t *testing.T) { TestingT(t) }
+
+type SubsetSuite struct{}
+
+var _ = Suite(&SubsetSuite{})
+
+// Make sure the spec is compatible and will be accepted by middleware registry
+func (s *SubsetSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *SubsetSuite) TestNewSubsetBadParams(c *C) {
+	_, err := NewSubset(nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewSubset(map[string]string{"": "v1"})
+	c.Assert(err, NotNil)
+
+	_, err = NewSubset(map[string]string{"version": "request.bogus"})
+	c.Assert(err, NotNil)
+}
+
+func (s *SubsetSuite) TestHandlerSetsLabels(c *C) {
+	ss, err := NewSubset(map[string]string{"version": "request.header.X-Version", "tier": "gold"})
+	c.Assert(err, IsNil)
+	c.Assert(ss.String(), Equals, "selector=tier=gold,version=request.header.X-Version")
+
+	var labels map[string]string
+	h, err := ss.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		labels = plugin.ServerLabels(r)
+	}))
+	c.Assert(err, IsNil)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Version", "v2")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(labels, DeepEquals, map[string]string{"version": "v2", "tier": "gold"})
+
+	// Labels that resolve to empty values are not required.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(labels, DeepEquals, map[string]string{"tier": "gold"})
+}
+
+func (s *SubsetSuite) TestNewSubsetFromOther(c *C) {
+	ss, err := NewSubset(map[string]string{"version": "v1"})
+	c.Assert(err, IsNil)
+
+	out, err := FromOther(*ss)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, ss)
+}
+
+func (s *SubsetSuite) TestNewSubsetFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		ss := out.(*Subset)
+		c.Assert(ss.Selector, DeepEquals, map[string]string{"version": "request.header.X-Version", "tier": "gold"})
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--selector=version=request.header.X-Version,tier=gold"})
+	c.Assert(executed, Equals, true)
+}
@@ -1,68 +1,138 @@
 package trace
 
 import (
-	"bytes"
 	"fmt"
 	"io"
-	"log/syslog"
+	"math/rand"
 	"net/http"
 	"net/url"
 
+	"github.com/mailgun/timetools"
 	"github.com/urfave/cli"
-	oxytrace "github.com/vulcand/oxy/trace"
+	"github.com/vulcand/vulcand/logsink"
 	"github.com/vulcand/vulcand/plugin"
 )
 
 const Type = "trace"
 
-// Trace plugin emits structured logs to syslog facility
+// Trace plugin emits structured logs of requests to syslog, files, stdout or
+// HTTP batch sinks.
 type Trace struct {
 	// ReqHeaders - request headers to capture
 	ReqHeaders []string
 	// RespHeaders - response headers to capture
 	RespHeaders []string
-	// Address in format syslog://host:port or syslog:///path/socket.sock
+	// Address of the output, e.g. syslog://host:port, file:///path/trace.log,
+	// stdout:// or http://host:port/_bulk, see package logsink for details
 	Addr string
+	// SampleRate is the fraction of requests to trace, from 0 to 1, all
+	// requests by default.
+	SampleRate float64 `json:",omitempty"`
+	// MaxBodyBytes is how many bytes of request and response bodies to
+	// capture, bodies are not captured if it is 0.
+	MaxBodyBytes int64 `json:",omitempty"`
+
+	clock timetools.TimeProvider
+	rand  func() float64
 }
 
 // New returns a new Trace plugin
 func New(addr string, reqHeaders, respHeaders []string) (*Trace, error) {
-	if _, err := newWriter(addr); err != nil {
-		return nil, err
-	}
-	return &Trace{
+	return NewTrace(Trace{
 		ReqHeaders:  reqHeaders,
 		RespHeaders: respHeaders,
 		Addr:        addr,
-	}, nil
+	})
+}
+
+// NewTrace validates settings and returns a new Trace plugin. The output is
+// not opened until the plugin is used by a handler.
+func NewTrace(t Trace) (*Trace, error) {
+	if err := logsink.Check(t.Addr); err != nil {
+		return nil, err
+	}
+	if t.SampleRate == 0 {
+		t.SampleRate = 1
+	}
+	if t.SampleRate < 0 || t.SampleRate > 1 {
+		return nil, fmt.Errorf("sample rate should be between 0 and 1, got %v", t.SampleRate)
+	}
+	if t.MaxBodyBytes < 0 {
+		return nil, fmt.Errorf("max body bytes should be >= 0, got %d", t.MaxBodyBytes)
+	}
+	if t.clock == nil {
+		t.clock = &timetools.RealTime{}
+	}
+	if t.rand == nil {
+		t.rand = rand.Float64
+	}
+	return &t, nil
 }
 
 // NewHandler creates a new http.Handler middleware
 func (t *Trace) NewHandler(next http.Handler) (http.Handler, error) {
-	return newTraceHandler(next, t)
+	return t.NewHandlerWithEnv(next, plugin.Env{})
+}
+
+// NewHandlerWithEnv creates a handler that captures the request id header in
+// every record, so that records can be tied to log lines of the request.
+func (t *Trace) NewHandlerWithEnv(next http.Handler, env plugin.Env) (http.Handler, error) {
+	return newTraceHandler(next, t, env.RequestIdHeader)
 }
 
 // String is a user-friendly representation of the handler
 func (t *Trace) String() string {
-	return fmt.Sprintf("addr=%v, reqHeaders=%v, respHeaders=%v", t.Addr, t.ReqHeaders, t.RespHeaders)
+	out := fmt.Sprintf("addr=%v, reqHeaders=%v, respHeaders=%v", t.Addr, t.ReqHeaders, t.RespHeaders)
+	if t.SampleRate != 1 {
+		out += fmt.Sprintf(", sampleRate=%v", t.SampleRate)
+	}
+	if t.MaxBodyBytes != 0 {
+		out += fmt.Sprintf(", maxBodyBytes=%v", t.MaxBodyBytes)
+	}
+	return out
 }
 
-func newTraceHandler(next http.Handler, t *Trace) (*oxytrace.Tracer, error) {
-	writer, err := newWriter(t.Addr)
+func newTraceHandler(next http.Handler, t *Trace, requestIdHeader string) (*tracer, error) {
+	writer, err := logsink.Open(outputAddr(t.Addr))
 	if err != nil {
 		return nil, err
 	}
-	return oxytrace.New(next, writer, oxytrace.RequestHeaders(t.ReqHeaders...), oxytrace.ResponseHeaders(t.RespHeaders...))
+	reqHeaders := t.ReqHeaders
+	if requestIdHeader != "" && !containsHeader(reqHeaders, requestIdHeader) {
+		reqHeaders = append(append([]string(nil), reqHeaders...), requestIdHeader)
+	}
+	return &tracer{
+		next:        next,
+		writer:      writer,
+		config:      t,
+		reqHeaders:  reqHeaders,
+		respHeaders: t.RespHeaders,
+	}, nil
+}
+
+func containsHeader(headers []string, header string) bool {
+	for _, h := range headers {
+		if http.CanonicalHeaderKey(h) == http.CanonicalHeaderKey(header) {
+			return true
+		}
+	}
+	return false
 }
 
 // FromOther creates and validates Trace plugin instance from serialized format
 func FromOther(t Trace) (plugin.Middleware, error) {
-	return New(t.Addr, t.ReqHeaders, t.RespHeaders)
+	return NewTrace(t)
 }
 
 // FromCli creates a Trace plugin object from command line
 func FromCli(c *cli.Context) (plugin.Middleware, error) {
-	return New(c.String("addr"), c.StringSlice("reqHeader"), c.StringSlice("respHeader"))
+	return NewTrace(Trace{
+		ReqHeaders:   c.StringSlice("reqHeader"),
+		RespHeaders:  c.StringSlice("respHeader"),
+		Addr:         c.String("addr"),
+		SampleRate:   c.Float64("sampleRate"),
+		MaxBodyBytes: c.Int64("maxBodyBytes"),
+	})
 }
 
 // GetSpec returns all information neccessary for Vulcand to plugin this extension
@@ -80,7 +150,7 @@ func CliFlags() []cli.Flag {
 	return []cli.Flag{
 		cli.StringFlag{
 			Name:  "addr",
-			Usage: "Address of the output, e.g. syslog:///tmp/out.sock",
+			Usage: "Address of the output, e.g. syslog:///tmp/out.sock, file:///var/log/trace.log, stdout:// or http://localhost:9200/_bulk",
 		},
 		cli.StringSliceFlag{
 			Name:  "reqHeader",
@@ -92,135 +162,40 @@ func CliFlags() []cli.Flag {
 			Usage: "if provided, captures headers from response",
 			Value: &cli.StringSlice{},
 		},
+		cli.Float64Flag{
+			Name:  "sampleRate",
+			Usage: "fraction of requests to trace, from 0 to 1, all requests by default",
+		},
+		cli.Int64Flag{
+			Name:  "maxBodyBytes",
+			Usage: "if provided, captures up to that many bytes of request and response bodies",
+		},
 	}
 }
 
-func newWriter(addr string) (io.Writer, error) {
-	u, err := url.Parse(addr)
-	if u.Scheme != "syslog" {
-		return nil, fmt.Errorf("unsupported scheme '%v' currently supported only 'syslog'", u.Scheme)
-	}
-	pr, err := parseSyslogPriority(u)
-	if err != nil {
-		return nil, err
-	}
-
-	var w io.Writer
-	if u.Host != "" {
-		w, err = syslog.Dial("udp", u.Host, pr, SyslogTag)
-	} else if u.Path != "" {
-		w, err = syslog.Dial("unixgram", u.Path, pr, SyslogTag)
-	} else if u.Host == "" && u.Path == "" {
-		w, err = syslog.Dial("", "", pr, SyslogTag)
-	} else {
-		return nil, fmt.Errorf("unsupported address format: %v", addr)
-	}
-	if err != nil {
-		return nil, err
-	}
-	return &prefixWriter{p: []byte(parsePrefix(u)), w: w}, nil
-}
-
-func parsePrefix(u *url.URL) string {
-	t := u.Query().Get("prefix")
-	if t != "" {
-		return t
-	}
-	return SyslogPrefix
-}
+// SyslogPrefix is the prefix of trace records sent to syslog, unless the
+// address of the output sets another one with the prefix query parameter.
+const SyslogPrefix = "@cee: "
 
-func parseSyslogPriority(u *url.URL) (syslog.Priority, error) {
-	vals := u.Query()
-	pr, err := sevToString(vals.Get("sev"))
-	if err != nil {
-		return 0, err
-	}
-	f, err := fToString(vals.Get("f"))
-	if err != nil {
-		return 0, err
-	}
-	return pr | f, nil
-}
+// SyslogTag is the tag of syslog messages.
+const SyslogTag = logsink.SyslogTag
 
-func sevToString(sev string) (pr syslog.Priority, err error) {
-	switch sev {
-	case "ALERT":
-		pr |= syslog.LOG_ALERT
-	case "CRIT":
-		pr |= syslog.LOG_CRIT
-	case "ERR":
-		pr |= syslog.LOG_ERR
-	case "WARNING":
-		pr |= syslog.LOG_WARNING
-	case "NOTICE":
-		pr |= syslog.LOG_NOTICE
-	case "INFO":
-		pr |= syslog.LOG_INFO
-	case "DEBUG", "":
-		pr |= syslog.LOG_DEBUG
-	default:
-		return 0, fmt.Errorf("uknown severity: %v", sev)
+// outputAddr returns the address of the output with the default prefix of
+// syslog messages.
+func outputAddr(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme != "syslog" {
+		return addr
 	}
-	return pr, nil
-}
-
-func fToString(v string) (f syslog.Priority, err error) {
-	switch v {
-	case "USER":
-		f |= syslog.LOG_USER
-	case "MAIL":
-		f |= syslog.LOG_MAIL
-	case "DAEMON":
-		f |= syslog.LOG_DAEMON
-	case "AUTH":
-		f |= syslog.LOG_AUTH
-	case "SYSLOG":
-		f |= syslog.LOG_SYSLOG
-	case "LPR":
-		f |= syslog.LOG_LPR
-	case "NEWS":
-		f |= syslog.LOG_NEWS
-	case "UUCP":
-		f |= syslog.LOG_UUCP
-	case "CRON":
-		f |= syslog.LOG_CRON
-	case "AUTHPRIV":
-		f |= syslog.LOG_AUTHPRIV
-	case "FTP":
-		f |= syslog.LOG_FTP
-	case "LOG_LOCAL0", "":
-		f |= syslog.LOG_LOCAL0
-	case "LOG_LOCAL1":
-		f |= syslog.LOG_LOCAL1
-	case "LOG_LOCAL2":
-		f |= syslog.LOG_LOCAL2
-	case "LOG_LOCAL3":
-		f |= syslog.LOG_LOCAL3
-	case "LOG_LOCAL4":
-		f |= syslog.LOG_LOCAL4
-	case "LOG_LOCAL5":
-		f |= syslog.LOG_LOCAL5
-	case "LOG_LOCAL6":
-		f |= syslog.LOG_LOCAL6
-	case "LOG_LOCAL7":
-		f |= syslog.LOG_LOCAL7
-	default:
-		return 0, fmt.Errorf("unsupported facility: %v", v)
+	q := u.Query()
+	if q.Get("prefix") == "" {
+		q.Set("prefix", SyslogPrefix)
+		u.RawQuery = q.Encode()
 	}
-	return f, nil
-}
-
-const SyslogPrefix = "@cee: "
-const SyslogTag = "pid"
-
-type prefixWriter struct {
-	w io.Writer
-	p []byte
+	return u.String()
 }
 
-func (p *prefixWriter) Write(val []byte) (int, error) {
-	b := bytes.Buffer{}
-	b.Write(p.p)
-	b.Write(val)
-	return p.w.Write(b.Bytes())
+// newWriter opens the output with the address.
+func newWriter(addr string) (io.Writer, error) {
+	return logsink.New(outputAddr(addr))
 }
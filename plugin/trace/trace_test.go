@@ -1,15 +1,20 @@
 package trace
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/mailgun/timetools"
 	"github.com/urfave/cli"
 	"github.com/vulcand/oxy/testutils"
 	oxytrace "github.com/vulcand/oxy/trace"
@@ -125,7 +130,7 @@ func (s *TraceSuite) TestHandler(c *C) {
 	var buf []byte
 	select {
 	case buf = <-outC:
-	case <-time.After(10 * time.Millisecond):
+	case <-time.After(time.Second):
 		c.Fatalf("timeout")
 	}
 
@@ -151,10 +156,166 @@ func (s *TraceSuite) TestNewFromCLI(c *C) {
 		c.Assert(t.Addr, Equals, "syslog://localhost:5000?sev=INFO&f=MAIL")
 		c.Assert(t.ReqHeaders, DeepEquals, []string{"X-A", "X-B"})
 		c.Assert(t.RespHeaders, DeepEquals, []string{"X-C", "X-D"})
+		c.Assert(t.SampleRate, Equals, 0.1)
+		c.Assert(t.MaxBodyBytes, Equals, int64(1024))
 
 		return nil
 	}
 	app.Flags = CliFlags()
-	app.Run([]string{"test", "--addr=syslog://localhost:5000?sev=INFO&f=MAIL", "--reqHeader=X-A", "--reqHeader=X-B", "--respHeader=X-C", "--respHeader=X-D"})
+	app.Run([]string{"test", "--addr=syslog://localhost:5000?sev=INFO&f=MAIL", "--reqHeader=X-A", "--reqHeader=X-B", "--respHeader=X-C", "--respHeader=X-D",
+		"--sampleRate=0.1", "--maxBodyBytes=1024"})
 	c.Assert(executed, Equals, true)
 }
+
+func (s *TraceSuite) TestFromOtherBadParams(c *C) {
+	tcs := []Trace{
+		{Addr: "omglog://"},
+		{Addr: "stdout://", SampleRate: -0.1},
+		{Addr: "stdout://", SampleRate: 1.1},
+		{Addr: "stdout://", MaxBodyBytes: -1},
+	}
+	for i, tc := range tcs {
+		_, err := FromOther(tc)
+		c.Assert(err, NotNil, Commentf("test case #%d: %v", i, tc))
+	}
+}
+
+// newTracer returns a tracer that writes records to the buffer.
+func newTracer(c *C, t Trace, buf *bytes.Buffer, next http.Handler) http.Handler {
+	t.Addr = "stdout://"
+	out, err := NewTrace(t)
+	c.Assert(err, IsNil)
+	return &tracer{next: next, writer: buf, config: out, reqHeaders: out.ReqHeaders, respHeaders: out.RespHeaders}
+}
+
+func (s *TraceSuite) TestSampling(c *C) {
+	buf := &bytes.Buffer{}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	sample := 0.0
+	h := newTracer(c, Trace{SampleRate: 0.5, rand: func() float64 { return sample }}, buf, next)
+
+	sample = 0.4
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/traced", nil))
+	sample = 0.6
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/skipped", nil))
+
+	records := readRecords(c, buf.Bytes())
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].Request.URL, Equals, "/traced")
+}
+
+func (s *TraceSuite) TestBodies(c *C) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	buf := &bytes.Buffer{}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		clock.Sleep(1500 * time.Microsecond)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("done"))
+	})
+	h := newTracer(c, Trace{MaxBodyBytes: 5, clock: clock}, buf, next)
+
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("hello world")))
+	c.Assert(re.Code, Equals, http.StatusCreated)
+	c.Assert(re.Body.String(), Equals, "done")
+
+	records := readRecords(c, buf.Bytes())
+	c.Assert(records, HasLen, 1)
+	r := records[0]
+	c.Assert(r.Request.Method, Equals, http.MethodPost)
+	c.Assert(r.Request.BodyBytes, Equals, int64(11))
+	c.Assert(r.Request.Body, Equals, "hello")
+	c.Assert(r.Request.BodyTruncated, Equals, true)
+	c.Assert(r.Response.Code, Equals, http.StatusCreated)
+	c.Assert(r.Response.BodyBytes, Equals, int64(4))
+	c.Assert(r.Response.Body, Equals, "done")
+	c.Assert(r.Response.BodyTruncated, Equals, false)
+	c.Assert(r.Response.Roundtrip, Equals, 1.5)
+}
+
+func (s *TraceSuite) TestNoBodies(c *C) {
+	buf := &bytes.Buffer{}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	})
+	h := newTracer(c, Trace{}, buf, next)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("hello")))
+
+	c.Assert(strings.Contains(buf.String(), "body\""), Equals, false)
+	records := readRecords(c, buf.Bytes())
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].Request.BodyBytes, Equals, int64(5))
+	c.Assert(records[0].Response.BodyBytes, Equals, int64(4))
+}
+
+func readRecords(c *C, data []byte) []Record {
+	var records []Record
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var r Record
+		c.Assert(json.Unmarshal(line, &r), IsNil)
+		records = append(records, r)
+	}
+	return records
+}
+
+func (s *TraceSuite) TestFile(c *C) {
+	path := filepath.Join(c.MkDir(), "trace.log")
+	t, err := NewTrace(Trace{Addr: "file://" + path})
+	c.Assert(err, IsNil)
+	h, err := t.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	c.Assert(err, IsNil)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/b", nil))
+
+	// Records are written in the background
+	var records []Record
+	for i := 0; i < 100 && len(records) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		data, err := ioutil.ReadFile(path)
+		c.Assert(err, IsNil)
+		records = readRecords(c, data)
+	}
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[0].Request.URL, Equals, "/a")
+	c.Assert(records[1].Request.URL, Equals, "/b")
+}
+
+func (s *TraceSuite) TestBatchHandler(c *C) {
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+	defer srv.Close()
+
+	t, err := NewTrace(Trace{Addr: srv.URL + "/_bulk?format=bulk&batchSize=1", MaxBodyBytes: 10})
+	c.Assert(err, IsNil)
+	h, err := t.NewHandlerWithEnv(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}), plugin.Env{RequestIdHeader: "X-Request-Id"})
+	c.Assert(err, IsNil)
+
+	req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	req.Header.Set("X-Request-Id", "abc")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var body string
+	select {
+	case body = <-bodies:
+	case <-time.After(time.Second):
+		c.Fatalf("timeout")
+	}
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(lines[0], Equals, `{"index":{}}`)
+	records := readRecords(c, []byte(lines[1]))
+	c.Assert(records[0].Request.URL, Equals, "/hello")
+	c.Assert(records[0].Request.Headers, DeepEquals, http.Header{"X-Request-Id": {"abc"}})
+	c.Assert(records[0].Response.Body, Equals, "hello")
+}
@@ -0,0 +1,217 @@
+package trace
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	oxytrace "github.com/vulcand/oxy/trace"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// Record is a structured record of a request and response, it extends the
+// record of the oxy trace middleware with captured bodies.
+type Record struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request contains information about an HTTP request.
+type Request struct {
+	oxytrace.Request
+	CapturedBody
+}
+
+// Response contains information about an HTTP response.
+type Response struct {
+	oxytrace.Response
+	CapturedBody
+}
+
+// CapturedBody is the beginning of a request or response body, captured if
+// the trace middleware is configured to. Bodies are recorded as text.
+type CapturedBody struct {
+	Body          string `json:"body,omitempty"`           // Body - captured body
+	BodyTruncated bool   `json:"body_truncated,omitempty"` // BodyTruncated tells if the body is longer than captured
+}
+
+// tracer writes a record of every sampled request to the writer.
+type tracer struct {
+	next        http.Handler
+	writer      io.Writer
+	config      *Trace
+	reqHeaders  []string
+	respHeaders []string
+}
+
+func (t *tracer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if t.config.SampleRate < 1 && t.config.rand() >= t.config.SampleRate {
+		t.next.ServeHTTP(w, r)
+		return
+	}
+	start := t.config.clock.UtcNow()
+	var reqBody *capture
+	if t.config.MaxBodyBytes != 0 && r.Body != nil && r.Body != http.NoBody {
+		reqBody = &capture{max: t.config.MaxBodyBytes}
+		r.Body = &captureReader{ReadCloser: r.Body, c: reqBody}
+	}
+	rw := &captureWriter{ResponseWriter: w, c: capture{max: t.config.MaxBodyBytes}}
+	t.next.ServeHTTP(rw, r)
+
+	record := t.newRecord(r, reqBody, rw, t.config.clock.UtcNow().Sub(start))
+	if err := json.NewEncoder(t.writer).Encode(record); err != nil {
+		plugin.RequestLog(r).Errorf("Failed to write trace record: %v", err)
+	}
+}
+
+func (t *tracer) newRecord(r *http.Request, reqBody *capture, rw *captureWriter, roundtrip time.Duration) *Record {
+	record := &Record{
+		Request: Request{
+			Request: oxytrace.Request{
+				Method:    r.Method,
+				URL:       r.URL.String(),
+				BodyBytes: r.ContentLength,
+				Headers:   captureHeaders(r.Header, t.reqHeaders),
+				TLS:       newTLS(r),
+			},
+		},
+		Response: Response{
+			Response: oxytrace.Response{
+				Code:      rw.code,
+				Roundtrip: float64(roundtrip) / float64(time.Millisecond),
+				Headers:   captureHeaders(rw.Header(), t.respHeaders),
+				BodyBytes: rw.c.size,
+			},
+			CapturedBody: rw.c.body(),
+		},
+	}
+	if record.Request.BodyBytes < 0 {
+		record.Request.BodyBytes = 0
+	}
+	if reqBody != nil {
+		record.Request.BodyBytes = reqBody.size
+		record.Request.CapturedBody = reqBody.body()
+	}
+	if record.Response.Code == 0 {
+		record.Response.Code = http.StatusOK
+	}
+	return record
+}
+
+func captureHeaders(in http.Header, headers []string) http.Header {
+	if len(headers) == 0 {
+		return nil
+	}
+	out := make(http.Header, len(headers))
+	for _, h := range headers {
+		h = http.CanonicalHeaderKey(h)
+		if vals, ok := in[h]; ok && len(out[h]) == 0 {
+			out[h] = append([]string(nil), vals...)
+		}
+	}
+	return out
+}
+
+func newTLS(r *http.Request) *oxytrace.TLS {
+	if r.TLS == nil {
+		return nil
+	}
+	return &oxytrace.TLS{
+		Version:     tlsVersionName(r.TLS.Version),
+		Resume:      r.TLS.DidResume,
+		CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+		Server:      r.TLS.ServerName,
+	}
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS10"
+	case tls.VersionTLS11:
+		return "TLS11"
+	case tls.VersionTLS12:
+		return "TLS12"
+	case tls.VersionTLS13:
+		return "TLS13"
+	}
+	return fmt.Sprintf("unknown: %x", v)
+}
+
+// capture keeps the beginning of a body and counts its bytes.
+type capture struct {
+	max  int64
+	buf  []byte
+	size int64
+}
+
+func (c *capture) write(p []byte) {
+	c.size += int64(len(p))
+	if n := c.max - int64(len(c.buf)); n > 0 {
+		if int64(len(p)) > n {
+			p = p[:n]
+		}
+		c.buf = append(c.buf, p...)
+	}
+}
+
+func (c *capture) body() CapturedBody {
+	if c.max == 0 {
+		return CapturedBody{}
+	}
+	return CapturedBody{Body: string(c.buf), BodyTruncated: c.size > int64(len(c.buf))}
+}
+
+type captureReader struct {
+	io.ReadCloser
+	c *capture
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.c.write(p[:n])
+	return n, err
+}
+
+// captureWriter records the status code and the body of a response.
+type captureWriter struct {
+	http.ResponseWriter
+	code int
+	c    capture
+}
+
+func (rw *captureWriter) WriteHeader(status int) {
+	if rw.code == 0 || rw.code < http.StatusOK {
+		rw.code = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *captureWriter) Write(p []byte) (int, error) {
+	if rw.code == 0 {
+		rw.code = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.c.write(p[:n])
+	return n, err
+}
+
+func (rw *captureWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", rw.ResponseWriter)
+	}
+	rw.code = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
@@ -5,8 +5,11 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"sync"
+	"time"
 
+	"github.com/mailgun/timetools"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/vulcand/engine"
@@ -20,6 +23,11 @@ type T struct {
 	id          string
 	httpCfg     engine.HTTPBackendSettings
 	httpTp      *http.Transport
+	slowStart   engine.SlowStartSettings
+	limiter     *Limiter
+	breaker     *Breaker
+	locality    engine.LocalitySettings
+	clock       timetools.TimeProvider
 	srvCfgsSeen bool
 	srvs        []Srv
 }
@@ -29,13 +37,24 @@ type Srv struct {
 	id        string
 	rawURL    string
 	parsedURL *url.URL
+	backup    bool
+	zone      string
+	region    string
+	labels    map[string]string
+	// since is the time when the server was brought into rotation. It is
+	// zero for servers that were there from the very beginning.
+	since time.Time
 }
 
 // Cfg returns engine.Server config of the backend server instance.
 func (s *Srv) Cfg() engine.Server {
 	return engine.Server{
-		Id:  s.id,
-		URL: s.rawURL,
+		Id:     s.id,
+		URL:    s.rawURL,
+		Backup: s.backup,
+		Zone:   s.zone,
+		Region: s.region,
+		Labels: s.labels,
 	}
 }
 
@@ -66,6 +85,10 @@ func NewServer(beSrvCfg engine.Server) (Srv, error) {
 		id:        beSrvCfg.Id,
 		rawURL:    beSrvCfg.URL,
 		parsedURL: parsed,
+		backup:    beSrvCfg.Backup,
+		zone:      beSrvCfg.Zone,
+		region:    beSrvCfg.Region,
+		labels:    beSrvCfg.Labels,
 	}, nil
 }
 
@@ -79,6 +102,38 @@ func (s *Srv) URLKey() SrvURLKey {
 	return NewSrvURLKey(s.parsedURL)
 }
 
+// Backup tells whether the server should only get traffic when no primary
+// server is available.
+func (s *Srv) Backup() bool {
+	return s.backup
+}
+
+// Zone returns the zone that the server is located in.
+func (s *Srv) Zone() string {
+	return s.zone
+}
+
+// Region returns the region that the server is located in.
+func (s *Srv) Region() string {
+	return s.region
+}
+
+// HasLabels tells whether the server has all the specified labels.
+func (s *Srv) HasLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		if s.labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Since returns the time when the server was brought into rotation. Zero time
+// is returned for servers that were part of the initial configuration.
+func (s *Srv) Since() time.Time {
+	return s.since
+}
+
 // New creates a new backend instance from a config fetched from a storage
 // engine and proxy options. An initial list of backend servers can be provided.
 func New(beCfg engine.Backend, opts proxy.Options, beSrvs []Srv) (*T, error) {
@@ -86,11 +141,37 @@ func New(beCfg engine.Backend, opts proxy.Options, beSrvs []Srv) (*T, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "bad config")
 	}
+	httpCfg := beCfg.HTTPSettings()
+	slowStart, err := httpCfg.SlowStartSettings()
+	if err != nil {
+		return nil, errors.Wrap(err, "bad config")
+	}
+	concurrency, err := httpCfg.ConcurrencySettings()
+	if err != nil {
+		return nil, errors.Wrap(err, "bad config")
+	}
+	locality, err := httpCfg.LocalitySettings()
+	if err != nil {
+		return nil, errors.Wrap(err, "bad config")
+	}
+	circuitBreaker, err := httpCfg.CircuitBreakerSettings()
+	if err != nil {
+		return nil, errors.Wrap(err, "bad config")
+	}
+	clock := opts.TimeProvider
+	if clock == nil {
+		clock = &timetools.RealTime{}
+	}
 	return &T{
-		id:      beCfg.Id,
-		httpCfg: beCfg.HTTPSettings(),
-		httpTp:  newTransport(tpCfg),
-		srvs:    beSrvs,
+		id:        beCfg.Id,
+		httpCfg:   httpCfg,
+		httpTp:    newTransport(tpCfg),
+		slowStart: slowStart,
+		limiter:   newLimiter(concurrency, clock),
+		breaker:   newBreaker(circuitBreaker, clock),
+		locality:  locality,
+		clock:     clock,
+		srvs:      beSrvs,
 	}, nil
 }
 
@@ -133,11 +214,34 @@ func (be *T) Update(beCfg engine.Backend, opts proxy.Options) (bool, error) {
 	if err != nil {
 		return false, errors.Wrap(err, "bad config")
 	}
+	httpCfg := beCfg.HTTPSettings()
+	slowStart, err := httpCfg.SlowStartSettings()
+	if err != nil {
+		return false, errors.Wrap(err, "bad config")
+	}
+	concurrency, err := httpCfg.ConcurrencySettings()
+	if err != nil {
+		return false, errors.Wrap(err, "bad config")
+	}
+	locality, err := httpCfg.LocalitySettings()
+	if err != nil {
+		return false, errors.Wrap(err, "bad config")
+	}
+	circuitBreaker, err := httpCfg.CircuitBreakerSettings()
+	if err != nil {
+		return false, errors.Wrap(err, "bad config")
+	}
 
 	// FIXME: But what about active connections?
 	be.httpTp.CloseIdleConnections()
 
-	be.httpCfg = beCfg.HTTPSettings()
+	be.httpCfg = httpCfg
+	be.slowStart = slowStart
+	be.limiter.update(concurrency)
+	if circuitBreaker != be.breaker.settings() {
+		be.breaker.update(circuitBreaker)
+	}
+	be.locality = locality
 	httpTp := newTransport(tpCfg)
 	be.httpTp = httpTp
 	return true, nil
@@ -152,9 +256,16 @@ func (be *T) UpsertServer(beSrvCfg engine.Server) (bool, error) {
 	if err != nil {
 		return false, errors.Wrapf(err, "bad config %v", beSrvCfg)
 	}
+	beSrv.since = be.clock.UtcNow()
 	if i := be.indexOfServer(beSrvCfg.Id); i != -1 {
 		if be.srvs[i].URLKey() == beSrv.URLKey() {
-			return false, nil
+			if reflect.DeepEqual(be.srvs[i].Cfg(), beSrv.Cfg()) {
+				return false, nil
+			}
+			// Changing server attributes other than URL, e.g. switching
+			// between primary and backup roles, does not bring the server
+			// into rotation anew.
+			beSrv.since = be.srvs[i].since
 		}
 		be.cloneSrvCfgsIfSeen()
 		be.srvs[i] = beSrv
@@ -175,6 +286,7 @@ func (be *T) DeleteServer(beSrvKey engine.ServerKey) bool {
 		log.Warnf("Cannot delete missing server %v from backend %v", beSrvKey.Id, be.id)
 		return false
 	}
+	be.breaker.remove(be.srvs[i].URLKey())
 	be.cloneSrvCfgsIfSeen()
 	lastIdx := len(be.srvs) - 1
 	copy(be.srvs[i:], be.srvs[i+1:])
@@ -195,6 +307,84 @@ func (be *T) Snapshot() (*http.Transport, []Srv) {
 	return be.httpTp, be.srvs
 }
 
+// SlowStart returns slow start settings of the backend.
+func (be *T) SlowStart() engine.SlowStartSettings {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	return be.slowStart
+}
+
+// SlowStartStats returns the current slow start state of a backend server. If
+// the server is not ramping up at the moment then false is returned.
+func (be *T) SlowStartStats(beSrvKey engine.ServerKey) (*engine.SlowStartStats, bool) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	i := be.indexOfServer(beSrvKey.Id)
+	if i == -1 {
+		return nil, false
+	}
+	since := be.srvs[i].since
+	// Servers that recover from tripped circuit breakers ramp up anew.
+	if recovered := be.breaker.recoveredAt(be.srvs[i].URLKey()); recovered.After(since) {
+		since = recovered
+	}
+	if since.IsZero() {
+		return nil, false
+	}
+	weight := be.slowStart.Weight(be.clock.UtcNow().Sub(since))
+	if weight >= 1 {
+		return nil, false
+	}
+	return &engine.SlowStartStats{Since: since, Weight: weight}, true
+}
+
+// Locality returns locality settings of the backend.
+func (be *T) Locality() engine.LocalitySettings {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	return be.locality
+}
+
+// Limiter returns the limiter that caps the number of in-flight requests per
+// server of the backend. It stays the same for the lifetime of the backend.
+func (be *T) Limiter() *Limiter {
+	return be.limiter
+}
+
+// Breaker returns circuit breakers of the backend servers. It stays the same
+// for the lifetime of the backend.
+func (be *T) Breaker() *Breaker {
+	return be.breaker
+}
+
+// CircuitBreakerStats returns the circuit breaker state of a backend server.
+// If circuit breakers are disabled for the backend then false is returned.
+func (be *T) CircuitBreakerStats(beSrvKey engine.ServerKey) (*engine.CircuitBreakerStats, bool) {
+	beSrv, ok := be.Server(beSrvKey)
+	if !ok || !be.breaker.Enabled() {
+		return nil, false
+	}
+	stats := be.breaker.Stats(beSrv.URLKey())
+	return &stats, true
+}
+
+// ServerCircuitBreakers returns circuit breaker states of all backend servers
+// by server id. The map is empty if circuit breakers are disabled.
+func (be *T) ServerCircuitBreakers() map[string]engine.CircuitBreakerStats {
+	_, beSrvs := be.Snapshot()
+	states := make(map[string]engine.CircuitBreakerStats)
+	if !be.breaker.Enabled() {
+		return states
+	}
+	for _, beSrv := range beSrvs {
+		states[beSrv.id] = be.breaker.Stats(beSrv.URLKey())
+	}
+	return states
+}
+
 // Server returns a backend server by a storage key if exists.
 func (be *T) Server(beSrvKey engine.ServerKey) (Srv, bool) {
 	be.mu.Lock()
@@ -0,0 +1,277 @@
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// ErrTripped is returned by a load balancer when circuit breakers of all
+// backend servers that could handle a request are tripped.
+var ErrTripped = errors.New("circuit breakers of all backend servers are tripped")
+
+// failoverSettings tell when servers of backends that have circuit breakers
+// disabled are down. Such servers keep getting their share of traffic, but
+// primary servers that are all down are replaced by backup ones.
+var failoverSettings = engine.CircuitBreakerSettings{
+	ErrorRatio:       0.5,
+	MinRequests:      engine.DefaultCircuitBreakerMinRequests,
+	Window:           engine.DefaultCircuitBreakerWindow,
+	FallbackDuration: engine.DefaultCircuitBreakerFallback,
+	RecoveryDuration: engine.DefaultCircuitBreakerRecovery,
+}
+
+// Breaker keeps circuit breakers of backend servers. A server breaker trips
+// when too many requests to the server fail, and then the server gets no
+// traffic for a while. After that its share of traffic grows back gradually,
+// unless requests keep failing. A breaker belongs to a backend and is shared
+// by all frontends associated with it, so that failures are counted no matter
+// what frontend requests come through.
+//
+// Breakers keep track of server health even if they are disabled, by the
+// failover settings, so that backup servers can take over failed primary
+// ones. Disabled breakers do not take servers out of rotation though.
+type Breaker struct {
+	mu    sync.Mutex
+	cfg   engine.CircuitBreakerSettings
+	clock timetools.TimeProvider
+	srvs  map[SrvURLKey]*srvBreaker
+}
+
+// srvBreaker is a circuit breaker of a single server.
+type srvBreaker struct {
+	state string
+	// since is the time the breaker entered the state.
+	since time.Time
+	// recovered is the last time the server came back into rotation after
+	// its breaker had tripped, zero if it never tripped.
+	recovered time.Time
+	// Requests are counted over fixed windows that start at windowStart.
+	windowStart time.Time
+	total       int
+	failed      int
+}
+
+func newBreaker(cfg engine.CircuitBreakerSettings, clock timetools.TimeProvider) *Breaker {
+	return &Breaker{
+		cfg:   cfg,
+		clock: clock,
+		srvs:  make(map[SrvURLKey]*srvBreaker),
+	}
+}
+
+// Enabled tells whether server circuit breakers are enabled.
+func (b *Breaker) Enabled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cfg.Enabled()
+}
+
+// Record counts a request to the specified server that completed with the
+// specified status, network errors are expected to be reported as 502 or 504.
+// It trips the server breaker if too many requests have failed.
+func (b *Breaker) Record(u *url.URL, status int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cfg := b.effective()
+	urlKey := NewSrvURLKey(u)
+	sb, ok := b.srvs[urlKey]
+	if !ok {
+		sb = &srvBreaker{state: engine.CircuitBreakerStandby}
+		b.srvs[urlKey] = sb
+	}
+	now := b.clock.UtcNow()
+	b.advance(urlKey, sb, now)
+	// Requests that were in flight when the breaker tripped say nothing new.
+	if sb.state == engine.CircuitBreakerTripped {
+		return
+	}
+	if now.Sub(sb.windowStart) >= cfg.Window {
+		sb.resetWindow(now)
+	}
+	sb.total++
+	if status >= http.StatusInternalServerError {
+		sb.failed++
+	}
+	if sb.total < cfg.MinRequests || float64(sb.failed)/float64(sb.total) <= cfg.ErrorRatio {
+		return
+	}
+	if b.cfg.Enabled() {
+		log.Warnf("Circuit breaker of server %v tripped, %d of %d requests failed", u, sb.failed, sb.total)
+	} else {
+		log.Warnf("Server %v is down, %d of %d requests failed", u, sb.failed, sb.total)
+	}
+	sb.state = engine.CircuitBreakerTripped
+	sb.since = now
+}
+
+// Weights returns the share of traffic, from 0 to 1, that servers with
+// tripped or recovering breakers should get. Servers that are not in the map
+// should get their full share. Nil is returned if all breakers are standing
+// by, which is what happens most of the time.
+func (b *Breaker) Weights() map[SrvURLKey]float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.cfg.Enabled() {
+		return nil
+	}
+	now := b.clock.UtcNow()
+	var weights map[SrvURLKey]float64
+	for urlKey, sb := range b.srvs {
+		b.advance(urlKey, sb, now)
+		var weight float64
+		switch sb.state {
+		case engine.CircuitBreakerStandby:
+			continue
+		case engine.CircuitBreakerRecovering:
+			weight = float64(now.Sub(sb.since)) / float64(b.cfg.RecoveryDuration)
+		}
+		if weights == nil {
+			weights = make(map[SrvURLKey]float64)
+		}
+		weights[urlKey] = weight
+	}
+	return weights
+}
+
+// Down returns servers with tripped breakers, whether breakers are enabled or
+// not. Nil is returned if no breaker is tripped.
+func (b *Breaker) Down() map[SrvURLKey]bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.UtcNow()
+	var down map[SrvURLKey]bool
+	for urlKey, sb := range b.srvs {
+		b.advance(urlKey, sb, now)
+		if sb.state != engine.CircuitBreakerTripped {
+			continue
+		}
+		if down == nil {
+			down = make(map[SrvURLKey]bool)
+		}
+		down[urlKey] = true
+	}
+	return down
+}
+
+// Recovered returns the times when servers with breakers that had tripped
+// came back into rotation. Servers that never tripped are not in the map.
+func (b *Breaker) Recovered() map[SrvURLKey]time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.UtcNow()
+	var recovered map[SrvURLKey]time.Time
+	for urlKey, sb := range b.srvs {
+		b.advance(urlKey, sb, now)
+		if sb.recovered.IsZero() {
+			continue
+		}
+		if recovered == nil {
+			recovered = make(map[SrvURLKey]time.Time)
+		}
+		recovered[urlKey] = sb.recovered
+	}
+	return recovered
+}
+
+// recoveredAt returns the last time a server came back into rotation after
+// its breaker had tripped, or zero time if it never tripped.
+func (b *Breaker) recoveredAt(urlKey SrvURLKey) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sb, ok := b.srvs[urlKey]
+	if !ok {
+		return time.Time{}
+	}
+	b.advance(urlKey, sb, b.clock.UtcNow())
+	return sb.recovered
+}
+
+// Stats returns the current state of the breaker of a server with the
+// specified URL key.
+func (b *Breaker) Stats(urlKey SrvURLKey) engine.CircuitBreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sb, ok := b.srvs[urlKey]
+	if !ok {
+		return engine.CircuitBreakerStats{State: engine.CircuitBreakerStandby}
+	}
+	b.advance(urlKey, sb, b.clock.UtcNow())
+	return engine.CircuitBreakerStats{State: sb.state, Since: sb.since}
+}
+
+func (b *Breaker) settings() engine.CircuitBreakerSettings {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cfg
+}
+
+// update applies new settings. All breakers are reset to standby, for they
+// have tripped by the rules that do not hold any more.
+func (b *Breaker) update(cfg engine.CircuitBreakerSettings) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cfg = cfg
+	b.srvs = make(map[SrvURLKey]*srvBreaker)
+}
+
+// effective returns the settings that breakers follow: the configured ones if
+// breakers are enabled, and the failover ones otherwise.
+func (b *Breaker) effective() engine.CircuitBreakerSettings {
+	if b.cfg.Enabled() {
+		return b.cfg
+	}
+	return failoverSettings
+}
+
+// remove forgets the breaker of a server that was deleted from the backend.
+func (b *Breaker) remove(urlKey SrvURLKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.srvs, urlKey)
+}
+
+// advance moves a tripped breaker to recovering once the fallback duration
+// is over, and a recovering one to standby once the recovery duration is
+// over.
+func (b *Breaker) advance(urlKey SrvURLKey, sb *srvBreaker, now time.Time) {
+	cfg := b.effective()
+	switch sb.state {
+	case engine.CircuitBreakerTripped:
+		if now.Sub(sb.since) < cfg.FallbackDuration {
+			return
+		}
+		log.Infof("Circuit breaker of server %s://%s is recovering", urlKey.scheme, urlKey.host)
+		sb.state = engine.CircuitBreakerRecovering
+		sb.since = now
+		sb.recovered = now
+		sb.resetWindow(now)
+	case engine.CircuitBreakerRecovering:
+		if now.Sub(sb.since) < cfg.RecoveryDuration {
+			return
+		}
+		log.Infof("Circuit breaker of server %s://%s is standing by", urlKey.scheme, urlKey.host)
+		sb.state = engine.CircuitBreakerStandby
+		sb.since = now
+	}
+}
+
+func (sb *srvBreaker) resetWindow(now time.Time) {
+	sb.windowStart = now
+	sb.total = 0
+	sb.failed = 0
+}
@@ -0,0 +1,227 @@
+package backend
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// QueueError is returned by Limiter.Acquire when a request could not get a
+// server either because the queue is full or because it waited for too long.
+type QueueError struct {
+	// Reason tells why the request was turned down
+	Reason string
+	// RetryAfter is a hint for the client on when to try again
+	RetryAfter time.Duration
+}
+
+func (e *QueueError) Error() string {
+	return fmt.Sprintf("backend servers are at capacity: %s", e.Reason)
+}
+
+// Limiter caps the number of in-flight requests per backend server. Requests
+// that come when every server is at its cap wait in a bounded queue for one to
+// free up. A limiter belongs to a backend and is shared by all frontends
+// associated with it, so that the cap holds no matter what frontend requests
+// come through.
+type Limiter struct {
+	mu       sync.Mutex
+	cfg      engine.ConcurrencySettings
+	clock    timetools.TimeProvider
+	inFlight map[SrvURLKey]int
+	// acquired are URLs returned by Acquire that have not been released yet.
+	// Every call to Acquire returns a URL of its own, so it tells whether a
+	// request being done actually took a slot, e.g. requests routed by a
+	// sticky session never do.
+	acquired map[*url.URL]bool
+	// released is closed and replaced every time a slot is released to wake
+	// up requests waiting in the queue.
+	released chan struct{}
+	depth    int
+	enqueued int64
+	rejected int64
+	timedOut int64
+	waited   int64
+	waitSum  time.Duration
+	waitMax  time.Duration
+}
+
+func newLimiter(cfg engine.ConcurrencySettings, clock timetools.TimeProvider) *Limiter {
+	return &Limiter{
+		cfg:      cfg,
+		clock:    clock,
+		inFlight: make(map[SrvURLKey]int),
+		acquired: make(map[*url.URL]bool),
+		released: make(chan struct{}),
+	}
+}
+
+// Enabled tells whether server concurrency is capped.
+func (l *Limiter) Enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg.Enabled()
+}
+
+// Acquire calls next to get servers suggested by a load balancer until it
+// gets one that is below its cap, or gives up after the specified number of
+// attempts. In the latter case the request is queued until a slot is released
+// somewhere, and then everything is tried again. A server returned by Acquire
+// must be released with Release when the request is done. The returned URL
+// must not be shared with other requests.
+func (l *Limiter) Acquire(next func() (*url.URL, error), attempts int) (*url.URL, error) {
+	var queuedAt time.Time
+	for {
+		l.mu.Lock()
+		cfg := l.cfg
+		released := l.released
+		l.mu.Unlock()
+
+		if !cfg.Enabled() {
+			l.dequeue(queuedAt, false)
+			return next()
+		}
+		for i := 0; i < attempts; i++ {
+			u, err := next()
+			if err != nil {
+				l.dequeue(queuedAt, false)
+				return nil, err
+			}
+			if l.tryAcquire(u) {
+				l.dequeue(queuedAt, false)
+				return u, nil
+			}
+		}
+
+		if queuedAt.IsZero() {
+			if !l.enqueue() {
+				return nil, &QueueError{Reason: "queue is full", RetryAfter: cfg.QueueTimeout}
+			}
+			queuedAt = l.clock.UtcNow()
+			// Give it another try right away, for a slot could have been
+			// released before the request got counted as waiting, in which
+			// case nobody would have woken it up.
+			continue
+		}
+		remaining := cfg.QueueTimeout - l.clock.UtcNow().Sub(queuedAt)
+		if remaining <= 0 {
+			l.dequeue(queuedAt, true)
+			return nil, &QueueError{Reason: "timed out waiting in queue", RetryAfter: cfg.QueueTimeout}
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-released:
+			timer.Stop()
+		case <-timer.C:
+			l.dequeue(queuedAt, true)
+			return nil, &QueueError{Reason: "timed out waiting in queue", RetryAfter: cfg.QueueTimeout}
+		}
+	}
+}
+
+// Release frees a slot taken by a request to the specified server. It does
+// nothing unless the URL is the one returned by Acquire, for requests that got
+// their servers some other way have not taken any slot.
+func (l *Limiter) Release(u *url.URL) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.acquired[u] {
+		return
+	}
+	delete(l.acquired, u)
+	urlKey := NewSrvURLKey(u)
+	count, ok := l.inFlight[urlKey]
+	if !ok {
+		return
+	}
+	if count <= 1 {
+		delete(l.inFlight, urlKey)
+	} else {
+		l.inFlight[urlKey] = count - 1
+	}
+	if l.depth > 0 {
+		close(l.released)
+		l.released = make(chan struct{})
+	}
+}
+
+// Stats returns the queue stats.
+func (l *Limiter) Stats() engine.QueueStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := engine.QueueStats{
+		Depth:    l.depth,
+		Enqueued: l.enqueued,
+		Rejected: l.rejected,
+		TimedOut: l.timedOut,
+		MaxWait:  l.waitMax,
+	}
+	if l.waited > 0 {
+		stats.MeanWait = l.waitSum / time.Duration(l.waited)
+	}
+	return stats
+}
+
+func (l *Limiter) update(cfg engine.ConcurrencySettings) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cfg = cfg
+	// Let waiting requests reconsider their options under the new config.
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+func (l *Limiter) tryAcquire(u *url.URL) bool {
+	urlKey := NewSrvURLKey(u)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cfg.Enabled() && l.inFlight[urlKey] >= l.cfg.MaxPerServer {
+		return false
+	}
+	l.inFlight[urlKey]++
+	l.acquired[u] = true
+	return true
+}
+
+func (l *Limiter) enqueue() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.depth >= l.cfg.QueueSize {
+		l.rejected++
+		return false
+	}
+	l.depth++
+	l.enqueued++
+	return true
+}
+
+// dequeue removes a request from the queue and records how long it waited.
+// It does nothing if the request was never queued.
+func (l *Limiter) dequeue(queuedAt time.Time, timedOut bool) {
+	if queuedAt.IsZero() {
+		return
+	}
+	wait := l.clock.UtcNow().Sub(queuedAt)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.depth--
+	l.waited++
+	l.waitSum += wait
+	if wait > l.waitMax {
+		l.waitMax = wait
+	}
+	if timedOut {
+		l.timedOut++
+	}
+}
@@ -0,0 +1,261 @@
+package frontend
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/proxy/backend"
+)
+
+// location tells where a vulcand instance is located.
+type location struct {
+	zone   string
+	region string
+}
+
+// balancer wraps a round-robin load balancer and gets the final say on the
+// servers that the latter picks. It is a place where server selection policies
+// that roundrobin knows nothing about are implemented, e.g. slow start, per
+// server concurrency caps, circuit breakers, backup servers and locality.
+//
+// It satisfies the interface that roundrobin.Rebalancer expects from the load
+// balancer that it wraps.
+type balancer struct {
+	*roundrobin.RoundRobin
+	// backups is a load balancer over backup servers. It is only consulted
+	// when no primary server is available.
+	backups   *roundrobin.RoundRobin
+	primaries int
+	slowStart engine.SlowStartSettings
+	limiter   *backend.Limiter
+	breaker   *backend.Breaker
+	clock     timetools.TimeProvider
+	srvs      map[backend.SrvURLKey]backend.Srv
+	// tiers are sets of primary servers ordered from the closest to vulcand
+	// to the farthest, e.g. servers in the same zone and servers in the same
+	// region. Servers that are not in any tier are the farthest. It is empty
+	// if the backend does not prefer local servers.
+	tiers []map[backend.SrvURLKey]bool
+	// backupTiers are the same for backup servers.
+	backupTiers []map[backend.SrvURLKey]bool
+	minLocal    int
+}
+
+func newBalancer(rr, backups *roundrobin.RoundRobin, be *backend.T, beSrvs []backend.Srv, loc location,
+	clock timetools.TimeProvider,
+) *balancer {
+	srvs := make(map[backend.SrvURLKey]backend.Srv, len(beSrvs))
+	primaries := 0
+	for _, beSrv := range beSrvs {
+		srvs[beSrv.URLKey()] = beSrv
+		if !beSrv.Backup() {
+			primaries++
+		}
+	}
+	b := &balancer{
+		RoundRobin: rr,
+		backups:    backups,
+		primaries:  primaries,
+		slowStart:  be.SlowStart(),
+		limiter:    be.Limiter(),
+		breaker:    be.Breaker(),
+		clock:      clock,
+		srvs:       srvs,
+	}
+	locality := be.Locality()
+	b.tiers = localityTiers(locality, loc, beSrvs, false)
+	b.backupTiers = localityTiers(locality, loc, beSrvs, true)
+	b.minLocal = locality.MinLocalServers
+	return b
+}
+
+// NextServer returns the next server that should handle a request. If server
+// concurrency is capped then it may block until a server frees up. The slot
+// taken on the returned server is released by releaser once the request is
+// done.
+func (b *balancer) NextServer() (*url.URL, error) {
+	// Give every server a couple of chances to be picked before queueing.
+	return b.limiter.Acquire(b.nextServer, 2*len(b.srvs)+1)
+}
+
+func (b *balancer) nextServer() (*url.URL, error) {
+	breakerWeights := b.breaker.Weights()
+	down := b.breaker.Down()
+	pool, tiers := b.pool(down)
+	tier := b.pickTier(tiers, down)
+	if tier == nil && !b.slowStart.Enabled() && breakerWeights == nil {
+		return pool.NextServer()
+	}
+	var weights map[backend.SrvURLKey]float64
+	maxWeight := 1.0
+	if b.slowStart.Enabled() {
+		weights, maxWeight = b.slowStartWeights()
+	}
+	// Servers outside of the picked tier are skipped. Servers that are ramping
+	// up are skipped with probability that is proportional to how far they
+	// are from their full weight, and so are servers with recovering circuit
+	// breakers. Servers with tripped circuit breakers are never used. The
+	// number of attempts is bounded, so that if we are out of luck, the last
+	// server suggested by roundrobin is used, preferably one from the picked
+	// tier.
+	var fallback *url.URL
+	for i := 0; i < maxPickAttempts+len(b.srvs); i++ {
+		u, err := pool.NextServer()
+		if err != nil {
+			return nil, err
+		}
+		urlKey := backend.NewSrvURLKey(u)
+		breakerWeight, ok := breakerWeights[urlKey]
+		if !ok {
+			breakerWeight = 1
+		}
+		if breakerWeight <= 0 {
+			continue
+		}
+		if tier != nil && !tier[urlKey] {
+			if fallback == nil {
+				fallback = u
+			}
+			continue
+		}
+		fallback = u
+		weight, ok := weights[urlKey]
+		if !ok {
+			weight = 1
+		}
+		if rand.Float64()*maxWeight < weight*breakerWeight {
+			return u, nil
+		}
+	}
+	if fallback == nil {
+		return nil, backend.ErrTripped
+	}
+	return fallback, nil
+}
+
+// pool returns the load balancer that servers should be picked from. That is
+// the primary one as long as there are primary servers available, and the
+// backup one otherwise. Primary servers that are down, i.e. have tripped
+// circuit breakers, are not available, unless there are no backup servers to
+// take over. Servers are known to be down even if circuit breakers are
+// disabled for the backend.
+func (b *balancer) pool(down map[backend.SrvURLKey]bool) (*roundrobin.RoundRobin, []map[backend.SrvURLKey]bool) {
+	available := b.primaries
+	for urlKey := range down {
+		if beSrv, ok := b.srvs[urlKey]; ok && !beSrv.Backup() {
+			available--
+		}
+	}
+	if available > 0 || b.primaries == len(b.srvs) {
+		return b.RoundRobin, b.tiers
+	}
+	return b.backups, b.backupTiers
+}
+
+// pickTier picks one of the locality tiers of a pool that a request should go
+// to, or returns nil if a request can go to any server. A tier gets all the
+// traffic that comes to it as long as it has at least the min number of local
+// servers that are not down. When there are fewer, the tier gets a
+// proportionally smaller share and the rest spills over to the next tier.
+func (b *balancer) pickTier(tiers []map[backend.SrvURLKey]bool, down map[backend.SrvURLKey]bool,
+) map[backend.SrvURLKey]bool {
+	for _, tier := range tiers {
+		healthy := 0
+		for urlKey := range tier {
+			if !down[urlKey] {
+				healthy++
+			}
+		}
+		share := float64(healthy) / float64(b.minLocal)
+		if share >= 1 || rand.Float64() < share {
+			return tier
+		}
+	}
+	return nil
+}
+
+// slowStartWeights returns current slow start weights of servers that are
+// ramping up along with the max weight across all servers. Servers ramp up
+// when they are brought into rotation, and again when they recover from
+// tripped circuit breakers.
+func (b *balancer) slowStartWeights() (map[backend.SrvURLKey]float64, float64) {
+	now := b.clock.UtcNow()
+	recovered := b.breaker.Recovered()
+	var weights map[backend.SrvURLKey]float64
+	maxWeight := 0.0
+	for urlKey, beSrv := range b.srvs {
+		since := beSrv.Since()
+		if recoveredAt := recovered[urlKey]; recoveredAt.After(since) {
+			since = recoveredAt
+		}
+		weight := 1.0
+		if !since.IsZero() {
+			weight = b.slowStart.Weight(now.Sub(since))
+		}
+		if weight > maxWeight {
+			maxWeight = weight
+		}
+		if weight >= 1 {
+			continue
+		}
+		if weights == nil {
+			weights = make(map[backend.SrvURLKey]float64)
+		}
+		weights[urlKey] = weight
+	}
+	return weights, maxWeight
+}
+
+// localityTiers groups servers of a pool, either primary or backup, into
+// locality tiers according to the backend locality settings.
+func localityTiers(settings engine.LocalitySettings, loc location, beSrvs []backend.Srv, backup bool,
+) []map[backend.SrvURLKey]bool {
+	if !settings.Enabled() {
+		return nil
+	}
+	sameZone := make(map[backend.SrvURLKey]bool)
+	sameRegion := make(map[backend.SrvURLKey]bool)
+	for _, beSrv := range beSrvs {
+		if beSrv.Backup() != backup {
+			continue
+		}
+		inZone := loc.zone != "" && beSrv.Zone() == loc.zone
+		if inZone {
+			sameZone[beSrv.URLKey()] = true
+		}
+		// Servers in the same zone are surely in the same region, even if
+		// they are not labeled so.
+		if inZone || (loc.region != "" && beSrv.Region() == loc.region) {
+			sameRegion[beSrv.URLKey()] = true
+		}
+	}
+	if settings.Prefer == engine.LocalityZone {
+		return []map[backend.SrvURLKey]bool{sameZone, sameRegion}
+	}
+	return []map[backend.SrvURLKey]bool{sameRegion}
+}
+
+const maxPickAttempts = 16
+
+// releaser frees a server slot taken by balancer when a request forwarded to
+// the server is done. It also reports the outcome of the request to the server
+// circuit breaker.
+type releaser struct {
+	next    http.Handler
+	limiter *backend.Limiter
+	breaker *backend.Breaker
+}
+
+func (rl *releaser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer rl.limiter.Release(r.URL)
+	// Outcomes are reported even if circuit breakers are disabled, for they
+	// tell when backup servers should take over.
+	pw := utils.NewProxyWriter(w)
+	rl.next.ServeHTTP(pw, r)
+	rl.breaker.Record(r.URL, pw.StatusCode())
+}
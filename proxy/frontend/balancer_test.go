@@ -0,0 +1,91 @@
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/proxy/backend"
+	. "gopkg.in/check.v1"
+)
+
+func TestFrontend(t *testing.T) { TestingT(t) }
+
+type BalancerSuite struct{}
+
+var _ = Suite(&BalancerSuite{})
+
+// newRebalancer returns a rebalancer with sticky sessions over a balancer of
+// the backend servers, that passes requests on to the handler.
+func newRebalancer(c *C, be *backend.T, beSrvs []backend.Srv, h http.Handler) *roundrobin.Rebalancer {
+	rl := &releaser{next: h, limiter: be.Limiter(), breaker: be.Breaker()}
+	rr, err := roundrobin.New(rl)
+	c.Assert(err, IsNil)
+	backupRR, err := roundrobin.New(rl)
+	c.Assert(err, IsNil)
+	lb := newBalancer(rr, backupRR, be, beSrvs, location{}, &timetools.RealTime{})
+	rb, err := roundrobin.NewRebalancer(lb,
+		roundrobin.RebalancerErrorHandler(DefaultHandler),
+		roundrobin.RebalancerStickySession(roundrobin.NewStickySession("backend")))
+	c.Assert(err, IsNil)
+	for _, beSrv := range beSrvs {
+		c.Assert(rb.UpsertServer(beSrv.URL()), IsNil)
+	}
+	return rb
+}
+
+// Requests routed by sticky sessions do not take server slots, and so they
+// must not release any.
+func (s *BalancerSuite) TestConcurrencyCapStickySession(c *C) {
+	beCfg, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{
+		Concurrency: engine.HTTPBackendConcurrency{MaxPerServer: 1},
+	})
+	c.Assert(err, IsNil)
+	beSrv, err := backend.NewServer(engine.Server{Id: "srv1", URL: "http://localhost:5000"})
+	c.Assert(err, IsNil)
+	be, err := backend.New(*beCfg, proxy.Options{}, []backend.Srv{beSrv})
+	c.Assert(err, IsNil)
+
+	inside := make(chan struct{})
+	unblock := make(chan struct{})
+	rb := newRebalancer(c, be, []backend.Srv{beSrv}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Block") != "" {
+			inside <- struct{}{}
+			<-unblock
+		}
+	}))
+
+	// The first request takes the only slot there is.
+	firstDone := make(chan int)
+	go func() {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Block", "yes")
+		w := httptest.NewRecorder()
+		rb.ServeHTTP(w, r)
+		firstDone <- w.Code
+	}()
+	<-inside
+
+	// A sticky request goes to the server anyway.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "backend", Value: "http://localhost:5000"})
+	w := httptest.NewRecorder()
+	rb.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	// And the slot is still taken.
+	w = httptest.NewRecorder()
+	rb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+
+	close(unblock)
+	c.Assert(<-firstDone, Equals, http.StatusOK)
+
+	w = httptest.NewRecorder()
+	rb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+}
@@ -3,12 +3,16 @@ package frontend
 import (
 	"errors"
 	"io"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/proxy/backend"
 	"golang.org/x/net/context"
 	"golang.org/x/time/rate"
 )
@@ -23,7 +27,15 @@ type StdHandler struct{}
 func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
 	statusCode := http.StatusInternalServerError
 
-	if e, ok := err.(net.Error); ok {
+	var queueErr *backend.QueueError
+	if errors.As(err, &queueErr) {
+		statusCode = http.StatusServiceUnavailable
+		retryAfter := int(math.Ceil(queueErr.RetryAfter.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	} else if e, ok := err.(net.Error); ok {
 		if e.Timeout() {
 			statusCode = http.StatusGatewayTimeout
 		} else {
@@ -31,13 +43,15 @@ func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err err
 		}
 	} else if errors.Is(err, io.EOF) {
 		statusCode = http.StatusBadGateway
+	} else if errors.Is(err, errNoSubsetServers) || errors.Is(err, backend.ErrTripped) {
+		statusCode = http.StatusServiceUnavailable
 	} else if errors.Is(err, context.Canceled) {
 		statusCode = utils.StatusClientClosedRequest
 	} else if err.Error() == "no servers in the pool" {
 		// TODO update once vulcand/oxy swaps this to a sentinel error
 		statusCode = http.StatusServiceUnavailable
 		if logLimiter.Allow() {
-			log.WithFields(log.Fields{
+			plugin.RequestLog(req).WithFields(log.Fields{
 				"url":         req.URL.String(),
 				"log-limiter": int(logLimiter.Tokens()),
 			}).Warnf("request failed with 503; the backend has no servers")
@@ -46,7 +60,7 @@ func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err err
 
 	w.WriteHeader(statusCode)
 	_, _ = w.Write([]byte(statusText(statusCode)))
-	log.Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
+	plugin.RequestLog(req).Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
 }
 
 func statusText(statusCode int) string {
@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"reflect"
 	"sort"
 	"sync"
 	"time"
 
+	"github.com/mailgun/timetools"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/oxy/buffer"
@@ -35,6 +37,9 @@ type T struct {
 	handler    http.Handler
 	rtmCollect *rtmcollect.T
 	listeners  plugin.FrontendListeners
+	clock      timetools.TimeProvider
+	location   location
+	env        plugin.Env
 }
 
 // New returns a new frontend instance.
@@ -45,12 +50,20 @@ func New(cfg engine.Frontend, be *backend.T, opts proxy.Options,
 	if mwCfgs == nil {
 		mwCfgs = make(map[engine.MiddlewareKey]engine.Middleware)
 	}
+	clock := opts.TimeProvider
+	if clock == nil {
+		clock = &timetools.RealTime{}
+	}
 	fe := T{
 		cfg:       cfg,
 		trustXFDH: opts.TrustForwardHeader,
 		mwCfgs:    mwCfgs,
 		backend:   be,
 		listeners: listeners,
+		clock:     clock,
+		location:  location{zone: opts.Zone, region: opts.Region},
+		env: plugin.Env{CacheProvider: opts.CacheProvider, MetricsClient: opts.MetricsClient, ValueStore: opts.ValueStore,
+			FrontendId: cfg.Id, RequestIdHeader: opts.RequestIdHeader},
 	}
 	return &fe
 }
@@ -108,6 +121,9 @@ func (fe *T) UpsertMiddleware(mwCfg engine.Middleware) {
 	defer fe.mu.Unlock()
 
 	mwKey := engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: fe.cfg.Id}, Id: mwCfg.Id}
+	if old, ok := fe.mwCfgs[mwKey]; ok && (old.Type != mwCfg.Type || !reflect.DeepEqual(old.Middleware, mwCfg.Middleware)) {
+		fe.releaseMiddleware(old)
+	}
 	fe.mwCfgs[mwKey] = mwCfg
 	fe.ready = false
 }
@@ -118,13 +134,32 @@ func (fe *T) DeleteMiddleware(mwKey engine.MiddlewareKey) {
 	fe.mu.Lock()
 	defer fe.mu.Unlock()
 
-	if _, ok := fe.mwCfgs[mwKey]; !ok {
+	mwCfg, ok := fe.mwCfgs[mwKey]
+	if !ok {
 		return
 	}
+	fe.releaseMiddleware(mwCfg)
 	delete(fe.mwCfgs, mwKey)
 	fe.ready = false
 }
 
+// Release drops the state that middlewares of the frontend keep beyond their
+// handlers. It should be called when the frontend is deleted.
+func (fe *T) Release() {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	for _, mwCfg := range fe.mwCfgs {
+		fe.releaseMiddleware(mwCfg)
+	}
+}
+
+func (fe *T) releaseMiddleware(mwCfg engine.Middleware) {
+	env := fe.env
+	env.MiddlewareId = mwCfg.Id
+	plugin.Release(mwCfg.Middleware, env)
+}
+
 // OnBackendMutated should be called when state of the associated backend is
 // changed, e.g. when a new backend server is added or something like that.
 func (fe *T) OnBackendMutated() {
@@ -234,7 +269,8 @@ func (fe *T) rebuild() error {
 		forward.WebsocketTLSClientConfig(httpTp.TLSClientConfig),
 		forward.Stream(httpCfg.Stream),
 		forward.StreamingFlushInterval(time.Duration(httpCfg.StreamFlushIntervalNanoSecs)*time.Nanosecond),
-		forward.StateListener(fe.listeners.ConnTck))
+		forward.StateListener(fe.listeners.ConnTck),
+		forward.ErrorHandler(DefaultHandler))
 
 	// Add a round-trip metrics collector to the handlers chain.
 	rc, err := rtmcollect.New(fwd)
@@ -242,22 +278,32 @@ func (fe *T) rebuild() error {
 		return errors.Wrap(err, "cannot create rtmCollect")
 	}
 
+	// Make sure that server slots taken by the load balancer are released
+	// and server circuit breakers learn about outcomes when requests are done.
+	rl := &releaser{next: rc, limiter: fe.backend.Limiter(), breaker: fe.backend.Breaker()}
+
 	// Add a load balancer to the handlers chain.
-	rr, err := roundrobin.New(rc,
-		roundrobin.Logger(log.StandardLogger()),
-		roundrobin.ErrorHandler(DefaultHandler),
-		roundrobin.RoundRobinRequestRewriteListener(fe.listeners.RrRewriteListener))
+	lbf := &lbFactory{
+		next:      rl,
+		watcher:   rc,
+		backend:   fe.backend,
+		listeners: fe.listeners,
+		location:  fe.location,
+		clock:     fe.clock,
+	}
+	rb, err := lbf.newLoadBalancer(beSrvs)
 	if err != nil {
-		return errors.Wrap(err, "cannot create load balancer")
+		return err
 	}
 
-	// Add a rebalancer to the handlers chain. It will readjust load balancer
-	// weights based on error ratios.
-	rb, err := roundrobin.NewRebalancer(rr,
-		roundrobin.RebalancerErrorHandler(DefaultHandler),
-		roundrobin.RebalancerRequestRewriteListener(fe.listeners.RbRewriteListener))
+	// Route requests that should only go to servers with certain labels to
+	// load balancers of their own. They are created as requests come, so the
+	// factory must not refer to the frontend state that can change meanwhile.
+	sr, err := newSubsetRouter(httpCfg.Subset, rb, beSrvs, func(subsetSrvs []backend.Srv) (http.Handler, error) {
+		return lbf.newLoadBalancer(subsetSrvs)
+	})
 	if err != nil {
-		return errors.Wrap(err, "cannot create rebalancer")
+		return errors.Wrap(err, "cannot create subset router")
 	}
 
 	// create middlewares sorted by priority and chain them
@@ -267,11 +313,13 @@ func (fe *T) rebuild() error {
 	for i, mw := range middlewares {
 		var prev http.Handler
 		if i == 0 {
-			prev = rb
+			prev = sr
 		} else {
 			prev = handlers[i-1]
 		}
-		h, err := mw.Middleware.NewHandler(prev)
+		env := fe.env
+		env.MiddlewareId = mw.Id
+		h, err := plugin.NewHandler(mw.Middleware, prev, env)
 		if err != nil {
 			return errors.Wrapf(err, "cannot get middleware %v handler", mw.Id)
 		}
@@ -282,7 +330,7 @@ func (fe *T) rebuild() error {
 	if len(handlers) != 0 {
 		next = handlers[len(handlers)-1]
 	} else {
-		next = rb
+		next = sr
 	}
 
 	// stream will retry and replay requests, fix encodings
@@ -303,15 +351,84 @@ func (fe *T) rebuild() error {
 		return errors.Wrap(err, "failed to create handler")
 	}
 
-	syncServers(rb, beSrvs, rc)
-
 	fe.handler = topHandler
 	fe.rtmCollect = rc
 	return nil
 }
 
-// syncServers syncs backend servers and rebalancer state.
-func syncServers(balancer *roundrobin.Rebalancer, beSrvs []backend.Srv, watcher *rtmcollect.T) {
+// lbFactory creates load balancers of a frontend. It is a snapshot of the
+// frontend state taken when the frontend handler is built.
+type lbFactory struct {
+	next      http.Handler
+	watcher   *rtmcollect.T
+	backend   *backend.T
+	listeners plugin.FrontendListeners
+	location  location
+	clock     timetools.TimeProvider
+}
+
+// newLoadBalancer creates a load balancer over the specified backend servers.
+func (f *lbFactory) newLoadBalancer(beSrvs []backend.Srv) (*roundrobin.Rebalancer, error) {
+	rr, err := roundrobin.New(f.next,
+		roundrobin.Logger(log.StandardLogger()),
+		roundrobin.ErrorHandler(DefaultHandler),
+		roundrobin.RoundRobinRequestRewriteListener(f.listeners.RrRewriteListener))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create load balancer")
+	}
+
+	// Backup servers are kept in a load balancer of their own, so that they
+	// do not get any traffic while primary servers are available.
+	backupRR, err := roundrobin.New(f.next,
+		roundrobin.Logger(log.StandardLogger()),
+		roundrobin.ErrorHandler(DefaultHandler),
+		roundrobin.RoundRobinRequestRewriteListener(f.listeners.RrRewriteListener))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create backup load balancer")
+	}
+
+	// Wrap the load balancers to apply server selection policies configured
+	// for the backend, e.g. slow start, server concurrency caps and locality.
+	lb := newBalancer(rr, backupRR, f.backend, beSrvs, f.location, f.clock)
+
+	// Add a rebalancer to the handlers chain. It will readjust load balancer
+	// weights based on error ratios.
+	rb, err := roundrobin.NewRebalancer(lb,
+		roundrobin.RebalancerErrorHandler(DefaultHandler),
+		roundrobin.RebalancerRequestRewriteListener(f.listeners.RbRewriteListener))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create rebalancer")
+	}
+
+	primarySrvs, backupSrvs := splitServers(beSrvs)
+	syncServers(rb, primarySrvs, f.watcher)
+	syncServers(backupRR, backupSrvs, f.watcher)
+	return rb, nil
+}
+
+// serverPool is implemented by both roundrobin.RoundRobin and
+// roundrobin.Rebalancer.
+type serverPool interface {
+	Servers() []*url.URL
+	UpsertServer(u *url.URL, options ...roundrobin.ServerOption) error
+	RemoveServer(u *url.URL) error
+}
+
+// splitServers splits backend servers into primary and backup ones.
+func splitServers(beSrvs []backend.Srv) ([]backend.Srv, []backend.Srv) {
+	var primarySrvs, backupSrvs []backend.Srv
+	for _, beSrv := range beSrvs {
+		if beSrv.Backup() {
+			backupSrvs = append(backupSrvs, beSrv)
+		} else {
+			primarySrvs = append(primarySrvs, beSrv)
+		}
+	}
+	return primarySrvs, backupSrvs
+}
+
+// syncServers syncs backend servers and load balancer state.
+func syncServers(balancer serverPool, beSrvs []backend.Srv, watcher *rtmcollect.T) {
 	// First, collect and parse servers to add
 	newServers := make(map[backend.SrvURLKey]backend.Srv)
 	for _, newBeSrv := range beSrvs {
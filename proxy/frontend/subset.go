@@ -0,0 +1,115 @@
+package frontend
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/proxy/backend"
+)
+
+// errNoSubsetServers is returned when no backend server has the labels that a
+// request asks for, and the frontend is not allowed to fall back to all
+// servers in such case.
+var errNoSubsetServers = errors.New("no servers match the subset selector")
+
+// subsetRouter routes requests to load balancers over subsets of backend
+// servers that have labels requested either by the frontend subset selector or
+// by middlewares. Load balancers are created on demand as distinct subsets are
+// requested. There can not be more of them than distinct subsets of servers
+// there are, no matter what request variables resolve to.
+type subsetRouter struct {
+	selector *plugin.ServerSelector
+	fallback bool
+	all      http.Handler
+	beSrvs   []backend.Srv
+	newLB    func([]backend.Srv) (http.Handler, error)
+
+	mu      sync.Mutex
+	subsets map[string]http.Handler
+}
+
+func newSubsetRouter(cfg engine.HTTPFrontendSubset, all http.Handler, beSrvs []backend.Srv,
+	newLB func([]backend.Srv) (http.Handler, error),
+) (*subsetRouter, error) {
+	selector, err := plugin.NewServerSelector(cfg.Selector)
+	if err != nil {
+		return nil, err
+	}
+	return &subsetRouter{
+		selector: selector,
+		fallback: cfg.Fallback != engine.SubsetFallbackNone,
+		all:      all,
+		beSrvs:   beSrvs,
+		newLB:    newLB,
+		subsets:  make(map[string]http.Handler),
+	}, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (sr *subsetRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	labels, err := sr.selector.Resolve(r)
+	if err != nil {
+		DefaultHandler.ServeHTTP(w, r, err)
+		return
+	}
+	// Labels requested by middlewares take precedence over the frontend ones.
+	if reqLabels := plugin.ServerLabels(r); len(reqLabels) != 0 {
+		if labels == nil {
+			labels = make(map[string]string, len(reqLabels))
+		}
+		for k, v := range reqLabels {
+			labels[k] = v
+		}
+	}
+	if len(labels) == 0 {
+		sr.all.ServeHTTP(w, r)
+		return
+	}
+	h, err := sr.subset(labels)
+	if err != nil {
+		DefaultHandler.ServeHTTP(w, r, err)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// subset returns a load balancer over servers that have the specified labels.
+func (sr *subsetRouter) subset(labels map[string]string) (http.Handler, error) {
+	var subsetSrvs []backend.Srv
+	var key strings.Builder
+	for i, beSrv := range sr.beSrvs {
+		if !beSrv.HasLabels(labels) {
+			continue
+		}
+		subsetSrvs = append(subsetSrvs, beSrv)
+		key.WriteString(strconv.Itoa(i))
+		key.WriteByte(',')
+	}
+	if len(subsetSrvs) == 0 {
+		if sr.fallback {
+			return sr.all, nil
+		}
+		return nil, errNoSubsetServers
+	}
+	if len(subsetSrvs) == len(sr.beSrvs) {
+		return sr.all, nil
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if h, ok := sr.subsets[key.String()]; ok {
+		return h, nil
+	}
+	h, err := sr.newLB(subsetSrvs)
+	if err != nil {
+		return nil, err
+	}
+	sr.subsets[key.String()] = h
+	return h, nil
+}
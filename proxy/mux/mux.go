@@ -544,6 +544,7 @@ func (m *mux) DeleteFrontend(feKey engine.FrontendKey) error {
 
 	m.router.Remove(fe.Route())
 	delete(m.frontends, feKey)
+	fe.Release()
 
 	beEnt, ok := m.backends[fe.BackendKey()]
 	if !ok {
@@ -675,9 +676,39 @@ func (m *mux) emitMetrics() error {
 			c.Gauge(fem.Metric("rtt", strconv.Itoa(int(b.Quantile*10.0))), int64(b.Value/time.Microsecond), 1)
 		}
 	}
+
+	// Emit request queue stats of backends with capped server concurrency
+	for _, qs := range m.backendQueueStats() {
+		bem := c.Metric("backend", strings.Replace(qs.beKey.Id, ".", "_", -1), "queue")
+		c.Gauge(bem.Metric("depth"), int64(qs.stats.Depth), 1)
+		c.Gauge(bem.Metric("enqueued"), qs.stats.Enqueued, 1)
+		c.Gauge(bem.Metric("rejected"), qs.stats.Rejected, 1)
+		c.Gauge(bem.Metric("timedout"), qs.stats.TimedOut, 1)
+		// wait times in microsecond resolution
+		c.Gauge(bem.Metric("wait", "mean"), int64(qs.stats.MeanWait/time.Microsecond), 1)
+		c.Gauge(bem.Metric("wait", "max"), int64(qs.stats.MaxWait/time.Microsecond), 1)
+	}
 	return nil
 }
 
+type backendQueueStats struct {
+	beKey engine.BackendKey
+	stats engine.QueueStats
+}
+
+func (m *mux) backendQueueStats() []backendQueueStats {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	var queueStats []backendQueueStats
+	for beKey, beEnt := range m.backends {
+		if limiter := beEnt.backend.Limiter(); limiter.Enabled() {
+			queueStats = append(queueStats, backendQueueStats{beKey: beKey, stats: limiter.Stats()})
+		}
+	}
+	return queueStats
+}
+
 func (m *mux) FrontendStats(feKey engine.FrontendKey) (*engine.RoundTripStats, error) {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
@@ -709,7 +740,15 @@ func (m *mux) BackendStats(beKey engine.BackendKey) (*engine.RoundTripStats, err
 	for _, fe := range beEnt.frontends {
 		fe.AppendRTMTo(aggregate)
 	}
-	return engine.NewRoundTripStats(aggregate)
+	stats, err := engine.NewRoundTripStats(aggregate)
+	if err != nil {
+		return nil, err
+	}
+	if limiter := beEnt.backend.Limiter(); limiter.Enabled() {
+		queueStats := limiter.Stats()
+		stats.Queue = &queueStats
+	}
+	return stats, nil
 }
 
 func (m *mux) ServerStats(beSrvKey engine.ServerKey) (*engine.RoundTripStats, error) {
@@ -729,7 +768,28 @@ func (m *mux) ServerStats(beSrvKey engine.ServerKey) (*engine.RoundTripStats, er
 	for _, fe := range beEnt.frontends {
 		fe.AppendBeSrvRTMTo(aggregates, beSrv.URLKey())
 	}
-	return engine.NewRoundTripStats(aggregates)
+	stats, err := engine.NewRoundTripStats(aggregates)
+	if err != nil {
+		return nil, err
+	}
+	if slowStart, ok := beEnt.backend.SlowStartStats(beSrvKey); ok {
+		stats.SlowStart = slowStart
+	}
+	if circuitBreaker, ok := beEnt.backend.CircuitBreakerStats(beSrvKey); ok {
+		stats.CircuitBreaker = circuitBreaker
+	}
+	return stats, nil
+}
+
+func (m *mux) ServerCircuitBreakers(beKey engine.BackendKey) (map[string]engine.CircuitBreakerStats, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	beEnt, ok := m.backends[beKey]
+	if !ok {
+		return nil, errors.Errorf("backend %v not found", beKey)
+	}
+	return beEnt.backend.ServerCircuitBreakers(), nil
 }
 
 // TopFrontends returns locations sorted by criteria (faulty, slow, most used)
@@ -2,18 +2,31 @@ package mux
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/cache"
+	"github.com/vulcand/vulcand/plugin/cacheprovider"
+	"github.com/vulcand/vulcand/plugin/cbreaker"
+	"github.com/vulcand/vulcand/plugin/subset"
 	"github.com/vulcand/vulcand/proxy"
 	"github.com/vulcand/vulcand/stapler"
 	. "github.com/vulcand/vulcand/testutils"
@@ -591,6 +604,66 @@ func (s *ServerSuite) TestMiddlewareUpdate(c *C) {
 	}
 }
 
+// Circuit breakers created again under the same ids must not inherit the
+// override and history of deleted or changed ones.
+func (s *ServerSuite) TestCircuitBreakerRecreated(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint 1")
+	defer e.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e.URL,
+	})
+	c.Assert(s.mux.Init(b.Snapshot()), IsNil)
+	c.Assert(s.mux.Start(), IsNil)
+
+	newBreaker := func(fallbackDuration time.Duration) engine.Middleware {
+		spec, err := cbreaker.NewSpec(`NetworkErrorRatio() > 0.5`,
+			`{"Type": "response", "Action": {"StatusCode": 400, "Body": "Come back later"}}`,
+			nil, nil, fallbackDuration, 10*time.Second, 0)
+		c.Assert(err, IsNil)
+		return engine.Middleware{Id: "cb1", Type: "cbreaker", Middleware: spec}
+	}
+	forceOpen := func() {
+		_, err := cbreaker.SetOverride(b.FK.Id, "cb1", cbreaker.OverrideOpen)
+		c.Assert(err, IsNil)
+		re, _, err := testutils.Get(b.FrontendURL("/"))
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+	}
+	assertFresh := func() {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 1")
+		st := cbreaker.GetState(b.FK.Id, "cb1")
+		c.Assert(st.State, Equals, cbreaker.StateStandby)
+		c.Assert(st.Override, Equals, "")
+		c.Assert(st.History, HasLen, 0)
+	}
+
+	// Deleted and created again.
+	c.Assert(s.mux.UpsertMiddleware(b.FK, newBreaker(10*time.Second)), IsNil)
+	forceOpen()
+	c.Assert(s.mux.DeleteMiddleware(engine.MiddlewareKey{FrontendKey: b.FK, Id: "cb1"}), IsNil)
+	c.Assert(s.mux.UpsertMiddleware(b.FK, newBreaker(10*time.Second)), IsNil)
+	assertFresh()
+
+	// Upserted with the same settings, the override stays.
+	forceOpen()
+	c.Assert(s.mux.UpsertMiddleware(b.FK, newBreaker(10*time.Second)), IsNil)
+	c.Assert(cbreaker.GetState(b.FK.Id, "cb1").Override, Equals, cbreaker.OverrideOpen)
+
+	// Upserted with different settings.
+	c.Assert(s.mux.UpsertMiddleware(b.FK, newBreaker(20*time.Second)), IsNil)
+	assertFresh()
+
+	// Created again along with the frontend.
+	forceOpen()
+	c.Assert(s.mux.DeleteFrontend(b.FK), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertMiddleware(b.FK, newBreaker(20*time.Second)), IsNil)
+	assertFresh()
+}
+
 func (s *ServerSuite) TestFrontendOptionsCRUD(c *C) {
 	e := testutils.NewResponder("Hi, I'm endpoint 1")
 	defer e.Close()
@@ -881,6 +954,845 @@ func (s *ServerSuite) TestSwitchBackendOptions(c *C) {
 	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "slow server")
 }
 
+func (s *ServerSuite) TestBackendSlowStart(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint")
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+
+	settings := b.B.HTTPSettings()
+	settings.SlowStart = engine.HTTPBackendSlowStart{Period: "1h"}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// A single server that is ramping up still gets all the traffic.
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+
+	stats, err := s.mux.ServerStats(b.SK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.SlowStart, NotNil)
+	c.Assert(stats.SlowStart.Weight < 1, Equals, true)
+
+	// Once slow start is disabled the server is reported at its full weight.
+	settings.SlowStart = engine.HTTPBackendSlowStart{}
+	b.B.Settings = settings
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+
+	stats, err = s.mux.ServerStats(b.SK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.SlowStart, IsNil)
+}
+
+// Servers that recover from tripped circuit breakers ramp up anew.
+func (s *ServerSuite) TestBackendSlowStartAfterRecovery(c *C) {
+	s.mux.Stop(true)
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	m, err := New(s.lastId, s.st, proxy.Options{TimeProvider: clock})
+	c.Assert(err, IsNil)
+	s.mux = m
+
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+	settings := b.B.HTTPSettings()
+	settings.SlowStart = engine.HTTPBackendSlowStart{Period: "1m"}
+	settings.CircuitBreaker = engine.HTTPBackendCircuitBreaker{ErrorRatio: 0.5, MinRequests: 1, FallbackDuration: "10s"}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	clock.CurrentTime = clock.CurrentTime.Add(2 * time.Minute)
+	stats, err := s.mux.ServerStats(b.SK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.SlowStart, IsNil)
+
+	testutils.Get(b.FrontendURL("/"))
+	stats, err = s.mux.ServerStats(b.SK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.CircuitBreaker.State, Equals, engine.CircuitBreakerTripped)
+
+	clock.CurrentTime = clock.CurrentTime.Add(15 * time.Second)
+	stats, err = s.mux.ServerStats(b.SK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.CircuitBreaker.State, Equals, engine.CircuitBreakerRecovering)
+	c.Assert(stats.SlowStart, NotNil)
+	c.Assert(stats.SlowStart.Since, Equals, clock.CurrentTime)
+	c.Assert(stats.SlowStart.Weight < 1, Equals, true)
+}
+
+func (s *ServerSuite) TestBackendConcurrencyCap(c *C) {
+	inside := make(chan struct{})
+	unblock := make(chan struct{})
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		inside <- struct{}{}
+		<-unblock
+		w.Write([]byte("busy server"))
+	})
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+
+	settings := b.B.HTTPSettings()
+	settings.Concurrency = engine.HTTPBackendConcurrency{MaxPerServer: 1, QueueSize: 1, QueueTimeout: "2s"}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// The first request takes the only slot there is.
+	firstDone := make(chan string)
+	go func() {
+		_, body, _ := testutils.Get(b.FrontendURL("/"))
+		firstDone <- string(body)
+	}()
+	<-inside
+
+	// The second one has to wait in the queue.
+	secondDone := make(chan string)
+	go func() {
+		_, body, _ := testutils.Get(b.FrontendURL("/"))
+		secondDone <- string(body)
+	}()
+	for i := 0; i < 100; i++ {
+		stats, err := s.mux.BackendStats(b.BK)
+		c.Assert(err, IsNil)
+		if stats.Queue.Depth == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The third one does not fit into the queue.
+	re, _, err := testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(re.Header.Get("Retry-After"), Equals, "2")
+
+	// Once the first request is done the queued one gets through.
+	unblock <- struct{}{}
+	c.Assert(<-firstDone, Equals, "busy server")
+	<-inside
+	unblock <- struct{}{}
+	c.Assert(<-secondDone, Equals, "busy server")
+
+	stats, err := s.mux.BackendStats(b.BK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Queue, NotNil)
+	c.Assert(stats.Queue.Depth, Equals, 0)
+	c.Assert(stats.Queue.Enqueued, Equals, int64(1))
+	c.Assert(stats.Queue.Rejected, Equals, int64(1))
+	c.Assert(stats.Queue.TimedOut, Equals, int64(0))
+}
+
+func (s *ServerSuite) TestBackendConcurrencyQueueTimeout(c *C) {
+	inside := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		inside <- struct{}{}
+		<-unblock
+		w.Write([]byte("busy server"))
+	})
+	defer e.Close()
+	defer close(unblock)
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+
+	settings := b.B.HTTPSettings()
+	settings.Concurrency = engine.HTTPBackendConcurrency{MaxPerServer: 1, QueueSize: 10, QueueTimeout: "50ms"}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	go testutils.Get(b.FrontendURL("/"))
+	<-inside
+
+	re, _, err := testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(re.Header.Get("Retry-After"), Equals, "1")
+
+	stats, err := s.mux.BackendStats(b.BK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Queue.TimedOut, Equals, int64(1))
+	c.Assert(stats.Queue.MaxWait >= 50*time.Millisecond, Equals, true)
+}
+
+func (s *ServerSuite) TestBackupServers(c *C) {
+	e1 := testutils.NewResponder("Hi, I'm primary")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("Hi, I'm backup")
+	defer e2.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+	backupSrv := engine.Server{Id: "backup", URL: e2.URL, Backup: true}
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, backupSrv), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// Backup server gets nothing while the primary one is there.
+	for i := 0; i < 3; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm primary")
+	}
+
+	// Once the primary is gone traffic moves over to the backup.
+	c.Assert(s.mux.DeleteServer(b.SK), IsNil)
+	for i := 0; i < 3; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm backup")
+	}
+
+	// And moves back when the primary returns.
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	for i := 0; i < 3; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm primary")
+	}
+
+	// A backup server promoted to primary starts sharing the traffic.
+	backupSrv.Backup = false
+	c.Assert(s.mux.UpsertServer(b.BK, backupSrv), IsNil)
+	responses := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		responses[GETResponse(c, b.FrontendURL("/"))] = true
+	}
+	c.Assert(responses, DeepEquals, map[string]bool{"Hi, I'm primary": true, "Hi, I'm backup": true})
+}
+
+// Backup servers take over when all primary servers fail, even if circuit
+// breakers are disabled.
+func (s *ServerSuite) TestBackupServersFailover(c *C) {
+	s.mux.Stop(true)
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	m, err := New(s.lastId, s.st, proxy.Options{TimeProvider: clock})
+	c.Assert(err, IsNil)
+	s.mux = m
+
+	e1 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Hi, I'm failing"))
+	})
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("Hi, I'm backup")
+	defer e2.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+	backupSrv := engine.Server{Id: "backup", URL: e2.URL, Backup: true}
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, backupSrv), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	for i := 0; i < engine.DefaultCircuitBreakerMinRequests; i++ {
+		re, _, err := testutils.Get(b.FrontendURL("/"))
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusInternalServerError)
+	}
+	for i := 0; i < 3; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm backup")
+	}
+
+	// The primary server is given another chance after a while.
+	clock.CurrentTime = clock.CurrentTime.Add(engine.DefaultCircuitBreakerFallback)
+	_, body, err := testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "Hi, I'm failing")
+}
+
+func (s *ServerSuite) TestRequestId(c *C) {
+	// Replace the default mux with one that has request ids enabled.
+	s.mux.Stop(true)
+	m, err := New(s.lastId, s.st, proxy.Options{RequestIdHeader: "X-Trace-Id"})
+	c.Assert(err, IsNil)
+	s.mux = m
+
+	// The backend echoes the id, like many do.
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Trace-Id", r.Header.Get("X-Trace-Id"))
+		w.Write([]byte(r.Header.Get("X-Trace-Id")))
+	})
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// Ids are generated for requests that have none.
+	re, body, err := testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.Header["X-Trace-Id"], HasLen, 1)
+	c.Assert(re.Header.Get("X-Trace-Id"), Matches, "[0-9a-f]{32}")
+	c.Assert(string(body), Equals, re.Header.Get("X-Trace-Id"))
+
+	// Ids of requests are passed through.
+	re, body, err = testutils.Get(b.FrontendURL("/"), testutils.Header("X-Trace-Id", "abc-123"))
+	c.Assert(err, IsNil)
+	c.Assert(re.Header["X-Trace-Id"], DeepEquals, []string{"abc-123"})
+	c.Assert(string(body), Equals, "abc-123")
+
+	// Ids that are not fit for logs are replaced.
+	re, body, err = testutils.Get(b.FrontendURL("/"), testutils.Header("X-Trace-Id", "abc 123"))
+	c.Assert(err, IsNil)
+	c.Assert(re.Header.Get("X-Trace-Id"), Matches, "[0-9a-f]{32}")
+	c.Assert(string(body), Equals, re.Header.Get("X-Trace-Id"))
+
+	// Requests that no frontend is routed to get ids too.
+	re, _, err = testutils.Get(b.FrontendURL("/missing"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(re.Header.Get("X-Trace-Id"), Matches, "[0-9a-f]{32}")
+	re, _, err = testutils.Get(b.FrontendURL("/missing"), testutils.Header("X-Trace-Id", "abc-404"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(re.Header["X-Trace-Id"], DeepEquals, []string{"abc-404"})
+}
+
+func (s *ServerSuite) TestRequestIdInErrorLogs(c *C) {
+	s.mux.Stop(true)
+	m, err := New(s.lastId, s.st, proxy.Options{RequestIdHeader: "X-Request-Id"})
+	c.Assert(err, IsNil)
+	s.mux = m
+
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(level)
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	// Nothing listens on the server port, so requests fail with 502.
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: "http://localhost:63999"})
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	re, _, err := testutils.Get(b.FrontendURL("/"), testutils.Method("POST"), testutils.Header("X-Request-Id", "failing-1"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(re.Header.Get("X-Request-Id"), Equals, "failing-1")
+
+	var logged bool
+	for _, e := range hook.AllEntries() {
+		if e.Data[plugin.RequestIdLogField] == "failing-1" {
+			logged = true
+		}
+	}
+	c.Assert(logged, Equals, true)
+}
+
+func (s *ServerSuite) TestAccessLog(c *C) {
+	s.mux.Stop(true)
+	m, err := New(s.lastId, s.st, proxy.Options{RequestIdHeader: "X-Request-Id"})
+	c.Assert(err, IsNil)
+	s.mux = m
+
+	e := testutils.NewResponder("hi https")
+	defer e.Close()
+
+	path := filepath.Join(c.MkDir(), "access.log")
+	b := MakeBatch(Batch{
+		Addr:     "localhost:41000",
+		Route:    `Path("/")`,
+		URL:      e.URL,
+		Protocol: engine.HTTPS,
+		KeyPair:  &engine.KeyPair{Key: localhostKey, Cert: localhostCert},
+	})
+	b.L.Settings = &engine.HTTPSListenerSettings{
+		AccessLog: &engine.AccessLogSettings{Addr: "file://" + path, Format: "json"},
+	}
+	c.Assert(s.mux.Init(b.Snapshot()), IsNil)
+	c.Assert(s.mux.Start(), IsNil)
+
+	// Requests routed to frontends and requests that are not are both logged
+	c.Assert(GETResponse(c, b.FrontendURL("/"), testutils.Header("X-Request-Id", "abc")), Equals, "hi https")
+	re, _, err := testutils.Get(b.FrontendURL("/missing"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+
+	// So are failed TLS handshakes
+	_, err = tls.Dial("tcp", b.L.Address.Address, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS10})
+	c.Assert(err, NotNil)
+
+	// Lines are written in the background
+	var lines []map[string]interface{}
+	for i := 0; i < 100 && len(lines) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		lines = nil
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var l map[string]interface{}
+			c.Assert(json.Unmarshal([]byte(line), &l), IsNil)
+			lines = append(lines, l)
+		}
+	}
+	c.Assert(lines, HasLen, 3)
+	c.Assert(lines[0]["uri"], Equals, "/")
+	c.Assert(lines[0]["status"], Equals, float64(http.StatusOK))
+	c.Assert(lines[0]["request_id"], Equals, "abc")
+	c.Assert(lines[0]["listener"], Equals, b.L.Id)
+	c.Assert(lines[1]["uri"], Equals, "/missing")
+	c.Assert(lines[1]["status"], Equals, float64(http.StatusNotFound))
+	c.Assert(lines[1]["request_id"], Matches, "[0-9a-f]{32}")
+	c.Assert(lines[2]["remote_addr"], Equals, "127.0.0.1")
+	c.Assert(lines[2]["error"], NotNil)
+	c.Assert(lines[2]["status"], IsNil)
+}
+
+func (s *ServerSuite) TestServerCircuitBreakers(c *C) {
+	// Replace the default mux with one that has its clock under control.
+	s.mux.Stop(true)
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	m, err := New(s.lastId, s.st, proxy.Options{TimeProvider: clock})
+	c.Assert(err, IsNil)
+	s.mux = m
+
+	e1 := testutils.NewResponder("Hi, I'm healthy")
+	defer e1.Close()
+
+	e2 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Hi, I'm failing"))
+	})
+	defer e2.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+	failingSrv := engine.Server{Id: "failing", URL: e2.URL}
+	failingSK := engine.ServerKey{BackendKey: b.BK, Id: failingSrv.Id}
+
+	settings := b.B.HTTPSettings()
+	settings.CircuitBreaker = engine.HTTPBackendCircuitBreaker{
+		ErrorRatio: 0.5, MinRequests: 2, Window: "1m", FallbackDuration: "10s", RecoveryDuration: "10s",
+	}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, failingSrv), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// Sooner or later the failing server trips its circuit breaker.
+	for i := 0; i < 20; i++ {
+		testutils.Get(b.FrontendURL("/"))
+	}
+	states, err := s.mux.ServerCircuitBreakers(b.BK)
+	c.Assert(err, IsNil)
+	c.Assert(states, DeepEquals, map[string]engine.CircuitBreakerStats{
+		b.S.Id:        {State: engine.CircuitBreakerStandby},
+		failingSrv.Id: {State: engine.CircuitBreakerTripped, Since: clock.CurrentTime},
+	})
+
+	// And then it gets no traffic.
+	for i := 0; i < 10; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm healthy")
+	}
+
+	// Once the fallback duration is over the server is recovering.
+	clock.CurrentTime = clock.CurrentTime.Add(15 * time.Second)
+	stats, err := s.mux.ServerStats(failingSK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.CircuitBreaker, DeepEquals, &engine.CircuitBreakerStats{State: engine.CircuitBreakerRecovering, Since: clock.CurrentTime})
+
+	// If it is still failing the breaker trips again.
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	for i := 0; i < 100; i++ {
+		testutils.Get(b.FrontendURL("/"))
+	}
+	stats, err = s.mux.ServerStats(failingSK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.CircuitBreaker.State, Equals, engine.CircuitBreakerTripped)
+
+	// With no failing servers left, the breaker of the healthy one does not
+	// trip and every request is served.
+	c.Assert(s.mux.DeleteServer(failingSK), IsNil)
+	for i := 0; i < 10; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm healthy")
+	}
+	states, err = s.mux.ServerCircuitBreakers(b.BK)
+	c.Assert(err, IsNil)
+	c.Assert(states, DeepEquals, map[string]engine.CircuitBreakerStats{b.S.Id: {State: engine.CircuitBreakerStandby}})
+}
+
+// If all servers are tripped, requests are rejected right away.
+func (s *ServerSuite) TestServerCircuitBreakersAllTripped(c *C) {
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+	settings := b.B.HTTPSettings()
+	settings.CircuitBreaker = engine.HTTPBackendCircuitBreaker{ErrorRatio: 0.5, MinRequests: 1, FallbackDuration: "1h"}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	re, _, err := testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusInternalServerError)
+
+	re, body, err := testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(string(body), Equals, http.StatusText(http.StatusServiceUnavailable))
+}
+
+func (s *ServerSuite) TestBackendPreferLocalServers(c *C) {
+	// Replace the default mux with one that knows where it is located.
+	s.mux.Stop(true)
+	m, err := New(s.lastId, s.st, proxy.Options{Zone: "us-east-1a", Region: "us-east-1"})
+	c.Assert(err, IsNil)
+	s.mux = m
+
+	e1 := testutils.NewResponder("Hi, I'm in the same zone")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("Hi, I'm in another zone")
+	defer e2.Close()
+
+	e3 := testutils.NewResponder("Hi, I'm in another region")
+	defer e3.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+	b.S.Zone = "us-east-1a"
+	sameRegionSrv := engine.Server{Id: "srv2", URL: e2.URL, Zone: "us-east-1b", Region: "us-east-1"}
+	farSrv := engine.Server{Id: "srv3", URL: e3.URL, Zone: "eu-west-1a", Region: "eu-west-1"}
+
+	settings := b.B.HTTPSettings()
+	settings.Locality = engine.HTTPBackendLocality{Prefer: engine.LocalityZone}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, sameRegionSrv), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, farSrv), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	for i := 0; i < 5; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm in the same zone")
+	}
+
+	// With no servers in the same zone, traffic spills over to the region.
+	c.Assert(s.mux.DeleteServer(b.SK), IsNil)
+	for i := 0; i < 5; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm in another zone")
+	}
+
+	// And then to any server.
+	c.Assert(s.mux.DeleteServer(engine.ServerKey{BackendKey: b.BK, Id: sameRegionSrv.Id}), IsNil)
+	for i := 0; i < 5; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm in another region")
+	}
+}
+
+// Backup servers that take over are picked by locality too, and local
+// servers that are down do not count.
+func (s *ServerSuite) TestBackendPreferLocalBackupServers(c *C) {
+	s.mux.Stop(true)
+	m, err := New(s.lastId, s.st, proxy.Options{Zone: "us-east-1a", Region: "us-east-1"})
+	c.Assert(err, IsNil)
+	s.mux = m
+
+	e1 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer e1.Close()
+
+	var failing int32
+	e2 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("Hi, I'm in the same zone"))
+	})
+	defer e2.Close()
+
+	e3 := testutils.NewResponder("Hi, I'm in another region")
+	defer e3.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+	localSrv := engine.Server{Id: "srv2", URL: e2.URL, Zone: "us-east-1a", Backup: true}
+	farSrv := engine.Server{Id: "srv3", URL: e3.URL, Zone: "eu-west-1a", Region: "eu-west-1", Backup: true}
+
+	settings := b.B.HTTPSettings()
+	settings.Locality = engine.HTTPBackendLocality{Prefer: engine.LocalityZone}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, localSrv), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, farSrv), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// Once the primary server is down, the local backup server takes over.
+	for i := 0; i < engine.DefaultCircuitBreakerMinRequests; i++ {
+		testutils.Get(b.FrontendURL("/"))
+	}
+	for i := 0; i < 5; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm in the same zone")
+	}
+
+	// Once the local server is down, traffic spills over to the far one.
+	atomic.StoreInt32(&failing, 1)
+	for i := 0; i < engine.DefaultCircuitBreakerMinRequests; i++ {
+		testutils.Get(b.FrontendURL("/"))
+	}
+	responses := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		_, body, err := testutils.Get(b.FrontendURL("/"))
+		c.Assert(err, IsNil)
+		responses[string(body)] = true
+	}
+	c.Assert(responses["Hi, I'm in another region"], Equals, true)
+}
+
+func (s *ServerSuite) TestFrontendSubset(c *C) {
+	e1 := testutils.NewResponder("Hi, I'm v1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("Hi, I'm v2")
+	defer e2.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+	b.S.Labels = map[string]string{"version": "v1"}
+	v2Srv := engine.Server{Id: "srv2", URL: e2.URL, Labels: map[string]string{"version": "v2"}}
+
+	settings := b.F.HTTPSettings()
+	settings.Subset = engine.HTTPFrontendSubset{
+		Selector: map[string]string{"version": "request.header.X-Version"},
+	}
+	b.F.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, v2Srv), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	for i := 0; i < 3; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/"), testutils.Header("X-Version", "v1")), Equals, "Hi, I'm v1")
+		c.Assert(GETResponse(c, b.FrontendURL("/"), testutils.Header("X-Version", "v2")), Equals, "Hi, I'm v2")
+	}
+
+	// Requests that do not ask for a subset go to all servers.
+	responses := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		responses[GETResponse(c, b.FrontendURL("/"))] = true
+	}
+	c.Assert(responses, DeepEquals, map[string]bool{"Hi, I'm v1": true, "Hi, I'm v2": true})
+
+	// Unless told otherwise, requests for a missing subset go to all servers too.
+	responses = make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		responses[GETResponse(c, b.FrontendURL("/"), testutils.Header("X-Version", "v3"))] = true
+	}
+	c.Assert(responses, DeepEquals, map[string]bool{"Hi, I'm v1": true, "Hi, I'm v2": true})
+
+	settings.Subset.Fallback = engine.SubsetFallbackNone
+	b.F.Settings = settings
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+
+	re, _, err := testutils.Get(b.FrontendURL("/"), testutils.Header("X-Version", "v3"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	// Subsets follow server label changes.
+	v2Srv.Labels = map[string]string{"version": "v3"}
+	c.Assert(s.mux.UpsertServer(b.BK, v2Srv), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/"), testutils.Header("X-Version", "v3")), Equals, "Hi, I'm v2")
+}
+
+// Subset load balancers are created while the frontend switches backends.
+func (s *ServerSuite) TestFrontendSubsetSwitchBackend(c *C) {
+	e1 := testutils.NewResponder("Hi, I'm b1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("Hi, I'm b2")
+	defer e2.Close()
+
+	e3 := testutils.NewResponder("Hi, I'm v2")
+	defer e3.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b1 := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+	b1.S.Labels = map[string]string{"version": "v1"}
+	b2 := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e2.URL})
+	b2.S.Labels = map[string]string{"version": "v1"}
+
+	settings := b1.F.HTTPSettings()
+	settings.Subset = engine.HTTPFrontendSubset{
+		Selector: map[string]string{"version": "request.header.X-Version"},
+	}
+	b1.F.Settings = settings
+
+	v2Srv := engine.Server{Id: "v2", URL: e3.URL, Labels: map[string]string{"version": "v2"}}
+
+	c.Assert(s.mux.UpsertBackend(b1.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b1.BK, b1.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b1.BK, v2Srv), IsNil)
+	c.Assert(s.mux.UpsertBackend(b2.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b2.BK, b2.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b2.BK, v2Srv), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b1.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b1.L), IsNil)
+
+	done := make(chan struct{})
+	url := b1.FrontendURL("/")
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			testutils.Get(url, testutils.Header("X-Version", "v1"))
+		}
+	}()
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+		default:
+			if i%2 == 0 {
+				b1.F.BackendId = b2.BK.Id
+			} else {
+				b1.F.BackendId = b1.BK.Id
+			}
+			c.Assert(s.mux.UpsertFrontend(b1.F), IsNil)
+			continue
+		}
+		break
+	}
+
+	b1.F.BackendId = b2.BK.Id
+	c.Assert(s.mux.UpsertFrontend(b1.F), IsNil)
+	c.Assert(GETResponse(c, url, testutils.Header("X-Version", "v1")), Equals, "Hi, I'm b2")
+}
+
+func (s *ServerSuite) TestMiddlewareSubset(c *C) {
+	e1 := testutils.NewResponder("Hi, I'm v1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("Hi, I'm v2")
+	defer e2.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+	b.S.Labels = map[string]string{"version": "v1"}
+	v2Srv := engine.Server{Id: "srv2", URL: e2.URL, Labels: map[string]string{"version": "v2"}}
+
+	ss, err := subset.NewSubset(map[string]string{"version": "v2"})
+	c.Assert(err, IsNil)
+	m := engine.Middleware{Id: "sub1", Type: subset.Type, Middleware: ss}
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, v2Srv), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertMiddleware(b.FK, m), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	for i := 0; i < 3; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm v2")
+	}
+}
+
+func (s *ServerSuite) TestCacheMiddleware(c *C) {
+	s.mux.Stop(true)
+	provider := cacheprovider.NewMemCacheProvider()
+	m, err := New(s.lastId, s.st, proxy.Options{CacheProvider: provider})
+	c.Assert(err, IsNil)
+	s.mux = m
+
+	var hits int64
+	e := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("Hi, I'm cached"))
+	}))
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+	cm, err := cache.NewCache(cache.Cache{})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertMiddleware(b.FK, engine.Middleware{Id: "c1", Type: cache.Type, Middleware: cm}), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	for i := 0; i < 3; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm cached")
+	}
+	c.Assert(atomic.LoadInt64(&hits), Equals, int64(1))
+
+	// Responses are kept by the cache provider, so they survive frontend
+	// rebuilds and can be purged through it.
+	c.Assert(s.mux.UpsertServer(b.BK, engine.Server{Id: "srv2", URL: e.URL + "/"}), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm cached")
+	c.Assert(atomic.LoadInt64(&hits), Equals, int64(1))
+
+	c.Assert(cache.Purge(context.Background(), cache.Storage(provider), b.FrontendURL("/")), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm cached")
+	c.Assert(atomic.LoadInt64(&hits), Equals, int64(2))
+}
+
 func (s *ServerSuite) TestFilesNoFiles(c *C) {
 	files, err := s.mux.GetFiles()
 	c.Assert(err, IsNil)
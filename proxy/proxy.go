@@ -68,7 +68,15 @@ type Options struct {
 	IncomingConnectionTracker conntracker.ConnectionTracker
 	FrontendListeners         plugin.FrontendListeners
 	CacheProvider             cacheprovider.T
+	ValueStore                plugin.ValueStore
 	Aliases                   map[string]string
+	// Zone and Region tell where the vulcand instance is located, so that
+	// backends can prefer servers that are close to it.
+	Zone   string
+	Region string
+	// RequestIdHeader is the header that request ids are accepted from and
+	// passed to backends and clients in, request ids are disabled if empty.
+	RequestIdHeader string
 }
 
 type NewProxyFn func(id int) (Proxy, error)
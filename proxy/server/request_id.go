@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// maxRequestIdLength is the length of the longest request id accepted from
+// clients, longer ones are replaced with generated ids.
+const maxRequestIdLength = 128
+
+// requestIdHandler accepts the request id from the request header, or
+// generates one if there is none, and passes it to the backend in the same
+// header and back to the client in the response header. It wraps the whole
+// listener handler, so that requests that are not routed to any frontend get
+// ids too.
+type requestIdHandler struct {
+	next   http.Handler
+	header string
+}
+
+func (h *requestIdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(h.header)
+	if !validRequestId(id) {
+		id = newRequestId()
+		r.Header.Set(h.header, id)
+	}
+	w.Header().Set(h.header, id)
+	h.next.ServeHTTP(&requestIdWriter{ResponseWriter: w, header: h.header, id: id}, plugin.WithRequestId(r, id))
+}
+
+// validRequestId tells whether an id taken from a request can be used, that
+// is whether it is not too long and made of printable ASCII characters only.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	// Reading from crypto/rand does not fail on supported platforms.
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIdWriter sets the request id right before the response header is
+// sent, so that a backend that echoes the id does not make it appear twice.
+type requestIdWriter struct {
+	http.ResponseWriter
+	header      string
+	id          string
+	wroteHeader bool
+}
+
+func (rw *requestIdWriter) WriteHeader(status int) {
+	if !rw.wroteHeader && (status >= http.StatusOK || status == http.StatusSwitchingProtocols) {
+		rw.wroteHeader = true
+		rw.ResponseWriter.Header().Set(rw.header, rw.id)
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *requestIdWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *requestIdWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *requestIdWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", rw.ResponseWriter)
+	}
+	rw.wroteHeader = true
+	return hj.Hijack()
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/route"
+	"github.com/vulcand/vulcand/accesslog"
 	"github.com/vulcand/vulcand/conntracker"
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/graceful"
@@ -40,6 +41,7 @@ type T struct {
 
 	srv          *graceful.Server
 	scopedRouter http.Handler
+	accessLog    *accesslog.Logger
 	options      proxy.Options
 	state        int
 }
@@ -54,10 +56,15 @@ func New(lsnCfg engine.Listener, router http.Handler, stapler stapler.Stapler,
 	if err != nil {
 		return nil, err
 	}
+	accessLog, err := newAccessLog(lsnCfg, options)
+	if err != nil {
+		return nil, err
+	}
 	return &T{
-		lsnCfg:  lsnCfg,
-		router:  router,
-		options: options,
+		lsnCfg:    lsnCfg,
+		router:    router,
+		options:   options,
+		accessLog: accessLog,
 
 		stapler:       stapler,
 		connTck:       connTck,
@@ -160,7 +167,12 @@ func (s *T) Update(lsnCfg engine.Listener, hostCfgs map[engine.HostKey]engine.Ho
 	if err != nil {
 		return errors.Wrap(err, "failed to create scoped handler")
 	}
+	accessLog, err := newAccessLog(lsnCfg, s.options)
+	if err != nil {
+		return errors.Wrap(err, "failed to create access log")
+	}
 	s.scopedRouter = scopedRouter
+	s.accessLog = accessLog
 	s.lsnCfg = lsnCfg
 	if err := s.reloadTLSCfg(hostCfgs); err != nil {
 		return errors.Wrap(err, "failed to reload TLS config")
@@ -256,12 +268,24 @@ func (s *T) reloadTLSCfg(hostCfgs map[engine.HostKey]engine.Host) error {
 }
 
 func (s *T) newHTTPServer() *http.Server {
-	return &http.Server{
-		Handler:        s.scopedRouter,
+	handler := s.scopedRouter
+	// Request ids are assigned before anything else happens to requests, so
+	// that all log lines and responses, including those of requests that no
+	// frontend is routed to, carry the ids.
+	if s.options.RequestIdHeader != "" {
+		handler = &requestIdHandler{next: handler, header: s.options.RequestIdHeader}
+	}
+	srv := &http.Server{
+		Handler:        handler,
 		ReadTimeout:    s.options.ReadTimeout,
 		WriteTimeout:   s.options.WriteTimeout,
 		MaxHeaderBytes: s.options.MaxHeaderBytes,
 	}
+	if s.accessLog != nil {
+		srv.Handler = s.accessLog.Wrap(handler)
+		srv.ErrorLog = s.accessLog.ErrorLog()
+	}
+	return srv
 }
 
 func (s *T) isTLS() bool {
@@ -371,6 +395,20 @@ func (s srvState) String() string {
 	return "undefined"
 }
 
+// newAccessLog returns the access logger of the listener, or nil if the
+// listener has no access log.
+func newAccessLog(lsnCfg engine.Listener, options proxy.Options) (*accesslog.Logger, error) {
+	if lsnCfg.Settings == nil || lsnCfg.Settings.AccessLog == nil {
+		return nil, nil
+	}
+	return accesslog.New(accesslog.Config{
+		Listener:        lsnCfg.Id,
+		Format:          lsnCfg.Settings.AccessLog.Format,
+		Addr:            lsnCfg.Settings.AccessLog.Addr,
+		RequestIdHeader: options.RequestIdHeader,
+	})
+}
+
 func newScopeRouter(scope string, router http.Handler) (http.Handler, error) {
 	if scope == "" {
 		if opentracing.IsGlobalTracerRegistered() {
@@ -61,6 +61,15 @@ type Options struct {
 	EnableJaegerTracing bool
 	DebugJaegerTracing  bool
 	Aliases             mapOptions
+
+	Zone   string
+	Region string
+
+	CacheDir       string
+	CacheMaxMemMB  int
+	CacheMaxDiskMB int
+
+	RequestIdHeader string
 }
 
 type SeverityFlag struct {
@@ -184,6 +193,12 @@ func ParseCommandLine() (options Options, err error) {
 	flag.BoolVar(&options.EnableJaegerTracing, "enableJaegerTracing", false, "Enable open tracing support via jaeger")
 	flag.BoolVar(&options.DebugJaegerTracing, "debugJaegerTracing", false, "Trace every request and log the trace")
 	flag.Var(&options.Aliases, "aliases", "Comma separated list of key=values which modify frontend expressions")
+	flag.StringVar(&options.Zone, "zone", "", "Availability zone this instance runs in, used to prefer servers in the same zone")
+	flag.StringVar(&options.Region, "region", "", "Region this instance runs in, used to prefer servers in the same region")
+	flag.StringVar(&options.CacheDir, "cacheDir", "", "Directory to keep cached responses in, expired ones are removed every minute, they are kept in memory if empty")
+	flag.IntVar(&options.CacheMaxMemMB, "cacheMaxMemMB", 64, "Max size of responses cached in memory, in MB")
+	flag.IntVar(&options.CacheMaxDiskMB, "cacheMaxDiskMB", 1024, "Max size of responses cached in cacheDir, in MB, not limited if 0")
+	flag.StringVar(&options.RequestIdHeader, "requestIdHeader", "X-Request-Id", "Header to accept or generate request ids in, request ids are disabled if empty")
 
 	flag.Parse()
 	options, err = validateOptions(options)
@@ -29,7 +29,6 @@ import (
 	"github.com/vulcand/vulcand/graceful"
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/plugin/cacheprovider"
-	"github.com/vulcand/vulcand/plugin/registry"
 	"github.com/vulcand/vulcand/proxy"
 	"github.com/vulcand/vulcand/proxy/builder"
 	"github.com/vulcand/vulcand/proxy/tracing"
@@ -143,6 +142,14 @@ func (s *Service) Start(controlC chan ControlCode) error {
 		}
 	}
 
+	// Proxies and the API share the cache provider, so that cached responses
+	// survive proxy restarts and can be purged.
+	if s.registry.GetCacheProvider() == nil {
+		if err := s.registry.SetCacheProvider(s.newCacheProvider()); err != nil {
+			return err
+		}
+	}
+
 	if err := s.newEngine(); err != nil {
 		return err
 	}
@@ -403,7 +410,7 @@ func (s *Service) newEngine() error {
 				options)
 		}
 	case "memng":
-		ng = memng.New(registry.GetRegistry()).(*memng.Mem)
+		ng = memng.New(s.registry).(*memng.Mem)
 	default:
 		err = fmt.Errorf("Unsupported engine %q, supported engines: etcd, memng", s.options.Engine)
 	}
@@ -429,15 +436,20 @@ func (s *Service) reportSystemMetrics() {
 	}
 }
 
+func (s *Service) newCacheProvider() cacheprovider.T {
+	if s.options.CacheDir != "" {
+		return cacheprovider.NewDiskCacheProvider(s.options.CacheDir, int64(s.options.CacheMaxDiskMB)<<20)
+	}
+	if s.options.CacheMaxMemMB > 0 {
+		return cacheprovider.NewMemCacheProviderWithLimit(int64(s.options.CacheMaxMemMB) << 20)
+	}
+	return cacheprovider.NewMemCacheProvider()
+}
+
 func (s *Service) newProxy(id int) (proxy.Proxy, error) {
 
 	cacheProvider := s.registry.GetCacheProvider()
-
-	// If there's no cache provider by the registry,
-	// then use memory-based cache provider
-	if cacheProvider == nil {
-		cacheProvider = cacheprovider.NewMemCacheProvider()
-	}
+	valueStore, _ := s.ng.(plugin.ValueStore)
 
 	return builder.NewProxy(id, s.stapler, proxy.Options{
 		MetricsClient:             s.metricsClient,
@@ -452,7 +464,11 @@ func (s *Service) newProxy(id int) (proxy.Proxy, error) {
 		IncomingConnectionTracker: s.registry.GetIncomingConnectionTracker(),
 		FrontendListeners:         s.registry.GetFrontendListeners(),
 		CacheProvider:             cacheProvider,
+		ValueStore:                valueStore,
 		Aliases:                   s.options.Aliases,
+		Zone:                      s.options.Zone,
+		Region:                    s.options.Region,
+		RequestIdHeader:           s.options.RequestIdHeader,
 	})
 }
 
@@ -9,6 +9,7 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin/fault"
 	"github.com/vulcand/vulcand/proxy"
 )
 
@@ -115,6 +116,14 @@ func (s *Supervisor) BackendStats(key engine.BackendKey) (*engine.RoundTripStats
 	return nil, fmt.Errorf("no current proxy")
 }
 
+func (s *Supervisor) ServerCircuitBreakers(key engine.BackendKey) (map[string]engine.CircuitBreakerStats, error) {
+	p := s.getCurrentProxy()
+	if p != nil {
+		return p.ServerCircuitBreakers(key)
+	}
+	return nil, fmt.Errorf("no current proxy")
+}
+
 // TopFrontends returns locations sorted by criteria (faulty, slow, most used)
 // if hostname or backendId is present, will filter out locations for that host
 // or backendId.
@@ -193,6 +202,7 @@ func (s *Supervisor) init() error {
 	if err = newProxy.Init(*snapshot); err != nil {
 		return errors.Wrap(err, "failed to init mux")
 	}
+	fault.SetEnabled(!snapshot.Faults.Disabled)
 	log.Infof("%v initial setup done, took=%v", newProxy, time.Now().Sub(checkpoint))
 
 	// If it is initialization on process startup then take over files from the
@@ -328,6 +338,10 @@ func processChange(p proxy.Proxy, ch interface{}) error {
 		return p.UpsertServer(change.BackendKey, change.Server)
 	case *engine.ServerDeleted:
 		return p.DeleteServer(change.ServerKey)
+
+	case *engine.FaultsUpserted:
+		fault.SetEnabled(!change.Faults.Disabled)
+		return nil
 	}
 	return fmt.Errorf("unsupported change: %#v", ch)
 }
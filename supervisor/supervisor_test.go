@@ -10,6 +10,7 @@ import (
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/engine/memng"
+	"github.com/vulcand/vulcand/plugin/fault"
 	"github.com/vulcand/vulcand/plugin/registry"
 	"github.com/vulcand/vulcand/proxy"
 	"github.com/vulcand/vulcand/proxy/builder"
@@ -87,6 +88,27 @@ func (s *SupervisorSuite) TestInitOnTheFly(c *C) {
 	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
 }
 
+// The fault injection kill switch set in the engine applies to the process,
+// both when the supervisor starts and when the switch changes.
+func (s *SupervisorSuite) TestFaultsKillSwitch(c *C) {
+	defer fault.SetEnabled(true)
+	c.Assert(s.ng.UpsertFaults(engine.Faults{Disabled: true}), IsNil)
+	<-s.ng.ChangesC
+
+	sup := New(newProxy, s.ng, Options{Clock: s.clock})
+	c.Assert(sup.Start(), IsNil)
+	defer sup.Stop()
+	c.Assert(fault.Enabled(), Equals, false)
+
+	c.Assert(s.ng.UpsertFaults(engine.Faults{}), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(fault.Enabled(), Equals, true)
+
+	c.Assert(s.ng.UpsertFaults(engine.Faults{Disabled: true}), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(fault.Enabled(), Equals, false)
+}
+
 func (s *SupervisorSuite) TestGracefulShutdown(c *C) {
 	e := testutils.NewResponder("Hi, I'm endpoint")
 	defer e.Close()
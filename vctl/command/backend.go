@@ -98,6 +98,23 @@ func getBackendSettings(c *cli.Context) (engine.HTTPBackendSettings, error) {
 	s.KeepAlive.Period = c.Duration("keepAlivePeriod").String()
 	s.KeepAlive.MaxIdleConnsPerHost = c.Int("maxIdleConns")
 
+	s.SlowStart.Period = c.Duration("slowStartPeriod").String()
+	s.SlowStart.Ramp = c.String("slowStartRamp")
+	s.SlowStart.MinWeight = c.Float64("slowStartMinWeight")
+
+	s.Concurrency.MaxPerServer = c.Int("maxConcurrency")
+	s.Concurrency.QueueSize = c.Int("queueSize")
+	s.Concurrency.QueueTimeout = c.Duration("queueTimeout").String()
+
+	s.Locality.Prefer = c.String("preferLocal")
+	s.Locality.MinLocalServers = c.Int("minLocalServers")
+
+	s.CircuitBreaker.ErrorRatio = c.Float64("cbErrorRatio")
+	s.CircuitBreaker.MinRequests = c.Int("cbMinRequests")
+	s.CircuitBreaker.Window = c.Duration("cbWindow").String()
+	s.CircuitBreaker.FallbackDuration = c.Duration("cbFallbackDuration").String()
+	s.CircuitBreaker.RecoveryDuration = c.Duration("cbRecoveryDuration").String()
+
 	tlsSettings, err := getTLSSettings(c)
 	if err != nil {
 		return s, err
@@ -116,5 +133,26 @@ func backendOptions() []cli.Flag {
 		// Keep-alive parameters
 		cli.StringFlag{Name: "keepAlivePeriod", Usage: "keep-alive period"},
 		cli.IntFlag{Name: "maxIdleConns", Usage: "maximum idle connections per host"},
+
+		// Slow start parameters
+		cli.DurationFlag{Name: "slowStartPeriod", Usage: "period during which new servers ramp up to their full weight"},
+		cli.StringFlag{Name: "slowStartRamp", Usage: "slow start ramp, 'linear' or 'exponential'"},
+		cli.Float64Flag{Name: "slowStartMinWeight", Usage: "fraction of the full weight that new servers start with"},
+
+		// Server concurrency parameters
+		cli.IntFlag{Name: "maxConcurrency", Usage: "maximum in-flight requests per server, unlimited if 0"},
+		cli.IntFlag{Name: "queueSize", Usage: "maximum requests waiting for a server when all are at capacity"},
+		cli.DurationFlag{Name: "queueTimeout", Value: engine.DefaultQueueTimeout, Usage: "maximum time a request waits in queue"},
+
+		// Locality parameters
+		cli.StringFlag{Name: "preferLocal", Usage: "prefer servers in the same 'zone' or 'region' as vulcand"},
+		cli.IntFlag{Name: "minLocalServers", Usage: "number of local servers below which traffic spills over to farther servers"},
+
+		// Server circuit breaker parameters
+		cli.Float64Flag{Name: "cbErrorRatio", Usage: "ratio of failed requests that trips a server circuit breaker, disabled if 0"},
+		cli.IntFlag{Name: "cbMinRequests", Value: engine.DefaultCircuitBreakerMinRequests, Usage: "requests within the window below which a circuit breaker does not trip"},
+		cli.DurationFlag{Name: "cbWindow", Value: engine.DefaultCircuitBreakerWindow, Usage: "period over which requests are counted"},
+		cli.DurationFlag{Name: "cbFallbackDuration", Value: engine.DefaultCircuitBreakerFallback, Usage: "how long a tripped server gets no traffic"},
+		cli.DurationFlag{Name: "cbRecoveryDuration", Value: engine.DefaultCircuitBreakerRecovery, Usage: "how long it takes a server to get back to its full share of traffic"},
 	}
 }
@@ -50,6 +50,7 @@ func (cmd *Command) Run(args []string) error {
 		NewFrontendCommand(cmd),
 		NewServerCommand(cmd),
 		NewListenerCommand(cmd),
+		NewPurgeCommand(cmd),
 	}
 	app.Commands = append(app.Commands, NewMiddlewareCommands(cmd)...)
 	return app.Run(args)
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -130,6 +131,23 @@ func (s *CmdSuite) TestListenerCRUD(c *C) {
 	c.Assert(s.run("listener", "upsert", "-id", l, "-proto", "http", "-addr", "localhost:11300", "-scope", `Host("localhost")`), Matches, OK)
 }
 
+func (s *CmdSuite) TestListenerAccessLog(c *C) {
+	l := "l1"
+	c.Assert(s.run("listener", "upsert", "-id", l, "-proto", "http", "-addr", "localhost:11300",
+		"-accessLog", "stdout://", "-accessLogFormat", "json"), Matches, OK)
+
+	out, err := s.ng.GetListener(engine.ListenerKey{Id: l})
+	c.Assert(err, IsNil)
+	c.Assert(out.Settings.AccessLog, DeepEquals, &engine.AccessLogSettings{Addr: "stdout://", Format: "json"})
+
+	// Bad formats are rejected
+	c.Assert(s.run("listener", "upsert", "-id", l, "-proto", "http", "-addr", "localhost:11300",
+		"-accessLog", "stdout://", "-accessLogFormat", "fancy"), Not(Matches), OK)
+	out, err = s.ng.GetListener(engine.ListenerKey{Id: l})
+	c.Assert(err, IsNil)
+	c.Assert(out.Settings.AccessLog.Format, Equals, "json")
+}
+
 func (s *CmdSuite) TestHTTPSListenerCRUD(c *C) {
 	host := "host"
 	c.Assert(s.run("host", "upsert", "-name", host), Matches, OK)
@@ -230,6 +248,108 @@ func (s *CmdSuite) TestServerCRUD(c *C) {
 	c.Assert(s.run("backend", "rm", "-id", b), Matches, OK)
 }
 
+func (s *CmdSuite) TestBackupServerCRUD(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+	srv := "srv1"
+	c.Assert(s.run("server", "upsert", "-id", srv, "-url", "http://localhost:5000", "-b", b, "-backup"), Matches, OK)
+
+	c.Assert(s.run("server", "ls", "-b", b), Matches, ".*http://localhost:5000.*backup.*")
+	c.Assert(s.run("server", "show", "-id", srv, "-b", b), Matches, ".*http://localhost:5000.*backup.*")
+
+	c.Assert(s.run("server", "rm", "-id", srv, "-b", b), Matches, OK)
+	c.Assert(s.run("backend", "rm", "-id", b), Matches, OK)
+}
+
+func (s *CmdSuite) TestServerLocationCRUD(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b, "-preferLocal", "zone", "-minLocalServers", "2"), Matches, OK)
+	srv := "srv1"
+	c.Assert(s.run("server", "upsert", "-id", srv, "-url", "http://localhost:5000", "-b", b,
+		"-zone", "us-east-1a", "-region", "us-east-1"), Matches, OK)
+
+	c.Assert(s.run("server", "ls", "-b", b), Matches, ".*http://localhost:5000.*primary.*us-east-1/us-east-1a.*")
+
+	c.Assert(s.run("server", "rm", "-id", srv, "-b", b), Matches, OK)
+	c.Assert(s.run("backend", "rm", "-id", b), Matches, OK)
+}
+
+func (s *CmdSuite) TestServerCircuitBreaker(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b, "-cbErrorRatio", "0.5", "-cbFallbackDuration", "1m"), Matches, OK)
+
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().CircuitBreaker, Equals, engine.HTTPBackendCircuitBreaker{
+		ErrorRatio: 0.5, MinRequests: 10, Window: "10s", FallbackDuration: "1m0s", RecoveryDuration: "10s",
+	})
+
+	srv := "srv1"
+	c.Assert(s.run("server", "upsert", "-id", srv, "-url", "http://localhost:5000", "-b", b), Matches, OK)
+
+	// Circuit breaker states show up once the proxy catches up with the
+	// config change.
+	out := ""
+	for i := 0; i < 100; i++ {
+		if out = s.run("server", "ls", "-b", b); strings.Contains(out, "standby") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(out, Matches, ".*Circuit.*http://localhost:5000.*primary.*standby.*")
+
+	c.Assert(s.run("server", "rm", "-id", srv, "-b", b), Matches, OK)
+	c.Assert(s.run("backend", "rm", "-id", b), Matches, OK)
+}
+
+func (s *CmdSuite) TestServerLabelsCRUD(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+	srv := "srv1"
+	c.Assert(s.run("server", "upsert", "-id", srv, "-url", "http://localhost:5000", "-b", b,
+		"-label", "version=v2,tenant=acme", "-label", "tier=gold"), Matches, OK)
+
+	srvs, err := s.ng.GetServers(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(srvs[0].Labels, DeepEquals, map[string]string{"version": "v2", "tenant": "acme", "tier": "gold"})
+
+	c.Assert(s.run("server", "ls", "-b", b), Matches, ".*http://localhost:5000.*tenant=acme,tier=gold,version=v2.*")
+
+	c.Assert(s.run("server", "upsert", "-id", srv, "-url", "http://localhost:5000", "-b", b,
+		"-label", "version"), Not(Matches), OK)
+
+	c.Assert(s.run("server", "rm", "-id", srv, "-b", b), Matches, OK)
+	c.Assert(s.run("backend", "rm", "-id", b), Matches, OK)
+}
+
+func (s *CmdSuite) TestFrontendSubsetCRUD(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", b, "-route", `Path("/path")`,
+		"-subset", "version=request.header.X-Version", "-subsetFallback", "none"), Matches, OK)
+
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(fr.HTTPSettings().Subset, DeepEquals, engine.HTTPFrontendSubset{
+		Selector: map[string]string{"version": "request.header.X-Version"},
+		Fallback: engine.SubsetFallbackNone,
+	})
+
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", b, "-route", `Path("/path")`,
+		"-subsetFallback", "sometimes"), Not(Matches), OK)
+
+	c.Assert(s.run("frontend", "rm", "-id", f), Matches, OK)
+}
+
+func (s *CmdSuite) TestPurgeCache(c *C) {
+	c.Assert(s.run("purge", "-url", "http://example.com/a"), Matches, OK)
+	c.Assert(s.run("purge", "-tag", "products"), Matches, OK)
+	c.Assert(s.run("purge"), Not(Matches), OK)
+	c.Assert(s.run("purge", "-url", "/a"), Not(Matches), OK)
+}
+
 func (s *CmdSuite) TestFrontendCRUD(c *C) {
 	b := "bk1"
 	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
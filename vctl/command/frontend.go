@@ -4,6 +4,7 @@ import (
 	"github.com/urfave/cli"
 	"github.com/vulcand/route"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
 )
 
 func NewFrontendCommand(cmd *Command) cli.Command {
@@ -108,6 +109,12 @@ func getFrontendSettings(c *cli.Context) (engine.HTTPFrontendSettings, error) {
 	s.TrustForwardHeader = c.Bool("trustForwardHeader")
 	s.PassHostHeader = c.Bool("passHostHeader")
 
+	selector, err := plugin.ParseLabels(c.StringSlice("subset"))
+	if err != nil {
+		return s, err
+	}
+	s.Subset = engine.HTTPFrontendSubset{Selector: selector, Fallback: c.String("subsetFallback")}
+
 	return s, nil
 }
 
@@ -122,5 +129,9 @@ func frontendOptions() []cli.Flag {
 		cli.StringFlag{Name: "forwardHost", Usage: "hostname to set when forwarding a request"},
 		cli.BoolFlag{Name: "trustForwardHeader", Usage: "allows copying X-Forwarded-For header value from the original request"},
 		cli.BoolFlag{Name: "passHostHeader", Usage: "allows passing custom headers to the backend servers"},
+
+		// Subset routing
+		cli.StringSliceFlag{Name: "subset", Value: &cli.StringSlice{}, Usage: "server labels to balance over, e.g. version=request.header.X-Version"},
+		cli.StringFlag{Name: "subsetFallback", Usage: "what to do when no server matches the subset: 'any' (default) or 'none'"},
 	}
 }
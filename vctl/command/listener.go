@@ -34,6 +34,8 @@ func NewListenerCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "addr", Value: "tcp", Usage: "address to bind to, e.g. 'localhost:31000'"},
 					cli.StringFlag{Name: "scope", Usage: "scope expression limits the listener, e.g. 'Hostname(`myhost`)'"},
 					cli.StringFlag{Name: "proxy-header", Value: "none", Usage: "none or PROXY_V1"},
+					cli.StringFlag{Name: "accessLog", Usage: "access log output, e.g. 'file:///var/log/vulcand/access.log?maxSizeMB=100' or 'stdout://'"},
+					cli.StringFlag{Name: "accessLogFormat", Usage: "access log format: common, combined, json or a template, e.g. '{{.Method}} {{.URI}} {{.Status}}'"},
 				}, getTLSFlags()...),
 				Action: cmd.upsertListenerAction,
 			},
@@ -58,6 +60,12 @@ func (cmd *Command) upsertListenerAction(c *cli.Context) error {
 		}
 		settings = &engine.HTTPSListenerSettings{TLS: *s}
 	}
+	if addr := c.String("accessLog"); addr != "" {
+		if settings == nil {
+			settings = &engine.HTTPSListenerSettings{}
+		}
+		settings.AccessLog = &engine.AccessLogSettings{Addr: addr, Format: c.String("accessLogFormat")}
+	}
 	listener, err := engine.NewListener(c.String("id"), c.String("proto"), c.String("net"), c.String("addr"), c.String("scope"), c.String("proxy-header"), settings)
 	if err != nil {
 		return err
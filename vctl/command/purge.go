@@ -0,0 +1,30 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+)
+
+func NewPurgeCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:   "purge",
+		Usage:  "Purge cached responses by URL or tag",
+		Action: cmd.purgeCacheAction,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "url", Usage: "absolute URL to purge cached responses of, e.g. http://example.com/products"},
+			cli.StringFlag{Name: "tag", Usage: "tag to purge cached responses by"},
+		},
+	}
+}
+
+func (cmd *Command) purgeCacheAction(c *cli.Context) error {
+	if c.String("url") == "" && c.String("tag") == "" {
+		return fmt.Errorf("either url or tag should be set")
+	}
+	if err := cmd.client.PurgeCache(c.String("url"), c.String("tag")); err != nil {
+		return err
+	}
+	cmd.printOk("cache purged")
+	return nil
+}
@@ -3,6 +3,7 @@ package command
 import (
 	"github.com/urfave/cli"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
 )
 
 func NewServerCommand(cmd *Command) cli.Command {
@@ -35,6 +36,10 @@ func NewServerCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "server id"},
 					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
 					cli.StringFlag{Name: "url", Usage: "url in form <scheme>://<host>:<port>"},
+					cli.BoolFlag{Name: "backup", Usage: "only send traffic to the server when no primary server is available"},
+					cli.StringFlag{Name: "zone", Usage: "availability zone the server is located in"},
+					cli.StringFlag{Name: "region", Usage: "region the server is located in"},
+					cli.StringSliceFlag{Name: "label", Value: &cli.StringSlice{}, Usage: "server labels in form key=value, e.g. version=v2,tenant=acme"},
 					cli.DurationFlag{Name: "ttl", Usage: "ttl"},
 				},
 			},
@@ -56,6 +61,12 @@ func (cmd *Command) upsertServerAction(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	s.Backup = c.Bool("backup")
+	s.Zone = c.String("zone")
+	s.Region = c.String("region")
+	if s.Labels, err = plugin.ParseLabels(c.StringSlice("label")); err != nil {
+		return err
+	}
 	if err := cmd.client.UpsertServer(engine.BackendKey{Id: c.String("backend")}, *s, c.Duration("ttl")); err != nil {
 		return err
 	}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/buger/goterm"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
 )
 
 func hostsView(hs []engine.Host) string {
@@ -78,7 +79,7 @@ func backendView(b *engine.Backend) string {
 
 func serversView(srvs []engine.Server) string {
 	t := goterm.NewTable(0, 10, 5, ' ', 0)
-	fmt.Fprint(t, "Id\tURL\n")
+	fmt.Fprint(t, "Id\tURL\tRole\tZone\tCircuit\tLabels\n")
 	if len(srvs) == 0 {
 		return t.String()
 	}
@@ -89,7 +90,30 @@ func serversView(srvs []engine.Server) string {
 }
 
 func serverView(s *engine.Server) string {
-	return fmt.Sprintf("%s\t%s\n", s.Id, s.URL)
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n", s.Id, s.URL, serverRole(s), serverZone(s), serverCircuit(s), plugin.FormatLabels(s.Labels))
+}
+
+// serverCircuit returns the state of the server circuit breaker, if the
+// backend has circuit breakers enabled.
+func serverCircuit(s *engine.Server) string {
+	if s.CircuitBreaker == nil {
+		return ""
+	}
+	return s.CircuitBreaker.State
+}
+
+func serverZone(s *engine.Server) string {
+	if s.Region == "" {
+		return s.Zone
+	}
+	return fmt.Sprintf("%s/%s", s.Region, s.Zone)
+}
+
+func serverRole(s *engine.Server) string {
+	if s.Backup {
+		return "backup"
+	}
+	return "primary"
 }
 
 func middlewaresView(ms []engine.Middleware) string {